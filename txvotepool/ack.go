@@ -0,0 +1,40 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorAcks makes the reactor confirm every vote it receives and accepts, or
+// already has, with an AckMessage sent back to the peer it came from. Peers
+// receiving an ack mark the vote as held by the acknowledging peer, so they
+// don't send it again, eg. from a batch not flushed yet or a bulk sync. Acks
+// are handled whether or not this is set, but only sent if it is.
+func ReactorAcks() ReactorOption {
+	return func(txR *TxpoolReactor) { txR.acks = true }
+}
+
+// sendAck acknowledges tx to the peer which sent it, if acks are enabled. It
+// doesn't block, acks which can't be queued are dropped.
+func (txR *TxpoolReactor) sendAck(src p2p.Peer, tx types.TxVote) {
+	if !txR.acks {
+		return
+	}
+	msgBytes := cdc.MustMarshalBinaryBare(&AckMessage{ID: tx.Signature})
+	if txR.coalescesOutboundTo(src) {
+		txR.queueOutbound(src, msgBytes, nil)
+		return
+	}
+	src.TrySend(TxpoolChannel, msgBytes)
+}
+
+// receiveAck records the peer has the vote it acknowledged.
+func (txR *TxpoolReactor) receiveAck(src p2p.Peer, msg *AckMessage) {
+	memTx, ok := txR.Txpool.memTxByID(msg.ID)
+	if !ok {
+		// committed or flushed since, nothing to do
+		return
+	}
+	memTx.addSender(txR.ids.GetForPeer(src))
+	txR.checkHeightBroadcast(memTx)
+}
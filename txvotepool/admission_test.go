@@ -0,0 +1,651 @@
+package txvotepool
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestOverloadSheddingKeepsCurrentHeightVotes(t *testing.T) {
+	config := cfg.TestConfig()
+	config.Mempool.Size = 10
+	txVotePool := NewTxVotePool(config.Mempool, WithOverloadShedding(0.5, 2))
+
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(10, nil))
+	txVotePool.Unlock()
+
+	validator := newTestValidator()
+	// No pressure yet, distant votes are accepted.
+	require.NoError(t, txVotePool.CheckTx(newTestVote(100, validator)))
+	for i := 0; i < 4; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(10, validator)))
+	}
+
+	// Half full, distant votes are shed while nearby ones still get in.
+	assert.Equal(t, ErrTxVoteShed, txVotePool.CheckTx(newTestVote(100, validator)))
+	assert.Equal(t, ErrTxVoteShed, txVotePool.CheckTx(newTestVote(3, validator)))
+	assert.NoError(t, txVotePool.CheckTx(newTestVote(12, validator)))
+	assert.NoError(t, txVotePool.CheckTx(newTestVote(8, validator)))
+	assert.Equal(t, 7, txVotePool.Size())
+}
+
+func TestOverloadSheddingDisabledByDefault(t *testing.T) {
+	config := cfg.TestConfig()
+	config.Mempool.Size = 2
+	txVotePool := NewTxVotePool(config.Mempool)
+
+	validator := newTestValidator()
+	require.NoError(t, txVotePool.CheckTx(newTestVote(100, validator)))
+	require.NoError(t, txVotePool.CheckTx(newTestVote(200, validator)))
+	_, ok := txVotePool.CheckTx(newTestVote(300, validator)).(ErrMempoolIsFull)
+	assert.True(t, ok)
+}
+
+func TestCommittedHeightPolicy(t *testing.T) {
+	testCases := []struct {
+		policy   CommittedHeightPolicy
+		err      error
+		poolSize int
+	}{
+		{CommittedHeightAccept, nil, 2},
+		{CommittedHeightReject, ErrTxVoteHeightCommitted, 1},
+		{CommittedHeightDrop, nil, 1},
+	}
+	for _, tc := range testCases {
+		config := cfg.TestConfig()
+		txVotePool := NewTxVotePool(config.Mempool, WithCommittedHeightPolicy(tc.policy))
+		txVotePool.Lock()
+		require.NoError(t, txVotePool.Update(5, nil))
+		txVotePool.Unlock()
+
+		validator := newTestValidator()
+		assert.Equal(t, tc.err, txVotePool.CheckTx(newTestVote(5, validator)), "policy %v", tc.policy)
+		assert.NoError(t, txVotePool.CheckTx(newTestVote(6, validator)), "policy %v", tc.policy)
+		assert.Equal(t, tc.poolSize, txVotePool.Size(), "policy %v", tc.policy)
+	}
+}
+
+func TestCheckTxNormalizesVoteEncodings(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	vote := newTestVote(1, newTestValidator())
+	vote.TxHash = nil
+
+	// The same logical vote in a different time zone, with an empty rather
+	// than a nil hash, and as decoded off the wire.
+	zoned := vote
+	zoned.Timestamp = vote.Timestamp.In(time.FixedZone("UTC+1", 3600))
+	zoned.TxHash = []byte{}
+	var decoded types.TxVote
+	require.NoError(t, cdc.UnmarshalBinaryBare(cdc.MustMarshalBinaryBare(vote), &decoded))
+
+	require.NoError(t, txVotePool.CheckTx(zoned))
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTx(vote))
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTx(decoded))
+	assert.Equal(t, 1, txVotePool.Size())
+
+	stored, ok := txVotePool.GetVote(vote.Signature)
+	require.True(t, ok)
+	assert.Equal(t, time.UTC, stored.Timestamp.Location())
+	assert.Nil(t, stored.TxHash)
+	assert.True(t, stored.Timestamp.Equal(vote.Timestamp))
+	assert.Equal(t, cdc.MustMarshalBinaryBare(decoded), cdc.MustMarshalBinaryBare(stored))
+
+	// The stored vote doesn't alias the caller's buffers.
+	id := append([]byte(nil), vote.Signature...)
+	zoned.Signature[0]++
+	stored, ok = txVotePool.GetVote(id)
+	require.True(t, ok)
+	assert.Equal(t, id, stored.Signature)
+}
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	var (
+		calls   int
+		healthy bool
+		invalid = errors.New("invalid vote")
+	)
+	preCheck := func(tx types.TxVote) error {
+		calls++
+		if !healthy {
+			return PreCheckFailure{errors.New("app unreachable")}
+		}
+		if tx.Height == 0 {
+			return invalid
+		}
+		return nil
+	}
+	config := cfg.TestConfig()
+	const cooldown = 100 * time.Millisecond
+	txVotePool := NewTxVotePool(config.Mempool, WithPreCheck(preCheck), WithCircuitBreaker(3, 0, cooldown))
+	validator := newTestValidator()
+
+	for i := 0; i < 3; i++ {
+		err := txVotePool.CheckTx(newTestVote(1, validator))
+		require.True(t, IsPreCheckError(err), "unexpected error %v", err)
+	}
+	// Open: votes fail fast without reaching the app.
+	assert.Equal(t, ErrCheckBreakerOpen, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, 3, calls)
+
+	// Half open: the probe fails, so the breaker opens again right away.
+	time.Sleep(cooldown)
+	assert.True(t, IsPreCheckError(txVotePool.CheckTx(newTestVote(1, validator))))
+	assert.Equal(t, ErrCheckBreakerOpen, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, 4, calls)
+
+	// The probe succeeds once the app is back, closing the breaker.
+	healthy = true
+	time.Sleep(cooldown)
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+
+	// Invalid votes are rejected, but don't trip the breaker.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, ErrPreCheck{invalid}, txVotePool.CheckTx(newTestVote(0, validator)))
+	}
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, 3, txVotePool.Size())
+}
+
+func TestPreCheckSkipsDuplicates(t *testing.T) {
+	var calls int
+	reject := true
+	preCheck := func(types.TxVote) error {
+		calls++
+		if reject {
+			return errors.New("not yet")
+		}
+		return nil
+	}
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithPreCheck(preCheck))
+	vote := newTestVote(1, newTestValidator())
+
+	// A rejected vote is checked again when received again,
+	assert.True(t, IsPreCheckError(txVotePool.CheckTx(vote)))
+	reject = false
+	require.NoError(t, txVotePool.CheckTx(vote))
+	assert.Equal(t, 2, calls)
+	// while duplicates of an admitted one are turned down by the cache.
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTx(vote))
+	assert.Equal(t, 2, calls)
+}
+
+func TestCircuitBreakerTimesOutHangingChecks(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	preCheck := func(types.TxVote) error {
+		<-hang
+		return nil
+	}
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool,
+		WithPreCheck(preCheck), WithCircuitBreaker(2, 10*time.Millisecond, time.Minute))
+	validator := newTestValidator()
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, ErrPreCheck{ErrPreCheckTimeout}, txVotePool.CheckTx(newTestVote(1, validator)))
+	}
+	assert.Equal(t, ErrCheckBreakerOpen, txVotePool.CheckTx(newTestVote(1, validator)))
+}
+
+func TestQuarantinedVotePromotedAfterValidatorSetUpdate(t *testing.T) {
+	var (
+		mtx        sync.Mutex
+		validators = map[string]bool{}
+	)
+	knownSigner := func(tx types.TxVote) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if !validators[string(tx.ValidatorAddress)] {
+			return errors.New("unknown validator")
+		}
+		return nil
+	}
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithQuarantine(knownSigner, 2))
+
+	joining, stranger := newTestValidator(), newTestValidator()
+	vote, strangerVote := newTestVote(1, joining), newTestVote(1, stranger)
+	assert.Equal(t, ErrTxVoteQuarantined, txVotePool.CheckTx(vote))
+	assert.Equal(t, ErrTxVoteQuarantined, txVotePool.CheckTx(vote))
+	assert.Equal(t, ErrTxVoteQuarantined, txVotePool.CheckTx(strangerVote))
+	assert.Equal(t, ErrQuarantineFull, txVotePool.CheckTx(newTestVote(1, stranger)))
+	assert.Equal(t, 2, txVotePool.QuarantineSize())
+	assert.Zero(t, txVotePool.Size())
+
+	// The validator set update makes joining a validator.
+	mtx.Lock()
+	validators[string(joining)] = true
+	mtx.Unlock()
+	assert.Equal(t, 1, txVotePool.ReevaluateQuarantine())
+
+	assert.Zero(t, txVotePool.QuarantineSize())
+	assert.Equal(t, []types.TxVote{vote}, txVotePool.ReapMaxTxs(-1))
+}
+
+func TestCheckTxRejectsOversizeFields(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+	validator := newTestValidator()
+
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+
+	vote := newTestVote(1, validator)
+	vote.TxHash = randBytes(1024)
+	assert.Equal(t, ErrTxVoteFieldTooLarge{"TxHash", 1024, 32}, txVotePool.CheckTx(vote))
+
+	vote = newTestVote(1, append(validator, 0))
+	assert.Equal(t, ErrTxVoteFieldTooLarge{"ValidatorAddress", 21, 20}, txVotePool.CheckTx(vote))
+
+	vote = newTestVote(1, validator)
+	vote.Signature = randBytes(65)
+	assert.Equal(t, ErrTxVoteFieldTooLarge{"Signature", 65, 64}, txVotePool.CheckTx(vote))
+	assert.Equal(t, 1, txVotePool.Size())
+
+	// Limits are configurable, 0 disabling them.
+	txVotePool = NewTxVotePool(cfg.TestConfig().Mempool, WithFieldLimits(FieldLimits{Signature: 128}))
+	require.NoError(t, txVotePool.CheckTx(vote))
+	vote = newTestVote(1, validator)
+	vote.Signature = randBytes(129)
+	assert.Equal(t, ErrTxVoteFieldTooLarge{"Signature", 129, 128}, txVotePool.CheckTx(vote))
+}
+
+// testStakeProvider turns down signers below minStake, and caps the votes
+// pending per signer to one per 10 staked.
+type testStakeProvider struct {
+	stakes   map[string]int64
+	minStake int64
+}
+
+var errDustStake = errors.New("dust stake")
+
+func (p testStakeProvider) Admit(tx types.TxVote, pending int) error {
+	stake := p.stakes[string(tx.ValidatorAddress)]
+	if stake < p.minStake {
+		return errDustStake
+	}
+	if int64(pending) >= stake/10 {
+		return errors.New("quota exceeded")
+	}
+	return nil
+}
+
+func TestStakeProviderAdmission(t *testing.T) {
+	whale, minnow, unknown := newTestValidator(), newTestValidator(), newTestValidator()
+	provider := testStakeProvider{
+		stakes:   map[string]int64{string(whale): 30, string(minnow): 5},
+		minStake: 10,
+	}
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithStakeProvider(provider))
+
+	assert.Equal(t, errDustStake, txVotePool.CheckTx(newTestVote(1, minnow)))
+	assert.Equal(t, errDustStake, txVotePool.CheckTx(newTestVote(1, unknown)))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(1, whale)))
+	}
+	vote := newTestVote(1, whale)
+	assert.Error(t, txVotePool.CheckTx(vote))
+	assert.Equal(t, 3, txVotePool.Size())
+
+	// A turned down vote can be admitted later on.
+	txVotePool.TakeMax(1)
+	assert.NoError(t, txVotePool.CheckTx(vote))
+}
+
+// testBlockStore holds blocks by height.
+type testBlockStore map[int64]*ttypes.Block
+
+func (s testBlockStore) LoadBlock(height int64) *ttypes.Block { return s[height] }
+
+func TestBlockStoreAdmission(t *testing.T) {
+	txs := ttypes.Txs{ttypes.Tx("tx1"), ttypes.Tx("tx2")}
+	store := testBlockStore{5: ttypes.MakeBlock(5, txs, nil, nil)}
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithBlockStore(store))
+	validator := newTestValidator()
+
+	vote := newTestVote(5, validator)
+	vote.TxHash = txs[1].Hash()
+	assert.NoError(t, txVotePool.CheckTx(vote))
+	nilVote := newTestVote(5, validator)
+	nilVote.TxHash = nil
+	assert.NoError(t, txVotePool.CheckTx(nilVote))
+
+	mismatched := newTestVote(5, validator)
+	assert.Equal(t, ErrTxVoteBlockMismatch, txVotePool.CheckTx(mismatched))
+	unknown := newTestVote(6, validator)
+	unknown.TxHash = txs[0].Hash()
+	assert.Equal(t, ErrTxVoteUnknownBlock, txVotePool.CheckTx(unknown))
+	assert.Equal(t, 2, txVotePool.Size())
+
+	// A vote for a block not stored yet is admitted once it is.
+	store[6] = ttypes.MakeBlock(6, txs, nil, nil)
+	assert.NoError(t, txVotePool.CheckTx(unknown))
+}
+
+// countingBlockStore counts the blocks loaded from a testBlockStore.
+type countingBlockStore struct {
+	testBlockStore
+	loads int
+}
+
+func (s *countingBlockStore) LoadBlock(height int64) *ttypes.Block {
+	s.loads++
+	return s.testBlockStore.LoadBlock(height)
+}
+
+func TestBlockStoreSkipsDuplicates(t *testing.T) {
+	txs := ttypes.Txs{ttypes.Tx("tx1")}
+	store := &countingBlockStore{testBlockStore: testBlockStore{5: ttypes.MakeBlock(5, txs, nil, nil)}}
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithBlockStore(store))
+
+	vote := newTestVote(5, newTestValidator())
+	vote.TxHash = txs[0].Hash()
+	require.NoError(t, txVotePool.CheckTx(vote))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTx(vote))
+	}
+	assert.Equal(t, 1, store.loads)
+}
+
+func TestCheckTxAfterStop(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+	validator := newTestValidator()
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+
+	txVotePool.Stop()
+	err := txVotePool.CheckTxWithInfo(newTestVote(1, validator), TxVoteInfo{PeerID: 1})
+	assert.Equal(t, ErrPoolStopped, err)
+	assert.Equal(t, 1, txVotePool.Size())
+}
+
+func TestReceiveDropsVotesQuietlyAfterPoolStop(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	buf := new(bytes.Buffer)
+	txR.SetLogger(log.NewTMLogger(log.NewSyncWriter(buf)))
+
+	txR.Txpool.Stop()
+	sendMsg(txR, newTestPeer("peer"), &TxMessage{Tx: newTestVote(1, newTestValidator())})
+	assert.Zero(t, txR.Txpool.Size())
+	assert.NotContains(t, buf.String(), "Could not check tx")
+}
+
+func TestPeerDuplicatesCountedAndWarned(t *testing.T) {
+	metrics := NopMetrics()
+	dups := &testCounter{}
+	metrics.PeerDuplicateTxs = dups
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithMetrics(metrics), WithPeerDuplicatePolicy(5, DuplicateWarn))
+	buf := new(bytes.Buffer)
+	txVotePool.SetLogger(log.NewTMLogger(log.NewSyncWriter(buf)))
+
+	vote := newTestVote(1, newTestValidator())
+	info := TxVoteInfo{PeerID: 1}
+	require.NoError(t, txVotePool.CheckTxWithInfo(vote, info))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, info))
+	}
+	// Another peer sending it once isn't a duplicate.
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 2}))
+
+	assert.Equal(t, float64(10), dups.value())
+	assert.Equal(t, 2, strings.Count(buf.String(), "Peer keeps sending duplicate votes"))
+}
+
+func TestPeerDuplicatesThrottle(t *testing.T) {
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithPeerDuplicatePolicy(3, DuplicateThrottle))
+
+	validator := newTestValidator()
+	vote := newTestVote(1, validator)
+	info := TxVoteInfo{PeerID: 1}
+	require.NoError(t, txVotePool.CheckTxWithInfo(vote, info))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, info))
+	}
+	assert.Equal(t, ErrPeerThrottled, txVotePool.CheckTxWithInfo(newTestVote(1, validator), info))
+	assert.NoError(t, txVotePool.CheckTxWithInfo(newTestVote(1, validator), TxVoteInfo{PeerID: 2}))
+
+	// Peers start over on a new height.
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(1, nil))
+	txVotePool.Unlock()
+	assert.NoError(t, txVotePool.CheckTxWithInfo(newTestVote(2, validator), info))
+}
+
+func TestPeerDuplicatesOnlyCountVotesReceived(t *testing.T) {
+	metrics := NopMetrics()
+	dups := &testCounter{}
+	metrics.PeerDuplicateTxs = dups
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithMetrics(metrics), WithPeerDuplicatePolicy(1, DuplicateThrottle))
+
+	validator := newTestValidator()
+	vote := newTestVote(1, validator)
+	require.NoError(t, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 1}))
+	// Peer 2 sends the vote while we send it to peer 2.
+	txVotePool.MarkSentTo(2, [][]byte{vote.Signature})
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 2}))
+	assert.Equal(t, float64(0), dups.value())
+	assert.NoError(t, txVotePool.CheckTxWithInfo(newTestVote(1, validator), TxVoteInfo{PeerID: 2}))
+
+	// Peer 1 re-sending it is a duplicate, until its ID is freed.
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 1}))
+	assert.Equal(t, ErrPeerThrottled, txVotePool.CheckTxWithInfo(newTestVote(1, validator), TxVoteInfo{PeerID: 1}))
+	txVotePool.forgetPeerDuplicates(1)
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 1}))
+	assert.Equal(t, float64(1), dups.value())
+}
+
+func TestPeerDuplicatePolicyNeedsPositiveThreshold(t *testing.T) {
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithPeerDuplicatePolicy(0, DuplicateWarn))
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 1}))
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTxWithInfo(vote, TxVoteInfo{PeerID: 1}))
+}
+
+func TestCheckTxWithResult(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithCommittedHeightPolicy(CommittedHeightDrop))
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(5, nil))
+	txVotePool.Unlock()
+	info := TxVoteInfo{PeerID: UnknownPeerID}
+	validator := newTestValidator()
+
+	vote := newTestVote(6, validator)
+	res, err := txVotePool.CheckTxWithResult(vote, info)
+	require.NoError(t, err)
+	assert.Equal(t, CheckTxResult{Added: true, PoolSize: 1}, res)
+
+	res, err = txVotePool.CheckTxWithResult(newTestVote(7, validator), info)
+	require.NoError(t, err)
+	assert.Equal(t, CheckTxResult{Added: true, PoolSize: 2}, res)
+
+	res, err = txVotePool.CheckTxWithResult(vote, info)
+	assert.Equal(t, ErrTxVoteInCache, err)
+	assert.Equal(t, CheckTxResult{Duplicate: true, PoolSize: 2}, res)
+
+	// Dropped votes are neither added nor duplicates.
+	res, err = txVotePool.CheckTxWithResult(newTestVote(5, validator), info)
+	require.NoError(t, err)
+	assert.Equal(t, CheckTxResult{Dropped: true, PoolSize: 2}, res)
+
+	txVotePool.Stop()
+	res, err = txVotePool.CheckTxWithResult(newTestVote(8, validator), info)
+	assert.Equal(t, ErrPoolStopped, err)
+	assert.Equal(t, CheckTxResult{PoolSize: 2}, res)
+}
+
+func TestAddSource(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+	validator := newTestValidator()
+
+	ch := make(chan types.TxVote)
+	txVotePool.AddSource(ch)
+	votes := make([]types.TxVote, 5)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		ch <- votes[i]
+	}
+	// Duplicates are dropped without stopping the source.
+	ch <- votes[0]
+	close(ch)
+	waitFor(t, time.Second, func() bool { return txVotePool.Size() == len(votes) })
+	assert.Equal(t, votes, txVotePool.ReapMaxTxs(-1))
+
+	// Stopping the pool ends the consumer of a source left open.
+	open := make(chan types.TxVote)
+	txVotePool.AddSource(open)
+	txVotePool.Stop()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case open <- newTestVote(1, validator):
+		t.Fatal("source still consumed after the pool stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, len(votes), txVotePool.Size())
+}
+
+func TestStrictSignerOrder(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithStrictSignerOrder(2, time.Minute))
+	validator, other := newTestValidator(), newTestValidator()
+
+	// In order votes, several per height, are accepted.
+	for _, height := range []int64{1, 1, 2, 3, 3} {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(height, validator)))
+	}
+	assert.Equal(t, ErrTxVoteOutOfOrder, txVotePool.CheckTx(newTestVote(2, validator)))
+	// Signers are ordered on their own.
+	require.NoError(t, txVotePool.CheckTx(newTestVote(7, other)))
+
+	// Votes skipping heights are buffered, as long as there is room.
+	ahead := []types.TxVote{newTestVote(5, validator), newTestVote(6, validator)}
+	for _, vote := range ahead {
+		assert.Equal(t, ErrTxVoteBuffered, txVotePool.CheckTx(vote))
+	}
+	assert.Equal(t, ErrTxVoteOutOfOrder, txVotePool.CheckTx(newTestVote(6, validator)))
+	assert.Equal(t, 6, txVotePool.Size())
+
+	// Filling the gap releases them.
+	require.NoError(t, txVotePool.CheckTx(newTestVote(4, validator)))
+	assert.Equal(t, 9, txVotePool.Size())
+	reaped := txVotePool.ReapMaxTxs(-1)
+	assert.Equal(t, ahead, reaped[len(reaped)-2:])
+	require.NoError(t, txVotePool.CheckTx(newTestVote(7, validator)))
+}
+
+func TestStrictSignerOrderBufferExpires(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithStrictSignerOrder(1, 50*time.Millisecond))
+	validator := newTestValidator()
+
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, ErrTxVoteBuffered, txVotePool.CheckTx(newTestVote(3, validator)))
+	assert.Equal(t, ErrTxVoteOutOfOrder, txVotePool.CheckTx(newTestVote(4, validator)))
+
+	// Once the gap times out the signer carries on from the buffered vote,
+	// which releases the next one.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, ErrTxVoteBuffered, txVotePool.CheckTx(newTestVote(4, validator)))
+	assert.Equal(t, 3, txVotePool.Size())
+	assert.Equal(t, ErrTxVoteOutOfOrder, txVotePool.CheckTx(newTestVote(2, validator)))
+	require.NoError(t, txVotePool.CheckTx(newTestVote(5, validator)))
+	assert.Equal(t, 4, txVotePool.Size())
+}
+
+func TestStrictSignerOrderCommittedFillsGap(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithStrictSignerOrder(2, time.Minute))
+	validator := newTestValidator()
+
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, ErrTxVoteBuffered, txVotePool.CheckTx(newTestVote(3, validator)))
+
+	// A committed vote never seen by the pool fills the gap.
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(2, []types.TxVote{newTestVote(2, validator)}))
+	txVotePool.Unlock()
+	waitFor(t, time.Second, func() bool { return txVotePool.Size() == 2 },
+		"pool has %d votes", txVotePool.Size())
+	require.NoError(t, txVotePool.CheckTx(newTestVote(4, validator)))
+}
+
+func TestMaxHeights(t *testing.T) {
+	config := cfg.TestConfig()
+	validator := newTestValidator()
+
+	txVotePool := NewTxVotePool(config.Mempool, WithMaxHeights(2, HeightCapReject))
+	for _, height := range []int64{1, 2, 2} {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(height, validator)))
+	}
+	late := newTestVote(3, validator)
+	assert.Equal(t, ErrTooManyHeights, txVotePool.CheckTx(late))
+	assert.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, 4, txVotePool.Size())
+	// The rejected vote gets in once there is room.
+	txVotePool.DrainBelow(2, func(types.TxVote) {})
+	assert.NoError(t, txVotePool.CheckTx(late))
+
+	txVotePool = NewTxVotePool(config.Mempool, WithMaxHeights(2, HeightCapDisplace))
+	kept := newTestVote(2, validator)
+	for _, vote := range []types.TxVote{newTestVote(1, validator), newTestVote(1, validator), kept} {
+		require.NoError(t, txVotePool.CheckTx(vote))
+	}
+	higher := newTestVote(3, validator)
+	require.NoError(t, txVotePool.CheckTx(higher))
+	assert.Equal(t, []types.TxVote{kept, higher}, txVotePool.ReapMaxTxs(-1))
+	// Votes below the lowest height don't displace it.
+	assert.Equal(t, ErrTooManyHeights, txVotePool.CheckTx(newTestVote(1, validator)))
+}
+
+func TestMaxMemory(t *testing.T) {
+	config := cfg.TestConfig()
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 30)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+	}
+	// Room for about 10 votes.
+	probe := NewTxVotePool(config.Mempool)
+	for _, vote := range votes[:10] {
+		require.NoError(t, probe.CheckTx(vote))
+	}
+	max := probe.MemoryUsage()
+
+	txVotePool := NewTxVotePool(config.Mempool, WithMaxMemory(max))
+	for _, vote := range votes {
+		require.NoError(t, txVotePool.CheckTx(vote))
+		require.True(t, txVotePool.MemoryUsage() <= max, "memory over the max")
+	}
+	// The oldest votes made room for the newest.
+	assert.True(t, txVotePool.Size() <= 10)
+	reaped := txVotePool.ReapMaxTxs(-1)
+	assert.Equal(t, votes[len(votes)-len(reaped):], reaped)
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTx(votes[0]), "removed vote added again")
+
+	// Senders are forgotten before votes are removed.
+	ids := make([][]byte, len(reaped))
+	for i, vote := range reaped {
+		ids[i] = vote.Signature
+	}
+	for peerID := uint16(1); peerID <= 20; peerID++ {
+		txVotePool.MarkSentTo(peerID, ids)
+	}
+	require.True(t, txVotePool.MemoryUsage() > max)
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.True(t, txVotePool.MemoryUsage() <= max, "memory over the max")
+	_, ok := txVotePool.memTxByID(reaped[len(reaped)-1].Signature)
+	assert.True(t, ok, "newest vote removed while senders could be forgotten")
+	assert.False(t, txVotePool.TxsFront().Value.(*mempoolTxVote).hasSender(1), "senders of oldest vote kept")
+}
@@ -0,0 +1,116 @@
+package txvotepool
+
+import (
+	"time"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// BackpressurePolicy defines how the reactor slows down the peers sending
+// messages faster than the pool takes their votes. Messages are received on
+// the p2p connection's receive routine, so holding them back in Receive stops
+// reading from the peer, and its connection's flow control slows it down.
+type BackpressurePolicy int
+
+const (
+	// BackpressureNone handles messages as they come, the votes the pool
+	// can't take are dropped.
+	BackpressureNone BackpressurePolicy = iota
+	// BackpressureDelay holds each message back for up to the max delay, the
+	// longer the more loaded the pool is above the threshold.
+	BackpressureDelay
+	// BackpressureWait holds each message back until the pool is below the
+	// threshold again, for up to the max delay.
+	BackpressureWait
+)
+
+// backpressurePollInterval is how often the load is checked again with
+// BackpressureWait.
+const backpressurePollInterval = 10 * time.Millisecond
+
+// ReactorBackpressure makes the reactor hold received messages back with the
+// given policy once the pool is loaded above threshold, from 0 to 1. The
+// load is the highest of how full the pool is, in votes or bytes, and how
+// busy the peer's receive workers are, see ReactorPeerReceiveWorkers. Messages
+// are never held back for more than maxDelay. Defaults to BackpressureNone.
+func ReactorBackpressure(policy BackpressurePolicy, threshold float64, maxDelay time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.backpressure = policy
+		txR.backpressureThreshold = threshold
+		txR.backpressureMaxDelay = maxDelay
+	}
+}
+
+// receiveLoad returns how loaded the pool and the receive workers of the
+// peer are, from 0 (idle) to 1 (full).
+func (txR *TxpoolReactor) receiveLoad(src p2p.Peer) float64 {
+	var load float64
+	config := txR.Txpool.config
+	if config.Size > 0 {
+		load = float64(txR.Txpool.Size()) / float64(config.Size)
+	}
+	if config.MaxTxsBytes > 0 {
+		if bytesLoad := float64(txR.Txpool.TxsBytes()) / float64(config.MaxTxsBytes); bytesLoad > load {
+			load = bytesLoad
+		}
+	}
+
+	txR.receiversMtx.Lock()
+	pr, ok := txR.receivers[src.ID()]
+	txR.receiversMtx.Unlock()
+	if ok {
+		if workersLoad := float64(len(pr.workers)) / float64(cap(pr.workers)); workersLoad > load {
+			load = workersLoad
+		}
+	}
+	return load
+}
+
+// applyBackpressure holds the message received from the peer back according
+// to the backpressure policy.
+func (txR *TxpoolReactor) applyBackpressure(src p2p.Peer) {
+	if txR.backpressure == BackpressureNone {
+		return
+	}
+	load := txR.receiveLoad(src)
+	if load < txR.backpressureThreshold {
+		return
+	}
+
+	start := time.Now()
+	switch txR.backpressure {
+	case BackpressureDelay:
+		over := 1.0
+		if txR.backpressureThreshold < 1 {
+			over = (load - txR.backpressureThreshold) / (1 - txR.backpressureThreshold)
+		}
+		if over > 1 {
+			over = 1
+		}
+		timer := time.NewTimer(time.Duration(over * float64(txR.backpressureMaxDelay)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-src.Quit():
+		case <-txR.Quit():
+		}
+	case BackpressureWait:
+		timer := time.NewTimer(txR.backpressureMaxDelay)
+		defer timer.Stop()
+		ticker := time.NewTicker(backpressurePollInterval)
+		defer ticker.Stop()
+	wait:
+		for txR.receiveLoad(src) >= txR.backpressureThreshold {
+			select {
+			case <-ticker.C:
+			case <-timer.C:
+				break wait
+			case <-src.Quit():
+				break wait
+			case <-txR.Quit():
+				break wait
+			}
+		}
+	}
+	txR.Txpool.metrics.BackpressureSeconds.Add(time.Since(start).Seconds())
+}
@@ -0,0 +1,90 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+// newBackpressureReactor returns a started reactor with a pool of 10 votes,
+// holding messages back with policy once the pool is half full.
+func newBackpressureReactor(t *testing.T, policy BackpressurePolicy, maxDelay time.Duration) *TxpoolReactor {
+	config := cfg.TestConfig()
+	config.Mempool.Size = 10
+	txR := NewTxpoolReactor(config.Mempool, NewTxVotePool(config.Mempool), ReactorBackpressure(policy, 0.5, maxDelay))
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	return txR
+}
+
+func TestBackpressureDelayGrowsWithLoad(t *testing.T) {
+	const maxDelay = 200 * time.Millisecond
+	txR := newBackpressureReactor(t, BackpressureDelay, maxDelay)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	receive := func() time.Duration {
+		start := time.Now()
+		sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+		return time.Since(start)
+	}
+
+	// Below the threshold messages are handled right away.
+	idle := receive()
+	assert.True(t, idle < maxDelay/4, "idle receive took %v", idle)
+
+	for txR.Txpool.Size() < 7 {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	loaded := receive()
+	assert.True(t, loaded >= maxDelay/4, "loaded receive took %v", loaded)
+
+	for txR.Txpool.Size() < 10 {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	full := receive()
+	assert.True(t, full > loaded, "full receive took %v, loaded %v", full, loaded)
+	assert.True(t, full >= maxDelay, "full receive took %v", full)
+}
+
+func TestBackpressureWaitReleasedOnceDrained(t *testing.T) {
+	txR := newBackpressureReactor(t, BackpressureWait, time.Minute)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	for txR.Txpool.Size() < 10 {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+
+	vote := newTestVote(1, validator)
+	received := make(chan struct{})
+	go func() {
+		sendMsg(txR, peer, &TxMessage{Tx: vote})
+		close(received)
+	}()
+	select {
+	case <-received:
+		t.Fatal("message handled while the pool was full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the pool drains, the message is handled, and its vote kept rather
+	// than dropped.
+	txR.Txpool.TakeMax(10)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message still held back after the pool drained")
+	}
+	_, ok := txR.Txpool.GetVote(vote.Signature)
+	assert.True(t, ok)
+}
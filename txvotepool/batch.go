@@ -0,0 +1,142 @@
+package txvotepool
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorBroadcastBatch makes the reactor send votes to each peer in
+// TxsMessage batches of up to size votes. A partial batch is sent once
+// flushInterval elapsed since its first vote, which bounds the latency added
+// when few votes come in. Votes are sent one at a time by default.
+func ReactorBroadcastBatch(size int, flushInterval time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.batchSize = size
+		txR.batchFlushInterval = flushInterval
+	}
+}
+
+// ReactorBatchClock sets the clock batches are timed with, see
+// ReactorBroadcastBatch. It may be useful to overwrite for testing.
+func ReactorBatchClock(clock BatchClock) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.batchClock = clock }
+}
+
+// BatchClock tells the time, and starts the timers partial batches are
+// flushed on.
+type BatchClock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) BatchTimer
+}
+
+// BatchTimer is a timer flushing a partial batch.
+type BatchTimer interface {
+	Chan() <-chan time.Time // receives once the timer fires
+	Stop() bool
+}
+
+// systemBatchClock is the BatchClock of time.Now and time.Timer.
+type systemBatchClock struct{}
+
+func (systemBatchClock) Now() time.Time { return time.Now() }
+
+func (systemBatchClock) NewTimer(d time.Duration) BatchTimer {
+	return systemBatchTimer{time.NewTimer(d)}
+}
+
+// systemBatchTimer wraps time.Timer.
+type systemBatchTimer struct {
+	*time.Timer
+}
+
+func (t systemBatchTimer) Chan() <-chan time.Time { return t.C }
+
+// voteBatch accumulates the votes to send to a peer. It is used by a single
+// broadcast routine, so it isn't safe for concurrent use.
+type voteBatch struct {
+	size     int
+	interval time.Duration
+	clock    BatchClock
+
+	votes    []*mempoolTxVote
+	timer    BatchTimer // running while votes is not empty
+	attempts int        // failed sends of votes
+}
+
+func newVoteBatch(size int, interval time.Duration, clock BatchClock) *voteBatch {
+	return &voteBatch{size: size, interval: interval, clock: clock}
+}
+
+// add appends memTx to the batch, and returns true if the batch is full.
+func (b *voteBatch) add(memTx *mempoolTxVote) bool {
+	if len(b.votes) == 0 {
+		b.timer = b.clock.NewTimer(b.interval)
+	}
+	b.votes = append(b.votes, memTx)
+	return len(b.votes) >= b.size
+}
+
+// flushC returns a channel receiving once the batch is due, nil if the batch
+// is empty or nil.
+func (b *voteBatch) flushC() <-chan time.Time {
+	if b == nil || b.timer == nil {
+		return nil
+	}
+	return b.timer.Chan()
+}
+
+// take empties the batch and returns its votes.
+func (b *voteBatch) take() []*mempoolTxVote {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	votes := b.votes
+	b.votes = nil
+	return votes
+}
+
+// flushBatch sends the votes of the batch to the peer in a single TxsMessage.
+// If the peer can't take it, the votes are kept for another attempt after
+// the flush interval. It returns false if the peer or the reactor quit while
+// waiting for the send budget.
+func (txR *TxpoolReactor) flushBatch(peer p2p.Peer, peerID uint16, batch *voteBatch, budget *byteBudget) bool {
+	votes := batch.take()
+	if len(votes) == 0 {
+		return true
+	}
+	msg := &TxsMessage{Txs: make([]types.TxVote, len(votes))}
+	for i, memTx := range votes {
+		msg.Txs[i] = memTx.tx
+	}
+	msgBytes := txR.encodeTxsMessage(votes)
+	if budget != nil && !budget.wait(int64(len(msgBytes)), peer.Quit(), txR.Quit()) {
+		return false
+	}
+	if !txR.sendVotes(peer, msgBytes, votes...) {
+		batch.attempts++
+		if txR.maxSendAttempts > 0 && batch.attempts >= txR.maxSendAttempts {
+			for _, memTx := range votes {
+				memTx.releaseFanout(txR.broadcastFanout)
+			}
+			txR.deadLetter(peer, "batch send failed", batch.attempts, msg.Txs...)
+			batch.attempts = 0
+			return true
+		}
+		batch.votes = votes
+		batch.timer = batch.clock.NewTimer(batch.interval)
+		return true
+	}
+	batch.attempts = 0
+	for _, memTx := range votes {
+		memTx.addSender(peerID)
+	}
+	atomic.StoreInt64(&txR.lastSend, batch.clock.Now().UnixNano())
+	for _, memTx := range votes {
+		txR.checkHeightBroadcast(memTx)
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package txvotepool
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+var (
+	// ErrTxVoteUnknownBlock means the block store doesn't hold the block at
+	// the vote's height, see WithBlockStore.
+	ErrTxVoteUnknownBlock = errors.New("TxVote for an unknown block")
+
+	// ErrTxVoteBlockMismatch means the block at the vote's height doesn't
+	// hold the tx the vote is for, see WithBlockStore.
+	ErrTxVoteBlockMismatch = errors.New("TxVote for a tx not in its block")
+)
+
+// BlockStore gives access to the blocks of the chain. Tendermint's block
+// store implements it.
+type BlockStore interface {
+	// LoadBlock returns the block at the given height, nil if it isn't
+	// stored.
+	LoadBlock(height int64) *ttypes.Block
+}
+
+// WithBlockStore makes the pool reject the votes whose block, the one at
+// their height, isn't in store, or doesn't hold the tx they are for. Nil
+// votes only need their block to be stored. As votes for blocks the node
+// hasn't stored yet are rejected, only nodes keeping up with the chain
+// should use it. Votes aren't checked against blocks by default.
+func WithBlockStore(store BlockStore) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.blockStore = store }
+}
+
+// checkBlock returns an error if tx doesn't match the block store.
+func (txVotePool *TxVotePool) checkBlock(tx types.TxVote) error {
+	if txVotePool.blockStore == nil {
+		return nil
+	}
+	block := txVotePool.blockStore.LoadBlock(tx.Height)
+	if block == nil {
+		return ErrTxVoteUnknownBlock
+	}
+	if len(tx.TxHash) > 0 && block.Data.Txs.IndexByHash(tx.TxHash) < 0 {
+		return ErrTxVoteBlockMismatch
+	}
+	return nil
+}
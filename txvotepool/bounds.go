@@ -0,0 +1,31 @@
+package txvotepool
+
+// Names of the bounded caches, the values of the "cache" label of the
+// CacheEntries metric.
+const (
+	cacheDedup            = "dedup"
+	cacheQuarantine       = "quarantine"
+	cacheDeferred         = "deferred"
+	cacheDeadLetters      = "dead_letters"
+	cacheGapSigners       = "gap_signers"
+	cacheCompletedHeights = "completed_heights"
+	cacheOrderBuffered    = "order_buffered"
+	cacheHeights          = "heights"
+)
+
+// maxCompletedHeights is the max number of heights remembered as broadcast,
+// see OnHeightBroadcastComplete. The lowest are forgotten past it.
+const maxCompletedHeights = 1024
+
+// reportCacheEntries sets the CacheEntries metric of the given cache.
+func (m *Metrics) reportCacheEntries(cache string, n int) {
+	m.CacheEntries.With("cache", cache).Set(float64(n))
+}
+
+// reportDedupCacheEntries reports the size of the dedup cache, if it can tell.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) reportDedupCacheEntries() {
+	if c, ok := txVotePool.cache.(interface{ Len() int }); ok {
+		txVotePool.metrics.reportCacheEntries(cacheDedup, c.Len())
+	}
+}
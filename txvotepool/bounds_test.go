@@ -0,0 +1,157 @@
+package txvotepool
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+// maxTestGauge is a metrics.Gauge recording the highest value set, by label
+// values joined as "label=value".
+type maxTestGauge struct {
+	mtx    *sync.Mutex
+	max    map[string]float64
+	labels string
+}
+
+func newMaxTestGauge() *maxTestGauge {
+	return &maxTestGauge{mtx: new(sync.Mutex), max: make(map[string]float64)}
+}
+
+func (g *maxTestGauge) With(labelValues ...string) metrics.Gauge {
+	return &maxTestGauge{mtx: g.mtx, max: g.max, labels: g.labels + strings.Join(labelValues, "=")}
+}
+
+func (g *maxTestGauge) Set(value float64) {
+	g.mtx.Lock()
+	if value > g.max[g.labels] {
+		g.max[g.labels] = value
+	}
+	g.mtx.Unlock()
+}
+
+func (g *maxTestGauge) Add(delta float64) {}
+
+func (g *maxTestGauge) highest(cache string) float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.max["cache="+cache]
+}
+
+// newBoundsTestPool returns a pool reporting its cache sizes to entries.
+func newBoundsTestPool(entries metrics.Gauge, options ...TxVotePoolOption) *TxVotePool {
+	config := cfg.TestConfig()
+	config.Mempool.CacheSize = 10
+	metrics := NopMetrics()
+	metrics.CacheEntries = entries
+	txVotePool := NewTxVotePool(config.Mempool, append(options, WithMetrics(metrics))...)
+	txVotePool.SetLogger(log.TestingLogger())
+	return txVotePool
+}
+
+func TestDedupCacheBounded(t *testing.T) {
+	entries := newMaxTestGauge()
+	txVotePool := newBoundsTestPool(entries)
+	validator := newTestValidator()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	}
+	assert.Equal(t, 10, txVotePool.cache.(*mapTxCache).Len())
+	assert.Equal(t, float64(10), entries.highest(cacheDedup))
+}
+
+func TestQuarantineBounded(t *testing.T) {
+	entries := newMaxTestGauge()
+	suspicious := func(types.TxVote) error { return errors.New("unknown signer") }
+	txVotePool := newBoundsTestPool(entries, WithQuarantine(suspicious, 5))
+	validator := newTestValidator()
+	for i := 0; i < 50; i++ {
+		_ = txVotePool.CheckTx(newTestVote(1, validator))
+	}
+	assert.Equal(t, 5, txVotePool.QuarantineSize())
+	assert.Equal(t, float64(5), entries.highest(cacheQuarantine))
+}
+
+func TestGapSignersBounded(t *testing.T) {
+	entries := newMaxTestGauge()
+	txVotePool := newBoundsTestPool(entries, WithGapTracking(10, 5))
+	for i := 0; i < 50; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(1, newTestValidator())))
+	}
+	assert.Len(t, txVotePool.gaps.signers, 5)
+	assert.Equal(t, float64(5), entries.highest(cacheGapSigners))
+}
+
+// newBoundsTestReactor returns a started reactor reporting its cache sizes
+// to entries.
+func newBoundsTestReactor(t *testing.T, entries metrics.Gauge, options ...ReactorOption) *TxpoolReactor {
+	txVotePool := newBoundsTestPool(entries)
+	txVotePool.config.CacheSize = 0
+	txR := NewTxpoolReactor(txVotePool.config, txVotePool, options...)
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	return txR
+}
+
+func TestDeferredVotesBounded(t *testing.T) {
+	entries := newMaxTestGauge()
+	status := &testSyncStatus{}
+	status.set(true)
+	txR := newBoundsTestReactor(t, entries, ReactorSyncGuard(status, 5))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	validator := newTestValidator()
+	for i := 0; i < 50; i++ {
+		sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	}
+	txR.deferredMtx.Lock()
+	assert.Len(t, txR.deferred, 5)
+	txR.deferredMtx.Unlock()
+	assert.Equal(t, float64(5), entries.highest(cacheDeferred))
+}
+
+func TestDeadLettersBounded(t *testing.T) {
+	entries := newMaxTestGauge()
+	txR := newBoundsTestReactor(t, entries)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	validator := newTestValidator()
+	for i := 0; i < 2*maxDeadLetters; i++ {
+		txR.deadLetter(peer, "send failed", 1, newTestVote(1, validator))
+	}
+	assert.Len(t, txR.DeadLetters(), maxDeadLetters)
+	assert.Equal(t, float64(maxDeadLetters), entries.highest(cacheDeadLetters))
+}
+
+func TestCompletedHeightsBounded(t *testing.T) {
+	entries := newMaxTestGauge()
+	txR := newBoundsTestReactor(t, entries)
+	defer txR.Stop()
+	var completed int
+	txR.OnHeightBroadcastComplete(func(int64) { completed++ })
+
+	// The pool never moves past these heights, the votes received from the
+	// only peer complete them right away.
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	for h := int64(1); h <= maxCompletedHeights+100; h++ {
+		sendMsg(txR, peer, &TxMessage{Tx: newTestVote(h, validator)})
+	}
+	assert.Equal(t, maxCompletedHeights+100, completed)
+	txR.heightCompleteMtx.Lock()
+	assert.Len(t, txR.completedHeights, maxCompletedHeights)
+	txR.heightCompleteMtx.Unlock()
+	assert.Equal(t, float64(maxCompletedHeights), entries.highest(cacheCompletedHeights))
+}
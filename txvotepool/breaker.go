@@ -0,0 +1,173 @@
+package txvotepool
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+var (
+	// ErrCheckBreakerOpen is returned by CheckTx while pre checks are
+	// suspended after failing repeatedly.
+	ErrCheckBreakerOpen = errors.New("Vote checks suspended after repeated failures")
+
+	// ErrPreCheckTimeout is the reason of the ErrPreCheck returned when the
+	// pre check doesn't return in time.
+	ErrPreCheckTimeout = errors.New("Pre check timed out")
+)
+
+// PreCheckFunc is an optional check performed on votes before they are added
+// to the pool, typically against the application. A vote is rejected with
+// ErrPreCheck if it returns an error.
+type PreCheckFunc func(types.TxVote) error
+
+// breakerState is the state of a circuitBreaker, as reported by the
+// CheckBreakerState metric.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // pre checks run
+	breakerOpen                         // pre checks are skipped, votes fail fast
+	breakerHalfOpen                     // a single pre check probes for recovery
+)
+
+// circuitBreaker stops running a failing pre check for a while. Once
+// threshold consecutive checks failed or timed out, it opens and votes fail
+// fast for cooldown. The next check then runs as a probe: the breaker closes
+// if it succeeds, and opens again otherwise.
+//
+// CheckTxWithInfo runs pre checks with the pool locked, so the breaker needs
+// no locking of its own.
+type circuitBreaker struct {
+	threshold int
+	timeout   time.Duration // 0 means checks are never timed out
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int // consecutive failures
+	openedAt time.Time
+}
+
+// allow returns true if the pre check should run.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb.state == breakerOpen {
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a pre check.
+func (cb *circuitBreaker) record(failed bool, now time.Time) {
+	if !failed {
+		cb.state = breakerClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = breakerOpen
+		cb.openedAt = now
+	}
+}
+
+// tripsBreaker returns true if err means the pre check itself failed, as
+// opposed to the vote being rejected by it.
+func tripsBreaker(err error) bool {
+	return err == ErrPreCheckTimeout || IsPreCheckFailure(err)
+}
+
+// PreCheckFailure wraps the errors of a PreCheckFunc which are caused by the
+// check failing, eg. the application being unreachable, rather than the vote
+// being invalid. Only such errors trip the circuit breaker.
+type PreCheckFailure struct {
+	Err error
+}
+
+func (e PreCheckFailure) Error() string {
+	return e.Err.Error()
+}
+
+// IsPreCheckFailure returns true if err is a PreCheckFailure.
+func IsPreCheckFailure(err error) bool {
+	_, ok := err.(PreCheckFailure)
+	return ok
+}
+
+// WithPreCheck sets a check votes must pass before being added to the pool.
+func WithPreCheck(f PreCheckFunc) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.preCheck = f }
+}
+
+// WithCircuitBreaker suspends the pre check after threshold consecutive
+// failures, see PreCheckFailure, or checks taking longer than timeout (0 for
+// no timeout). For cooldown, votes are then rejected with
+// ErrCheckBreakerOpen without being checked, after which a single check
+// probes whether it recovered. Disabled by default.
+func WithCircuitBreaker(threshold int, timeout, cooldown time.Duration) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		txVotePool.breaker = &circuitBreaker{
+			threshold: threshold,
+			timeout:   timeout,
+			cooldown:  cooldown,
+		}
+	}
+}
+
+// runPreCheck runs the pre check on tx, if any, through the circuit breaker.
+func (txVotePool *TxVotePool) runPreCheck(tx types.TxVote) error {
+	if txVotePool.preCheck == nil {
+		return nil
+	}
+	cb := txVotePool.breaker
+	if cb == nil {
+		if err := txVotePool.preCheck(tx); err != nil {
+			return ErrPreCheck{err}
+		}
+		return nil
+	}
+
+	if !cb.allow(time.Now()) {
+		txVotePool.metrics.BreakerRejectedTxs.Add(1)
+		return ErrCheckBreakerOpen
+	}
+	err := txVotePool.preCheckWithTimeout(tx, cb.timeout)
+	cb.record(tripsBreaker(err), time.Now())
+	txVotePool.metrics.CheckBreakerState.Set(float64(cb.state))
+	var openUntil int64
+	if cb.state == breakerOpen {
+		openUntil = cb.openedAt.Add(cb.cooldown).UnixNano()
+	}
+	atomic.StoreInt64(&txVotePool.breakerOpenUntil, openUntil)
+	if err != nil {
+		return ErrPreCheck{err}
+	}
+	return nil
+}
+
+// checkBreakerOpen returns true if the circuit breaker is open, and votes are
+// rejected without being checked. It doesn't lock the pool.
+func (txVotePool *TxVotePool) checkBreakerOpen() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&txVotePool.breakerOpenUntil)
+}
+
+// preCheckWithTimeout runs the pre check, giving up after timeout. A check
+// which timed out is left running in the background.
+func (txVotePool *TxVotePool) preCheckWithTimeout(tx types.TxVote, timeout time.Duration) error {
+	if timeout <= 0 {
+		return txVotePool.preCheck(tx)
+	}
+	res := make(chan error, 1)
+	go func() { res <- txVotePool.preCheck(tx) }()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(timeout):
+		return ErrPreCheckTimeout
+	}
+}
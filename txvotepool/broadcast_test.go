@@ -0,0 +1,1032 @@
+package txvotepool
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestAddPeerWaitsForPreviousBroadcastRoutine(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	oldPeer := newTestPeer("peer")
+	txR.AddPeer(oldPeer)
+	require.Len(t, txR.routines, 1)
+	oldRoutine := txR.routines[oldPeer.ID()]
+
+	// The old connection is removed, but its routine hasn't noticed yet.
+	txR.RemovePeer(oldPeer, nil)
+
+	newPeer := newTestPeer("peer")
+	added := make(chan struct{})
+	go func() {
+		txR.AddPeer(newPeer)
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("AddPeer returned while the previous routine was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	oldPeer.Stop()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("AddPeer did not return after the previous routine exited")
+	}
+
+	select {
+	case <-oldRoutine.done:
+	default:
+		t.Fatal("new routine started before the old one finished")
+	}
+
+	txR.routinesMtx.Lock()
+	assert.Len(t, txR.routines, 1)
+	assert.Equal(t, newPeer, txR.routines[newPeer.ID()].peer)
+	txR.routinesMtx.Unlock()
+
+	// Adding the same peer twice must not spawn a second routine.
+	assert.False(t, txR.startBroadcastRoutine(newPeer))
+}
+
+func TestOverlappingAddRemoveKeepsOneRoutinePerPeer(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	const rounds = 20
+	var prev *testPeer
+	for i := 0; i < rounds; i++ {
+		peer := newTestPeer("peer")
+		if prev != nil {
+			txR.RemovePeer(prev, nil)
+			go prev.Stop()
+		}
+		txR.AddPeer(peer)
+
+		txR.routinesMtx.Lock()
+		require.Len(t, txR.routines, 1)
+		require.Equal(t, peer, txR.routines[peer.ID()].peer)
+		txR.routinesMtx.Unlock()
+		prev = peer
+	}
+}
+
+func TestBroadcastFanoutBoundsInitialSends(t *testing.T) {
+	txR := newTestReactor(t, ReactorBroadcastFanout(3))
+	defer txR.Stop()
+
+	const numPeers = 10
+	peers := make([]*testPeer, numPeers)
+	for i := range peers {
+		peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i)))
+		peers[i].Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peers[i])
+	}
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+
+	countReached := func() int {
+		n := 0
+		for _, peer := range peers {
+			if len(peer.Sent()) > 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Well within the first broadcast cycle only the fanout got the vote.
+	time.Sleep(50 * time.Millisecond)
+	reached := countReached()
+	assert.True(t, reached > 0 && reached <= 3, "expected 1-3 peers to be reached, got %d", reached)
+
+	// The remaining peers get it on the following cycles.
+	waitFor(t, 2*time.Second, func() bool { return countReached() == numPeers })
+}
+
+func TestBroadcastHonorsPeerInterest(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{10})
+	sendMsg(txR, peer, &InterestMessage{MinHeight: 2, MaxHeight: 3})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	for h := int64(1); h <= 4; h++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(h, validator)))
+	}
+
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) >= 2 })
+	time.Sleep(100 * time.Millisecond)
+
+	sent := peer.Sent()
+	require.Len(t, sent, 2)
+	assert.EqualValues(t, 2, sent[0].(*TxMessage).Tx.Height)
+	assert.EqualValues(t, 3, sent[1].(*TxMessage).Tx.Height)
+}
+
+func TestInterestMessageMatches(t *testing.T) {
+	val1, val2 := newTestValidator(), newTestValidator()
+	interest := &InterestMessage{MinHeight: 5, Validators: []crypto.Address{val1}}
+
+	assert.True(t, interest.Matches(newTestVote(5, val1)))
+	assert.True(t, interest.Matches(newTestVote(100, val1)))
+	assert.False(t, interest.Matches(newTestVote(4, val1)))
+	assert.False(t, interest.Matches(newTestVote(5, val2)))
+	assert.True(t, (&InterestMessage{}).Matches(newTestVote(1, val2)))
+}
+
+func TestBroadcastStartDelay(t *testing.T) {
+	txR := newTestReactor(t, ReactorBroadcastStartDelay(300*time.Millisecond))
+	defer txR.Stop()
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Empty(t, peer.Sent())
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+}
+
+func TestBroadcastStepsAreDeterministic(t *testing.T) {
+	txR := newTestReactor(t)
+	enableBroadcastSteps(txR)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	assert.Empty(t, peer.Sent())
+
+	for i := 1; i <= 3; i++ {
+		stepBroadcast(t, txR)
+		assert.Len(t, peer.Sent(), i)
+	}
+}
+
+func TestBroadcastCoverage(t *testing.T) {
+	txR := newTestReactor(t)
+	enableBroadcastSteps(txR)
+	defer txR.Stop()
+
+	peers := []*testPeer{newTestPeer("a"), newTestPeer("b"), newTestPeer("c")}
+	for _, peer := range peers {
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peer)
+	}
+
+	validator := newTestValidator()
+	fromA := newTestVote(1, validator)
+	local := newTestVote(1, validator)
+	sendMsg(txR, peers[0], &TxMessage{Tx: fromA})
+	require.NoError(t, txR.Txpool.CheckTx(local))
+
+	coverage := txR.BroadcastCoverage()
+	assert.Equal(t, map[string]int{
+		fmt.Sprintf("%X", fromA.Signature): 1,
+		fmt.Sprintf("%X", local.Signature): 0,
+	}, coverage)
+
+	// Each step handles one vote for one of the routines; after 6 steps all
+	// routines went through both votes.
+	for i := 0; i < 6; i++ {
+		stepBroadcast(t, txR)
+	}
+	coverage = txR.BroadcastCoverage()
+	assert.Equal(t, 3, coverage[fmt.Sprintf("%X", fromA.Signature)])
+	assert.Equal(t, 3, coverage[fmt.Sprintf("%X", local.Signature)])
+}
+
+func TestBroadcastWaitsForLaggingPeer(t *testing.T) {
+	txR := newTestReactor(t, ReactorMaxPeerLag(10))
+	defer txR.Stop()
+
+	// The vote arrives before the pool moves on, so only the peer's lag
+	// behind the pool holds it back.
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+	txR.Txpool.Lock()
+	require.NoError(t, txR.Txpool.Update(100, nil))
+	txR.Txpool.Unlock()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{50})
+	txR.AddPeer(peer)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, peer.Sent())
+
+	// Within the allowed lag now.
+	peer.Set(ttypes.PeerStateKey, testPeerState{90})
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+}
+
+func TestBroadcastToValidatorPeersOnly(t *testing.T) {
+	txR := newTestReactor(t, ReactorValidatorPeersOnly(nil))
+	defer txR.Stop()
+
+	validator, fullNode, unknown := newTestPeer("validator"), newTestPeer("fullnode"), newTestPeer("unknown")
+	validator.Set(ttypes.PeerStateKey, testValidatorPeerState{testPeerState{1}, true})
+	fullNode.Set(ttypes.PeerStateKey, testValidatorPeerState{testPeerState{1}, false})
+	unknown.Set(ttypes.PeerStateKey, testPeerState{1})
+	for _, peer := range []*testPeer{validator, fullNode, unknown} {
+		txR.AddPeer(peer)
+	}
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+	waitFor(t, time.Second, func() bool { return len(validator.Sent()) == 1 })
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, fullNode.Sent())
+	assert.Empty(t, unknown.Sent())
+}
+
+func TestBroadcastToValidatorNodeIDs(t *testing.T) {
+	validators := NewValidatorNodeIDs("validator")
+	txR := newTestReactor(t, ReactorValidatorPeersOnly(validators))
+	defer txR.Stop()
+
+	validator, joining := newTestPeer("validator"), newTestPeer("joining")
+	for _, peer := range []*testPeer{validator, joining} {
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peer)
+	}
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	waitFor(t, time.Second, func() bool { return len(validator.Sent()) == 1 })
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, joining.Sent())
+
+	// The peer gets the vote once it joins the validator set.
+	validators.Set("validator", "joining")
+	waitFor(t, time.Second, func() bool { return sentVote(joining, vote) }, "vote not sent to new validator")
+}
+
+func TestHandleReorgPrunesAndRegossips(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{10})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	kept, abandoned, above := newTestVote(2, validator), newTestVote(4, validator), newTestVote(7, validator)
+	for _, vote := range []types.TxVote{kept, abandoned, above} {
+		sendMsg(txR, peer, &TxMessage{Tx: vote})
+	}
+	txR.Txpool.Lock()
+	require.NoError(t, txR.Txpool.Update(5, nil))
+	txR.Txpool.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	require.Empty(t, peer.Sent(), "votes went back to their sender")
+
+	txR.Txpool.HandleReorg(5, 3)
+	assert.EqualValues(t, 3, txR.Txpool.Height())
+	assert.Equal(t, 2, txR.Txpool.Size())
+	_, ok := txR.Txpool.GetVote(abandoned.Signature)
+	assert.False(t, ok)
+
+	// The remaining votes are gossiped again, even to their sender.
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 2 })
+	// And the pruned one can be received again.
+	assert.NoError(t, txR.Txpool.CheckTx(abandoned))
+}
+
+func TestUpdateBelowPoolHeightHandlesReorg(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+	validator := newTestValidator()
+	kept, abandoned, committed := newTestVote(2, validator), newTestVote(4, validator), newTestVote(3, validator)
+	for _, vote := range []types.TxVote{kept, abandoned, committed} {
+		require.NoError(t, txVotePool.CheckTx(vote))
+	}
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(5, nil))
+	txVotePool.Unlock()
+
+	// The chain was rolled back to 2, and 3 committed anew.
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(3, []types.TxVote{committed}))
+	txVotePool.Unlock()
+	assert.EqualValues(t, 3, txVotePool.Height())
+	assert.Equal(t, []types.TxVote{kept}, txVotePool.ReapMaxTxs(-1))
+	assert.NoError(t, txVotePool.CheckTx(abandoned))
+}
+
+func TestPeerSendRateLimitsThroughput(t *testing.T) {
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 20)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+	}
+	msgSize := int64(len(cdc.MustMarshalBinaryBare(&TxMessage{Tx: votes[0]})))
+
+	// Two votes in a burst, then ten per second.
+	txR := newTestReactor(t, ReactorPeerSendRate(10*msgSize, 2*msgSize))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	start := time.Now()
+	txR.AddPeer(peer)
+	for _, vote := range votes {
+		require.NoError(t, txR.Txpool.CheckTx(vote))
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	sent := len(peer.Sent())
+	elapsed := time.Since(start)
+	assert.True(t, sent >= 3, "only %d votes sent", sent)
+	max := 2 + int(10*elapsed.Seconds())
+	assert.True(t, sent <= max, "%d votes sent in %v, expected at most %d", sent, elapsed, max)
+}
+
+// testBatchClock is a BatchClock whose timers only fire when told to.
+type testBatchClock struct {
+	mtx    sync.Mutex
+	timers []*testBatchTimer
+}
+
+type testBatchTimer struct {
+	d time.Duration
+	c chan time.Time
+}
+
+func (c *testBatchClock) Now() time.Time { return time.Now() }
+
+func (c *testBatchClock) NewTimer(d time.Duration) BatchTimer {
+	timer := &testBatchTimer{d: d, c: make(chan time.Time, 1)}
+	c.mtx.Lock()
+	c.timers = append(c.timers, timer)
+	c.mtx.Unlock()
+	return timer
+}
+
+// started returns the number of timers started.
+func (c *testBatchClock) started() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.timers)
+}
+
+// fire fires the last timer started.
+func (c *testBatchClock) fire() {
+	c.mtx.Lock()
+	timer := c.timers[len(c.timers)-1]
+	c.mtx.Unlock()
+	timer.c <- time.Now()
+}
+
+func (t *testBatchTimer) Chan() <-chan time.Time { return t.c }
+func (t *testBatchTimer) Stop() bool             { return true }
+
+func TestBroadcastBatchFlushesPartialBatch(t *testing.T) {
+	flushInterval := 200 * time.Millisecond
+	clock := &testBatchClock{}
+	txR := newTestReactor(t, ReactorBroadcastBatch(10, flushInterval), ReactorBatchClock(clock))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	waitFor(t, time.Second, func() bool { return clock.started() == 1 })
+	assert.Equal(t, flushInterval, clock.timers[0].d)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, peer.Sent(), "partial batch sent before the timer fired")
+
+	clock.fire()
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+	msg, ok := peer.Sent()[0].(*TxsMessage)
+	require.True(t, ok, "expected a TxsMessage")
+	assert.Len(t, msg.Txs, 2)
+}
+
+func TestBroadcastBatchSendsFullBatch(t *testing.T) {
+	txR := newTestReactor(t, ReactorBroadcastBatch(2, time.Minute))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+	msg := peer.Sent()[0].(*TxsMessage)
+	assert.Len(t, msg.Txs, 2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, peer.Sent(), 1, "partial batch sent before the interval")
+}
+
+func TestBroadcastStopsOnWrongPeerStateType(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	buf := new(bytes.Buffer)
+	txR.SetLogger(log.NewTMLogger(log.NewSyncWriter(buf)))
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, "not a PeerState")
+	txR.AddPeer(peer)
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+
+	waitFor(t, time.Second, func() bool {
+		txR.routinesMtx.Lock()
+		defer txR.routinesMtx.Unlock()
+		_, running := txR.routines[peer.ID()]
+		return !running
+	}, "broadcast routine still running")
+	assert.Contains(t, buf.String(), "Peer state of unexpected type")
+	assert.Empty(t, peer.Sent())
+}
+
+// testCounter is a metrics.Counter which can be read.
+type testCounter struct {
+	mtx sync.Mutex
+	val float64
+}
+
+func (c *testCounter) With(...string) metrics.Counter { return c }
+
+func (c *testCounter) Add(delta float64) {
+	c.mtx.Lock()
+	c.val += delta
+	c.mtx.Unlock()
+}
+
+func (c *testCounter) value() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.val
+}
+
+func TestBroadcastYieldsAfterMaxScan(t *testing.T) {
+	config := cfg.TestConfig()
+	metrics := NopMetrics()
+	yields := &testCounter{}
+	metrics.BroadcastScanYields = yields
+	txR := NewTxpoolReactor(config.Mempool, NewTxVotePool(config.Mempool, WithMetrics(metrics)), ReactorMaxScanPerWake(10))
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	const numVotes = 35
+	for i := 0; i < numVotes; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == numVotes })
+	assert.Equal(t, float64(numVotes/10), yields.value())
+}
+
+func newRandomFanoutReactor(t *testing.T, fanout int, weight func(p2p.ID) float64, peers ...p2p.ID) *TxpoolReactor {
+	txR := newTestReactor(t, ReactorBroadcastFanout(fanout), ReactorRandomFanout(rand.New(rand.NewSource(0)), weight))
+	for _, id := range peers {
+		txR.AddPeer(newTestPeer(id))
+	}
+	return txR
+}
+
+func TestRandomFanoutVariesAcrossSeeds(t *testing.T) {
+	txR := newRandomFanoutReactor(t, 2, nil, "a", "b", "c", "d", "e")
+	defer txR.Stop()
+
+	pick := func(seed int64) string {
+		txR.fanoutRand = rand.New(rand.NewSource(seed))
+		picked := txR.pickFanoutPeers()
+		require.Len(t, picked, 2)
+		ids := make([]string, 0, len(picked))
+		for id := range picked {
+			ids = append(ids, string(id))
+		}
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+	selections := make(map[string]struct{})
+	for seed := int64(0); seed < 20; seed++ {
+		selections[pick(seed)] = struct{}{}
+		assert.Equal(t, pick(seed), pick(seed), "same seed, different picks")
+	}
+	assert.True(t, len(selections) > 1, "picks don't depend on the seed")
+}
+
+func TestRandomFanoutRespectsWeights(t *testing.T) {
+	weights := map[p2p.ID]float64{"heavy": 9, "a": 1, "b": 1, "c": 1, "never": 0}
+	weight := func(id p2p.ID) float64 { return weights[id] }
+	txR := newRandomFanoutReactor(t, 1, weight, "heavy", "a", "b", "c", "never")
+	defer txR.Stop()
+
+	counts := make(map[p2p.ID]int)
+	const picks = 1000
+	for i := 0; i < picks; i++ {
+		for id := range txR.pickFanoutPeers() {
+			counts[id]++
+		}
+	}
+	// heavy is expected to be picked 75% of the time
+	assert.InDelta(t, 750, counts["heavy"], 100)
+	assert.Zero(t, counts["never"])
+
+	// Everyone with a weight is picked when the fanout allows it.
+	txR.broadcastFanout = len(weights)
+	assert.Len(t, txR.pickFanoutPeers(), 4)
+}
+
+func TestClaimFanoutOnlyLetsPickedPeersInFirstCycle(t *testing.T) {
+	memTx := &mempoolTxVote{timestamp: time.Now()}
+	pick := func() map[p2p.ID]struct{} { return map[p2p.ID]struct{}{"picked": {}} }
+
+	assert.False(t, memTx.claimFanout(1, "other", pick))
+	assert.True(t, memTx.claimFanout(1, "picked", pick))
+	assert.False(t, memTx.claimFanout(1, "picked", pick), "fanout exceeded")
+
+	// Past the first cycle, anyone may get the vote.
+	memTx = &mempoolTxVote{timestamp: time.Now().Add(-peerCatchupSleepIntervalMS * time.Millisecond)}
+	assert.True(t, memTx.claimFanout(1, "other", pick))
+}
+
+func TestFanoutSkippedVoteDoesNotHoldBackNextVotes(t *testing.T) {
+	// Each vote is picked for the peer whose turn it is.
+	var turn atomic.Value
+	turn.Store(p2p.ID("a"))
+	weight := func(id p2p.ID) float64 {
+		if id == turn.Load().(p2p.ID) {
+			return 1
+		}
+		return 0
+	}
+	txR := newTestReactor(t, ReactorBroadcastFanout(1), ReactorRandomFanout(rand.New(rand.NewSource(0)), weight))
+	defer txR.Stop()
+	a, b := newTestPeer("a"), newTestPeer("b")
+	for _, peer := range []*testPeer{a, b} {
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peer)
+	}
+
+	validator := newTestValidator()
+	first, second := newTestVote(1, validator), newTestVote(1, validator)
+	require.NoError(t, txR.Txpool.CheckTx(first))
+	waitFor(t, time.Second, func() bool { return sentVote(a, first) }, "first vote not sent")
+	turn.Store(p2p.ID("b"))
+	require.NoError(t, txR.Txpool.CheckTx(second))
+
+	// b gets the second vote without waiting for the first one's cycle to end.
+	waitFor(t, 50*time.Millisecond, func() bool { return sentVote(b, second) }, "second vote held back")
+	assert.False(t, sentVote(b, first))
+	// and the first one on the next cycle.
+	waitFor(t, time.Second, func() bool { return sentVote(b, first) }, "first vote not sent again")
+}
+
+func TestFailedSendReleasesFanoutClaim(t *testing.T) {
+	txR := newTestReactor(t, ReactorBroadcastFanout(1))
+	defer txR.Stop()
+	refusing := &refusingPeer{testPeer: newTestPeer("refusing"), refuse: func(TxpoolMessage) bool { return true }}
+	peer := newTestPeer("peer")
+	refusing.Set(ttypes.PeerStateKey, testPeerState{1})
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(refusing)
+	txR.AddPeer(peer)
+
+	// The peer gets the vote within its first cycle, whoever claimed it first.
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	waitFor(t, 50*time.Millisecond, func() bool { return sentVote(peer, vote) }, "vote not sent")
+}
+
+func TestIdleBroadcastRoutineExitsAndRespawns(t *testing.T) {
+	txR := newTestReactor(t, ReactorBroadcastIdleTimeout(50*time.Millisecond))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+
+	running := func() bool {
+		txR.routinesMtx.Lock()
+		defer txR.routinesMtx.Unlock()
+		_, ok := txR.routines[peer.ID()]
+		return ok
+	}
+	waitFor(t, time.Second, func() bool { return !running() }, "routine didn't exit when idle")
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 2 }, "vote not sent after respawn")
+}
+
+func TestPriorityLanesSendHighFirstWithoutStarvingNormal(t *testing.T) {
+	classify := func(tx types.TxVote) Lane {
+		if tx.Height == 2 {
+			return LaneHigh
+		}
+		return LaneNormal
+	}
+	txR := newTestReactor(t, ReactorPriorityLanes(classify, 2))
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	heights := []int64{1, 1, 2, 2, 2, 2, 2}
+	for _, height := range heights {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(height, validator)))
+	}
+	votes := txR.Txpool.ReapMaxTxs(-1)
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{2})
+	txR.AddPeer(peer)
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == len(heights) })
+
+	// Two high lane votes, then a normal lane one.
+	expected := []types.TxVote{votes[2], votes[3], votes[0], votes[4], votes[5], votes[1], votes[6]}
+	for i, msg := range peer.Sent() {
+		assert.Equal(t, expected[i], msg.(*TxMessage).Tx, "vote %d", i)
+	}
+
+	// Normal lane votes are sent once caught up with the high lane.
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == len(heights)+1 })
+}
+
+func TestHeightBroadcastCompleteFiresOnce(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	var (
+		mtx       sync.Mutex
+		completed []int64
+	)
+	txR.OnHeightBroadcastComplete(func(height int64) {
+		mtx.Lock()
+		completed = append(completed, height)
+		mtx.Unlock()
+	})
+	getCompleted := func() []int64 {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]int64(nil), completed...)
+	}
+
+	peer1, peer2 := newTestPeer("peer1"), newTestPeer("peer2")
+	peer1.Set(ttypes.PeerStateKey, testPeerState{2})
+	txR.AddPeer(peer1)
+	txR.AddPeer(peer2)
+
+	validator := newTestValidator()
+	// peer1 sends a vote, which must still reach peer2.
+	sendMsg(txR, peer1, &TxMessage{Tx: newTestVote(1, validator)})
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(2, validator)))
+	waitFor(t, time.Second, func() bool { return len(peer1.Sent()) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, getCompleted(), "peer2 doesn't have the votes yet")
+
+	peer2.Set(ttypes.PeerStateKey, testPeerState{2})
+	waitFor(t, time.Second, func() bool { return len(getCompleted()) == 2 })
+	assert.ElementsMatch(t, []int64{1, 2}, getCompleted())
+
+	// More votes for a complete height don't fire again.
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, time.Second, func() bool { return len(peer2.Sent()) == 4 })
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, getCompleted(), 2)
+}
+
+func TestHeightPendingBroadcastsCounted(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+	pending := func() map[int64]int {
+		txR.Txpool.pendingMtx.Lock()
+		defer txR.Txpool.pendingMtx.Unlock()
+		counts := make(map[int64]int)
+		for h, n := range txR.Txpool.pendingBroadcasts {
+			counts[h] = n
+		}
+		return counts
+	}
+
+	validator := newTestValidator()
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	// Votes aren't counted until a callback is set.
+	assert.Nil(t, txR.Txpool.pendingBroadcasts)
+	txR.OnHeightBroadcastComplete(func(int64) {})
+	assert.Equal(t, map[int64]int{1: 1}, pending())
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(2, validator)))
+	assert.Equal(t, map[int64]int{1: 2, 2: 1}, pending())
+
+	// A vote received from the only peer is never pending.
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(3, validator)})
+	assert.Equal(t, map[int64]int{1: 2, 2: 1}, pending())
+
+	// Votes are counted off as the peer gets them.
+	peer.Set(ttypes.PeerStateKey, testPeerState{2})
+	waitFor(t, time.Second, func() bool { return len(pending()) == 0 }, "votes still pending")
+
+	// A new peer needs every vote again.
+	txR.AddPeer(newTestPeer("other"))
+	assert.Equal(t, map[int64]int{1: 2, 2: 1, 3: 1}, pending())
+
+	txR.Txpool.Flush()
+	assert.Empty(t, pending())
+}
+
+// refusingPeer is a testPeer which can't be sent some messages.
+type refusingPeer struct {
+	*testPeer
+	refuse func(TxpoolMessage) bool
+}
+
+func (rp *refusingPeer) Send(chID byte, msgBytes []byte) bool {
+	msg, err := decodeMsg(msgBytes)
+	if err != nil {
+		panic(err)
+	}
+	if rp.refuse(msg) {
+		return false
+	}
+	return rp.testPeer.Send(chID, msgBytes)
+}
+
+func TestUnsendableVoteDeadLettered(t *testing.T) {
+	txR := newTestReactor(t, ReactorMaxSendAttempts(3))
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	stuck := newTestVote(1, validator)
+	peer := &refusingPeer{
+		testPeer: newTestPeer("peer"),
+		refuse: func(msg TxpoolMessage) bool {
+			txMsg, ok := msg.(*TxMessage)
+			return ok && bytes.Equal(txMsg.Tx.Signature, stuck.Signature)
+		},
+	}
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	require.NoError(t, txR.Txpool.CheckTx(stuck))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	// The next vote goes through once the stuck one was given up on.
+	waitFor(t, 2*time.Second, func() bool { return len(peer.Sent()) == 1 })
+
+	deadLetters := txR.DeadLetters()
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, stuck, deadLetters[0].Tx)
+	assert.Equal(t, peer.ID(), deadLetters[0].Peer)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.NotEmpty(t, deadLetters[0].Reason)
+}
+
+func TestSendAttemptsCountRetries(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	vote := newTestVote(1, newTestValidator())
+	var refused int32
+	peer := &refusingPeer{
+		testPeer: newTestPeer("peer"),
+		refuse: func(TxpoolMessage) bool {
+			// fail twice, then go through
+			return atomic.AddInt32(&refused, 1) <= 2
+		},
+	}
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	attempts, ok := txR.Txpool.SendAttempts(vote.Signature)
+	require.True(t, ok)
+	assert.Zero(t, attempts)
+
+	txR.AddPeer(peer)
+	waitFor(t, 2*time.Second, func() bool { return sentVote(peer.testPeer, vote) }, "vote not sent")
+	attempts, _ = txR.Txpool.SendAttempts(vote.Signature)
+	assert.EqualValues(t, 3, attempts)
+	assert.Equal(t, []int64{3}, txR.Txpool.Snapshot().SendAttempts)
+
+	_, ok = txR.Txpool.SendAttempts(randBytes(64))
+	assert.False(t, ok)
+}
+
+func TestFlushDuringBroadcast(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peers := make([]*testPeer, 3)
+	for i := range peers {
+		peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i)))
+		peers[i].Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peers[i])
+	}
+
+	validator := newTestValidator()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = txR.Txpool.CheckTx(newTestVote(1, validator))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			txR.Txpool.GetVote(randBytes(64))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		time.Sleep(time.Millisecond)
+		txR.Txpool.Flush()
+	}
+	close(stop)
+	wg.Wait()
+	txR.Txpool.Flush()
+
+	votes := make([]types.TxVote, 10)
+	var txsBytes int64
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		require.NoError(t, txR.Txpool.CheckTx(votes[i]))
+		txsBytes += int64(votes[i].Size())
+	}
+
+	assert.Equal(t, len(votes), txR.Txpool.Size())
+	assert.Equal(t, txsBytes, txR.Txpool.TxsBytes())
+	txR.Txpool.Lock()
+	assert.Equal(t, map[string]int{string(validator): len(votes)}, txR.Txpool.signerVotes)
+	txR.Txpool.Unlock()
+	for _, vote := range votes {
+		_, ok := txR.Txpool.GetVote(vote.Signature)
+		assert.True(t, ok)
+	}
+
+	// The broadcast routines got over the flushes.
+	for _, peer := range peers {
+		peer := peer
+		waitFor(t, 2*time.Second, func() bool {
+			for _, vote := range votes {
+				if !sentVote(peer, vote) {
+					return false
+				}
+			}
+			return true
+		}, "peer %s missing votes", peer.ID())
+	}
+}
+
+// sentVote returns true if vote was sent to peer.
+func sentVote(peer *testPeer, vote types.TxVote) bool {
+	for _, msg := range peer.Sent() {
+		if m, ok := msg.(*TxMessage); ok && bytes.Equal(m.Tx.Signature, vote.Signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWakeCoalesceWindowReducesWakes(t *testing.T) {
+	countWakes := func(options ...ReactorOption) float64 {
+		config := cfg.TestConfig()
+		metrics := NopMetrics()
+		wakes := &testCounter{}
+		metrics.BroadcastWakes = wakes
+		txR := NewTxpoolReactor(config.Mempool, NewTxVotePool(config.Mempool, WithMetrics(metrics)), options...)
+		txR.SetLogger(log.TestingLogger())
+		require.NoError(t, txR.Start())
+		defer txR.Stop()
+
+		peer := newTestPeer("peer")
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peer)
+
+		validator := newTestValidator()
+		const numVotes = 40
+		for i := 0; i < numVotes; i++ {
+			require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+			time.Sleep(time.Millisecond)
+		}
+		waitFor(t, 2*time.Second, func() bool { return len(peer.Sent()) == numVotes })
+		return wakes.value()
+	}
+
+	immediate := countWakes()
+	coalesced := countWakes(ReactorWakeCoalesceWindow(20 * time.Millisecond))
+	assert.True(t, coalesced > 0)
+	assert.True(t, coalesced*4 < immediate, "%v wakes with the window, %v without", coalesced, immediate)
+}
+
+func TestSyncPeerSendsWholePool(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	// The peer lags behind the votes, so its routine sends it none.
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 5)
+	for i := range votes {
+		votes[i] = newTestVote(10, validator)
+		require.NoError(t, txR.Txpool.CheckTx(votes[i]))
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 0, votesSent(peer))
+
+	n, err := txR.SyncPeer(peer)
+	require.NoError(t, err)
+	assert.Equal(t, len(votes), n)
+	var got []types.TxVote
+	for _, msg := range peer.Sent() {
+		got = append(got, msg.(*TxMessage).Tx)
+	}
+	assert.Equal(t, votes, got)
+
+	// Votes the peer has are not sent again.
+	n, err = txR.SyncPeer(peer)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = txR.SyncPeer(newTestPeer("other"))
+	assert.Equal(t, ErrUnknownPeer, err)
+}
+
+func TestSubmitVoteBroadcasts(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{10})
+	txR.AddPeer(peer)
+
+	vote := newTestVote(1, newTestValidator())
+	res, err := txR.SubmitVote(vote)
+	require.NoError(t, err)
+	assert.Equal(t, CheckTxResult{Added: true, PoolSize: 1}, res)
+	waitFor(t, time.Second, func() bool { return votesSent(peer) == 1 }, "vote not broadcast")
+	assert.Equal(t, vote, peer.Sent()[0].(*TxMessage).Tx)
+
+	res, err = txR.SubmitVote(vote)
+	assert.Equal(t, ErrTxVoteInCache, err)
+	assert.True(t, res.Duplicate)
+
+	config := cfg.TestConfig()
+	config.Mempool.Broadcast = false
+	quiet := NewTxpoolReactor(config.Mempool, newTestTxVotePool())
+	_, err = quiet.SubmitVote(newTestVote(1, newTestValidator()))
+	assert.Equal(t, ErrBroadcastDisabled, err)
+	assert.Zero(t, quiet.Txpool.Size())
+}
@@ -0,0 +1,334 @@
+package txvotepool
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tendermint/tendermint/libs/clist"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorBroadcastWorkers makes n workers broadcast votes to all the peers,
+// instead of a routine per peer, so that the number of goroutines
+// broadcasting stays the same whatever the number of peers. Peers ready for
+// votes are queued, and each worker in turn sends up to the max number of
+// votes handled in a row (see ReactorMaxScanPerWake) to the peer at the head
+// of the queue, before queuing it again. Caught up peers are queued again
+// once votes arrive. Broadcast batches, lanes, send rates, start delays and
+// idle timeouts only apply to per peer routines, as workers never wait on a
+// single peer. Votes are broadcast by a routine per peer by default.
+func ReactorBroadcastWorkers(n int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.broadcastWorkers = n }
+}
+
+// sharedBroadcast returns true if votes are broadcast by shared workers.
+func (txR *TxpoolReactor) sharedBroadcast() bool {
+	return txR.broadcastWorkers > 0
+}
+
+// scheduledPeer is a peer votes are broadcast to by the shared workers,
+// along with where it is in the pool. It is handled by one worker at a time.
+type scheduledPeer struct {
+	peer p2p.Peer
+
+	next     *clist.CElement // vote being handled, nil to start from the front
+	handled  bool            // next was handled, move on to the vote after it
+	attempts int             // failed sends of next
+	retries  fanoutRetries   // votes skipped until the next cycle, see claimFanout
+
+	// guarded by broadcastScheduler.mtx
+	waiting bool // caught up, queued again once votes arrive
+	removed bool
+}
+
+// broadcastScheduler is the queue of peers the shared workers pick from.
+type broadcastScheduler struct {
+	mtx   sync.Mutex
+	peers map[p2p.ID]*scheduledPeer
+	ready []*scheduledPeer
+	wake  chan struct{} // signaled when ready isn't empty
+}
+
+func newBroadcastScheduler() *broadcastScheduler {
+	return &broadcastScheduler{
+		peers: make(map[p2p.ID]*scheduledPeer),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// add queues the peer, replacing any previous connection with the same ID.
+func (s *broadcastScheduler) add(peer p2p.Peer) {
+	sp := &scheduledPeer{peer: peer}
+	s.mtx.Lock()
+	if prev, ok := s.peers[peer.ID()]; ok {
+		prev.removed = true
+	}
+	s.peers[peer.ID()] = sp
+	s.ready = append(s.ready, sp)
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// remove stops broadcasting to the peer.
+func (s *broadcastScheduler) remove(peer p2p.Peer) {
+	s.mtx.Lock()
+	if sp, ok := s.peers[peer.ID()]; ok && sp.peer == peer {
+		sp.removed = true
+		delete(s.peers, peer.ID())
+	}
+	s.mtx.Unlock()
+}
+
+// schedule queues the peer again, unless it was removed.
+func (s *broadcastScheduler) schedule(sp *scheduledPeer) {
+	s.mtx.Lock()
+	if sp.removed {
+		s.mtx.Unlock()
+		return
+	}
+	s.ready = append(s.ready, sp)
+	s.mtx.Unlock()
+	s.signal()
+}
+
+// scheduleAfter queues the peer again after d.
+func (s *broadcastScheduler) scheduleAfter(sp *scheduledPeer, d time.Duration) {
+	time.AfterFunc(d, func() { s.schedule(sp) })
+}
+
+// park makes the caught up peer wait for votes. It returns false, and leaves
+// the peer to the caller, if caughtUp no longer holds, as votes arriving
+// concurrently may not have seen it waiting.
+func (s *broadcastScheduler) park(sp *scheduledPeer, caughtUp func() bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if sp.removed {
+		return true
+	}
+	if !caughtUp() {
+		return false
+	}
+	sp.waiting = true
+	return true
+}
+
+// wakeWaiting queues the peers waiting for votes.
+func (s *broadcastScheduler) wakeWaiting() {
+	s.mtx.Lock()
+	var woken int
+	for _, sp := range s.peers {
+		if sp.waiting {
+			sp.waiting = false
+			s.ready = append(s.ready, sp)
+			woken++
+		}
+	}
+	s.mtx.Unlock()
+	if woken > 0 {
+		s.signal()
+	}
+}
+
+func (s *broadcastScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the peer at the head of the queue, waiting for one if there
+// are none, or nil once quit is closed.
+func (s *broadcastScheduler) pop(quit <-chan struct{}) *scheduledPeer {
+	for {
+		s.mtx.Lock()
+		for len(s.ready) > 0 {
+			sp := s.ready[0]
+			s.ready[0] = nil
+			s.ready = s.ready[1:]
+			if sp.removed {
+				continue
+			}
+			more := len(s.ready) > 0
+			s.mtx.Unlock()
+			if more {
+				// let another worker pick the next one
+				s.signal()
+			}
+			return sp
+		}
+		s.mtx.Unlock()
+		select {
+		case <-s.wake:
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// startBroadcastWorkers starts the shared workers and the routine waking
+// caught up peers.
+func (txR *TxpoolReactor) startBroadcastWorkers() {
+	for i := 0; i < txR.broadcastWorkers; i++ {
+		txR.trackBroadcastGoroutine(1)
+		go func() {
+			defer txR.trackBroadcastGoroutine(-1)
+			txR.broadcastWorker()
+		}()
+	}
+	go txR.broadcastWakeRoutine()
+}
+
+// trackBroadcastGoroutine counts a broadcasting goroutine starting, or
+// returning if delta is -1.
+func (txR *TxpoolReactor) trackBroadcastGoroutine(delta int64) {
+	n := atomic.AddInt64(&txR.broadcastGoroutines, delta)
+	txR.Txpool.metrics.BroadcastGoroutines.Set(float64(n))
+}
+
+// broadcastWorker handles the peers queued by the scheduler, one at a time.
+func (txR *TxpoolReactor) broadcastWorker() {
+	for {
+		sp := txR.broadcastScheduler.pop(txR.Quit())
+		if sp == nil {
+			return
+		}
+		txR.serveScheduledPeer(sp)
+	}
+}
+
+// serveScheduledPeer sends the peer the votes it is missing, up to
+// maxScanPerWake of them, and then queues it again, after a while if it isn't
+// ready, or once votes arrive if it is caught up.
+func (txR *TxpoolReactor) serveScheduledPeer(sp *scheduledPeer) {
+	peer := sp.peer
+	if !txR.config.Broadcast {
+		return
+	}
+	retry := peerCatchupSleepIntervalMS * time.Millisecond
+	for scanned := 0; scanned < txR.maxScanPerWake; scanned++ {
+		if !txR.IsRunning() || !peer.IsRunning() {
+			return
+		}
+		retried := sp.retries.popDue()
+		if retried == nil && (sp.next == nil || sp.handled) {
+			var elem *clist.CElement
+			if sp.next == nil {
+				elem = txR.Txpool.TxsFront()
+			} else {
+				elem = sp.next.Next()
+			}
+			if elem == nil {
+				if sp.next != nil && sp.next.Removed() {
+					// next was removed from the back of the pool, start over
+					sp.next = nil
+					continue
+				}
+				if d, ok := sp.retries.untilDue(); ok {
+					// caught up, but for the votes skipped until the next cycle
+					txR.broadcastScheduler.scheduleAfter(sp, d)
+					return
+				}
+				next := sp.next
+				if txR.broadcastScheduler.park(sp, func() bool {
+					if next == nil {
+						return txR.Txpool.TxsFront() == nil
+					}
+					return next.Next() == nil && !next.Removed()
+				}) {
+					return
+				}
+				continue
+			}
+			sp.next, sp.handled = elem, false
+		}
+
+		elem := sp.next
+		if retried != nil {
+			elem = retried
+		}
+		txTx := elem.Value.(*mempoolTxVote)
+		ready, stop := txR.peerReadyFor(peer, txTx)
+		if stop {
+			txR.broadcastScheduler.remove(peer)
+			return
+		}
+		if !ready {
+			if retried != nil {
+				sp.retries.add(retried)
+			}
+			txR.broadcastScheduler.scheduleAfter(sp, retry)
+			return
+		}
+
+		// the peer's ID may have been reassigned, see ReassignPeer
+		peerID := txR.ids.GetForPeer(peer)
+		if txR.shouldSendTo(peer, peerID, elem) {
+			if !txTx.claimFanout(txR.broadcastFanout, peer.ID(), txR.fanoutPicker()) {
+				// Enough peers got the vote during this cycle, move on to the
+				// next votes and come back to it on the next one.
+				sp.retries.add(elem)
+				if retried == nil {
+					sp.handled = true
+				}
+				continue
+			}
+			signed := txR.signsOutbound()
+			if !txR.deliverVote(peer, peerID, txR.encodeVoteFor(peer, txTx, signed), txTx) {
+				// the send is claimed again on the next attempt
+				txTx.releaseFanout(txR.broadcastFanout)
+				if retried != nil {
+					// only the sends of next are counted, try again next cycle
+					sp.retries.add(retried)
+					continue
+				}
+				sp.attempts++
+				if txR.maxSendAttempts <= 0 || sp.attempts < txR.maxSendAttempts {
+					txR.broadcastScheduler.scheduleAfter(sp, retry)
+					return
+				}
+				// give up on the vote for this peer
+				txR.deadLetter(peer, "send failed", sp.attempts, txTx.tx)
+			}
+		}
+		if retried != nil {
+			continue
+		}
+		sp.attempts = 0
+		sp.handled = true
+	}
+	txR.Txpool.metrics.BroadcastScanYields.Add(1)
+	txR.broadcastScheduler.schedule(sp)
+}
+
+// broadcastWakeRoutine queues the peers waiting for votes whenever votes are
+// added to the pool.
+func (txR *TxpoolReactor) broadcastWakeRoutine() {
+	var last *clist.CElement // back of the pool
+	for {
+		if last == nil {
+			select {
+			case <-txR.Txpool.TxsWaitChan():
+				last = txR.Txpool.TxsFront()
+			case <-txR.Quit():
+				return
+			}
+		} else {
+			select {
+			case <-last.NextWaitChan():
+				// nil if last was removed from the back
+				last = last.Next()
+			case <-txR.Quit():
+				return
+			}
+		}
+		if last == nil {
+			continue
+		}
+		for last.Next() != nil {
+			last = last.Next()
+		}
+		txR.Txpool.metrics.BroadcastWakes.Add(1)
+		txR.broadcastScheduler.wakeWaiting()
+	}
+}
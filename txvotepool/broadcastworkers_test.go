@@ -0,0 +1,89 @@
+package txvotepool
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+// votesSent returns the number of votes sent to the peer.
+func votesSent(peer *testPeer) int {
+	var n int
+	for _, msg := range peer.Sent() {
+		switch m := msg.(type) {
+		case *TxMessage:
+			n++
+		case *TxsMessage:
+			n += len(m.Txs)
+		}
+	}
+	return n
+}
+
+func TestBroadcastWorkersServeManyPeers(t *testing.T) {
+	const (
+		numWorkers = 4
+		numPeers   = 200
+		numVotes   = 20
+	)
+	txR := newTestReactor(t, ReactorBroadcastWorkers(numWorkers), ReactorMaxScanPerWake(5))
+	defer txR.Stop()
+	assert.EqualValues(t, numWorkers, atomic.LoadInt64(&txR.broadcastGoroutines))
+
+	goroutines := runtime.NumGoroutine()
+	peers := make([]*testPeer, numPeers)
+	for i := range peers {
+		peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i)))
+		peers[i].Set(ttypes.PeerStateKey, testPeerState{10})
+		txR.AddPeer(peers[i])
+	}
+
+	validator := newTestValidator()
+	votes := make([]types.TxVote, numVotes)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		require.NoError(t, txR.Txpool.CheckTx(votes[i]))
+	}
+	for _, peer := range peers {
+		waitFor(t, 5*time.Second, func() bool { return votesSent(peer) == numVotes },
+			"peer %v got %d votes", peer.ID(), votesSent(peer))
+	}
+	assert.EqualValues(t, numWorkers, atomic.LoadInt64(&txR.broadcastGoroutines))
+	assert.True(t, runtime.NumGoroutine() < goroutines+numPeers/10,
+		"%d goroutines for %d peers, from %d", runtime.NumGoroutine(), numPeers, goroutines)
+
+	// Caught up peers get the votes added later, removed peers don't.
+	txR.RemovePeer(peers[0], nil)
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	for _, peer := range peers[1:] {
+		waitFor(t, 5*time.Second, func() bool { return votesSent(peer) == numVotes+1 },
+			"peer %v got %d votes", peer.ID(), votesSent(peer))
+	}
+	assert.Equal(t, numVotes, votesSent(peers[0]))
+}
+
+func TestBroadcastWorkersWaitForPeerState(t *testing.T) {
+	txR := newTestReactor(t, ReactorBroadcastWorkers(1))
+	defer txR.Stop()
+
+	// The worker moves on to other peers while one isn't ready.
+	behind, ready := newTestPeer("behind"), newTestPeer("ready")
+	ready.Set(ttypes.PeerStateKey, testPeerState{10})
+	txR.AddPeer(behind)
+	txR.AddPeer(ready)
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+	waitFor(t, 2*time.Second, func() bool { return votesSent(ready) == 1 }, "vote not sent")
+	assert.Equal(t, 0, votesSent(behind))
+
+	behind.Set(ttypes.PeerStateKey, testPeerState{10})
+	waitFor(t, 2*time.Second, func() bool { return votesSent(behind) == 1 }, "vote not sent once ready")
+}
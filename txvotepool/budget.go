@@ -0,0 +1,58 @@
+package txvotepool
+
+import (
+	"time"
+)
+
+// byteBudget is a token bucket limiting the rate at which bytes are sent to a
+// peer. It holds up to burst bytes, refilled at rate bytes per second. It is
+// used by a single broadcast routine, so it isn't safe for concurrent use.
+type byteBudget struct {
+	rate  int64 // bytes per second
+	burst int64
+
+	tokens int64
+	last   time.Time // last refill
+}
+
+func newByteBudget(rate, burst int64) *byteBudget {
+	return &byteBudget{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *byteBudget) refill(now time.Time) {
+	b.tokens += int64(now.Sub(b.last).Seconds() * float64(b.rate))
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait blocks until n bytes can be spent, and spends them. A send larger than
+// the burst waits for a full bucket and overdraws it. It returns false if
+// peerQuit or quit is closed first.
+func (b *byteBudget) wait(n int64, peerQuit, quit <-chan struct{}) bool {
+	want := n
+	if want > b.burst {
+		want = b.burst
+	}
+	for {
+		b.refill(time.Now())
+		if b.tokens >= want {
+			b.tokens -= n
+			return true
+		}
+		delay := time.Duration(float64(want-b.tokens) / float64(b.rate) * float64(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-peerQuit:
+			return false
+		case <-quit:
+			return false
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package txvotepool
+
+import (
+	"time"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorBulkSync makes the reactor fetch the pool of newly added peers, and
+// serve its own pool to the peers asking for it, instead of only relying on
+// gossip. The pool is transferred in chunks of up to chunkSize votes, one
+// chunk per interval, and up to maxVotes votes. A peer is served at most one
+// chunk per interval. Disabled by default.
+func ReactorBulkSync(maxVotes, chunkSize int, interval time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.bulkMaxVotes = maxVotes
+		txR.bulkChunkSize = chunkSize
+		txR.bulkInterval = interval
+	}
+}
+
+// bulkSyncEnabled returns true if the reactor fetches and serves pools.
+func (txR *TxpoolReactor) bulkSyncEnabled() bool {
+	return txR.bulkMaxVotes > 0 && txR.bulkChunkSize > 0
+}
+
+// startBulkSync requests the first chunk of the peer's pool.
+func (txR *TxpoolReactor) startBulkSync(peer p2p.Peer) {
+	txR.requestPoolChunk(peer, 0)
+}
+
+// requestPoolChunk requests the chunk of the peer's pool starting at offset.
+func (txR *TxpoolReactor) requestPoolChunk(peer p2p.Peer, offset int) {
+	txR.bulkSyncMtx.Lock()
+	txR.bulkSyncing[peer.ID()] = offset
+	txR.bulkSyncMtx.Unlock()
+
+	limit := txR.bulkChunkSize
+	if offset+limit > txR.bulkMaxVotes {
+		limit = txR.bulkMaxVotes - offset
+	}
+	peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(&PoolRequestMessage{Offset: offset, Limit: limit}))
+}
+
+// servePoolChunk sends the requested chunk of the pool to the peer, signed if
+// envelopes are, and marks its votes as sent to the peer. Committed votes are skipped. Requests past
+// the bulk sync bounds, and those coming less than the bulk sync interval
+// after the last chunk served to the peer, are ignored.
+func (txR *TxpoolReactor) servePoolChunk(peer p2p.Peer, req *PoolRequestMessage) {
+	if !txR.bulkSyncEnabled() || req.Offset < 0 || req.Offset >= txR.bulkMaxVotes || req.Limit <= 0 {
+		txR.Logger.Debug("Ignoring pool request out of bounds", "peer", peer, "offset", req.Offset, "limit", req.Limit)
+		return
+	}
+	if !txR.takeBulkServe(peer) {
+		txR.Logger.Debug("Ignoring pool request sent too soon", "peer", peer, "offset", req.Offset)
+		return
+	}
+	limit := req.Limit
+	if limit > txR.bulkChunkSize {
+		limit = txR.bulkChunkSize
+	}
+	if req.Offset+limit > txR.bulkMaxVotes {
+		limit = txR.bulkMaxVotes - req.Offset
+	}
+
+	chunk := &PoolChunkMessage{Offset: req.Offset, Txs: make([]types.TxVote, 0, limit)}
+	ids := make([][]byte, 0, limit)
+	i := 0
+	for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
+		if i >= req.Offset {
+			if len(chunk.Txs) == limit {
+				chunk.More = true
+				break
+			}
+			chunk.Txs = append(chunk.Txs, txR.outboundVote(memTx.tx))
+			ids = append(ids, memTx.tx.Signature)
+		}
+		i++
+	}
+	if txR.signsOutbound() {
+		chunk.sign(txR.privKey)
+	}
+	if peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(chunk)) {
+		txR.Txpool.MarkSentTo(txR.ids.GetForPeer(peer), ids)
+	}
+}
+
+// takeBulkServe returns true, and records the time, if the peer wasn't served
+// a chunk within the bulk sync interval.
+func (txR *TxpoolReactor) takeBulkServe(peer p2p.Peer) bool {
+	now := time.Now()
+	txR.bulkSyncMtx.Lock()
+	defer txR.bulkSyncMtx.Unlock()
+	if last, ok := txR.bulkServed[peer.ID()]; ok && now.Sub(last) < txR.bulkInterval {
+		return false
+	}
+	txR.bulkServed[peer.ID()] = now
+	return true
+}
+
+// receivePoolChunk adds the votes of a chunk requested from the peer to the
+// pool, and requests the next one after the bulk sync interval if any. Chunks
+// which weren't requested are ignored.
+func (txR *TxpoolReactor) receivePoolChunk(src p2p.Peer, chunk *PoolChunkMessage, seq uint64) {
+	txR.bulkSyncMtx.Lock()
+	offset, ok := txR.bulkSyncing[src.ID()]
+	if ok && offset == chunk.Offset {
+		delete(txR.bulkSyncing, src.ID())
+	}
+	txR.bulkSyncMtx.Unlock()
+	if !ok || offset != chunk.Offset || len(chunk.Txs) > txR.bulkChunkSize {
+		txR.Logger.Debug("Ignoring unexpected pool chunk", "src", src, "offset", chunk.Offset)
+		return
+	}
+
+	errs := txR.verifyVotes(chunk.Txs)
+	for i, tx := range chunk.Txs {
+		if errs[i] != nil {
+			if txR.invalidVote(src, tx, seq, errs[i]) {
+				return
+			}
+			continue
+		}
+		txR.receiveTx(src, tx, seq, nil)
+	}
+
+	next := chunk.Offset + len(chunk.Txs)
+	if !chunk.More || len(chunk.Txs) == 0 || next >= txR.bulkMaxVotes {
+		txR.Logger.Info("Bulk synced pool", "src", src, "votes", next)
+		return
+	}
+	time.AfterFunc(txR.bulkInterval, func() {
+		if txR.IsRunning() && src.IsRunning() {
+			txR.requestPoolChunk(src, next)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestBulkSyncOnConnect(t *testing.T) {
+	const (
+		numVotes  = 25
+		chunkSize = 10
+		maxVotes  = 22
+	)
+	old := newTestReactor(t, ReactorBulkSync(maxVotes, chunkSize, 20*time.Millisecond))
+	defer old.Stop()
+	fresh := newTestReactor(t, ReactorBulkSync(maxVotes, chunkSize, 20*time.Millisecond))
+	defer fresh.Stop()
+
+	validator := newTestValidator()
+	votes := make([]types.TxVote, numVotes)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		require.NoError(t, old.Txpool.CheckTx(votes[i]))
+	}
+
+	// Neither peer has a PeerState, so only the bulk sync moves votes.
+	oldPeer, freshPeer := newTestPeer("old"), newTestPeer("fresh")
+	old.AddPeer(freshPeer)
+	fresh.AddPeer(oldPeer)
+
+	// Relay the messages between the two reactors until the transfer ends.
+	var chunks []*PoolChunkMessage
+	relayed := map[*testPeer]int{}
+	relay := func(to *TxpoolReactor, from, via *testPeer) {
+		sent := via.Sent()
+		for _, msg := range sent[relayed[via]:] {
+			if chunk, ok := msg.(*PoolChunkMessage); ok && to == fresh {
+				chunks = append(chunks, chunk)
+			}
+			sendMsg(to, from, msg)
+		}
+		relayed[via] = len(sent)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for fresh.Txpool.Size() < maxVotes && time.Now().Before(deadline) {
+		relay(old, freshPeer, oldPeer)
+		relay(fresh, oldPeer, freshPeer)
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Give a stray request the time to show up.
+	time.Sleep(50 * time.Millisecond)
+	relay(old, freshPeer, oldPeer)
+	relay(fresh, oldPeer, freshPeer)
+
+	assert.Equal(t, votes[:maxVotes], fresh.Txpool.ReapMaxTxs(-1))
+	require.Len(t, chunks, 3)
+	for i, chunk := range chunks {
+		assert.Equal(t, i*chunkSize, chunk.Offset)
+		assert.True(t, len(chunk.Txs) <= chunkSize)
+	}
+	assert.Len(t, chunks[2].Txs, maxVotes-2*chunkSize)
+
+	// Unsolicited chunks don't trigger requests.
+	requests := len(oldPeer.Sent())
+	sendMsg(fresh, oldPeer, &PoolChunkMessage{Offset: 0, Txs: votes[:1], More: true})
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, oldPeer.Sent(), requests)
+}
+
+func TestServedPoolChunkNotBroadcastAgain(t *testing.T) {
+	txR := newTestReactor(t, ReactorBulkSync(10, 10, 20*time.Millisecond))
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	// Without a PeerState, the peer's broadcast routine waits.
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, &PoolRequestMessage{Offset: 0, Limit: 2})
+	var served []types.TxVote
+	for _, msg := range peer.Sent() {
+		if chunk, ok := msg.(*PoolChunkMessage); ok {
+			served = chunk.Txs
+		}
+	}
+	require.Len(t, served, 2)
+
+	// Only the vote left out of the chunk is broadcast.
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	waitFor(t, 2*time.Second, func() bool { return votesSent(peer) == 1 }, "vote not broadcast")
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, votesSent(peer), "served votes broadcast again")
+	for _, msg := range peer.Sent() {
+		if m, ok := msg.(*TxMessage); ok {
+			assert.NotContains(t, served, m.Tx)
+		}
+	}
+}
+
+func TestBulkSyncBetweenSigningPeers(t *testing.T) {
+	oldKey, freshKey := ed25519.GenPrivKey(), ed25519.GenPrivKey()
+	old := newTestSwitchReactor(t, ReactorBulkSync(10, 5, 20*time.Millisecond), ReactorSignEnvelopes(oldKey))
+	defer old.Stop()
+	fresh := newTestSwitchReactor(t, ReactorBulkSync(10, 5, 20*time.Millisecond), ReactorSignEnvelopes(freshKey))
+	defer fresh.Stop()
+
+	validator := newTestValidator()
+	for i := 0; i < 8; i++ {
+		require.NoError(t, old.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+
+	// Neither peer has a PeerState, so only the bulk sync moves votes.
+	oldPeer := newTestPeer(p2p.PubKeyToID(oldKey.PubKey()))
+	freshPeer := newTestPeer(p2p.PubKeyToID(freshKey.PubKey()))
+	old.AddPeer(freshPeer)
+	fresh.AddPeer(oldPeer)
+	relayed := map[*testPeer]int{}
+	relay := func(to *TxpoolReactor, from, via *testPeer) {
+		sent := via.Sent()
+		for _, msg := range sent[relayed[via]:] {
+			sendMsg(to, from, msg)
+		}
+		relayed[via] = len(sent)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		relay(old, freshPeer, oldPeer)
+		relay(fresh, oldPeer, freshPeer)
+		return fresh.Txpool.Size() == 8
+	}, "pool not synced")
+	assert.True(t, oldPeer.IsRunning() && freshPeer.IsRunning(), "signing peer stopped")
+
+	// Chunks are signed by the serving node.
+	var chunk *PoolChunkMessage
+	for _, msg := range freshPeer.Sent() {
+		if m, ok := msg.(*PoolChunkMessage); ok {
+			chunk = m
+		}
+	}
+	require.NotNil(t, chunk)
+	assert.NoError(t, chunk.Verify(oldPeer.ID()))
+	chunk.Txs = chunk.Txs[1:]
+	assert.Equal(t, ErrInvalidEnvelopeSignature, chunk.Verify(oldPeer.ID()))
+}
+
+func TestPoolRequestBoundsAndRate(t *testing.T) {
+	txR := newTestReactor(t, ReactorBulkSync(10, 10, time.Minute))
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	chunks := func() int {
+		n := 0
+		for _, msg := range peer.Sent() {
+			if _, ok := msg.(*PoolChunkMessage); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Requests with no votes to serve are ignored.
+	sendMsg(txR, peer, &PoolRequestMessage{Offset: 0, Limit: -1})
+	sendMsg(txR, peer, &PoolRequestMessage{Offset: 0, Limit: 0})
+	assert.Equal(t, 0, chunks())
+
+	// A peer is served a chunk per bulk sync interval.
+	sendMsg(txR, peer, &PoolRequestMessage{Offset: 0, Limit: 2})
+	sendMsg(txR, peer, &PoolRequestMessage{Offset: 2, Limit: 2})
+	assert.Equal(t, 1, chunks())
+
+	// Other peers are served meanwhile.
+	other := newTestPeer("other")
+	txR.AddPeer(other)
+	sendMsg(txR, other, &PoolRequestMessage{Offset: 0, Limit: 2})
+	served := false
+	for _, msg := range other.Sent() {
+		if _, ok := msg.(*PoolChunkMessage); ok {
+			served = true
+		}
+	}
+	assert.True(t, served, "other peer not served")
+}
@@ -0,0 +1,170 @@
+package txvotepool
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/tendermint/tendermint/crypto"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// PeerCapabilitiesKey is the key the capabilities a peer announced are stored
+// under in the peer, see Peer.Get.
+const PeerCapabilitiesKey = "TxpoolReactor.capabilities"
+
+// ErrInvalidCapabilities is the reason a peer is stopped for when the
+// capabilities it announced aren't signed by it.
+var ErrInvalidCapabilities = errors.New("Invalid capabilities signature")
+
+// Capabilities is the profile a node announces to its peers, which they base
+// their broadcast and encoding decisions on.
+type Capabilities struct {
+	// latest vote version it accepts
+	MaxTxVoteVersion uint8
+	// signs the votes it relays, and verifies the signature of ours, see
+	// ReactorSignEnvelopes
+	SignsEnvelopes bool
+	// handles BundleMessage, see ReactorCoalesceOutbound
+	AcceptsBundles bool
+	// max number of votes it takes per TxsMessage
+	MaxBatchSize int
+	// votes it wants to receive, all of them if nil
+	Interest *InterestMessage
+}
+
+// ReactorCapabilities makes the reactor announce its capabilities to the
+// peers it adds, in a CapabilitiesMessage signed with nodeKey, the key of the
+// node's p2p identity, along with interest, nil for all votes. The
+// capabilities cover what VersionMessage and SignedEnvelopesMessage announce
+// on their own, which are still sent for the peers running a release without
+// capabilities. Peers running a release which doesn't know
+// CapabilitiesMessage count it as unknown, see ReactorMaxUnknownMessages.
+// Capabilities aren't announced by default, the ones peers announce are
+// always honored.
+func ReactorCapabilities(nodeKey crypto.PrivKey, interest *InterestMessage) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.capabilitiesKey = nodeKey
+		txR.interest = interest
+	}
+}
+
+// capabilities returns the capabilities of the reactor.
+func (txR *TxpoolReactor) capabilities() Capabilities {
+	return Capabilities{
+		MaxTxVoteVersion: txR.maxTxVoteVersion,
+		SignsEnvelopes:   txR.privKey != nil,
+		AcceptsBundles:   true,
+		MaxBatchSize:     txR.maxMsgElements,
+		Interest:         txR.interest,
+	}
+}
+
+// announceCapabilities sends the peer our capabilities, if enabled.
+func (txR *TxpoolReactor) announceCapabilities(peer p2p.Peer) {
+	if txR.capabilitiesKey == nil {
+		return
+	}
+	msg := newCapabilitiesMessage(txR.capabilities(), txR.capabilitiesKey)
+	peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(msg))
+}
+
+// receiveCapabilities verifies and records the capabilities the peer
+// announced. The version, envelope signing and interest are recorded as if
+// announced on their own.
+func (txR *TxpoolReactor) receiveCapabilities(src p2p.Peer, msg *CapabilitiesMessage) {
+	if err := msg.Verify(src.ID()); err != nil {
+		txR.Logger.Error("Invalid capabilities", "src", src, "err", err)
+		txR.Switch.StopPeerForError(src, err)
+		return
+	}
+	caps := msg.Capabilities
+	src.Set(PeerCapabilitiesKey, caps)
+
+	txR.receiveVersion(src, &VersionMessage{MaxTxVoteVersion: caps.MaxTxVoteVersion})
+	txR.signingPeersMtx.Lock()
+	if caps.SignsEnvelopes {
+		txR.signingPeers[src.ID()] = struct{}{}
+	} else {
+		delete(txR.signingPeers, src.ID())
+	}
+	txR.signingPeersMtx.Unlock()
+	txR.interestsMtx.Lock()
+	if caps.Interest != nil {
+		txR.interests[src.ID()] = caps.Interest
+	} else {
+		delete(txR.interests, src.ID())
+	}
+	txR.interestsMtx.Unlock()
+}
+
+// PeerCapabilities returns the capabilities the peer announced, and false if
+// it didn't.
+func (txR *TxpoolReactor) PeerCapabilities(peer p2p.Peer) (Capabilities, bool) {
+	caps, ok := peer.Get(PeerCapabilitiesKey).(Capabilities)
+	return caps, ok
+}
+
+// batchSizeFor returns the max number of votes sent to the peer per
+// TxsMessage.
+func (txR *TxpoolReactor) batchSizeFor(peer p2p.Peer) int {
+	caps, ok := txR.PeerCapabilities(peer)
+	if !ok || caps.MaxBatchSize <= 0 || caps.MaxBatchSize >= txR.batchSize {
+		return txR.batchSize
+	}
+	return caps.MaxBatchSize
+}
+
+// coalescesOutboundTo returns true if the messages for the peer are queued,
+// see ReactorCoalesceOutbound. Peers which announced they don't handle
+// bundles get their messages on their own.
+func (txR *TxpoolReactor) coalescesOutboundTo(peer p2p.Peer) bool {
+	if !txR.coalescesOutbound() {
+		return false
+	}
+	caps, ok := txR.PeerCapabilities(peer)
+	return !ok || caps.AcceptsBundles
+}
+
+//-------------------------------------
+
+// CapabilitiesMessage is a TxpoolMessage announcing the sender's
+// capabilities, signed with its node key, see ReactorCapabilities.
+type CapabilitiesMessage struct {
+	Capabilities Capabilities
+	PubKey       crypto.PubKey
+	Signature    []byte
+}
+
+// newCapabilitiesMessage returns the capabilities signed with the given key.
+func newCapabilitiesMessage(caps Capabilities, privKey crypto.PrivKey) *CapabilitiesMessage {
+	msg := &CapabilitiesMessage{Capabilities: caps, PubKey: privKey.PubKey()}
+	sig, err := privKey.Sign(msg.signBytes())
+	if err != nil {
+		panic(err)
+	}
+	msg.Signature = sig
+	return msg
+}
+
+func (m *CapabilitiesMessage) signBytes() []byte {
+	return cdc.MustMarshalBinaryBare(m.Capabilities)
+}
+
+// Verify checks that the capabilities were signed by the node with the given
+// ID.
+func (m *CapabilitiesMessage) Verify(peerID p2p.ID) error {
+	if m.PubKey == nil || p2p.PubKeyToID(m.PubKey) != peerID {
+		return ErrInvalidCapabilities
+	}
+	if !m.PubKey.VerifyBytes(m.signBytes(), m.Signature) {
+		return ErrInvalidCapabilities
+	}
+	return nil
+}
+
+// String returns a string representation of the CapabilitiesMessage.
+func (m *CapabilitiesMessage) String() string {
+	return fmt.Sprintf("[CapabilitiesMessage %+v %X]", m.Capabilities, cmn.Fingerprint(m.Signature))
+}
@@ -0,0 +1,139 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestCapabilitiesAnnouncedAndRecorded(t *testing.T) {
+	key := ed25519.GenPrivKey()
+	interest := &InterestMessage{MinHeight: 5}
+	announcer := newTestReactor(t, ReactorCapabilities(key, interest), ReactorTxVoteVersions(VoteVersion2))
+	defer announcer.Stop()
+
+	peer := newTestPeer("peer")
+	announcer.AddPeer(peer)
+	var msg *CapabilitiesMessage
+	for _, sent := range peer.Sent() {
+		if m, ok := sent.(*CapabilitiesMessage); ok {
+			msg = m
+		}
+	}
+	require.NotNil(t, msg, "capabilities not announced")
+	require.NoError(t, msg.Verify(p2p.PubKeyToID(key.PubKey())))
+	assert.Equal(t, VoteVersion2, msg.Capabilities.MaxTxVoteVersion)
+	assert.True(t, msg.Capabilities.AcceptsBundles)
+	assert.Equal(t, interest, msg.Capabilities.Interest)
+
+	receiver := newTestReactor(t)
+	defer receiver.Stop()
+	announcerPeer := newTestPeer(p2p.PubKeyToID(key.PubKey()))
+	sendMsg(receiver, announcerPeer, msg)
+	caps, ok := receiver.PeerCapabilities(announcerPeer)
+	require.True(t, ok)
+	assert.Equal(t, msg.Capabilities, caps)
+
+	_, ok = receiver.PeerCapabilities(newTestPeer("other"))
+	assert.False(t, ok)
+}
+
+func TestCapabilitiesWithWrongKeyStopPeer(t *testing.T) {
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer(p2p.PubKeyToID(ed25519.GenPrivKey().PubKey()))
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, newCapabilitiesMessage(Capabilities{}, ed25519.GenPrivKey()))
+	assert.False(t, peer.IsRunning())
+	_, ok := txR.PeerCapabilities(peer)
+	assert.False(t, ok)
+}
+
+// addPeerWithCapabilities adds a peer to txR, after it announced caps.
+func addPeerWithCapabilities(t *testing.T, txR *TxpoolReactor, caps Capabilities) *testPeer {
+	key := ed25519.GenPrivKey()
+	peer := newTestPeer(p2p.PubKeyToID(key.PubKey()))
+	peer.Set(ttypes.PeerStateKey, testPeerState{10})
+	sendMsg(txR, peer, newCapabilitiesMessage(caps, key))
+	txR.AddPeer(peer)
+	return peer
+}
+
+func TestBroadcastHonorsCapabilities(t *testing.T) {
+	caps := Capabilities{
+		MaxTxVoteVersion: VoteVersion2,
+		AcceptsBundles:   false,
+		MaxBatchSize:     2,
+		Interest:         &InterestMessage{MinHeight: 5},
+	}
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 6)
+	for i := range votes {
+		height := int64(1)
+		if i%2 == 0 {
+			height = 6
+		}
+		votes[i] = newTestVote(height, validator)
+	}
+
+	// Batches are cut down to the size the peer takes, and only hold the
+	// votes it is interested in.
+	batching := newTestReactor(t, ReactorBroadcastBatch(10, 20*time.Millisecond))
+	defer batching.Stop()
+	peer := addPeerWithCapabilities(t, batching, caps)
+	for _, vote := range votes {
+		require.NoError(t, batching.Txpool.CheckTx(vote))
+	}
+	var got int
+	waitFor(t, 2*time.Second, func() bool {
+		got = 0
+		for _, msg := range peer.Sent() {
+			if m, ok := msg.(*TxsMessage); ok {
+				got += len(m.Txs)
+			}
+		}
+		return got == 3
+	}, "peer got %d votes", got)
+	for _, msg := range peer.Sent() {
+		m, ok := msg.(*TxsMessage)
+		require.True(t, ok, "unexpected %T", msg)
+		assert.True(t, len(m.Txs) <= caps.MaxBatchSize, "batch of %d votes", len(m.Txs))
+		for _, tx := range m.Txs {
+			assert.EqualValues(t, 6, tx.Height)
+		}
+	}
+
+	// Votes go on their own, in the announced version, rather than in
+	// bundles the peer can't handle.
+	coalescing := newTestReactor(t, ReactorCoalesceOutbound(8, 20*time.Millisecond),
+		ReactorTxVoteVersions(VoteVersion2))
+	defer coalescing.Stop()
+	peer = addPeerWithCapabilities(t, coalescing, caps)
+	for _, vote := range votes {
+		require.NoError(t, coalescing.Txpool.CheckTx(vote))
+	}
+	sentVotes := func() (msgs []TxpoolMessage) {
+		for _, msg := range peer.Sent() {
+			if _, ok := msg.(*VersionMessage); !ok {
+				msgs = append(msgs, msg)
+			}
+		}
+		return msgs
+	}
+	waitFor(t, 2*time.Second, func() bool { return len(sentVotes()) == 3 }, "peer got %d votes", len(sentVotes()))
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, sentVotes(), 3)
+	for _, msg := range sentVotes() {
+		m, ok := msg.(*TxV2Message)
+		require.True(t, ok, "unexpected %T", msg)
+		assert.EqualValues(t, 6, m.Tx.Height)
+	}
+}
@@ -0,0 +1,192 @@
+package txvotepool
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/p2p/mock"
+)
+
+// testPeer is a mock peer with a chosen ID which records every message sent
+// to it.
+type testPeer struct {
+	*mock.Peer
+	id p2p.ID
+
+	mtx  sync.Mutex
+	kv   map[string]interface{}
+	sent []TxpoolMessage
+}
+
+var _ p2p.Peer = (*testPeer)(nil)
+
+func newTestPeer(id p2p.ID) *testPeer {
+	return &testPeer{
+		Peer: mock.NewPeer(net.IP{127, 0, 0, 1}),
+		id:   id,
+		kv:   make(map[string]interface{}),
+	}
+}
+
+func (tp *testPeer) ID() p2p.ID { return tp.id }
+
+func (tp *testPeer) Send(chID byte, msgBytes []byte) bool {
+	msg, err := decodeMsg(msgBytes)
+	if err != nil {
+		panic(err)
+	}
+	tp.mtx.Lock()
+	tp.sent = append(tp.sent, msg)
+	tp.mtx.Unlock()
+	return true
+}
+
+func (tp *testPeer) TrySend(chID byte, msgBytes []byte) bool {
+	return tp.Send(chID, msgBytes)
+}
+
+func (tp *testPeer) Get(key string) interface{} {
+	tp.mtx.Lock()
+	defer tp.mtx.Unlock()
+	return tp.kv[key]
+}
+
+func (tp *testPeer) Set(key string, value interface{}) {
+	tp.mtx.Lock()
+	tp.kv[key] = value
+	tp.mtx.Unlock()
+}
+
+// Sent returns a copy of the messages sent to the peer so far.
+func (tp *testPeer) Sent() []TxpoolMessage {
+	tp.mtx.Lock()
+	defer tp.mtx.Unlock()
+	return append([]TxpoolMessage(nil), tp.sent...)
+}
+
+// testPeerState is a PeerState with a fixed height.
+type testPeerState struct {
+	height int64
+}
+
+func (ps testPeerState) GetHeight() int64 {
+	return ps.height
+}
+
+// testValidatorPeerState is a ValidatorPeerState with a fixed height.
+type testValidatorPeerState struct {
+	testPeerState
+	validator bool
+}
+
+func (ps testValidatorPeerState) IsValidator() bool {
+	return ps.validator
+}
+
+func newTestTxVotePool() *TxVotePool {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool)
+	txVotePool.SetLogger(log.TestingLogger())
+	return txVotePool
+}
+
+// newTestReactor returns a started reactor backed by a fresh pool.
+func newTestReactor(t *testing.T, options ...ReactorOption) *TxpoolReactor {
+	config := cfg.TestConfig()
+	txR := NewTxpoolReactor(config.Mempool, NewTxVotePool(config.Mempool), options...)
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	return txR
+}
+
+// newTestSwitchReactor returns a started reactor registered with a switch,
+// so that it can stop peers.
+func newTestSwitchReactor(t *testing.T, options ...ReactorOption) *TxpoolReactor {
+	txR := newTestReactor(t, options...)
+	p2p.MakeSwitch(cfg.TestConfig().P2P, 0, "127.0.0.1", "123.123.123", func(i int, sw *p2p.Switch) *p2p.Switch {
+		sw.AddReactor("TXPOOL", txR)
+		return sw
+	})
+	return txR
+}
+
+// sendMsg delivers msg to the reactor as if src had sent it.
+func sendMsg(txR *TxpoolReactor, src p2p.Peer, msg TxpoolMessage) {
+	txR.Receive(TxpoolChannel, src, cdc.MustMarshalBinaryBare(msg))
+}
+
+// unknownTestMessage is a registered message the reactor doesn't handle.
+type unknownTestMessage struct {
+	Payload []byte
+}
+
+func init() {
+	cdc.RegisterConcrete(&unknownTestMessage{}, "tendermint/txpool/UnknownTestMessage", nil)
+}
+
+func randBytes(n int) []byte {
+	bz := make([]byte, n)
+	if _, err := rand.Read(bz); err != nil {
+		panic(err)
+	}
+	return bz
+}
+
+// newTestVote returns a vote at the given height with a random signature.
+func newTestVote(height int64, validator crypto.Address) types.TxVote {
+	return types.TxVote{
+		Height:           height,
+		TxHash:           randBytes(32),
+		Timestamp:        time.Now().UTC(),
+		ValidatorAddress: validator,
+		Signature:        randBytes(64),
+	}
+}
+
+func newTestValidator() crypto.Address {
+	return crypto.Address(randBytes(crypto.AddressSize))
+}
+
+// waitFor polls cond until it returns true, failing the test on timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool, msgAndArgs ...interface{}) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "Timed out waiting for condition", msgAndArgs...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// enableBroadcastSteps makes the reactor's broadcast routines wait for
+// stepBroadcast before handling each vote. It must be called before adding
+// peers.
+func enableBroadcastSteps(txR *TxpoolReactor) {
+	txR.broadcastStep = make(chan chan struct{})
+}
+
+// stepBroadcast lets one broadcast routine handle one vote, and waits for it
+// to be done.
+func stepBroadcast(t *testing.T, txR *TxpoolReactor) {
+	done := make(chan struct{})
+	select {
+	case txR.broadcastStep <- done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "No broadcast routine waiting for a step")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Broadcast step not completed")
+	}
+}
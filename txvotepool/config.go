@@ -0,0 +1,278 @@
+package txvotepool
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	cfg "github.com/tendermint/tendermint/config"
+)
+
+// TxVotePoolConfig gathers the tunables of the pool and the reactor which are
+// plain values, so they can be set in one place and validated together. The
+// fields shared with the mempool, eg. the pool's size or whether to
+// broadcast, are taken from Mempool. Options taking functions or keys, eg.
+// ReactorVoteVerifier, are still passed on their own. Use it as:
+//
+//	pool := NewTxVotePool(config.Mempool, config.PoolOptions()...)
+//	txR := NewTxpoolReactor(config.Mempool, pool, config.ReactorOptions()...)
+type TxVotePoolConfig struct {
+	Mempool *cfg.MempoolConfig
+
+	// see WithCommitGrace
+	CommitGrace time.Duration
+	// see WithOverloadShedding, disabled if ShedPressure is 0
+	ShedPressure float64
+	ShedWindow   int64
+	// see WithMaxSendersPerVote, unlimited if 0
+	MaxSendersPerVote int
+	// see WithMaxMemory, unlimited if 0
+	MaxMemory int64
+
+	// see ReactorBroadcastFanout, unlimited if 0
+	BroadcastFanout int
+	// see ReactorBroadcastStartDelay
+	BroadcastStartDelay time.Duration
+	// see ReactorBroadcastIdleTimeout, never if 0
+	BroadcastIdleTimeout time.Duration
+	// see ReactorBroadcastWorkers, a routine per peer if 0
+	BroadcastWorkers int
+	// see ReactorMaxPeerLag, only used if LimitPeerLag is set
+	LimitPeerLag bool
+	MaxPeerLag   int64
+	// see ReactorMaxPeerStateAge, unlimited if 0
+	MaxPeerStateAge time.Duration
+	// see ReactorMaxConcurrentSends, unlimited if 0
+	MaxConcurrentSends int
+	// see ReactorPeerIDCooldown, none if 0
+	PeerIDCooldown time.Duration
+	// see ReactorPeerSendRate, unlimited if PeerSendRate is 0
+	PeerSendRate  int64
+	PeerSendBurst int64
+	// see ReactorBroadcastBatch, votes are sent one at a time if BatchSize is
+	// 0 or 1
+	BatchSize          int
+	BatchFlushInterval time.Duration
+	// see ReactorCoalesceOutbound, disabled if OutboundMaxMsgs is 0 or 1
+	OutboundMaxMsgs       int
+	OutboundFlushInterval time.Duration
+	// see ReactorBulkSync, disabled if BulkMaxVotes is 0
+	BulkMaxVotes  int
+	BulkChunkSize int
+	BulkInterval  time.Duration
+	// see ReactorWarmUp, disabled if WarmUpPeers is 0
+	WarmUpPeers    int
+	WarmUpMaxVotes int
+	// see ReactorMaxScanPerWake
+	MaxScanPerWake int
+	// see ReactorWakeCoalesceWindow
+	WakeCoalesceWindow time.Duration
+	// see ReactorMaxSendAttempts, unlimited if 0
+	MaxSendAttempts int
+	// see ReactorCompactionInterval, never if 0
+	CompactionInterval time.Duration
+	// see ReactorStallTimeout
+	StallTimeout time.Duration
+
+	// see ReactorVerifyParallelism
+	VerifyParallelism int
+	// see ReactorPeerReceiveWorkers
+	PeerReceiveWorkers int
+	// see ReactorBackpressure
+	Backpressure          BackpressurePolicy
+	BackpressureThreshold float64
+	BackpressureMaxDelay  time.Duration
+	// see ReactorMaxMsgElements
+	MaxMsgElements int
+	// see ReactorMaxUnknownMessages, only logged if 0
+	MaxUnknownMessages int
+	// see ReactorWrongChannelPolicy
+	WrongChannelPolicy WrongChannelPolicy
+	// see ReactorStrictProtocol
+	StrictProtocol bool
+	// see ReactorTxVoteVersions
+	MaxTxVoteVersion uint8
+	// see ReactorLogSampling, every line is logged if 0 or 1
+	LogSampling int
+}
+
+// DefaultConfig returns the configuration the pool and the reactor use when
+// no option is given, with Tendermint's default mempool configuration.
+func DefaultConfig() *TxVotePoolConfig {
+	return &TxVotePoolConfig{
+		Mempool:           cfg.DefaultMempoolConfig(),
+		MaxScanPerWake:    defaultMaxScanPerWake,
+		StallTimeout:      defaultStallTimeout,
+		VerifyParallelism: 1,
+		MaxMsgElements:    defaultMaxMsgElements,
+		MaxTxVoteVersion:  VoteVersion1,
+	}
+}
+
+// ValidateBasic returns an error if a value is out of range, or values which
+// only make sense together are inconsistent.
+func (config *TxVotePoolConfig) ValidateBasic() error {
+	if config.Mempool == nil {
+		return errors.New("Mempool config is missing")
+	}
+	if config.Mempool.Size <= 0 {
+		return fmt.Errorf("Mempool size must be positive, got %d", config.Mempool.Size)
+	}
+	if config.Mempool.MaxTxsBytes <= 0 {
+		return fmt.Errorf("Mempool max txs bytes must be positive, got %d", config.Mempool.MaxTxsBytes)
+	}
+
+	for _, f := range []struct {
+		name string
+		v    int64
+	}{
+		{"CommitGrace", int64(config.CommitGrace)},
+		{"ShedWindow", config.ShedWindow},
+		{"MaxSendersPerVote", int64(config.MaxSendersPerVote)},
+		{"MaxMemory", config.MaxMemory},
+		{"BroadcastFanout", int64(config.BroadcastFanout)},
+		{"BroadcastStartDelay", int64(config.BroadcastStartDelay)},
+		{"BroadcastIdleTimeout", int64(config.BroadcastIdleTimeout)},
+		{"BroadcastWorkers", int64(config.BroadcastWorkers)},
+		{"MaxPeerLag", config.MaxPeerLag},
+		{"MaxPeerStateAge", int64(config.MaxPeerStateAge)},
+		{"MaxConcurrentSends", int64(config.MaxConcurrentSends)},
+		{"PeerIDCooldown", int64(config.PeerIDCooldown)},
+		{"PeerSendRate", config.PeerSendRate},
+		{"PeerSendBurst", config.PeerSendBurst},
+		{"BatchSize", int64(config.BatchSize)},
+		{"BatchFlushInterval", int64(config.BatchFlushInterval)},
+		{"OutboundMaxMsgs", int64(config.OutboundMaxMsgs)},
+		{"OutboundFlushInterval", int64(config.OutboundFlushInterval)},
+		{"BulkMaxVotes", int64(config.BulkMaxVotes)},
+		{"BulkChunkSize", int64(config.BulkChunkSize)},
+		{"BulkInterval", int64(config.BulkInterval)},
+		{"WarmUpPeers", int64(config.WarmUpPeers)},
+		{"WarmUpMaxVotes", int64(config.WarmUpMaxVotes)},
+		{"WakeCoalesceWindow", int64(config.WakeCoalesceWindow)},
+		{"MaxSendAttempts", int64(config.MaxSendAttempts)},
+		{"CompactionInterval", int64(config.CompactionInterval)},
+		{"BackpressureMaxDelay", int64(config.BackpressureMaxDelay)},
+		{"PeerReceiveWorkers", int64(config.PeerReceiveWorkers)},
+		{"MaxUnknownMessages", int64(config.MaxUnknownMessages)},
+		{"LogSampling", int64(config.LogSampling)},
+	} {
+		if f.v < 0 {
+			return fmt.Errorf("%s can't be negative, got %d", f.name, f.v)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		v    int
+	}{
+		{"MaxScanPerWake", config.MaxScanPerWake},
+		{"VerifyParallelism", config.VerifyParallelism},
+		{"MaxMsgElements", config.MaxMsgElements},
+	} {
+		if f.v < 1 {
+			return fmt.Errorf("%s must be at least 1, got %d", f.name, f.v)
+		}
+	}
+	if config.StallTimeout <= 0 {
+		return fmt.Errorf("StallTimeout must be positive, got %v", config.StallTimeout)
+	}
+
+	if config.ShedPressure < 0 || config.ShedPressure > 1 {
+		return fmt.Errorf("ShedPressure must be within [0, 1], got %v", config.ShedPressure)
+	}
+	if config.PeerSendRate > 0 && config.PeerSendBurst == 0 {
+		return errors.New("PeerSendBurst must be set with PeerSendRate")
+	}
+	if config.BatchSize > 1 && config.BatchFlushInterval == 0 {
+		return errors.New("BatchFlushInterval must be set with BatchSize")
+	}
+	if config.OutboundMaxMsgs > 1 {
+		if config.OutboundFlushInterval == 0 {
+			return errors.New("OutboundFlushInterval must be set with OutboundMaxMsgs")
+		}
+		if config.OutboundMaxMsgs > config.MaxMsgElements {
+			return fmt.Errorf("OutboundMaxMsgs (%d) can't exceed MaxMsgElements (%d)",
+				config.OutboundMaxMsgs, config.MaxMsgElements)
+		}
+	}
+	if config.BulkMaxVotes > 0 && config.BulkChunkSize == 0 {
+		return errors.New("BulkChunkSize must be set with BulkMaxVotes")
+	}
+	if config.WarmUpPeers > 0 && config.WarmUpMaxVotes == 0 {
+		return errors.New("WarmUpMaxVotes must be set with WarmUpPeers")
+	}
+	switch config.Backpressure {
+	case BackpressureNone:
+	case BackpressureDelay, BackpressureWait:
+		if config.BackpressureThreshold <= 0 || config.BackpressureThreshold > 1 {
+			return fmt.Errorf("BackpressureThreshold must be within (0, 1], got %v", config.BackpressureThreshold)
+		}
+		if config.BackpressureMaxDelay == 0 {
+			return errors.New("BackpressureMaxDelay must be set with Backpressure")
+		}
+	default:
+		return fmt.Errorf("Unknown Backpressure policy %d", config.Backpressure)
+	}
+	switch config.WrongChannelPolicy {
+	case WrongChannelDrop, WrongChannelStopPeer:
+	default:
+		return fmt.Errorf("Unknown WrongChannelPolicy %d", config.WrongChannelPolicy)
+	}
+	if config.MaxTxVoteVersion < VoteVersion1 || config.MaxTxVoteVersion > LatestVoteVersion {
+		return fmt.Errorf("MaxTxVoteVersion must be within [%d, %d], got %d",
+			VoteVersion1, LatestVoteVersion, config.MaxTxVoteVersion)
+	}
+	return nil
+}
+
+// PoolOptions returns the options setting up the pool as configured.
+func (config *TxVotePoolConfig) PoolOptions() []TxVotePoolOption {
+	options := []TxVotePoolOption{
+		WithCommitGrace(config.CommitGrace),
+		WithMaxSendersPerVote(config.MaxSendersPerVote),
+		WithMaxMemory(config.MaxMemory),
+	}
+	if config.ShedPressure > 0 {
+		options = append(options, WithOverloadShedding(config.ShedPressure, config.ShedWindow))
+	}
+	return options
+}
+
+// ReactorOptions returns the options setting up the reactor as configured.
+func (config *TxVotePoolConfig) ReactorOptions() []ReactorOption {
+	options := []ReactorOption{
+		ReactorBroadcastFanout(config.BroadcastFanout),
+		ReactorBroadcastStartDelay(config.BroadcastStartDelay),
+		ReactorBroadcastIdleTimeout(config.BroadcastIdleTimeout),
+		ReactorBroadcastWorkers(config.BroadcastWorkers),
+		ReactorMaxPeerStateAge(config.MaxPeerStateAge),
+		ReactorMaxConcurrentSends(config.MaxConcurrentSends),
+		ReactorPeerIDCooldown(config.PeerIDCooldown),
+		ReactorPeerSendRate(config.PeerSendRate, config.PeerSendBurst),
+		ReactorBroadcastBatch(config.BatchSize, config.BatchFlushInterval),
+		ReactorCoalesceOutbound(config.OutboundMaxMsgs, config.OutboundFlushInterval),
+		ReactorBulkSync(config.BulkMaxVotes, config.BulkChunkSize, config.BulkInterval),
+		ReactorWarmUp(config.WarmUpPeers, config.WarmUpMaxVotes),
+		ReactorMaxScanPerWake(config.MaxScanPerWake),
+		ReactorWakeCoalesceWindow(config.WakeCoalesceWindow),
+		ReactorMaxSendAttempts(config.MaxSendAttempts),
+		ReactorCompactionInterval(config.CompactionInterval),
+		ReactorStallTimeout(config.StallTimeout),
+		ReactorVerifyParallelism(config.VerifyParallelism),
+		ReactorPeerReceiveWorkers(config.PeerReceiveWorkers),
+		ReactorBackpressure(config.Backpressure, config.BackpressureThreshold, config.BackpressureMaxDelay),
+		ReactorMaxMsgElements(config.MaxMsgElements),
+		ReactorMaxUnknownMessages(config.MaxUnknownMessages),
+		ReactorWrongChannelPolicy(config.WrongChannelPolicy),
+		ReactorTxVoteVersions(config.MaxTxVoteVersion),
+		ReactorLogSampling(config.LogSampling),
+	}
+	if config.LimitPeerLag {
+		options = append(options, ReactorMaxPeerLag(config.MaxPeerLag))
+	}
+	if config.StrictProtocol {
+		options = append(options, ReactorStrictProtocol())
+	}
+	return options
+}
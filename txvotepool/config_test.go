@@ -0,0 +1,106 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+)
+
+func TestDefaultConfigMatchesDefaults(t *testing.T) {
+	config := DefaultConfig()
+	require.NoError(t, config.ValidateBasic())
+
+	mempool := cfg.DefaultMempoolConfig()
+	plain := NewTxpoolReactor(mempool, NewTxVotePool(mempool))
+	configured := NewTxpoolReactor(config.Mempool,
+		NewTxVotePool(config.Mempool, config.PoolOptions()...), config.ReactorOptions()...)
+
+	assert.Equal(t, plain.maxScanPerWake, configured.maxScanPerWake)
+	assert.Equal(t, plain.stallTimeout, configured.stallTimeout)
+	assert.Equal(t, plain.verifyParallelism, configured.verifyParallelism)
+	assert.Equal(t, plain.maxMsgElements, configured.maxMsgElements)
+	assert.Equal(t, plain.maxTxVoteVersion, configured.maxTxVoteVersion)
+	assert.Equal(t, plain.limitPeerLag, configured.limitPeerLag)
+	assert.Equal(t, plain.backpressure, configured.backpressure)
+	assert.Equal(t, plain.strictProtocol, configured.strictProtocol)
+	assert.Equal(t, plain.coalescesOutbound(), configured.coalescesOutbound())
+	assert.Equal(t, plain.bulkSyncEnabled(), configured.bulkSyncEnabled())
+	assert.Equal(t, plain.Txpool.commitGrace, configured.Txpool.commitGrace)
+	assert.Equal(t, plain.Txpool.shedPressure, configured.Txpool.shedPressure)
+}
+
+func TestConfigOptionsApplied(t *testing.T) {
+	config := DefaultConfig()
+	config.BroadcastFanout = 3
+	config.LimitPeerLag = true
+	config.MaxPeerLag = 2
+	config.ShedPressure = 0.8
+	config.ShedWindow = 5
+	config.StrictProtocol = true
+	config.BroadcastWorkers = 2
+	require.NoError(t, config.ValidateBasic())
+
+	txR := NewTxpoolReactor(config.Mempool,
+		NewTxVotePool(config.Mempool, config.PoolOptions()...), config.ReactorOptions()...)
+	assert.Equal(t, 3, txR.broadcastFanout)
+	assert.True(t, txR.limitPeerLag)
+	assert.EqualValues(t, 2, txR.maxPeerLag)
+	assert.Equal(t, 0.8, txR.Txpool.shedPressure)
+	assert.EqualValues(t, 5, txR.Txpool.shedWindow)
+	assert.True(t, txR.strictProtocol)
+	assert.Equal(t, 2, txR.broadcastWorkers)
+}
+
+func TestNewTxpoolReactorNilArgs(t *testing.T) {
+	mempool := cfg.DefaultMempoolConfig()
+	assert.PanicsWithValue(t, "NewTxpoolReactor: config is nil", func() {
+		NewTxpoolReactor(nil, NewTxVotePool(mempool))
+	})
+	assert.PanicsWithValue(t, "NewTxpoolReactor: txpool is nil", func() {
+		NewTxpoolReactor(mempool, nil)
+	})
+}
+
+func TestConfigValidateBasic(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*TxVotePoolConfig)
+	}{
+		{"no mempool config", func(c *TxVotePoolConfig) { c.Mempool = nil }},
+		{"empty pool", func(c *TxVotePoolConfig) { c.Mempool.Size = 0 }},
+		{"negative fanout", func(c *TxVotePoolConfig) { c.BroadcastFanout = -1 }},
+		{"negative interval", func(c *TxVotePoolConfig) { c.CompactionInterval = -time.Second }},
+		{"no scan", func(c *TxVotePoolConfig) { c.MaxScanPerWake = 0 }},
+		{"no stall timeout", func(c *TxVotePoolConfig) { c.StallTimeout = 0 }},
+		{"shed pressure above 1", func(c *TxVotePoolConfig) { c.ShedPressure = 1.5 }},
+		{"rate without burst", func(c *TxVotePoolConfig) { c.PeerSendRate = 1024 }},
+		{"batch without interval", func(c *TxVotePoolConfig) { c.BatchSize = 10 }},
+		{"outbound without interval", func(c *TxVotePoolConfig) { c.OutboundMaxMsgs = 10 }},
+		{"outbound above msg elements", func(c *TxVotePoolConfig) {
+			c.OutboundMaxMsgs = 10
+			c.OutboundFlushInterval = time.Millisecond
+			c.MaxMsgElements = 5
+		}},
+		{"bulk sync without chunks", func(c *TxVotePoolConfig) { c.BulkMaxVotes = 100 }},
+		{"backpressure without threshold", func(c *TxVotePoolConfig) {
+			c.Backpressure = BackpressureDelay
+			c.BackpressureMaxDelay = time.Second
+		}},
+		{"backpressure without delay", func(c *TxVotePoolConfig) {
+			c.Backpressure = BackpressureWait
+			c.BackpressureThreshold = 0.5
+		}},
+		{"unknown backpressure", func(c *TxVotePoolConfig) { c.Backpressure = BackpressurePolicy(42) }},
+		{"unknown wrong channel policy", func(c *TxVotePoolConfig) { c.WrongChannelPolicy = WrongChannelPolicy(42) }},
+		{"unknown vote version", func(c *TxVotePoolConfig) { c.MaxTxVoteVersion = LatestVoteVersion + 1 }},
+	}
+	for _, tc := range testCases {
+		config := DefaultConfig()
+		tc.modify(config)
+		assert.Error(t, config.ValidateBasic(), tc.name)
+	}
+}
@@ -0,0 +1,47 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// maxDeadLetters is the max number of dead lettered votes kept, the oldest
+// are dropped past it.
+const maxDeadLetters = 1024
+
+// DeadVote is a vote the reactor gave up broadcasting to a peer.
+type DeadVote struct {
+	Tx       types.TxVote
+	Peer     p2p.ID
+	Reason   string
+	Attempts int
+}
+
+// ReactorMaxSendAttempts makes broadcast routines give up sending a vote to a
+// peer after max failed attempts, and move it to the dead letters instead of
+// retrying forever. See DeadLetters. Sends are retried forever by default.
+func ReactorMaxSendAttempts(max int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.maxSendAttempts = max }
+}
+
+// deadLetter records the reactor gave up sending txs to the peer.
+func (txR *TxpoolReactor) deadLetter(peer p2p.Peer, reason string, attempts int, txs ...types.TxVote) {
+	txR.deadLettersMtx.Lock()
+	defer txR.deadLettersMtx.Unlock()
+	for _, tx := range txs {
+		txR.Logger.Error("Giving up broadcasting vote", "peer", peer, "tx", TxVoteID(tx), "reason", reason, "attempts", attempts)
+		txR.deadLetters = append(txR.deadLetters, DeadVote{Tx: tx, Peer: peer.ID(), Reason: reason, Attempts: attempts})
+	}
+	if over := len(txR.deadLetters) - maxDeadLetters; over > 0 {
+		txR.deadLetters = append([]DeadVote(nil), txR.deadLetters[over:]...)
+	}
+	txR.Txpool.metrics.reportCacheEntries(cacheDeadLetters, len(txR.deadLetters))
+}
+
+// DeadLetters returns the votes the reactor gave up sending to a peer, oldest
+// first. Only the last maxDeadLetters are kept.
+func (txR *TxpoolReactor) DeadLetters() []DeadVote {
+	txR.deadLettersMtx.Lock()
+	defer txR.deadLettersMtx.Unlock()
+	return append([]DeadVote(nil), txR.deadLetters...)
+}
@@ -0,0 +1,203 @@
+package txvotepool
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// DedupCache remembers the votes seen by the pool, so that those received
+// again are turned down with ErrTxVoteInCache without being checked. It must
+// be safe for concurrent use.
+type DedupCache interface {
+	// AddIfNew adds tx to the cache, and returns false if it was already in
+	// it.
+	AddIfNew(tx types.TxVote) bool
+	// Has returns true if tx is in the cache.
+	Has(tx types.TxVote) bool
+	// Remove removes tx from the cache. It is only called for votes which
+	// were added to it.
+	Remove(tx types.TxVote)
+}
+
+// WithDedupCache makes the pool remember the votes it saw with the given
+// cache instead of the exact LRU cache of config.CacheSize votes. If the
+// cache implements Reset(), it is called when the pool is flushed.
+func WithDedupCache(cache DedupCache) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.cache = dedupTxCache{cache} }
+}
+
+// dedupTxCache adapts a DedupCache to the txCache used by the pool.
+type dedupTxCache struct {
+	DedupCache
+}
+
+var _ txCache = dedupTxCache{}
+
+func (c dedupTxCache) Push(tx types.TxVote) bool { return c.AddIfNew(tx) }
+
+func (c dedupTxCache) Reset() {
+	if r, ok := c.DedupCache.(interface{ Reset() }); ok {
+		r.Reset()
+	}
+}
+
+func (c dedupTxCache) Compact() {}
+
+var _ DedupCache = (*mapTxCache)(nil)
+
+// AddIfNew implements DedupCache.
+func (cache *mapTxCache) AddIfNew(tx types.TxVote) bool {
+	return cache.Push(tx)
+}
+
+// Has implements DedupCache.
+func (cache *mapTxCache) Has(tx types.TxVote) bool {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	_, ok := cache.map_[txVoteKey(tx)]
+	return ok
+}
+
+// BloomDedupCache is a DedupCache backed by counting bloom filters. It uses
+// a fixed amount of memory, two bytes per counter, however many votes it
+// sees, but may report a vote it never saw as already seen: such a false
+// positive makes the pool turn down a new vote as a duplicate, so the node
+// only gets it once it is committed. Like the LRU cache it forgets the oldest
+// votes: once the expected number of votes was added, the filter is set
+// aside for a new one, and the one set aside before is dropped, so the cache
+// remembers the last n to 2n votes added and its false positive rate stays
+// bounded.
+type BloomDedupCache struct {
+	mtx sync.Mutex
+	// the filter votes are added to, and the one set aside before it
+	current  []uint8
+	previous []uint8
+	added    int
+	capacity int
+	hashes   int
+}
+
+var _ DedupCache = (*BloomDedupCache)(nil)
+
+// NewBloomDedupCache returns a BloomDedupCache sized for n votes with the
+// given false positive rate.
+func NewBloomDedupCache(n int, falsePositiveRate float64) *BloomDedupCache {
+	if n < 1 {
+		n = 1
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 1 {
+		m = 1
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomDedupCache{
+		current:  make([]uint8, m),
+		previous: make([]uint8, m),
+		capacity: n,
+		hashes:   k,
+	}
+}
+
+// indexes returns the counters of tx.
+func (b *BloomDedupCache) indexes(tx types.TxVote) []int {
+	return bloomIndexes(tx, b.hashes, len(b.current))
+}
+
+// bloomIndexes returns the k indexes, out of m, of tx in a bloom filter,
+// derived from its key by double hashing.
+func bloomIndexes(tx types.TxVote, k, m int) []int {
+	key := txVoteKey(tx)
+	h1 := binary.BigEndian.Uint64(key[0:8])
+	h2 := binary.BigEndian.Uint64(key[8:16]) | 1
+	idx := make([]int, k)
+	for i := range idx {
+		idx[i] = int((h1 + uint64(i)*h2) % uint64(m))
+	}
+	return idx
+}
+
+// AddIfNew implements DedupCache.
+func (b *BloomDedupCache) AddIfNew(tx types.TxVote) bool {
+	idx := b.indexes(tx)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if bloomHas(b.current, idx) || bloomHas(b.previous, idx) {
+		return false
+	}
+	for _, i := range idx {
+		if b.current[i] < math.MaxUint8 {
+			b.current[i]++
+		}
+	}
+	b.added++
+	if b.added >= b.capacity {
+		b.rotate()
+	}
+	return true
+}
+
+// rotate sets the current filter aside, dropping the one set aside before.
+// NOTE: the cache must be locked.
+func (b *BloomDedupCache) rotate() {
+	b.current, b.previous = b.previous, b.current
+	for i := range b.current {
+		b.current[i] = 0
+	}
+	b.added = 0
+}
+
+// Has implements DedupCache.
+func (b *BloomDedupCache) Has(tx types.TxVote) bool {
+	idx := b.indexes(tx)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return bloomHas(b.current, idx) || bloomHas(b.previous, idx)
+}
+
+func bloomHas(counters []uint8, idx []int) bool {
+	for _, i := range idx {
+		if counters[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove implements DedupCache. Saturated counters are left as is, as they
+// may count more votes than they can tell.
+func (b *BloomDedupCache) Remove(tx types.TxVote) {
+	idx := b.indexes(tx)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	counters := b.current
+	switch {
+	case bloomHas(b.current, idx):
+		b.added--
+	case bloomHas(b.previous, idx):
+		counters = b.previous
+	default:
+		return
+	}
+	for _, i := range idx {
+		if counters[i] < math.MaxUint8 {
+			counters[i]--
+		}
+	}
+}
+
+// Reset empties the cache.
+func (b *BloomDedupCache) Reset() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for i := range b.current {
+		b.current[i] = 0
+		b.previous[i] = 0
+	}
+	b.added = 0
+}
@@ -0,0 +1,106 @@
+package txvotepool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+)
+
+func testDedupCache(t *testing.T, cache DedupCache) {
+	vote := newTestVote(1, newTestValidator())
+	assert.False(t, cache.Has(vote))
+	assert.True(t, cache.AddIfNew(vote))
+	assert.True(t, cache.Has(vote))
+	assert.False(t, cache.AddIfNew(vote))
+
+	cache.Remove(vote)
+	assert.False(t, cache.Has(vote))
+	assert.True(t, cache.AddIfNew(vote))
+}
+
+func TestMapDedupCache(t *testing.T) {
+	testDedupCache(t, newMapTxCache(10))
+}
+
+func TestBloomDedupCache(t *testing.T) {
+	testDedupCache(t, NewBloomDedupCache(100, 0.01))
+}
+
+func TestBloomDedupCacheHasNoFalseNegatives(t *testing.T) {
+	const n = 1000
+	cache := NewBloomDedupCache(n, 0.01)
+
+	validator := newTestValidator()
+	var added []types.TxVote
+	for i := 0; i < n; i++ {
+		vote := newTestVote(1, validator)
+		// false positives aren't added
+		if cache.AddIfNew(vote) {
+			added = append(added, vote)
+		}
+		require.True(t, cache.Has(vote))
+	}
+	for i, vote := range added {
+		require.True(t, cache.Has(vote), "vote %d reported unseen", i)
+	}
+
+	// Removing votes leaves the others in.
+	half := len(added) / 2
+	for _, vote := range added[:half] {
+		cache.Remove(vote)
+	}
+	for i, vote := range added[half:] {
+		require.True(t, cache.Has(vote), "vote %d reported unseen", half+i)
+	}
+
+	var falsePositives int
+	for i := 0; i < n; i++ {
+		if cache.Has(newTestVote(1, validator)) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < n/20, "%d false positives", falsePositives)
+}
+
+func TestBloomDedupCacheForgetsOldestVotes(t *testing.T) {
+	const n = 100
+	cache := NewBloomDedupCache(n, 0.01)
+
+	// Well past its capacity the cache still admits new votes, and remembers
+	// the latest ones.
+	validator := newTestValidator()
+	var latest []types.TxVote
+	for i := 0; i < 20*n; i++ {
+		vote := newTestVote(1, validator)
+		if cache.AddIfNew(vote) {
+			latest = append(latest, vote)
+		}
+	}
+	for _, vote := range latest[len(latest)-n:] {
+		require.True(t, cache.Has(vote))
+	}
+	var rejected int
+	for i := 0; i < n; i++ {
+		if !cache.AddIfNew(newTestVote(1, validator)) {
+			rejected++
+		}
+	}
+	assert.True(t, rejected < n/20, "%d new votes rejected", rejected)
+}
+
+func TestPoolUsesDedupCache(t *testing.T) {
+	cache := NewBloomDedupCache(100, 0.01)
+	txVotePool := NewTxVotePool(cfg.TestConfig().Mempool, WithDedupCache(cache))
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txVotePool.CheckTx(vote))
+	assert.True(t, cache.Has(vote))
+	assert.Equal(t, ErrTxVoteInCache, txVotePool.CheckTx(vote))
+
+	txVotePool.Flush()
+	assert.False(t, cache.Has(vote))
+}
@@ -0,0 +1,62 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+)
+
+const (
+	// DigestSize is the size in bytes of the digests returned by Digest.
+	DigestSize = 8192
+
+	// digestHashes is the number of bits set per vote in a digest.
+	digestHashes = 4
+)
+
+// Digest returns a summary of the votes in the pool, for a peer to find out
+// which votes it has that we lack, see MissingFrom. It is a bloom filter of
+// DigestSize bytes, and only depends on the votes, not on their order.
+// Committed votes are left out.
+func (txVotePool *TxVotePool) Digest() []byte {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+
+	digest := make([]byte, DigestSize)
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
+		for _, i := range bloomIndexes(memTx.tx, digestHashes, DigestSize*8) {
+			digest[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return digest
+}
+
+// MissingFrom returns the votes in the pool which the peer whose Digest is
+// digest lacks, in pool order. As the digest is a bloom filter, a few votes
+// the peer lacks may be deemed held, the larger its pool the more, but none
+// it holds are returned. Committed votes are left out. It returns nil if
+// digest isn't DigestSize bytes long.
+func (txVotePool *TxVotePool) MissingFrom(digest []byte) []types.TxVote {
+	if len(digest) != DigestSize {
+		return nil
+	}
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+
+	var missing []types.TxVote
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
+		for _, i := range bloomIndexes(memTx.tx, digestHashes, DigestSize*8) {
+			if digest[i/8]&(1<<uint(i%8)) == 0 {
+				missing = append(missing, memTx.tx)
+				break
+			}
+		}
+	}
+	return missing
+}
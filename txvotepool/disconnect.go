@@ -0,0 +1,90 @@
+package txvotepool
+
+import (
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ErrMalformedMsg is the reason a peer is stopped for when it sends a message
+// which can't be decoded.
+var ErrMalformedMsg = errors.New("Malformed msg")
+
+// DisconnectReason is the class of the reason a peer was removed for, as
+// logged and metered by RemovePeer.
+type DisconnectReason string
+
+const (
+	// DisconnectNone is for peers removed without a reason, eg. on shutdown.
+	DisconnectNone DisconnectReason = "none"
+	// DisconnectConnection is for peers whose connection failed or closed.
+	DisconnectConnection DisconnectReason = "connection"
+	// DisconnectWrongChannel is for peers stopped with ErrWrongChannel.
+	DisconnectWrongChannel DisconnectReason = "wrong_channel"
+	// DisconnectMalformedMsg is for peers stopped with ErrMalformedMsg or
+	// ErrTooManyMsgElements.
+	DisconnectMalformedMsg DisconnectReason = "malformed_msg"
+	// DisconnectUnknownMsgs is for peers stopped with
+	// ErrTooManyUnknownMessages or ErrUnknownMsgType.
+	DisconnectUnknownMsgs DisconnectReason = "unknown_msgs"
+	// DisconnectInvalidEnvelope is for peers stopped with
+	// ErrInvalidEnvelopeSignature or ErrInvalidCapabilities.
+	DisconnectInvalidEnvelope DisconnectReason = "invalid_envelope"
+	// DisconnectInvalidVote is for peers stopped with ErrInvalidVote.
+	DisconnectInvalidVote DisconnectReason = "invalid_vote"
+	// DisconnectOther is for any other reason, eg. given by another reactor.
+	DisconnectOther DisconnectReason = "other"
+)
+
+// classifyDisconnect returns the class of the reason a peer was removed for.
+func classifyDisconnect(reason interface{}) DisconnectReason {
+	if reason == nil {
+		return DisconnectNone
+	}
+	err, ok := reason.(error)
+	if !ok {
+		return DisconnectOther
+	}
+	switch cause := errors.Cause(err); cause {
+	case ErrWrongChannel:
+		return DisconnectWrongChannel
+	case ErrMalformedMsg, ErrTooManyMsgElements:
+		return DisconnectMalformedMsg
+	case ErrTooManyUnknownMessages, ErrUnknownMsgType:
+		return DisconnectUnknownMsgs
+	case ErrInvalidEnvelopeSignature, ErrInvalidCapabilities:
+		return DisconnectInvalidEnvelope
+	case ErrInvalidVote:
+		return DisconnectInvalidVote
+	case io.EOF, io.ErrUnexpectedEOF:
+		return DisconnectConnection
+	default:
+		if _, ok := cause.(net.Error); ok {
+			return DisconnectConnection
+		}
+		return DisconnectOther
+	}
+}
+
+// malformedMsgErr returns the reason to stop a peer sending a message which
+// failed to decode with err.
+func malformedMsgErr(err error) error {
+	if err == ErrTooManyMsgElements {
+		return err
+	}
+	return errors.Wrap(ErrMalformedMsg, err.Error())
+}
+
+// recordDisconnect logs and meters the reason the peer was removed for.
+func (txR *TxpoolReactor) recordDisconnect(peer p2p.Peer, reason interface{}) {
+	class := classifyDisconnect(reason)
+	txR.Txpool.metrics.PeerDisconnects.With("reason", string(class)).Add(1)
+	if class == DisconnectNone {
+		txR.Logger.Info("Peer removed", "peer", peer)
+		return
+	}
+	txR.Logger.Info("Peer removed", "peer", peer, "class", class, "reason", reason)
+}
@@ -0,0 +1,111 @@
+package txvotepool
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrPeerThrottled is returned by CheckTx for the votes of a peer which sent
+// too many duplicates during the current height, with DuplicateThrottle.
+var ErrPeerThrottled = errors.New("Peer throttled after sending too many duplicate votes")
+
+// DuplicatePolicy defines how the pool handles peers re-sending votes they
+// already sent.
+type DuplicatePolicy int
+
+const (
+	// DuplicateWarn logs a warning every threshold duplicates from a peer.
+	DuplicateWarn DuplicatePolicy = iota
+	// DuplicateThrottle rejects the votes of a peer which sent threshold
+	// duplicates with ErrPeerThrottled, before checking them, for the rest of
+	// the height.
+	DuplicateThrottle
+)
+
+// WithPeerDuplicatePolicy counts, per height, the votes each peer re-sends
+// after already sending them, which may point at a buggy peer, and applies
+// policy once a peer sent threshold of them. Only the votes a peer sent us
+// count, not the ones we sent it. The threshold must be positive, the option
+// is ignored otherwise. Duplicates are silently ignored by default.
+func WithPeerDuplicatePolicy(threshold int, policy DuplicatePolicy) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		if threshold <= 0 {
+			return
+		}
+		txVotePool.dupThreshold = threshold
+		txVotePool.dupPolicy = policy
+		txVotePool.peerDups = make(map[uint16]int)
+	}
+}
+
+// markReceivedFrom records the peer sent us the vote, and returns true if it
+// already had. Only tracked with WithPeerDuplicatePolicy.
+func (txVotePool *TxVotePool) markReceivedFrom(memTx *mempoolTxVote, peerID uint16) bool {
+	if txVotePool.peerDups == nil || peerID == UnknownPeerID {
+		return false
+	}
+	_, loaded := memTx.receivedFrom.LoadOrStore(peerID, struct{}{})
+	return loaded
+}
+
+// recordPeerDuplicate records the peer re-sent a vote it already sent.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) recordPeerDuplicate(peerID uint16) {
+	txVotePool.metrics.PeerDuplicateTxs.Add(1)
+	txVotePool.peerDups[peerID]++
+	n := txVotePool.peerDups[peerID]
+	if n%txVotePool.dupThreshold == 0 {
+		txVotePool.logger.Error("Peer keeps sending duplicate votes", "peerID", peerID,
+			"duplicates", n, "height", txVotePool.height)
+	}
+}
+
+// peerThrottled returns true if the votes of the peer must be rejected, see
+// DuplicateThrottle.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) peerThrottled(peerID uint16) bool {
+	return txVotePool.dupPolicy == DuplicateThrottle && txVotePool.peerDups != nil &&
+		txVotePool.peerDups[peerID] >= txVotePool.dupThreshold
+}
+
+// resetPeerDuplicates starts counting duplicates anew, on a new height.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) resetPeerDuplicates() {
+	if txVotePool.peerDups != nil {
+		txVotePool.peerDups = make(map[uint16]int)
+	}
+}
+
+// forgetPeerDuplicates forgets the duplicates of the peer, and the votes it
+// sent, once its ID is freed, so that the peer given the ID next doesn't
+// inherit them.
+func (txVotePool *TxVotePool) forgetPeerDuplicates(peerID uint16) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	if txVotePool.peerDups == nil || peerID == UnknownPeerID {
+		return
+	}
+	delete(txVotePool.peerDups, peerID)
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		e.Value.(*mempoolTxVote).receivedFrom.Delete(peerID)
+	}
+}
+
+// movePeerDuplicates moves the duplicates of the peer, and the votes it sent,
+// to its new ID, see ReassignPeer.
+func (txVotePool *TxVotePool) movePeerDuplicates(oldID, newID uint16) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	if txVotePool.peerDups == nil {
+		return
+	}
+	if n, ok := txVotePool.peerDups[oldID]; ok {
+		delete(txVotePool.peerDups, oldID)
+		txVotePool.peerDups[newID] += n
+	}
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if _, ok := memTx.receivedFrom.LoadAndDelete(oldID); ok {
+			memTx.receivedFrom.Store(newID, struct{}{})
+		}
+	}
+}
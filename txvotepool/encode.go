@@ -0,0 +1,132 @@
+package txvotepool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	amino "github.com/tendermint/go-amino"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+const (
+	// maxPooledBufferSize is the capacity above which encode buffers aren't
+	// put back into the pool, so that a few large messages don't pin memory.
+	maxPooledBufferSize = 64 * 1024
+
+	// field1Key is the amino key of a length prefixed field 1, the only field
+	// of the messages framed here.
+	field1Key = 1<<3 | byte(amino.Typ3_ByteLength)
+)
+
+// encodeBuffers holds the buffers outbound messages are framed in.
+var encodeBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// msgPrefixes holds the amino prefix of the messages framed here, set once
+// they are registered, see RegisterTxVotePoolMessages.
+var msgPrefixes struct {
+	once            sync.Once
+	tx, txs, bundle []byte
+}
+
+func initMsgPrefixes() {
+	msgPrefixes.once.Do(func() {
+		prefix := func(msg TxpoolMessage) []byte {
+			return cdc.MustMarshalBinaryBare(msg)[:amino.PrefixBytesLen]
+		}
+		msgPrefixes.tx = prefix(&TxMessage{})
+		msgPrefixes.txs = prefix(&TxsMessage{})
+		msgPrefixes.bundle = prefix(&BundleMessage{})
+	})
+}
+
+// encodedVote returns the amino encoding of the vote, as sent to peers (see
+// ReactorVoteTransforms). It is computed on the first call, and shared by the
+// messages sending the vote to every peer.
+func (txR *TxpoolReactor) encodedVote(memTx *mempoolTxVote) []byte {
+	if bz, ok := memTx.encoded.Load().([]byte); ok {
+		return bz
+	}
+	bz := cdc.MustMarshalBinaryBare(txR.outboundVote(memTx.tx))
+	memTx.encoded.Store(bz)
+	return bz
+}
+
+// The messages broadcast in volume are framed in pooled buffers, around the
+// encoding of their votes, rather than encoded by amino from scratch for each
+// peer. The encoding is the same as cdc.MustMarshalBinaryBare's. The bytes
+// returned are a copy the caller owns, as the p2p layer holds on to the
+// bytes it is sent.
+
+// encodeTxMessage returns the encoding of the TxMessage sending the vote.
+func (txR *TxpoolReactor) encodeTxMessage(memTx *mempoolTxVote) []byte {
+	initMsgPrefixes()
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	defer putEncodeBuffer(buf)
+	buf.Write(msgPrefixes.tx)
+	// amino leaves out fields which encode to nothing
+	if bz := txR.encodedVote(memTx); len(bz) > 0 {
+		writeField(buf, bz)
+	}
+	return copyBytes(buf)
+}
+
+// encodeTxsMessage returns the encoding of the TxsMessage sending the votes.
+func (txR *TxpoolReactor) encodeTxsMessage(memTxs []*mempoolTxVote) []byte {
+	initMsgPrefixes()
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	defer putEncodeBuffer(buf)
+	buf.Write(msgPrefixes.txs)
+	for _, memTx := range memTxs {
+		writeField(buf, txR.encodedVote(memTx))
+	}
+	return copyBytes(buf)
+}
+
+// encodeBundleMessage returns the encoding of the BundleMessage holding the
+// encoded messages.
+func encodeBundleMessage(msgs [][]byte) []byte {
+	initMsgPrefixes()
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	defer putEncodeBuffer(buf)
+	buf.Write(msgPrefixes.bundle)
+	for _, bz := range msgs {
+		writeField(buf, bz)
+	}
+	return copyBytes(buf)
+}
+
+// encodeTxMessageFor returns the encoding of the message sending the vote to
+// the peer, see txMessageFor.
+func (txR *TxpoolReactor) encodeTxMessageFor(peer p2p.Peer, memTx *mempoolTxVote) []byte {
+	msg := txR.txMessageFor(peer, txR.outboundVote(memTx.tx))
+	if _, ok := msg.(*TxMessage); ok {
+		return txR.encodeTxMessage(memTx)
+	}
+	return cdc.MustMarshalBinaryBare(msg)
+}
+
+// writeField writes bz as field 1.
+func writeField(buf *bytes.Buffer, bz []byte) {
+	var length [binary.MaxVarintLen64]byte
+	buf.WriteByte(field1Key)
+	buf.Write(length[:binary.PutUvarint(length[:], uint64(len(bz)))])
+	buf.Write(bz)
+}
+
+func copyBytes(buf *bytes.Buffer) []byte {
+	bz := make([]byte, buf.Len())
+	copy(bz, buf.Bytes())
+	return bz
+}
+
+// putEncodeBuffer returns the buffer to the pool, unless it grew too large.
+func putEncodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	encodeBuffers.Put(buf)
+}
@@ -0,0 +1,105 @@
+package txvotepool
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+)
+
+// newTestMemTxs returns n votes as held by the pool.
+func newTestMemTxs(n int) []*mempoolTxVote {
+	validator := newTestValidator()
+	memTxs := make([]*mempoolTxVote, n)
+	for i := range memTxs {
+		memTxs[i] = &mempoolTxVote{tx: newTestVote(int64(i+1), validator)}
+	}
+	return memTxs
+}
+
+// newEncodeTestReactor returns a reactor, not started, to encode messages
+// with.
+func newEncodeTestReactor() *TxpoolReactor {
+	return NewTxpoolReactor(cfg.TestConfig().Mempool, newTestTxVotePool())
+}
+
+func TestEncodeMatchesAmino(t *testing.T) {
+	memTxs := newTestMemTxs(5)
+	votes := make([]types.TxVote, len(memTxs))
+	for i, memTx := range memTxs {
+		votes[i] = memTx.tx
+	}
+	empty := &mempoolTxVote{}
+	txR := newEncodeTestReactor()
+
+	assert.Equal(t, cdc.MustMarshalBinaryBare(&TxMessage{Tx: votes[0]}), txR.encodeTxMessage(memTxs[0]))
+	assert.Equal(t, cdc.MustMarshalBinaryBare(&TxMessage{}), txR.encodeTxMessage(empty))
+	assert.Equal(t, cdc.MustMarshalBinaryBare(&TxsMessage{Txs: votes}), txR.encodeTxsMessage(memTxs))
+	assert.Equal(t, cdc.MustMarshalBinaryBare(&TxsMessage{}), txR.encodeTxsMessage(nil))
+	assert.Equal(t, cdc.MustMarshalBinaryBare(&TxsMessage{Txs: []types.TxVote{{}}}),
+		txR.encodeTxsMessage([]*mempoolTxVote{empty}))
+	parts := [][]byte{txR.encodeTxMessage(memTxs[1]), randBytes(300), {}}
+	assert.Equal(t, cdc.MustMarshalBinaryBare(&BundleMessage{Msgs: parts}), encodeBundleMessage(parts))
+}
+
+func TestEncodeConcurrent(t *testing.T) {
+	const numMsgs = 200
+	memTxs := newTestMemTxs(numMsgs + 7)
+	batch := func(i int) []*mempoolTxVote { return memTxs[i : i+1+i%7] }
+	txR := newEncodeTestReactor()
+
+	// Encoded bytes must stay intact while the buffers they were framed in
+	// are reused for other messages.
+	encoded := make([][]byte, numMsgs)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < numMsgs; i += 8 {
+				encoded[i] = txR.encodeTxsMessage(batch(i))
+				for k := 0; k < 10; k++ {
+					txR.encodeTxsMessage(batch((i + k) % numMsgs))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i, bz := range encoded {
+		msg, err := decodeMsg(bz)
+		require.NoError(t, err)
+		txs := msg.(*TxsMessage).Txs
+		require.Len(t, txs, len(batch(i)))
+		for j, memTx := range batch(i) {
+			assert.Equal(t, memTx.tx, txs[j])
+		}
+	}
+}
+
+// BenchmarkEncodeTxsMessage compares encoding a batch with amino to framing
+// it in a pooled buffer, as done when the batch's votes are sent to several
+// peers.
+func BenchmarkEncodeTxsMessage(b *testing.B) {
+	memTxs := newTestMemTxs(32)
+	msg := &TxsMessage{Txs: make([]types.TxVote, len(memTxs))}
+	for i, memTx := range memTxs {
+		msg.Txs[i] = memTx.tx
+	}
+	b.Run("amino", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cdc.MustMarshalBinaryBare(msg)
+		}
+	})
+	txR := newEncodeTestReactor()
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			txR.encodeTxsMessage(memTxs)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestSignedTxMessageRoundTrip(t *testing.T) {
+	privKey := ed25519.GenPrivKey()
+	peerID := p2p.PubKeyToID(privKey.PubKey())
+
+	msg := newSignedTxMessage(newTestVote(1, newTestValidator()), privKey)
+	decoded, err := decodeMsg(cdc.MustMarshalBinaryBare(msg))
+	require.NoError(t, err)
+	signed := decoded.(*SignedTxMessage)
+	assert.NoError(t, signed.Verify(peerID))
+
+	// Signed by someone else than the relaying peer.
+	assert.Equal(t, ErrInvalidEnvelopeSignature, signed.Verify(p2p.PubKeyToID(ed25519.GenPrivKey().PubKey())))
+
+	// Tampered with on the way.
+	signed.Tx.Height++
+	assert.Equal(t, ErrInvalidEnvelopeSignature, signed.Verify(peerID))
+}
+
+func TestReactorVerifiesSignedEnvelopes(t *testing.T) {
+	txR := newTestSwitchReactor(t, ReactorSignEnvelopes(ed25519.GenPrivKey()))
+	defer txR.Stop()
+
+	peerKey := ed25519.GenPrivKey()
+	peer := newTestPeer(p2p.PubKeyToID(peerKey.PubKey()))
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, &SignedEnvelopesMessage{})
+
+	validator := newTestValidator()
+	sendMsg(txR, peer, newSignedTxMessage(newTestVote(1, validator), peerKey))
+	assert.Equal(t, 1, txR.Txpool.Size())
+	require.True(t, peer.IsRunning())
+
+	tampered := newSignedTxMessage(newTestVote(1, validator), peerKey)
+	tampered.Tx.Height++
+	sendMsg(txR, peer, tampered)
+	assert.Equal(t, 1, txR.Txpool.Size())
+	assert.False(t, peer.IsRunning())
+}
+
+func TestReactorSignsEnvelopesForAllPeers(t *testing.T) {
+	txR := newTestReactor(t, ReactorSignEnvelopes(ed25519.GenPrivKey()))
+	defer txR.Stop()
+
+	signing, plain := newTestPeer("signing"), newTestPeer("plain")
+	sendMsg(txR, signing, &SignedEnvelopesMessage{})
+	for _, peer := range []*testPeer{signing, plain} {
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peer)
+	}
+	require.IsType(t, &SignedEnvelopesMessage{}, plain.Sent()[0])
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+	waitFor(t, time.Second, func() bool { return len(signing.Sent()) == 2 && len(plain.Sent()) == 2 })
+
+	assert.IsType(t, &SignedTxMessage{}, signing.Sent()[1])
+	assert.IsType(t, &SignedTxMessage{}, plain.Sent()[1])
+
+	// Peers which don't sign take signed envelopes too.
+	receiver := newTestSwitchReactor(t)
+	defer receiver.Stop()
+	src := newTestPeer(p2p.PubKeyToID(txR.privKey.PubKey()))
+	receiver.AddPeer(src)
+	sendMsg(receiver, src, plain.Sent()[1])
+	assert.Equal(t, 1, receiver.Txpool.Size())
+	assert.True(t, src.IsRunning())
+}
+
+func TestSigningPeersConnecting(t *testing.T) {
+	keyA, keyB := ed25519.GenPrivKey(), ed25519.GenPrivKey()
+	a := newTestSwitchReactor(t, ReactorSignEnvelopes(keyA))
+	defer a.Stop()
+	b := newTestSwitchReactor(t, ReactorSignEnvelopes(keyB))
+	defer b.Stop()
+	require.NoError(t, a.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+
+	// a broadcasts to b before b's announcement got to it.
+	peerB := newTestPeer(p2p.PubKeyToID(keyB.PubKey()))
+	peerB.Set(ttypes.PeerStateKey, testPeerState{1})
+	a.AddPeer(peerB)
+	waitFor(t, time.Second, func() bool {
+		for _, msg := range peerB.Sent() {
+			if _, ok := msg.(*SignedTxMessage); ok {
+				return true
+			}
+		}
+		return false
+	}, "vote not sent")
+
+	peerA := newTestPeer(p2p.PubKeyToID(keyA.PubKey()))
+	b.AddPeer(peerA)
+	for _, msg := range peerB.Sent() {
+		sendMsg(b, peerA, msg)
+	}
+	assert.True(t, peerA.IsRunning(), "signing peer stopped on connect")
+	assert.Equal(t, 1, b.Txpool.Size())
+}
+
+func TestRelayProvenanceAcrossTwoHops(t *testing.T) {
+	keys := []crypto.PrivKey{ed25519.GenPrivKey(), ed25519.GenPrivKey(), ed25519.GenPrivKey()}
+	reactors := make([]*TxpoolReactor, len(keys))
+	ids := make([]p2p.ID, len(keys))
+	for i, key := range keys {
+		reactors[i] = newTestReactor(t, ReactorSignEnvelopes(key), ReactorRelayProvenance())
+		defer reactors[i].Stop()
+		ids[i] = p2p.PubKeyToID(key.PubKey())
+	}
+
+	// relay has reactors[i] broadcast the vote to reactors[i+1], and returns
+	// the envelope it was sent in.
+	relay := func(i int) *SignedTxMessage {
+		next := newTestPeer(ids[i+1])
+		sendMsg(reactors[i], next, &SignedEnvelopesMessage{})
+		next.Set(ttypes.PeerStateKey, testPeerState{1})
+		reactors[i].AddPeer(next)
+		var msg *SignedTxMessage
+		waitFor(t, time.Second, func() bool {
+			for _, sent := range next.Sent() {
+				if m, ok := sent.(*SignedTxMessage); ok {
+					msg = m
+					return true
+				}
+			}
+			return false
+		})
+		sendMsg(reactors[i+1], newTestPeer(ids[i]), msg)
+		return msg
+	}
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, reactors[0].Txpool.CheckTx(vote))
+	first := relay(0)
+	second := relay(1)
+	assert.Len(t, first.Provenance, 1)
+	assert.Len(t, second.Provenance, 2)
+	assert.Equal(t, vote, second.Tx, "vote changed on the way")
+
+	provenance, ok := reactors[2].Txpool.Provenance(vote.Signature)
+	require.True(t, ok)
+	require.Len(t, provenance, 3)
+	for i, hop := range provenance {
+		assert.Equal(t, ids[i], hop.NodeID)
+		if i > 0 {
+			assert.False(t, hop.ReceivedAt.Before(provenance[i-1].ReceivedAt))
+		}
+	}
+
+	// The record can't be altered on the way.
+	tampered := *second
+	tampered.Provenance = tampered.Provenance[1:]
+	assert.Equal(t, ErrInvalidEnvelopeSignature, tampered.Verify(ids[1]))
+}
+
+func TestRelayProvenanceWithoutKey(t *testing.T) {
+	txR := newTestReactor(t, ReactorRelayProvenance())
+	defer txR.Stop()
+
+	key := ed25519.GenPrivKey()
+	peer := newTestPeer(p2p.PubKeyToID(key.PubKey()))
+	vote := newTestVote(1, newTestValidator())
+	msg := signTxMessage(&SignedTxMessage{Tx: vote, Provenance: []RelayHop{{NodeID: peer.ID()}}}, key)
+	sendMsg(txR, peer, msg)
+
+	require.Equal(t, 1, txR.Txpool.Size())
+	provenance, ok := txR.Txpool.Provenance(vote.Signature)
+	require.True(t, ok)
+	assert.Empty(t, provenance, "provenance recorded without a key")
+}
+
+func TestRelayProvenanceDropsOverLongRecord(t *testing.T) {
+	txR := newTestReactor(t, ReactorSignEnvelopes(ed25519.GenPrivKey()), ReactorRelayProvenance())
+	defer txR.Stop()
+
+	key := ed25519.GenPrivKey()
+	peer := newTestPeer(p2p.PubKeyToID(key.PubKey()))
+	hops := make([]RelayHop, maxRelayHops)
+	for i := range hops {
+		hops[i] = RelayHop{NodeID: peer.ID()}
+	}
+	vote := newTestVote(1, newTestValidator())
+	sendMsg(txR, peer, signTxMessage(&SignedTxMessage{Tx: vote, Provenance: hops}, key))
+
+	require.Equal(t, 1, txR.Txpool.Size())
+	provenance, ok := txR.Txpool.Provenance(vote.Signature)
+	require.True(t, ok)
+	assert.Empty(t, provenance)
+}
+
+func TestProvenanceCountedInMemoryUsage(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+	txVotePool := txR.Txpool
+
+	validator := newTestValidator()
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	without := txVotePool.MemoryUsage()
+	txVotePool.Flush()
+
+	hops := []RelayHop{{NodeID: "a"}, {NodeID: "b"}, {NodeID: "c"}}
+	require.NoError(t, txVotePool.CheckTxWithInfo(newTestVote(1, validator), TxVoteInfo{Provenance: hops}))
+	assert.Equal(t, without+3*memPerRelayHop, txVotePool.MemoryUsage())
+
+	txVotePool.Flush()
+	assert.Equal(t, int64(0), txVotePool.numRelayHops)
+}
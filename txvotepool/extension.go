@@ -0,0 +1,69 @@
+package txvotepool
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ErrNestedExtension is the reason a peer is stopped for when it sends an
+// ExtensionMessage within an ExtensionMessage.
+var ErrNestedExtension = errors.New("Extension within an extension")
+
+// ExtensionMessage is a TxpoolMessage carrying another amino encoded message,
+// Msg, of a type introduced after this node was released. A node handles the
+// messages of the types it knows as if they were sent on their own, and skips
+// the others, rather than stopping the peer for sending an unknown type. New
+// message types are to be sent wrapped in one until all nodes know them.
+type ExtensionMessage struct {
+	Msg []byte
+}
+
+// String returns a string representation of the ExtensionMessage.
+func (m *ExtensionMessage) String() string {
+	return fmt.Sprintf("[ExtensionMessage %X]", msgPrefix(m.Msg))
+}
+
+// receiveExtension handles the message the extension carries as if it was
+// received on its own, or skips it if its type is unknown.
+func (txR *TxpoolReactor) receiveExtension(src p2p.Peer, msg *ExtensionMessage, bundled bool) {
+	prefix := msgPrefix(msg.Msg)
+	if prefix == extensionPrefix {
+		txR.Logger.Error("Nested extension", "src", src)
+		txR.Switch.StopPeerForError(src, malformedMsgErr(ErrNestedExtension))
+		return
+	}
+	if _, ok := knownPrefixes[prefix]; !ok {
+		txR.Logger.Debug("Skipping extension of unknown type", "src", src, "prefix", fmt.Sprintf("%X", prefix))
+		txR.Txpool.metrics.UnknownExtensions.Add(1)
+		return
+	}
+	txR.receiveMsg(src, msg.Msg, bundled)
+}
+
+// msgPrefix returns the prefix of the concrete type of the amino encoded
+// message bz, zero if too short to have one.
+func msgPrefix(bz []byte) (prefix [4]byte) {
+	copy(prefix[:], bz)
+	if len(bz) < len(prefix) {
+		return [4]byte{}
+	}
+	return prefix
+}
+
+var (
+	// prefixes of the messages the reactor handles, see txpoolMessages
+	knownPrefixes = make(map[[4]byte]struct{})
+	// prefix of ExtensionMessage
+	extensionPrefix [4]byte
+)
+
+// registerPrefixes sets knownPrefixes and extensionPrefix, once the messages
+// are registered on cdc.
+func registerPrefixes() {
+	for _, m := range txpoolMessages {
+		knownPrefixes[msgPrefix(cdc.MustMarshalBinaryBare(m))] = struct{}{}
+	}
+	extensionPrefix = msgPrefix(cdc.MustMarshalBinaryBare(&ExtensionMessage{}))
+}
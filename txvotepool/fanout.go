@@ -0,0 +1,157 @@
+package txvotepool
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/tendermint/tendermint/libs/clist"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorRandomFanout makes the reactor pick the peers a vote is pushed to in
+// its first broadcast cycle at random, drawing from rng, instead of leaving
+// it to whichever broadcast routines get to it first. The chance of a peer
+// being picked is proportional to its weight, peers with a weight <= 0 are
+// never picked. A nil weight gives all peers the same weight. Only applies
+// with a broadcast fanout, see ReactorBroadcastFanout.
+func ReactorRandomFanout(rng *rand.Rand, weight func(p2p.ID) float64) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.fanoutRand = rng
+		txR.fanoutWeight = weight
+	}
+}
+
+// fanoutPicker returns the function picking the peers of the first broadcast
+// cycle of a vote, nil if they aren't picked at random.
+func (txR *TxpoolReactor) fanoutPicker() func() map[p2p.ID]struct{} {
+	if txR.fanoutRand == nil {
+		return nil
+	}
+	return txR.pickFanoutPeers
+}
+
+// pickFanoutPeers picks up to broadcastFanout peers at random, by weight.
+func (txR *TxpoolReactor) pickFanoutPeers() map[p2p.ID]struct{} {
+	txR.peersMtx.RLock()
+	ids := make([]p2p.ID, 0, len(txR.peers))
+	for id := range txR.peers {
+		ids = append(ids, id)
+	}
+	txR.peersMtx.RUnlock()
+	// sort so that picks only depend on rng
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	weights := make([]float64, len(ids))
+	var total float64
+	for i, id := range ids {
+		weights[i] = 1
+		if txR.fanoutWeight != nil {
+			weights[i] = txR.fanoutWeight(id)
+		}
+		if weights[i] < 0 {
+			weights[i] = 0
+		}
+		total += weights[i]
+	}
+
+	picked := make(map[p2p.ID]struct{}, txR.broadcastFanout)
+	txR.fanoutRandMtx.Lock()
+	defer txR.fanoutRandMtx.Unlock()
+	for len(picked) < txR.broadcastFanout && total > 0 {
+		r := txR.fanoutRand.Float64() * total
+		chosen := -1
+		for i, w := range weights {
+			if w == 0 {
+				continue
+			}
+			// falls back on the last peer with a weight on rounding errors
+			chosen = i
+			if r < w {
+				break
+			}
+			r -= w
+		}
+		if chosen < 0 {
+			break
+		}
+		picked[ids[chosen]] = struct{}{}
+		total -= weights[chosen]
+		weights[chosen] = 0
+	}
+	return picked
+}
+
+// fanoutRetries holds the votes a broadcast routine skipped as enough peers
+// got them during the current cycle, so that it moves on to the next votes
+// and comes back to them once the cycle is over. It is used by a single
+// routine, so it isn't safe for concurrent use.
+type fanoutRetries struct {
+	votes []fanoutRetry
+	timer *time.Timer
+}
+
+// fanoutRetry is a vote skipped by a broadcast routine, and when to handle
+// it again.
+type fanoutRetry struct {
+	elem *clist.CElement
+	due  time.Time
+}
+
+// add skips e until the next cycle.
+func (fr *fanoutRetries) add(e *clist.CElement) {
+	due := time.Now().Add(peerCatchupSleepIntervalMS * time.Millisecond)
+	fr.votes = append(fr.votes, fanoutRetry{elem: e, due: due})
+}
+
+// popDue returns the oldest skipped vote still in the pool if it is due, nil
+// otherwise.
+func (fr *fanoutRetries) popDue() *clist.CElement {
+	now := time.Now()
+	for len(fr.votes) > 0 && !now.Before(fr.votes[0].due) {
+		e := fr.votes[0].elem
+		fr.votes[0] = fanoutRetry{}
+		fr.votes = fr.votes[1:]
+		if !e.Removed() {
+			return e
+		}
+	}
+	return nil
+}
+
+// untilDue returns how long until the oldest skipped vote is due, and false
+// if there is none.
+func (fr *fanoutRetries) untilDue() (time.Duration, bool) {
+	if len(fr.votes) == 0 {
+		return 0, false
+	}
+	return time.Until(fr.votes[0].due), true
+}
+
+// dueC returns a channel receiving once the oldest skipped vote is due, nil
+// if there is none.
+func (fr *fanoutRetries) dueC() <-chan time.Time {
+	d, ok := fr.untilDue()
+	if !ok {
+		return nil
+	}
+	if fr.timer == nil {
+		fr.timer = time.NewTimer(d)
+		return fr.timer.C
+	}
+	if !fr.timer.Stop() {
+		select {
+		case <-fr.timer.C:
+		default:
+		}
+	}
+	fr.timer.Reset(d)
+	return fr.timer.C
+}
+
+// stop releases the timer of dueC.
+func (fr *fanoutRetries) stop() {
+	if fr.timer != nil {
+		fr.timer.Stop()
+	}
+}
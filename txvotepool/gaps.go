@@ -0,0 +1,90 @@
+package txvotepool
+
+// WithGapTracking tracks the heights the votes added to the pool were cast
+// at, per signer, so the heights a signer has no vote for can be listed with
+// Gaps. Only the window heights up to the highest one seen from a signer, and
+// up to maxSigners signers, are tracked. Disabled by default.
+func WithGapTracking(window int64, maxSigners int) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		txVotePool.gaps = &gapTracker{
+			window:     window,
+			maxSigners: maxSigners,
+			signers:    make(map[string]*signerHeights),
+		}
+	}
+}
+
+// gapTracker records the heights of the votes seen from each signer. The pool
+// must be locked when using it.
+type gapTracker struct {
+	window     int64
+	maxSigners int
+	signers    map[string]*signerHeights
+}
+
+// signerHeights are the heights a signer's votes were seen at, within window
+// heights of the highest.
+type signerHeights struct {
+	highest int64
+	seen    map[int64]struct{}
+}
+
+// record marks height as seen from signer. Heights which fell out of the
+// window are dropped.
+func (gt *gapTracker) record(signer string, height int64) {
+	sh, ok := gt.signers[signer]
+	if !ok {
+		if len(gt.signers) >= gt.maxSigners {
+			return
+		}
+		sh = &signerHeights{highest: height, seen: make(map[int64]struct{})}
+		gt.signers[signer] = sh
+	}
+	if height <= sh.highest-gt.window {
+		return
+	}
+	sh.seen[height] = struct{}{}
+	if height > sh.highest {
+		sh.highest = height
+		for h := range sh.seen {
+			if h <= height-gt.window {
+				delete(sh.seen, h)
+			}
+		}
+	}
+}
+
+// gaps returns the heights, in increasing order, between the lowest and the
+// highest tracked heights of signer which no vote was seen at.
+func (gt *gapTracker) gaps(signer string) []int64 {
+	sh, ok := gt.signers[signer]
+	if !ok {
+		return nil
+	}
+	lowest := sh.highest
+	for h := range sh.seen {
+		if h < lowest {
+			lowest = h
+		}
+	}
+	var gaps []int64
+	for h := lowest + 1; h < sh.highest; h++ {
+		if _, ok := sh.seen[h]; !ok {
+			gaps = append(gaps, h)
+		}
+	}
+	return gaps
+}
+
+// Gaps returns the heights, in increasing order, the signer skipped: those
+// between the lowest and the highest tracked heights of its votes which none
+// of its votes were cast at. This helps spotting censored or lost votes. It
+// returns nil if gap tracking is disabled, see WithGapTracking.
+func (txVotePool *TxVotePool) Gaps(signer []byte) []int64 {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	if txVotePool.gaps == nil {
+		return nil
+	}
+	return txVotePool.gaps.gaps(string(signer))
+}
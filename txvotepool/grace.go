@@ -0,0 +1,54 @@
+package txvotepool
+
+import (
+	"time"
+)
+
+// GraceHeightPolicy defines how the pool handles new votes for a height
+// some of whose votes were committed and are still kept during the commit
+// grace period, see WithCommitGrace.
+type GraceHeightPolicy int
+
+const (
+	// GraceHeightAccept adds such votes like any other.
+	GraceHeightAccept GraceHeightPolicy = iota
+	// GraceHeightReject rejects them with ErrTxVoteHeightCommitted, as the
+	// height was already committed.
+	GraceHeightReject
+	// GraceHeightServe adds them as committed votes, so that they are handed
+	// to peers fetching them until the grace period ends, but are neither
+	// reaped nor broadcast.
+	GraceHeightServe
+)
+
+// WithGraceHeightPolicy sets how new votes for heights still within the
+// commit grace period are handled. They are accepted by default.
+func WithGraceHeightPolicy(policy GraceHeightPolicy) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.graceHeightPolicy = policy }
+}
+
+// inGrace returns true if committed votes for the height are kept in the
+// pool.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) inGrace(height int64) bool {
+	return txVotePool.graceHeights[height] > 0
+}
+
+// commitVote marks the vote as committed at t, keeping it until the commit
+// grace period is over.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) commitVote(memTx *mempoolTxVote, t time.Time) {
+	memTx.markCommitted(t)
+	txVotePool.removePendingBroadcast(memTx)
+	txVotePool.graceHeights[memTx.tx.Height]++
+}
+
+// uncommitVote forgets the committed vote, once removed from the pool.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) uncommitVote(memTx *mempoolTxVote) {
+	height := memTx.tx.Height
+	txVotePool.graceHeights[height]--
+	if txVotePool.graceHeights[height] <= 0 {
+		delete(txVotePool.graceHeights, height)
+	}
+}
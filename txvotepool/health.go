@@ -0,0 +1,79 @@
+package txvotepool
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultStallTimeout = time.Minute
+
+var (
+	// ErrBroadcastStalled is returned by Healthz when votes are waiting to
+	// be sent to peers, but none was sent for a while.
+	ErrBroadcastStalled = errors.New("Broadcast stalled")
+
+	// ErrPoolWedged is returned by Healthz when the pool is full and no vote
+	// left it for a while.
+	ErrPoolWedged = errors.New("Pool wedged at capacity")
+)
+
+// ReactorStallTimeout sets how long broadcasting, or a full pool, may make no
+// progress before Healthz reports it. Defaults to a minute.
+func ReactorStallTimeout(timeout time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.stallTimeout = timeout }
+}
+
+// Healthz returns an error if broadcasting stalled, the pool is wedged at
+// capacity, or the pool's circuit breaker is open. The cause of the error,
+// see errors.Cause, is respectively ErrBroadcastStalled, ErrPoolWedged or
+// ErrCheckBreakerOpen. It's cheap enough to back liveness probes, and doesn't
+// lock the pool.
+func (txR *TxpoolReactor) Healthz() error {
+	now := time.Now()
+
+	if txR.Txpool.checkBreakerOpen() {
+		return ErrCheckBreakerOpen
+	}
+
+	if size := txR.Txpool.Size(); size >= txR.config.Size {
+		since := now.Sub(time.Unix(0, atomic.LoadInt64(&txR.Txpool.lastRemoved)))
+		if since > txR.stallTimeout {
+			return errors.Wrapf(ErrPoolWedged, "%d votes, none removed for %v", size, since)
+		}
+	}
+
+	if since := now.Sub(time.Unix(0, atomic.LoadInt64(&txR.lastSend))); since > txR.stallTimeout {
+		if vote, ok := txR.undeliveredVote(now); ok {
+			return errors.Wrapf(ErrBroadcastStalled, "vote %X waiting, none sent for %v", vote, since)
+		}
+	}
+	return nil
+}
+
+// undeliveredVote returns the ID of a vote added to the pool over
+// stallTimeout ago which some active peer doesn't have. Only the votes older
+// than stallTimeout, at the front of the pool, are looked at. Note peers may
+// legitimately not get a vote, eg. when lagging behind or not interested.
+func (txR *TxpoolReactor) undeliveredVote(now time.Time) ([]byte, bool) {
+	active := txR.ids.ActivePeers()
+	if len(active) == 0 || !txR.config.Broadcast {
+		return nil, false
+	}
+	for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if now.Sub(memTx.timestamp) <= txR.stallTimeout {
+			break
+		}
+		if memTx.isCommitted() {
+			continue
+		}
+		for _, id := range active {
+			if _, ok := memTx.senders.Load(id); !ok && !txR.isBlacklisted(id) {
+				return memTx.tx.Signature, true
+			}
+		}
+	}
+	return nil, false
+}
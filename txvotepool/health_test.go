@@ -0,0 +1,81 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+const testStallTimeout = 50 * time.Millisecond
+
+func TestHealthzHealthy(t *testing.T) {
+	txR := newTestReactor(t, ReactorStallTimeout(testStallTimeout))
+	defer txR.Stop()
+	assert.NoError(t, txR.Healthz())
+
+	// Votes every peer has don't make broadcasting look stalled.
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+	time.Sleep(2 * testStallTimeout)
+	assert.NoError(t, txR.Healthz())
+}
+
+func TestHealthzBroadcastStalled(t *testing.T) {
+	txR := newTestReactor(t, ReactorStallTimeout(testStallTimeout))
+	defer txR.Stop()
+
+	// Without a PeerState the peer never gets the vote.
+	txR.AddPeer(newTestPeer("peer"))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, newTestValidator())))
+	assert.NoError(t, txR.Healthz())
+
+	time.Sleep(2 * testStallTimeout)
+	assert.Equal(t, ErrBroadcastStalled, errors.Cause(txR.Healthz()))
+}
+
+func TestHealthzPoolWedged(t *testing.T) {
+	config := cfg.TestConfig()
+	config.Mempool.Size = 2
+	txR := NewTxpoolReactor(config.Mempool, NewTxVotePool(config.Mempool), ReactorStallTimeout(testStallTimeout))
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	assert.NoError(t, txR.Healthz())
+
+	time.Sleep(2 * testStallTimeout)
+	assert.Equal(t, ErrPoolWedged, errors.Cause(txR.Healthz()))
+
+	// Taking votes out unwedges it.
+	txR.Txpool.TakeMax(1)
+	assert.NoError(t, txR.Healthz())
+}
+
+func TestHealthzBreakerOpen(t *testing.T) {
+	config := cfg.TestConfig()
+	failing := func(types.TxVote) error { return PreCheckFailure{errors.New("app down")} }
+	txVotePool := NewTxVotePool(config.Mempool, WithPreCheck(failing), WithCircuitBreaker(1, 0, time.Minute))
+	txR := NewTxpoolReactor(config.Mempool, txVotePool)
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	defer txR.Stop()
+
+	assert.NoError(t, txR.Healthz())
+	assert.Error(t, txVotePool.CheckTx(newTestVote(1, newTestValidator())))
+	assert.Equal(t, ErrCheckBreakerOpen, errors.Cause(txR.Healthz()))
+}
@@ -0,0 +1,74 @@
+package txvotepool
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// ErrTooManyHeights is returned by CheckTx, with WithMaxHeights, for a vote
+// at a height the pool holds no vote for, when it already holds votes for
+// the max number of heights.
+var ErrTooManyHeights = errors.New("TxVote for a new height, pool holds too many heights")
+
+// HeightCapPolicy defines how the pool handles votes for a new height once
+// it holds votes for the max number of heights.
+type HeightCapPolicy int
+
+const (
+	// HeightCapReject rejects them with ErrTooManyHeights.
+	HeightCapReject HeightCapPolicy = iota
+	// HeightCapDisplace removes the votes of the lowest height to make room
+	// for a vote above it. Votes below it are rejected with
+	// ErrTooManyHeights. The removed votes are kept in the cache, so they
+	// aren't added again when received from peers.
+	HeightCapDisplace
+)
+
+// WithMaxHeights bounds the number of distinct heights the pool holds votes
+// for to max, so that a peer can't fill the memory with votes scattered over
+// many heights, and sets how votes for a new height past it are handled.
+// Unlimited by default.
+func WithMaxHeights(max int, policy HeightCapPolicy) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		txVotePool.maxHeights = max
+		txVotePool.heightCapPolicy = policy
+	}
+}
+
+// makeRoomForHeight returns nil if the pool can take a vote at the height,
+// after displacing the votes of the lowest height if needed.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) makeRoomForHeight(tx types.TxVote) error {
+	if txVotePool.maxHeights <= 0 || len(txVotePool.heightVotes) < txVotePool.maxHeights {
+		return nil
+	}
+	if _, ok := txVotePool.heightVotes[tx.Height]; ok {
+		return nil
+	}
+	if txVotePool.heightCapPolicy != HeightCapDisplace {
+		return ErrTooManyHeights
+	}
+	lowest := tx.Height
+	for height := range txVotePool.heightVotes {
+		if height < lowest {
+			lowest = height
+		}
+	}
+	if lowest == tx.Height {
+		return ErrTooManyHeights
+	}
+
+	var displaced int
+	for e := txVotePool.txs.Front(); e != nil; {
+		next := e.Next()
+		if memTx := e.Value.(*mempoolTxVote); memTx.tx.Height == lowest {
+			txVotePool.removeTx(memTx.tx, e, false)
+			displaced++
+		}
+		e = next
+	}
+	txVotePool.logger.Info("Displaced votes of lowest height", "height", lowest, "votes", displaced,
+		"newHeight", tx.Height)
+	return nil
+}
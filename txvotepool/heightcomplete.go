@@ -0,0 +1,171 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// OnHeightBroadcastComplete sets a callback invoked once for each height,
+// when all the votes for it in the pool were broadcast to, or received from,
+// every active peer. Peers joining before the votes reached them delay the
+// callback, as do blacklisted peers and the other peers votes aren't
+// broadcast to. With WithMaxSendersPerVote below the number of active peers,
+// the peers past the max aren't recorded as having the votes, so the callback
+// is never invoked. It is checked whenever a peer gets a vote, and invoked
+// from the goroutine which handled the vote, so it must not block.
+func (txR *TxpoolReactor) OnHeightBroadcastComplete(cb func(height int64)) {
+	txR.heightCompleteMtx.Lock()
+	txR.heightCompleteCb = cb
+	if txR.completedHeights == nil {
+		txR.completedHeights = make(map[int64]struct{})
+	}
+	txR.heightCompleteMtx.Unlock()
+	txR.recountHeightBroadcasts()
+}
+
+// recountHeightBroadcasts counts anew the votes of each height still to be
+// broadcast to some active peer, as the peers changed, see
+// TxVotePool.recountPendingBroadcasts.
+func (txR *TxpoolReactor) recountHeightBroadcasts() {
+	txR.heightCompleteMtx.Lock()
+	cb := txR.heightCompleteCb
+	txR.heightCompleteMtx.Unlock()
+	if cb == nil {
+		return
+	}
+	active := txR.ids.ActivePeers()
+	txR.Txpool.recountPendingBroadcasts(func(memTx *mempoolTxVote) bool {
+		return coversPeers(memTx, active)
+	})
+}
+
+// checkHeightBroadcast invokes the OnHeightBroadcastComplete callback if the
+// vote, which a peer just got, was the last vote of its height in the pool
+// some active peer didn't have.
+func (txR *TxpoolReactor) checkHeightBroadcast(memTx *mempoolTxVote) {
+	txR.heightCompleteMtx.Lock()
+	cb := txR.heightCompleteCb
+	txR.heightCompleteMtx.Unlock()
+	if cb == nil || !coversPeers(memTx, txR.ids.ActivePeers()) {
+		return
+	}
+	height, complete := txR.Txpool.markBroadcast(memTx)
+	if !complete {
+		return
+	}
+
+	txR.heightCompleteMtx.Lock()
+	if _, done := txR.completedHeights[height]; done {
+		txR.heightCompleteMtx.Unlock()
+		return
+	}
+	txR.completedHeights[height] = struct{}{}
+	// heights the pool moved past won't be checked again
+	lowest := height
+	for h := range txR.completedHeights {
+		if h < txR.Txpool.Height() {
+			delete(txR.completedHeights, h)
+		} else if h < lowest {
+			lowest = h
+		}
+	}
+	// votes may leave the pool without it moving past their height, eg. when
+	// flushed
+	if len(txR.completedHeights) > maxCompletedHeights {
+		delete(txR.completedHeights, lowest)
+	}
+	txR.Txpool.metrics.reportCacheEntries(cacheCompletedHeights, len(txR.completedHeights))
+	txR.heightCompleteMtx.Unlock()
+	cb(height)
+}
+
+// checkTxHeightBroadcast is checkHeightBroadcast for the vote in the pool
+// matching tx, if any.
+func (txR *TxpoolReactor) checkTxHeightBroadcast(tx types.TxVote) {
+	if memTx, ok := txR.Txpool.memTxByID(tx.Signature); ok {
+		txR.checkHeightBroadcast(memTx)
+	}
+}
+
+// coversPeers returns true if there are peers, and they all have the vote.
+func coversPeers(memTx *mempoolTxVote, peers map[p2p.ID]uint16) bool {
+	if len(peers) == 0 {
+		return false
+	}
+	for _, id := range peers {
+		if _, ok := memTx.senders.Load(id); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//-------------------------------------
+
+// addPendingBroadcast counts the vote added to the pool as still to be
+// broadcast, if tracked, see OnHeightBroadcastComplete.
+func (txVotePool *TxVotePool) addPendingBroadcast(memTx *mempoolTxVote) {
+	txVotePool.pendingMtx.Lock()
+	defer txVotePool.pendingMtx.Unlock()
+	if txVotePool.pendingBroadcasts == nil || memTx.isCommitted() {
+		return
+	}
+	memTx.pendingBroadcast = true
+	txVotePool.pendingBroadcasts[memTx.tx.Height]++
+}
+
+// removePendingBroadcast stops counting the vote, committed or removed from
+// the pool, as still to be broadcast.
+func (txVotePool *TxVotePool) removePendingBroadcast(memTx *mempoolTxVote) {
+	txVotePool.pendingMtx.Lock()
+	defer txVotePool.pendingMtx.Unlock()
+	txVotePool.unpendLocked(memTx)
+}
+
+// markBroadcast records every active peer has the vote, and returns its
+// height and true if it was the last vote of the height some peer didn't
+// have.
+func (txVotePool *TxVotePool) markBroadcast(memTx *mempoolTxVote) (int64, bool) {
+	txVotePool.pendingMtx.Lock()
+	defer txVotePool.pendingMtx.Unlock()
+	if !memTx.pendingBroadcast {
+		return memTx.tx.Height, false
+	}
+	return memTx.tx.Height, txVotePool.unpendLocked(memTx)
+}
+
+// unpendLocked stops counting the vote as still to be broadcast, and returns
+// true if no vote of its height is left to broadcast.
+// NOTE: pendingMtx must be locked.
+func (txVotePool *TxVotePool) unpendLocked(memTx *mempoolTxVote) bool {
+	if !memTx.pendingBroadcast {
+		return false
+	}
+	memTx.pendingBroadcast = false
+	height := memTx.tx.Height
+	txVotePool.pendingBroadcasts[height]--
+	if txVotePool.pendingBroadcasts[height] > 0 {
+		return false
+	}
+	delete(txVotePool.pendingBroadcasts, height)
+	return true
+}
+
+// recountPendingBroadcasts counts the votes of each height the peers don't
+// all have, as told by covered, and tracks them from now on. It walks the
+// whole pool, so it is only run when the peers change.
+func (txVotePool *TxVotePool) recountPendingBroadcasts(covered func(*mempoolTxVote) bool) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	txVotePool.pendingMtx.Lock()
+	defer txVotePool.pendingMtx.Unlock()
+
+	txVotePool.pendingBroadcasts = make(map[int64]int)
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		memTx.pendingBroadcast = !memTx.isCommitted() && !covered(memTx)
+		if memTx.pendingBroadcast {
+			txVotePool.pendingBroadcasts[memTx.tx.Height]++
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package txvotepool
+
+import (
+	"time"
+
+	"github.com/tendermint/tendermint/libs/clist"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorBroadcastIdleTimeout makes broadcast routines which had no vote to
+// handle for timeout exit, and be spawned again once a vote is added to the
+// pool. This saves the memory of the routines of mostly idle peers on nodes
+// with many peers. Routines run as long as their peer by default.
+func ReactorBroadcastIdleTimeout(timeout time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.broadcastIdleTimeout = timeout }
+}
+
+// idleTimer fires once a broadcast routine was idle for timeout. A nil
+// idleTimer never fires. It is used by a single broadcast routine, so it
+// isn't safe for concurrent use.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	return &idleTimer{timeout: timeout, timer: time.NewTimer(timeout)}
+}
+
+// C returns the channel receiving once the routine was idle for timeout.
+func (t *idleTimer) C() <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// reset restarts the idle period.
+func (t *idleTimer) reset() {
+	if t == nil {
+		return
+	}
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	t.timer.Reset(t.timeout)
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// parkBroadcastRoutine unregisters the idle broadcast routine of the peer,
+// which is waiting for a vote after next, or for the pool not to be empty if
+// next is nil, so that it is spawned again by idleWakeRoutine. It returns
+// false if a vote came in meanwhile, and the routine must go on.
+func (txR *TxpoolReactor) parkBroadcastRoutine(peer p2p.Peer, next *clist.CElement) bool {
+	txR.routinesMtx.Lock()
+	defer txR.routinesMtx.Unlock()
+
+	if next != nil && next.Next() != nil || next == nil && txR.Txpool.TxsFront() != nil {
+		return false
+	}
+	if routine, ok := txR.routines[peer.ID()]; ok && routine.peer == peer {
+		delete(txR.routines, peer.ID())
+	}
+	txR.idlePeers[peer.ID()] = peer
+	txR.Logger.Debug("Broadcast routine idle", "peer", peer)
+	return true
+}
+
+// idleWakeRoutine spawns the broadcast routines of idle peers again whenever
+// a vote is added to the pool.
+func (txR *TxpoolReactor) idleWakeRoutine() {
+	var last *clist.CElement // back of the pool
+	for {
+		if last == nil {
+			select {
+			case <-txR.Txpool.TxsWaitChan():
+				last = txR.Txpool.TxsFront()
+			case <-txR.Quit():
+				return
+			}
+		} else {
+			select {
+			case <-last.NextWaitChan():
+				// nil if last was removed from the back
+				last = last.Next()
+			case <-txR.Quit():
+				return
+			}
+		}
+		if last == nil {
+			continue
+		}
+		for last.Next() != nil {
+			last = last.Next()
+		}
+		txR.wakeIdlePeers()
+	}
+}
+
+// wakeIdlePeers spawns the broadcast routines of the idle peers.
+func (txR *TxpoolReactor) wakeIdlePeers() {
+	txR.routinesMtx.Lock()
+	peers := make([]p2p.Peer, 0, len(txR.idlePeers))
+	for id, peer := range txR.idlePeers {
+		peers = append(peers, peer)
+		delete(txR.idlePeers, id)
+	}
+	txR.routinesMtx.Unlock()
+
+	for _, peer := range peers {
+		txR.peersMtx.RLock()
+		current := txR.peers[peer.ID()] == peer
+		txR.peersMtx.RUnlock()
+		if current && peer.IsRunning() {
+			txR.spawnBroadcastRoutine(peer, 0)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package txvotepool
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestDeterministicPeerIDs(t *testing.T) {
+	peers := make([]*testPeer, 20)
+	for i := range peers {
+		peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i)))
+	}
+
+	forward := newTxpoolIDs()
+	forward.deterministic = true
+	for _, peer := range peers {
+		forward.ReserveForPeer(peer)
+	}
+
+	backward := newTxpoolIDs()
+	backward.deterministic = true
+	for i := len(peers) - 1; i >= 0; i-- {
+		backward.ReserveForPeer(peers[i])
+	}
+
+	for _, peer := range peers {
+		id := forward.GetForPeer(peer)
+		assert.NotEqual(t, UnknownPeerID, id)
+		assert.Equal(t, id, backward.GetForPeer(peer), "peer %v", peer.ID())
+	}
+
+	// The same peer keeps its ID across reconnects.
+	id := forward.GetForPeer(peers[0])
+	forward.Reclaim(peers[0])
+	forward.ReserveForPeer(peers[0])
+	assert.Equal(t, id, forward.GetForPeer(peers[0]))
+}
+
+func TestDeterministicPeerIDsCollision(t *testing.T) {
+	ids := newTxpoolIDs()
+	ids.deterministic = true
+
+	peer := newTestPeer("peer")
+	hash := sha256.Sum256([]byte(peer.ID()))
+	derived := binary.BigEndian.Uint16(hash[:2])
+
+	// Another peer already holds the derived ID.
+	ids.activeIDs[derived] = struct{}{}
+	ids.ReserveForPeer(peer)
+	assert.Equal(t, derived+1, ids.GetForPeer(peer))
+}
+
+func TestPeerIDCooldown(t *testing.T) {
+	ids := newTxpoolIDs()
+	ids.cooldown = 100 * time.Millisecond
+
+	gone, next := newTestPeer("gone"), newTestPeer("next")
+	ids.ReserveForPeer(gone)
+	freed := ids.GetForPeer(gone)
+	ids.Reclaim(gone)
+
+	// The freed ID would be next, but is cooling down.
+	ids.nextID = freed
+	ids.ReserveForPeer(next)
+	assert.NotEqual(t, freed, ids.GetForPeer(next))
+	ids.Reclaim(next)
+
+	// The peer which held it gets it back.
+	ids.nextID = freed
+	ids.ReserveForPeer(gone)
+	assert.Equal(t, freed, ids.GetForPeer(gone))
+	ids.Reclaim(gone)
+
+	// Once cooled down, it is given to other peers again.
+	time.Sleep(150 * time.Millisecond)
+	ids.nextID = freed
+	ids.ReserveForPeer(next)
+	assert.Equal(t, freed, ids.GetForPeer(next))
+}
+
+func TestActivePeersReturnsCopy(t *testing.T) {
+	ids := newTxpoolIDs()
+
+	peers := []*testPeer{newTestPeer("a"), newTestPeer("b"), newTestPeer("c")}
+	for _, peer := range peers {
+		ids.ReserveForPeer(peer)
+	}
+	ids.Reclaim(peers[1])
+
+	active := ids.ActivePeers()
+	assert.Equal(t, map[p2p.ID]uint16{"a": 1, "c": 3}, active)
+
+	active["d"] = 4
+	delete(active, "a")
+	assert.Equal(t, map[p2p.ID]uint16{"a": 1, "c": 3}, ids.ActivePeers())
+}
+
+func TestLaggingPeers(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	heights := map[p2p.ID]int64{"a": 10, "b": 7, "c": 9, "d": 7, "e": 12}
+	peers := make(map[p2p.ID]*testPeer)
+	for id, height := range heights {
+		peers[id] = newTestPeer(id)
+		peers[id].Set(ttypes.PeerStateKey, testPeerState{height})
+		txR.AddPeer(peers[id])
+	}
+	// A peer without a PeerState yet is left out.
+	txR.AddPeer(newTestPeer("nostate"))
+
+	assert.Equal(t, []PeerLag{
+		{ID: "b", Height: 7, Lag: 3},
+		{ID: "d", Height: 7, Lag: 3},
+		{ID: "c", Height: 9, Lag: 1},
+	}, txR.LaggingPeers(10))
+	assert.Empty(t, txR.LaggingPeers(7))
+
+	txR.RemovePeer(peers["b"], nil)
+	assert.Equal(t, []PeerLag{{ID: "d", Height: 7, Lag: 3}, {ID: "c", Height: 9, Lag: 1}}, txR.LaggingPeers(10))
+}
+
+func TestCompactionPrunesGonePeers(t *testing.T) {
+	txR := newTestReactor(t, ReactorCompactionInterval(20*time.Millisecond))
+	defer txR.Stop()
+
+	countSenders := func() int {
+		n := 0
+		for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+			e.Value.(*mempoolTxVote).senders.Range(func(key, _ interface{}) bool {
+				n++
+				return true
+			})
+		}
+		return n
+	}
+
+	validator := newTestValidator()
+	peers := make([]*testPeer, 10)
+	for i := range peers {
+		peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i)))
+		txR.AddPeer(peers[i])
+		for j := 0; j < 5; j++ {
+			sendMsg(txR, peers[i], &TxMessage{Tx: newTestVote(1, validator)})
+		}
+	}
+	require.Equal(t, 50, countSenders())
+
+	// All but the first peer leave.
+	for _, peer := range peers[1:] {
+		txR.RemovePeer(peer, nil)
+	}
+	waitFor(t, time.Second, func() bool { return countSenders() == 5 })
+	assert.Equal(t, 50, txR.Txpool.Size())
+	cache := txR.Txpool.cache.(*mapTxCache)
+	cache.mtx.Lock()
+	assert.Len(t, cache.map_, 50)
+	cache.mtx.Unlock()
+}
+
+func TestCompactionKeepsCoolingSenders(t *testing.T) {
+	txR := newTestReactor(t, ReactorPeerIDCooldown(200*time.Millisecond))
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	id := txR.ids.GetForPeer(peer)
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	memTx := txR.Txpool.TxsFront().Value.(*mempoolTxVote)
+	require.True(t, memTx.hasSender(id))
+
+	// The peer's ID is cooling down: it gets it back if it reconnects, so
+	// its senders are kept.
+	txR.RemovePeer(peer, nil)
+	assert.Equal(t, 0, txR.compact())
+	assert.True(t, memTx.hasSender(id))
+
+	// Once cooled down, they are forgotten.
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 1, txR.compact())
+	assert.False(t, memTx.hasSender(id))
+}
+
+func TestCompactionLoopStats(t *testing.T) {
+	txR := newTestReactor(t, ReactorCompactionInterval(100*time.Millisecond))
+	defer txR.Stop()
+
+	waitFor(t, 2*time.Second, func() bool { return txR.LoopStats()[loopCompactor].Runs > 0 })
+	first := txR.LoopStats()[loopCompactor]
+	assert.False(t, first.LastRun.IsZero())
+
+	// The peer leaves behind the senders of its votes for the next run.
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	}
+	txR.RemovePeer(peer, nil)
+	waitFor(t, 2*time.Second, func() bool { return txR.LoopStats()[loopCompactor].Processed == 3 })
+	last := txR.LoopStats()[loopCompactor]
+	assert.True(t, last.LastRun.After(first.LastRun))
+	assert.True(t, last.Runs > first.Runs)
+	_, ok := txR.LoopStats()[loopSyncGuard]
+	assert.False(t, ok, "sync guard not enabled")
+}
+
+func TestReassignPeerID(t *testing.T) {
+	ids := newTxpoolIDs()
+	peer := newTestPeer("peer")
+	ids.ReserveForPeer(peer)
+	oldID := ids.GetForPeer(peer)
+
+	newID := ids.Reassign(peer)
+	assert.NotEqual(t, oldID, newID)
+	assert.Equal(t, newID, ids.GetForPeer(peer))
+	assert.Equal(t, map[p2p.ID]uint16{peer.ID(): newID}, ids.ActivePeers())
+	_, active := ids.activeIDs[oldID]
+	assert.True(t, active, "old ID freed before Free")
+
+	ids.Free(oldID, peer)
+	_, active = ids.activeIDs[oldID]
+	assert.False(t, active, "old ID still reserved")
+	assert.Equal(t, newID, ids.GetForPeer(peer))
+}
+
+func TestReassignPeerKeepsBroadcastRoutine(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+	txR.routinesMtx.Lock()
+	routine := txR.routines[peer.ID()]
+	txR.routinesMtx.Unlock()
+
+	validator := newTestValidator()
+	before := newTestVote(1, validator)
+	require.NoError(t, txR.Txpool.CheckTx(before))
+	waitFor(t, 2*time.Second, func() bool { return sentVote(peer, before) }, "vote not sent")
+
+	oldID := txR.ids.GetForPeer(peer)
+	newID := txR.ReassignPeer(peer)
+	assert.NotEqual(t, oldID, newID)
+
+	// The peer's votes moved to its new ID.
+	memTx, ok := txR.Txpool.memTxByID(before.Signature)
+	require.True(t, ok)
+	_, ok = memTx.senders.Load(newID)
+	assert.True(t, ok)
+	_, ok = memTx.senders.Load(oldID)
+	assert.False(t, ok)
+
+	// The same routine keeps broadcasting, under the new ID.
+	after := newTestVote(1, validator)
+	require.NoError(t, txR.Txpool.CheckTx(after))
+	waitFor(t, 2*time.Second, func() bool { return sentVote(peer, after) }, "vote not sent after reassign")
+	memTx, ok = txR.Txpool.memTxByID(after.Signature)
+	require.True(t, ok)
+	waitFor(t, 2*time.Second, func() bool {
+		_, ok := memTx.senders.Load(newID)
+		return ok
+	}, "vote not marked sent under new ID")
+
+	txR.routinesMtx.Lock()
+	assert.Len(t, txR.routines, 1)
+	assert.Equal(t, routine, txR.routines[peer.ID()])
+	txR.routinesMtx.Unlock()
+
+	// and exits as usual once the peer is gone.
+	txR.RemovePeer(peer, nil)
+	peer.Stop()
+	select {
+	case <-routine.done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast routine leaked")
+	}
+}
+
+func TestReassignPeerKeepsOldIDUntilSendsAreMoved(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	oldID := txR.ids.GetForPeer(peer)
+	newID := txR.ReassignPeer(peer)
+
+	// A send started under the old ID marks the vote after the move.
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	memTx, ok := txR.Txpool.memTxByID(vote.Signature)
+	require.True(t, ok)
+	memTx.addSender(oldID)
+
+	// Meanwhile the old ID isn't given to another peer.
+	txR.ids.nextID = oldID
+	other := newTestPeer("other")
+	txR.AddPeer(other)
+	assert.NotEqual(t, oldID, txR.ids.GetForPeer(other))
+
+	waitFor(t, 2*reassignGrace, func() bool {
+		txR.ids.mtx.RLock()
+		defer txR.ids.mtx.RUnlock()
+		_, reserved := txR.ids.activeIDs[oldID]
+		return !reserved
+	}, "old ID not freed")
+	assert.False(t, memTx.hasSender(oldID))
+	assert.True(t, memTx.hasSender(newID))
+}
+
+func TestIDsResetAfterChurn(t *testing.T) {
+	ids := newTxpoolIDs()
+	initialNext := ids.NextID()
+	require.Equal(t, 0, ids.ActiveIDs())
+
+	peers := make([]*testPeer, 50)
+	for round := 0; round < 5; round++ {
+		for i := range peers {
+			peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d-%d", round, i)))
+			ids.ReserveForPeer(peers[i])
+		}
+		oldID := ids.GetForPeer(peers[0])
+		ids.Reassign(peers[0])
+		ids.Free(oldID, peers[0])
+		assert.Equal(t, len(peers), ids.ActiveIDs())
+
+		// Peers leave in a different order than they came.
+		for i := len(peers) - 1; i >= 0; i-- {
+			ids.Reclaim(peers[i])
+		}
+		assert.Equal(t, 0, ids.ActiveIDs(), "IDs leaked in round %d", round)
+	}
+
+	peer := newTestPeer("peer")
+	ids.ReserveForPeer(peer)
+	assert.Equal(t, ErrPeerIDsInUse, ids.Reset())
+	assert.Equal(t, 1, ids.ActiveIDs())
+	ids.Reclaim(peer)
+
+	assert.NotEqual(t, initialNext, ids.NextID())
+	require.NoError(t, ids.Reset())
+	assert.Equal(t, initialNext, ids.NextID())
+	assert.Equal(t, 0, ids.ActiveIDs())
+	assert.Empty(t, ids.ActivePeers())
+
+	ids.ReserveForPeer(peer)
+	assert.Equal(t, initialNext, ids.GetForPeer(peer))
+}
@@ -0,0 +1,131 @@
+package txvotepool
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+var (
+	// errVoteNotChecked is returned by receiveTx for votes it didn't check
+	// into the pool, eg. from a blacklisted peer.
+	errVoteNotChecked = errors.New("Vote not checked")
+
+	// errVoteDropped is returned by receiveTx for votes the pool silently
+	// dropped, see CommittedHeightDrop.
+	errVoteDropped = errors.New("Vote dropped")
+)
+
+// ReactorCoalesceReceives makes concurrent receives of the same vote, eg. from
+// many peers relaying it at once, run a single verification and check: the
+// others wait for it to complete, and then only record their peer as having
+// the vote. By default every receive is verified and checked on its own, the
+// duplicates only being caught by the cache.
+func ReactorCoalesceReceives() ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.inflight = &inflightVotes{calls: make(map[[sha256.Size]byte]*inflightCall)}
+	}
+}
+
+// inflightVotes tracks the votes being verified and checked. A nil
+// inflightVotes coalesces nothing.
+type inflightVotes struct {
+	mtx   sync.Mutex
+	calls map[[sha256.Size]byte]*inflightCall
+}
+
+// inflightCall is the verification and check of a vote.
+type inflightCall struct {
+	done     chan struct{} // closed once the call completed
+	verified bool          // the vote passed verification
+	err      error         // error checking the vote into the pool
+}
+
+// inflightKey is the key of tx in inflightVotes: the hash of its canonical
+// encoding rather than its signature only, so that a copy of a vote tampered
+// with but keeping its signature, which fails verification, doesn't take the
+// honest copies down with it.
+func inflightKey(tx types.TxVote) [sha256.Size]byte {
+	return sha256.Sum256(cdc.MustMarshalBinaryBare(normalizeTxVote(tx)))
+}
+
+// join returns the call for the vote with the given key, and true if the
+// caller must make it, in which case it must then call finish.
+func (iv *inflightVotes) join(key [sha256.Size]byte) (*inflightCall, bool) {
+	if iv == nil {
+		return nil, true
+	}
+	iv.mtx.Lock()
+	defer iv.mtx.Unlock()
+	if call, ok := iv.calls[key]; ok {
+		return call, false
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	iv.calls[key] = call
+	return call, true
+}
+
+// finish completes the call for the vote with the given key.
+func (iv *inflightVotes) finish(key [sha256.Size]byte, call *inflightCall) {
+	if iv == nil {
+		return
+	}
+	iv.mtx.Lock()
+	delete(iv.calls, key)
+	iv.mtx.Unlock()
+	close(call.done)
+}
+
+// verifyAndReceiveTx verifies a vote received from the peer and adds it to the
+// pool, unless the same vote is being received from another peer, see
+// ReactorCoalesceReceives.
+func (txR *TxpoolReactor) verifyAndReceiveTx(src p2p.Peer, tx types.TxVote, seq uint64, provenance []RelayHop) {
+	var key [sha256.Size]byte
+	if txR.inflight != nil {
+		key = inflightKey(tx)
+	}
+	call, leader := txR.inflight.join(key)
+	if !leader {
+		<-call.done
+		switch {
+		case !call.verified:
+			// invalid, already logged
+		case call.err == nil || call.err == ErrTxVoteInCache:
+			txR.receiveDuplicate(src, tx, seq)
+		default:
+			// The outcome depended on the other peer or the pool's state at
+			// the time, check it again.
+			txR.receiveTx(src, tx, seq, provenance)
+		}
+		return
+	}
+
+	if err := txR.verifyVote(tx); err != nil {
+		txR.invalidVote(src, tx, seq, err)
+		txR.inflight.finish(key, call)
+		return
+	}
+	err := txR.receiveTx(src, tx, seq, provenance)
+	if call != nil {
+		call.verified, call.err = true, err
+	}
+	txR.inflight.finish(key, call)
+}
+
+// receiveDuplicate records the peer sent a vote the pool already saw.
+func (txR *TxpoolReactor) receiveDuplicate(src p2p.Peer, tx types.TxVote, seq uint64) {
+	peerID := txR.ids.GetForPeer(src)
+	if txR.isBlacklisted(peerID) {
+		txR.Txpool.metrics.BlacklistedTxs.Add(1)
+		return
+	}
+	txR.Txpool.proxyMtx.Lock()
+	txR.Txpool.recordSender(tx, TxVoteInfo{PeerID: peerID, ReceiveSeq: seq})
+	txR.Txpool.proxyMtx.Unlock()
+	txR.sendAck(src, tx)
+	txR.checkTxHeightBroadcast(tx)
+}
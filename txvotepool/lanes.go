@@ -0,0 +1,82 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/libs/clist"
+)
+
+// Lane is the priority lane of a vote, see ReactorPriorityLanes.
+type Lane int
+
+const (
+	// LaneNormal votes are broadcast once no high lane vote is pending.
+	LaneNormal Lane = iota
+	// LaneHigh votes are broadcast first, eg. votes for the current height.
+	LaneHigh
+)
+
+// ReactorPriorityLanes makes broadcast routines send the votes classify puts
+// in LaneHigh before those in LaneNormal, which are sent once caught up with
+// the high lane. So that the normal lane isn't starved when high lane votes
+// keep coming, a normal lane vote is sent after every normalEvery high lane
+// votes. All votes are broadcast in pool order by default.
+func ReactorPriorityLanes(classify func(types.TxVote) Lane, normalEvery int) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.laneClassifier = classify
+		txR.normalLaneEvery = normalEvery
+	}
+}
+
+// laneScheduler defers the normal lane votes a broadcast routine comes across
+// while walking the pool, and tells when to handle them. A nil laneScheduler
+// defers nothing. It is used by a single broadcast routine, so it isn't safe
+// for concurrent use.
+type laneScheduler struct {
+	classify    func(types.TxVote) Lane
+	normalEvery int
+
+	deferred   []*clist.CElement
+	highStreak int // high lane votes handled since the last normal lane one
+}
+
+func newLaneScheduler(classify func(types.TxVote) Lane, normalEvery int) *laneScheduler {
+	if classify == nil {
+		return nil
+	}
+	return &laneScheduler{classify: classify, normalEvery: normalEvery}
+}
+
+// deferVote defers e if it is a normal lane vote, and returns true if it did.
+func (ls *laneScheduler) deferVote(e *clist.CElement) bool {
+	if ls == nil || ls.classify(e.Value.(*mempoolTxVote).tx) != LaneNormal {
+		return false
+	}
+	ls.deferred = append(ls.deferred, e)
+	return true
+}
+
+// handledHigh records a high lane vote was handled.
+func (ls *laneScheduler) handledHigh() {
+	if ls != nil {
+		ls.highStreak++
+	}
+}
+
+// popDue returns the oldest deferred vote still in the pool if it is due,
+// that is if caughtUp is true, or normalEvery high lane votes were handled
+// since the last normal lane one. It returns nil otherwise.
+func (ls *laneScheduler) popDue(caughtUp bool) *clist.CElement {
+	if ls == nil || !caughtUp && ls.highStreak < ls.normalEvery {
+		return nil
+	}
+	for len(ls.deferred) > 0 {
+		e := ls.deferred[0]
+		ls.deferred[0] = nil
+		ls.deferred = ls.deferred[1:]
+		if !e.Removed() {
+			ls.highStreak = 0
+			return e
+		}
+	}
+	return nil
+}
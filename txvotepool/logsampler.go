@@ -0,0 +1,49 @@
+package txvotepool
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/tendermint/tendermint/libs/log"
+)
+
+// sampledLogger is a log.Logger which only emits 1 in n of the debug and info
+// lines with the same message, for the logs of high frequency paths. Errors
+// are always emitted.
+type sampledLogger struct {
+	log.Logger
+	n      uint64
+	counts *sync.Map // msg -> *uint64, shared with the loggers derived using With
+}
+
+var _ log.Logger = sampledLogger{}
+
+// newSampledLogger returns a logger emitting 1 in n debug and info lines of
+// l, or l itself if n <= 1.
+func newSampledLogger(l log.Logger, n int) log.Logger {
+	if n <= 1 {
+		return l
+	}
+	return sampledLogger{Logger: l, n: uint64(n), counts: new(sync.Map)}
+}
+
+func (l sampledLogger) sample(msg string) bool {
+	count, _ := l.counts.LoadOrStore(msg, new(uint64))
+	return (atomic.AddUint64(count.(*uint64), 1)-1)%l.n == 0
+}
+
+func (l sampledLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.sample(msg) {
+		l.Logger.Debug(msg, keyvals...)
+	}
+}
+
+func (l sampledLogger) Info(msg string, keyvals ...interface{}) {
+	if l.sample(msg) {
+		l.Logger.Info(msg, keyvals...)
+	}
+}
+
+func (l sampledLogger) With(keyvals ...interface{}) log.Logger {
+	return sampledLogger{Logger: l.Logger.With(keyvals...), n: l.n, counts: l.counts}
+}
@@ -0,0 +1,59 @@
+package txvotepool
+
+import (
+	"time"
+)
+
+// Names of the background loops, the keys of LoopStats and the values of the
+// "loop" label of the loop metrics.
+const (
+	loopCompactor = "compactor"
+	loopSyncGuard = "sync_guard"
+)
+
+// LoopStats tells when a background loop of the reactor last ran, so that
+// operators can tell it is still running.
+type LoopStats struct {
+	// Runs is the number of times the loop ran.
+	Runs int64
+	// LastRun is when the last run started.
+	LastRun time.Time
+	// Duration is how long the last run took.
+	Duration time.Duration
+	// Processed is the number of items the last run processed: senders
+	// pruned by the compactor, deferred votes checked by the sync guard.
+	Processed int
+}
+
+// LoopStats returns the stats of the background loops which ran so far, by
+// name: "compactor" (see ReactorCompactionInterval) and "sync_guard" (see
+// ReactorSyncGuard).
+func (txR *TxpoolReactor) LoopStats() map[string]LoopStats {
+	txR.loopsMtx.Lock()
+	defer txR.loopsMtx.Unlock()
+
+	stats := make(map[string]LoopStats, len(txR.loops))
+	for loop, s := range txR.loops {
+		stats[loop] = s
+	}
+	return stats
+}
+
+// recordLoopRun records a run of the loop which started at start and
+// processed the given number of items.
+func (txR *TxpoolReactor) recordLoopRun(loop string, start time.Time, processed int) {
+	duration := time.Since(start)
+	txR.loopsMtx.Lock()
+	s := txR.loops[loop]
+	s.Runs++
+	s.LastRun = start
+	s.Duration = duration
+	s.Processed = processed
+	txR.loops[loop] = s
+	txR.loopsMtx.Unlock()
+
+	metrics := txR.Txpool.metrics
+	metrics.LoopLastRun.With("loop", loop).Set(float64(start.Unix()))
+	metrics.LoopDuration.With("loop", loop).Observe(duration.Seconds())
+	metrics.LoopProcessed.With("loop", loop).Add(float64(processed))
+}
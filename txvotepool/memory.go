@@ -0,0 +1,184 @@
+package txvotepool
+
+import (
+	"crypto/sha256"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// ErrPoolMemoryFull is returned by CheckTx, with WithMaxMemory, when the pool
+// can't free enough memory to take the vote.
+var ErrPoolMemoryFull = errors.New("TxVote pool memory is full")
+
+// Approximate memory held by an entry of the structures of the pool, on top
+// of the size of the votes themselves.
+const (
+	memPerVote       = 400 // mempoolTxVote, its list element and txsMap entry
+	memPerSender     = 48  // entry of the senders of a vote
+	memPerCacheEntry = 100 // hash, list element and map entry of the cache
+	memPerIndexEntry = 64  // entry of the votes by signer, by height, etc.
+	memPerRelayHop   = 80  // node recorded with a vote, see RelayHop
+)
+
+// memoryLowWater is the fraction of the max memory reclaiming frees the pool
+// down to, so that it doesn't reclaim again on the next vote.
+const memoryLowWater = 0.9
+
+// WithMaxMemory bounds the approximate memory held by the pool, see
+// MemoryUsage, to max bytes. Past it, the pool reclaims memory before adding
+// a vote, down to 90% of max: it first drops the cache entries of the votes
+// no longer in the pool, then forgets the senders of the votes, so some votes
+// may be sent again to peers which have them, then removes the oldest votes.
+// Removed votes are kept in the cache, so they aren't added again when
+// received from peers. Votes which can't fit still are rejected with
+// ErrPoolMemoryFull. Unlimited by default.
+func WithMaxMemory(max int64) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.maxMemory = max }
+}
+
+// MemoryUsage returns the approximate number of bytes held by the pool: its
+// votes, their senders and provenance, the cache and the indices of the
+// votes.
+func (txVotePool *TxVotePool) MemoryUsage() int64 {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	return txVotePool.memoryUsage()
+}
+
+// memoryUsage returns MemoryUsage.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) memoryUsage() int64 {
+	votes := int64(txVotePool.Size() + len(txVotePool.quarantine) + txVotePool.orderBuffered)
+	indices := int64(len(txVotePool.signerVotes) + len(txVotePool.heightVotes) + len(txVotePool.graceHeights))
+	usage := txVotePool.TxsBytes() + votes*memPerVote + indices*memPerIndexEntry +
+		atomic.LoadInt64(&txVotePool.numSenders)*memPerSender +
+		atomic.LoadInt64(&txVotePool.numRelayHops)*memPerRelayHop
+	if c, ok := txVotePool.cache.(interface{ Len() int }); ok {
+		usage += int64(c.Len()) * memPerCacheEntry
+	}
+	return usage
+}
+
+// reclaimMemory returns nil if the pool can take the vote within the max
+// memory, after reclaiming memory if needed, see WithMaxMemory. It reports
+// the memory used either way.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) reclaimMemory(tx types.TxVote) error {
+	usage := txVotePool.memoryUsage()
+	txVotePool.metrics.MemoryBytes.Set(float64(usage))
+	need := int64(tx.Size()) + memPerVote + memPerSender
+	if txVotePool.maxMemory <= 0 || usage+need <= txVotePool.maxMemory {
+		return nil
+	}
+
+	// Senders added to votes after they left the pool are still counted.
+	txVotePool.recountSenders()
+	target := int64(memoryLowWater*float64(txVotePool.maxMemory)) - need
+	var trimmed, forgotten, removed int
+	if usage = txVotePool.memoryUsage(); usage > target {
+		trimmed = txVotePool.trimCache(usage - target)
+	}
+	if usage = txVotePool.memoryUsage(); usage > target {
+		forgotten = txVotePool.forgetSenders(usage - target)
+	}
+	if usage = txVotePool.memoryUsage(); usage > target {
+		removed = txVotePool.removeOldest(usage - target)
+	}
+	if removed > 0 {
+		txVotePool.compact()
+	}
+	usage = txVotePool.memoryUsage()
+	txVotePool.metrics.MemoryBytes.Set(float64(usage))
+	txVotePool.metrics.Size.Set(float64(txVotePool.Size()))
+	txVotePool.logger.Info("Reclaimed pool memory", "cacheEntries", trimmed, "senders", forgotten,
+		"votes", removed, "usage", usage, "max", txVotePool.maxMemory)
+	if usage+need > txVotePool.maxMemory {
+		return ErrPoolMemoryFull
+	}
+	return nil
+}
+
+// recountSenders sets numSenders to the number of senders of the votes in
+// the pool.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) recountSenders() {
+	var n int64
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		n += int64(atomic.LoadInt32(&e.Value.(*mempoolTxVote).numSenders))
+	}
+	atomic.StoreInt64(&txVotePool.numSenders, n)
+}
+
+// trimCache drops the oldest cache entries of votes no longer in the pool nor
+// quarantined, until about excess bytes are freed, and returns the number dropped.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) trimCache(excess int64) int {
+	cache, ok := txVotePool.cache.(*mapTxCache)
+	if !ok {
+		return 0
+	}
+	n := cache.trim(int((excess+memPerCacheEntry-1)/memPerCacheEntry), func(key [sha256.Size]byte) bool {
+		_, inPool := txVotePool.txsMap.Load(key)
+		_, quarantined := txVotePool.quarantine[key]
+		return inPool || quarantined
+	})
+	txVotePool.reportDedupCacheEntries()
+	return n
+}
+
+// forgetSenders forgets the senders of the oldest votes, until about excess
+// bytes are freed, and returns the number forgotten.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) forgetSenders(excess int64) int {
+	var n int
+	for e := txVotePool.txs.Front(); e != nil && int64(n)*memPerSender < excess; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		memTx.senders.Range(func(key, _ interface{}) bool {
+			if memTx.removeSender(key.(uint16)) {
+				n++
+			}
+			return true
+		})
+	}
+	return n
+}
+
+// removeOldest removes the oldest votes, until about excess bytes are freed,
+// and returns the number removed. They are kept in the cache.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) removeOldest(excess int64) int {
+	var n int
+	var freed int64
+	for e := txVotePool.txs.Front(); e != nil && freed < excess; {
+		next := e.Next()
+		memTx := e.Value.(*mempoolTxVote)
+		freed += int64(memTx.tx.Size()) + memPerVote + int64(atomic.LoadInt32(&memTx.numSenders))*memPerSender +
+			int64(len(memTx.provenance))*memPerRelayHop
+		txVotePool.removeTx(memTx.tx, e, false)
+		n++
+		e = next
+	}
+	return n
+}
+
+// trim drops up to n of the oldest entries for which keep returns false, and
+// returns the number dropped.
+func (cache *mapTxCache) trim(n int, keep func(key [sha256.Size]byte) bool) int {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	var dropped int
+	for e := cache.list.Front(); e != nil && dropped < n; {
+		next := e.Next()
+		if key := e.Value.([sha256.Size]byte); !keep(key) {
+			delete(cache.map_, key)
+			cache.list.Remove(e)
+			dropped++
+		}
+		e = next
+	}
+	return dropped
+}
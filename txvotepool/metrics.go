@@ -24,6 +24,59 @@ type Metrics struct {
 	FailedTxs metrics.Counter
 	// Number of times transactions are rechecked in the mempool.
 	RecheckTimes metrics.Counter
+	// Histogram of the delay between a vote's timestamp and it being added
+	// to the pool, in seconds. Votes are deliberately not used as labels, to
+	// keep the cardinality bounded.
+	VoteLatency metrics.Histogram
+	// Number of votes rejected because the pool was under pressure.
+	ShedTxs metrics.Counter
+	// Number of votes dropped because they came from a blacklisted peer.
+	BlacklistedTxs metrics.Counter
+	// Number of votes dropped because they came from a peer scoring below
+	// the trust threshold, see ReactorPeerTrust.
+	UntrustedTxs metrics.Counter
+	// Number of votes turned down because their height was already committed.
+	CommittedHeightTxs metrics.Counter
+	// State of the pre check circuit breaker: 0 closed, 1 open, 2 half open.
+	CheckBreakerState metrics.Gauge
+	// Number of votes rejected without being checked while the pre check
+	// circuit breaker was open.
+	BreakerRejectedTxs metrics.Counter
+	// Number of messages received on a channel other than TxpoolChannel.
+	WrongChannelMsgs metrics.Counter
+	// Number of ExtensionMessages skipped because the type of the message
+	// they carry is unknown.
+	UnknownExtensions metrics.Counter
+	// Number of times a broadcast routine yielded after handling its max
+	// number of votes in a row.
+	BroadcastScanYields metrics.Counter
+	// Number of votes re-sent by a peer which already sent them, counted with
+	// WithPeerDuplicatePolicy.
+	PeerDuplicateTxs metrics.Counter
+	// Number of times a broadcast routine was woken by a vote while caught
+	// up.
+	BroadcastWakes metrics.Counter
+	// Number of goroutines broadcasting votes, see ReactorBroadcastWorkers.
+	BroadcastGoroutines metrics.Gauge
+	// Number of peers removed, by class of reason (see DisconnectReason).
+	PeerDisconnects metrics.Counter
+	// Number of entries in each bounded cache.
+	CacheEntries metrics.Gauge
+	// Approximate memory held by the pool, in bytes, see MemoryUsage.
+	MemoryBytes metrics.Gauge
+	// Seconds messages were held back in Receive because the pool couldn't
+	// keep up, see ReactorBackpressure.
+	BackpressureSeconds metrics.Counter
+	// Number of votes messages being sent to peers, see
+	// ReactorMaxConcurrentSends.
+	InflightSends metrics.Gauge
+	// Unix time at which each background loop last ran, see LoopStats.
+	LoopLastRun metrics.Gauge
+	// Histogram of how long the runs of each background loop took, in
+	// seconds.
+	LoopDuration metrics.Histogram
+	// Number of items processed by each background loop.
+	LoopProcessed metrics.Counter
 }
 
 // PrometheusMetrics returns Metrics build using Prometheus client library.
@@ -60,15 +113,164 @@ func PrometheusMetrics(namespace string, labelsAndValues ...string) *Metrics {
 			Name:      "recheck_times",
 			Help:      "Number of times transactions are rechecked in the mempool.",
 		}, labels).With(labelsAndValues...),
+		VoteLatency: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "vote_latency_seconds",
+			Help:      "Delay between a vote's timestamp and it being added to the pool, in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.001, 2, 16),
+		}, labels).With(labelsAndValues...),
+		ShedTxs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "shed_txs",
+			Help:      "Number of votes rejected because the pool was under pressure.",
+		}, labels).With(labelsAndValues...),
+		BlacklistedTxs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "blacklisted_txs",
+			Help:      "Number of votes dropped because they came from a blacklisted peer.",
+		}, labels).With(labelsAndValues...),
+		UntrustedTxs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "untrusted_txs",
+			Help:      "Number of votes dropped because they came from a peer below the trust threshold.",
+		}, labels).With(labelsAndValues...),
+		CommittedHeightTxs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "committed_height_txs",
+			Help:      "Number of votes turned down because their height was already committed.",
+		}, labels).With(labelsAndValues...),
+		CheckBreakerState: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "check_breaker_state",
+			Help:      "State of the pre check circuit breaker: 0 closed, 1 open, 2 half open.",
+		}, labels).With(labelsAndValues...),
+		BreakerRejectedTxs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "breaker_rejected_txs",
+			Help:      "Number of votes rejected unchecked while the pre check circuit breaker was open.",
+		}, labels).With(labelsAndValues...),
+		WrongChannelMsgs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "wrong_channel_msgs",
+			Help:      "Number of messages received on a channel other than the txpool channel.",
+		}, labels).With(labelsAndValues...),
+		UnknownExtensions: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "unknown_extension_msgs",
+			Help:      "Number of extension messages skipped because the type of the message they carry is unknown.",
+		}, labels).With(labelsAndValues...),
+		BroadcastScanYields: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "broadcast_scan_yields",
+			Help:      "Number of times a broadcast routine yielded after handling its max number of votes in a row.",
+		}, labels).With(labelsAndValues...),
+		PeerDuplicateTxs: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "peer_duplicate_txs",
+			Help:      "Number of votes re-sent by a peer which already sent them.",
+		}, labels).With(labelsAndValues...),
+		BroadcastWakes: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "broadcast_wakes",
+			Help:      "Number of times a broadcast routine was woken by a vote while caught up.",
+		}, labels).With(labelsAndValues...),
+		BroadcastGoroutines: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "broadcast_goroutines",
+			Help:      "Number of goroutines broadcasting votes.",
+		}, labels).With(labelsAndValues...),
+		PeerDisconnects: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "peer_disconnects",
+			Help:      "Number of peers removed, by class of reason.",
+		}, append(labels, "reason")).With(labelsAndValues...),
+		CacheEntries: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "cache_entries",
+			Help:      "Number of entries in each bounded cache.",
+		}, append(labels, "cache")).With(labelsAndValues...),
+		MemoryBytes: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "memory_bytes",
+			Help:      "Approximate memory held by the pool, in bytes.",
+		}, labels).With(labelsAndValues...),
+		BackpressureSeconds: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "backpressure_seconds",
+			Help:      "Seconds messages were held back because the pool couldn't keep up.",
+		}, labels).With(labelsAndValues...),
+		InflightSends: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "inflight_sends",
+			Help:      "Number of votes messages being sent to peers.",
+		}, labels).With(labelsAndValues...),
+		LoopLastRun: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "loop_last_run",
+			Help:      "Unix time at which each background loop last ran.",
+		}, append(labels, "loop")).With(labelsAndValues...),
+		LoopDuration: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "loop_duration_seconds",
+			Help:      "How long the runs of each background loop took, in seconds.",
+			Buckets:   stdprometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, append(labels, "loop")).With(labelsAndValues...),
+		LoopProcessed: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "loop_processed",
+			Help:      "Number of items processed by each background loop.",
+		}, append(labels, "loop")).With(labelsAndValues...),
 	}
 }
 
 // NopMetrics returns no-op Metrics.
 func NopMetrics() *Metrics {
 	return &Metrics{
-		Size:         discard.NewGauge(),
-		TxSizeBytes:  discard.NewHistogram(),
-		FailedTxs:    discard.NewCounter(),
-		RecheckTimes: discard.NewCounter(),
+		Size:                discard.NewGauge(),
+		TxSizeBytes:         discard.NewHistogram(),
+		FailedTxs:           discard.NewCounter(),
+		RecheckTimes:        discard.NewCounter(),
+		VoteLatency:         discard.NewHistogram(),
+		ShedTxs:             discard.NewCounter(),
+		BlacklistedTxs:      discard.NewCounter(),
+		UntrustedTxs:        discard.NewCounter(),
+		CommittedHeightTxs:  discard.NewCounter(),
+		CheckBreakerState:   discard.NewGauge(),
+		BreakerRejectedTxs:  discard.NewCounter(),
+		WrongChannelMsgs:    discard.NewCounter(),
+		UnknownExtensions:   discard.NewCounter(),
+		BroadcastScanYields: discard.NewCounter(),
+		PeerDuplicateTxs:    discard.NewCounter(),
+		BroadcastWakes:      discard.NewCounter(),
+		BroadcastGoroutines: discard.NewGauge(),
+		PeerDisconnects:     discard.NewCounter(),
+		CacheEntries:        discard.NewGauge(),
+		MemoryBytes:         discard.NewGauge(),
+		BackpressureSeconds: discard.NewCounter(),
+		InflightSends:       discard.NewGauge(),
+		LoopLastRun:         discard.NewGauge(),
+		LoopDuration:        discard.NewHistogram(),
+		LoopProcessed:       discard.NewCounter(),
 	}
 }
@@ -0,0 +1,88 @@
+package txvotepool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// PoolExportVersion is the version of the format Export writes. It is bumped
+// whenever the encoding of the exported votes changes.
+const PoolExportVersion uint32 = 1
+
+// exportHeader starts the streams written by Export.
+type exportHeader struct {
+	Version uint32
+}
+
+// Migration turns a record exported by a release writing format version
+// into a vote of the current format, see Import.
+type Migration func(version uint32, record []byte) (types.TxVote, error)
+
+// Export writes the pending votes to w like ExportTo, after a header holding
+// the version of the format, PoolExportVersion. This lets a release with a
+// different format import them, see Import.
+func (txVotePool *TxVotePool) Export(w io.Writer) error {
+	if _, err := cdc.MarshalBinaryLengthPrefixedWriter(w, exportHeader{Version: PoolExportVersion}); err != nil {
+		return err
+	}
+	return txVotePool.ExportTo(w)
+}
+
+// Import adds the votes written by Export to the pool, as ImportFrom does.
+// Votes exported with an older format version are turned into current ones
+// by migrate, those it fails to migrate are skipped. It returns an error if
+// r can't be read or decoded, if the votes were exported with a newer format,
+// or with an older one and migrate is nil.
+func (txVotePool *TxVotePool) Import(r io.Reader, migrate Migration) error {
+	var header exportHeader
+	if _, err := cdc.UnmarshalBinaryLengthPrefixedReader(r, &header, maxMsgSize); err != nil {
+		return errors.Wrap(err, "failed to decode export header")
+	}
+	switch {
+	case header.Version == PoolExportVersion:
+		return txVotePool.ImportFrom(r)
+	case header.Version > PoolExportVersion:
+		return errors.Errorf("exported with format version %d, newer than %d", header.Version, PoolExportVersion)
+	case migrate == nil:
+		return errors.Errorf("exported with format version %d, no migration to %d", header.Version, PoolExportVersion)
+	}
+
+	br := bufio.NewReader(r)
+	var imported, skipped int
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to decode record length")
+		}
+		if size > maxMsgSize {
+			return errors.Errorf("record of %d bytes, max is %d", size, maxMsgSize)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(br, record); err != nil {
+			return errors.Wrap(err, "failed to read record")
+		}
+		tx, err := migrate(header.Version, record)
+		if err != nil {
+			txVotePool.logger.Error("Failed to migrate vote", "version", header.Version, "err", err)
+			skipped++
+			continue
+		}
+		if err := txVotePool.CheckTx(tx); err != nil {
+			txVotePool.logger.Debug("Skipped imported vote", "event", TxVoteID(tx), "err", err)
+			skipped++
+			continue
+		}
+		imported++
+	}
+	txVotePool.logger.Info("Imported and migrated votes", "version", header.Version,
+		"imported", imported, "skipped", skipped)
+	return nil
+}
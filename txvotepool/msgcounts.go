@@ -0,0 +1,43 @@
+package txvotepool
+
+import (
+	"reflect"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// PeerMessageCounts returns the number of messages of each type, eg.
+// "TxMessage", received from each connected peer so far. Messages within
+// bundles are counted along with the bundles. It helps spotting peers sending
+// unexpected messages.
+func (txR *TxpoolReactor) PeerMessageCounts() map[p2p.ID]map[string]int64 {
+	txR.msgCountsMtx.Lock()
+	defer txR.msgCountsMtx.Unlock()
+
+	counts := make(map[p2p.ID]map[string]int64, len(txR.msgCounts))
+	for id, byType := range txR.msgCounts {
+		counts[id] = make(map[string]int64, len(byType))
+		for msgType, n := range byType {
+			counts[id][msgType] = n
+		}
+	}
+	return counts
+}
+
+// countMsg counts a message received from the peer.
+func (txR *TxpoolReactor) countMsg(src p2p.Peer, msg TxpoolMessage) {
+	t := reflect.TypeOf(msg)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	txR.msgCountsMtx.Lock()
+	defer txR.msgCountsMtx.Unlock()
+
+	byType, ok := txR.msgCounts[src.ID()]
+	if !ok {
+		byType = make(map[string]int64)
+		txR.msgCounts[src.ID()] = byType
+	}
+	byType[t.Name()]++
+}
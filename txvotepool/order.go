@@ -0,0 +1,167 @@
+package txvotepool
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+var (
+	// ErrTxVoteOutOfOrder is returned by CheckTx, with WithStrictSignerOrder,
+	// for a vote cast at a height below the last one of its signer in the
+	// pool, or skipping heights when it can't be buffered.
+	ErrTxVoteOutOfOrder = errors.New("TxVote out of order for its signer")
+
+	// ErrTxVoteBuffered is returned by CheckTx, with WithStrictSignerOrder,
+	// for a vote skipping heights of its signer. It is checked again once
+	// the votes of the heights in between are added.
+	ErrTxVoteBuffered = errors.New("TxVote buffered until its signer's previous heights")
+)
+
+// WithStrictSignerOrder only adds the votes of each signer in order of
+// height: once a signer has a vote at height h in the pool, its votes are
+// accepted at h or h+1 only. Votes further ahead are buffered, up to
+// bufferSize per signer, and checked again once the heights in between are
+// filled, by votes added or committed. Once a vote has been buffered for
+// maxWait the heights missing before the lowest buffered one are given up on,
+// and the signer carries on from there. Votes behind, or which can't be
+// buffered, are rejected with ErrTxVoteOutOfOrder. Disabled by default.
+func WithStrictSignerOrder(bufferSize int, maxWait time.Duration) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		txVotePool.orderBufferSize = bufferSize
+		txVotePool.orderMaxWait = maxWait
+		txVotePool.signerOrders = make(map[string]*signerOrder)
+	}
+}
+
+// signerOrder is the last height of the votes of a signer added to the pool,
+// and the votes buffered until the heights up to theirs are.
+type signerOrder struct {
+	last     int64
+	buffered []bufferedVote
+}
+
+// bufferedVote is a vote skipping heights of its signer, with the info it
+// was checked with so it can be checked again as if just received.
+type bufferedVote struct {
+	tx   types.TxVote
+	info TxVoteInfo
+	at   time.Time
+}
+
+// checkOrder returns nil if the vote follows the last one of its signer in
+// the pool, and buffers it if it skips heights.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) checkOrder(tx types.TxVote, txInfo TxVoteInfo) error {
+	if txVotePool.signerOrders == nil {
+		return nil
+	}
+	so, ok := txVotePool.signerOrders[string(tx.ValidatorAddress)]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	txVotePool.skipExpiredGap(so, now)
+	switch {
+	case tx.Height == so.last, tx.Height == so.last+1:
+		return nil
+	case tx.Height < so.last:
+		return ErrTxVoteOutOfOrder
+	}
+
+	key := txVoteKey(tx)
+	for _, v := range so.buffered {
+		if txVoteKey(v.tx) == key {
+			return ErrTxVoteBuffered
+		}
+	}
+	if len(so.buffered) >= txVotePool.orderBufferSize {
+		txVotePool.metrics.reportCacheEntries(cacheOrderBuffered, txVotePool.orderBuffered)
+		return ErrTxVoteOutOfOrder
+	}
+	so.buffered = append(so.buffered, bufferedVote{tx: tx, info: txInfo, at: now})
+	txVotePool.orderBuffered++
+	txVotePool.metrics.reportCacheEntries(cacheOrderBuffered, txVotePool.orderBuffered)
+	return ErrTxVoteBuffered
+}
+
+// advanceOrder records the vote was added to the pool, or committed, and
+// releases the buffered votes of its signer which now follow the last one,
+// to be checked by checkReleased.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) advanceOrder(tx types.TxVote) {
+	if txVotePool.signerOrders == nil {
+		return
+	}
+	signer := string(tx.ValidatorAddress)
+	so, ok := txVotePool.signerOrders[signer]
+	if !ok {
+		so = &signerOrder{last: tx.Height}
+		txVotePool.signerOrders[signer] = so
+	}
+	if tx.Height > so.last {
+		so.last = tx.Height
+	}
+	txVotePool.releaseBuffered(so)
+	txVotePool.skipExpiredGap(so, time.Now())
+}
+
+// skipExpiredGap gives up on the heights missing before the buffered votes
+// of the signer once one of them has waited for orderMaxWait: the last
+// height moves to just below the lowest buffered one, whose votes are
+// released.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) skipExpiredGap(so *signerOrder, now time.Time) {
+	expired := false
+	lowest := int64(math.MaxInt64)
+	for _, v := range so.buffered {
+		if now.Sub(v.at) > txVotePool.orderMaxWait {
+			expired = true
+		}
+		if v.tx.Height < lowest {
+			lowest = v.tx.Height
+		}
+	}
+	if !expired {
+		return
+	}
+	if lowest-1 > so.last {
+		so.last = lowest - 1
+	}
+	txVotePool.releaseBuffered(so)
+}
+
+// releaseBuffered releases the buffered votes of the signer which follow its
+// last height, to be checked by checkReleased.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) releaseBuffered(so *signerOrder) {
+	kept := so.buffered[:0]
+	for _, v := range so.buffered {
+		if v.tx.Height <= so.last+1 {
+			txVotePool.released = append(txVotePool.released, v)
+			txVotePool.orderBuffered--
+			continue
+		}
+		kept = append(kept, v)
+	}
+	so.buffered = kept
+	txVotePool.metrics.reportCacheEntries(cacheOrderBuffered, txVotePool.orderBuffered)
+}
+
+// checkReleased checks the votes released by advanceOrder into the pool.
+// NOTE: the pool must not be locked.
+func (txVotePool *TxVotePool) checkReleased() {
+	txVotePool.proxyMtx.Lock()
+	votes := txVotePool.released
+	txVotePool.released = nil
+	txVotePool.proxyMtx.Unlock()
+
+	for _, v := range votes {
+		if err := txVotePool.CheckTxWithInfo(v.tx, v.info); err != nil {
+			txVotePool.logger.Info("Could not check released vote", "event", TxVoteID(v.tx), "err", err)
+		}
+	}
+}
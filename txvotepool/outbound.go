@@ -0,0 +1,250 @@
+package txvotepool
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorCoalesceOutbound makes the reactor queue the votes it sends one at a
+// time and the acks for each peer, and send them together in a BundleMessage
+// once maxMsgs are queued or flushInterval elapsed since the first one. The
+// receiver handles each message of a bundle as if it was sent on its own, so
+// maxMsgs must not exceed the max number of elements the peers accept, see
+// ReactorMaxMsgElements. Messages are sent on their own by default.
+func ReactorCoalesceOutbound(maxMsgs int, flushInterval time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.outboundMaxMsgs = maxMsgs
+		txR.outboundFlushInterval = flushInterval
+	}
+}
+
+// outboundMsg is an encoded message queued for a peer, the vote it carries,
+// nil for an ack, and the number of times it failed to be sent.
+type outboundMsg struct {
+	bz       []byte
+	memTx    *mempoolTxVote
+	attempts int
+}
+
+// outbox holds the messages queued for a peer. It is flushed by the goroutine
+// filling it up, or by its timer. Flushed messages are sent outside of the
+// lock, in order, by a single goroutine at a time.
+type outbox struct {
+	peer p2p.Peer
+
+	mtx     sync.Mutex
+	msgs    []outboundMsg
+	size    int             // encoded size of msgs
+	timer   *time.Timer     // running while msgs is not empty
+	ready   [][]outboundMsg // flushed bundles left to send
+	sending bool            // a goroutine is sending the ready bundles
+	removed bool            // the peer was removed, see removeOutbox
+}
+
+// coalescesOutbound returns true if messages are queued, see
+// ReactorCoalesceOutbound.
+func (txR *TxpoolReactor) coalescesOutbound() bool {
+	return txR.outboundMaxMsgs > 1
+}
+
+// outboxFor returns the outbox of the peer, creating it if needed.
+func (txR *TxpoolReactor) outboxFor(peer p2p.Peer) *outbox {
+	txR.outboxesMtx.Lock()
+	defer txR.outboxesMtx.Unlock()
+	box, ok := txR.outboxes[peer.ID()]
+	if !ok || box.peer != peer {
+		box = &outbox{peer: peer}
+		txR.outboxes[peer.ID()] = box
+	}
+	return box
+}
+
+// removeOutbox drops the messages queued for the peer.
+func (txR *TxpoolReactor) removeOutbox(peer p2p.Peer) {
+	txR.outboxesMtx.Lock()
+	box, ok := txR.outboxes[peer.ID()]
+	if ok && box.peer == peer {
+		delete(txR.outboxes, peer.ID())
+	}
+	txR.outboxesMtx.Unlock()
+	if ok && box.peer == peer {
+		box.mtx.Lock()
+		box.take()
+		box.ready = nil
+		box.removed = true
+		box.mtx.Unlock()
+	}
+}
+
+// queueOutbound queues the encoded message for the peer, flushing the outbox
+// if it is full. memTx is the vote msgBytes carries, nil if none.
+func (txR *TxpoolReactor) queueOutbound(peer p2p.Peer, msgBytes []byte, memTx *mempoolTxVote) {
+	box := txR.outboxFor(peer)
+	box.mtx.Lock()
+	send := false
+	if len(box.msgs) > 0 && box.size+len(msgBytes) > maxMsgSize-bundleOverhead {
+		// the bundle would be too large to be decoded
+		send = box.flushLocked()
+	}
+	txR.appendOutboundLocked(box, outboundMsg{bz: msgBytes, memTx: memTx})
+	if len(box.msgs) >= txR.outboundMaxMsgs {
+		send = box.flushLocked() || send
+	}
+	box.mtx.Unlock()
+	if send {
+		txR.sendReady(box)
+	}
+}
+
+// appendOutboundLocked appends the messages to the outbox, starting its timer
+// if it was empty.
+// NOTE: the outbox must be locked.
+func (txR *TxpoolReactor) appendOutboundLocked(box *outbox, msgs ...outboundMsg) {
+	if len(box.msgs) == 0 {
+		box.timer = time.AfterFunc(txR.outboundFlushInterval, func() { txR.flushOutbox(box) })
+	}
+	for _, msg := range msgs {
+		box.msgs = append(box.msgs, msg)
+		box.size += len(msg.bz)
+	}
+}
+
+// take empties the outbox and returns its messages.
+// NOTE: the outbox must be locked.
+func (box *outbox) take() []outboundMsg {
+	if box.timer != nil {
+		box.timer.Stop()
+		box.timer = nil
+	}
+	msgs := box.msgs
+	box.msgs = nil
+	box.size = 0
+	return msgs
+}
+
+// flushLocked moves the queued messages to the bundles ready to be sent. It
+// returns true if the caller is to send them, with sendReady, false if
+// another goroutine is already sending.
+// NOTE: the outbox must be locked.
+func (box *outbox) flushLocked() bool {
+	if msgs := box.take(); len(msgs) > 0 {
+		box.ready = append(box.ready, msgs)
+	}
+	if box.sending || len(box.ready) == 0 {
+		return false
+	}
+	box.sending = true
+	return true
+}
+
+// flushOutbox sends the queued messages to the peer.
+func (txR *TxpoolReactor) flushOutbox(box *outbox) {
+	box.mtx.Lock()
+	send := box.flushLocked()
+	box.mtx.Unlock()
+	if send {
+		txR.sendReady(box)
+	}
+}
+
+// sendReady sends the ready bundles of the outbox, in order, until there are
+// none left. The votes of a bundle the peer can't take are queued again, on
+// their own if messages were queued meanwhile so the bundle stays within
+// bounds.
+func (txR *TxpoolReactor) sendReady(box *outbox) {
+	for {
+		box.mtx.Lock()
+		if len(box.ready) == 0 {
+			box.sending = false
+			box.mtx.Unlock()
+			return
+		}
+		msgs := box.ready[0]
+		box.ready = box.ready[1:]
+		box.mtx.Unlock()
+
+		retry := txR.sendBundle(box.peer, msgs)
+		if len(retry) == 0 {
+			continue
+		}
+		box.mtx.Lock()
+		switch {
+		case box.removed || !box.peer.IsRunning():
+		case len(box.msgs) == 0:
+			txR.appendOutboundLocked(box, retry...)
+		default:
+			box.ready = append(box.ready, retry)
+		}
+		box.mtx.Unlock()
+	}
+}
+
+// sendBundle sends the messages to the peer, in a single BundleMessage if
+// there are several. Once sent, the votes are marked as held by the peer. If
+// the peer can't take the bundle, the acks are dropped, and the votes
+// returned to be sent again, unless they failed too many times, see
+// ReactorMaxSendAttempts, in which case they are dead lettered.
+func (txR *TxpoolReactor) sendBundle(peer p2p.Peer, msgs []outboundMsg) (retry []outboundMsg) {
+	msgBytes := msgs[0].bz
+	if len(msgs) > 1 {
+		parts := make([][]byte, len(msgs))
+		for i, msg := range msgs {
+			parts[i] = msg.bz
+		}
+		msgBytes = encodeBundleMessage(parts)
+	}
+
+	var votes []*mempoolTxVote
+	for _, msg := range msgs {
+		if msg.memTx != nil {
+			votes = append(votes, msg.memTx)
+		}
+	}
+	if !txR.sendVotes(peer, msgBytes, votes...) {
+		for _, msg := range msgs {
+			if msg.memTx == nil {
+				continue
+			}
+			msg.attempts++
+			if txR.maxSendAttempts <= 0 || msg.attempts < txR.maxSendAttempts {
+				retry = append(retry, msg)
+				continue
+			}
+			msg.memTx.releaseFanout(txR.broadcastFanout)
+			txR.deadLetter(peer, "bundle send failed", msg.attempts, msg.memTx.tx)
+		}
+		return retry
+	}
+	if len(votes) == 0 {
+		return nil
+	}
+	peerID := txR.ids.GetForPeer(peer)
+	for _, memTx := range votes {
+		memTx.addSender(peerID)
+	}
+	atomic.StoreInt64(&txR.lastSend, time.Now().UnixNano())
+	for _, memTx := range votes {
+		txR.checkHeightBroadcast(memTx)
+	}
+	return nil
+}
+
+// receiveBundle handles each message of the bundle as if it was received on
+// its own.
+func (txR *TxpoolReactor) receiveBundle(src p2p.Peer, msg *BundleMessage) {
+	for _, bz := range msg.Msgs {
+		if !src.IsRunning() {
+			// stopped for one of the previous messages
+			return
+		}
+		txR.receiveMsg(src, bz, true)
+	}
+}
+
+// bundleOverhead bounds the bytes a BundleMessage adds to the messages it
+// carries: its prefix, and the key and length of each of them, up to
+// maxMsgElements.
+const bundleOverhead = 4 + defaultMaxMsgElements*(1+4)
@@ -0,0 +1,219 @@
+package txvotepool
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestCoalesceOutboundBundlesVotesAndAcks(t *testing.T) {
+	txR := newTestReactor(t, ReactorAcks(), ReactorCoalesceOutbound(4, time.Hour))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	// 4 acks for the votes received from the peer,
+	validator := newTestValidator()
+	received := make([]types.TxVote, 4)
+	for i := range received {
+		received[i] = newTestVote(1, validator)
+		sendMsg(txR, peer, &TxMessage{Tx: received[i]})
+	}
+	// and 4 votes sent to it.
+	sent := make([]types.TxVote, 4)
+	for i := range sent {
+		sent[i] = newTestVote(1, validator)
+		require.NoError(t, txR.Txpool.CheckTx(sent[i]))
+	}
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 2 }, "messages not flushed")
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, peer.Sent(), 2, "8 messages should take 2 sends")
+
+	var acks, votes int
+	for _, msg := range peer.Sent() {
+		bundle, ok := msg.(*BundleMessage)
+		require.True(t, ok, "unexpected %T", msg)
+		require.Len(t, bundle.Msgs, 4)
+		for _, bz := range bundle.Msgs {
+			inner, err := decodeMsg(bz)
+			require.NoError(t, err)
+			switch inner.(type) {
+			case *AckMessage:
+				acks++
+			case *TxMessage:
+				votes++
+			default:
+				t.Fatalf("unexpected bundled %T", inner)
+			}
+		}
+	}
+	assert.Equal(t, 4, acks)
+	assert.Equal(t, 4, votes)
+
+	// The votes are marked as sent once their bundle is.
+	peerID := txR.ids.GetForPeer(peer)
+	for _, vote := range sent {
+		memTx, ok := txR.Txpool.memTxByID(vote.Signature)
+		require.True(t, ok)
+		_, ok = memTx.senders.Load(peerID)
+		assert.True(t, ok)
+	}
+
+	// The receiver handles each bundled message as if sent on its own.
+	other := newTestReactor(t)
+	defer other.Stop()
+	src := newTestPeer("src")
+	other.AddPeer(src)
+	for _, msg := range peer.Sent() {
+		sendMsg(other, src, msg)
+	}
+	for _, vote := range sent {
+		_, ok := other.Txpool.GetVote(vote.Signature)
+		assert.True(t, ok)
+	}
+}
+
+func TestCoalesceOutboundFlushesAfterInterval(t *testing.T) {
+	txR := newTestReactor(t, ReactorCoalesceOutbound(100, 20*time.Millisecond))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	// A single message is sent on its own.
+	waitFor(t, time.Second, func() bool { return sentVote(peer, vote) }, "vote not flushed")
+}
+
+func TestNestedBundleStopsPeer(t *testing.T) {
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	inner := cdc.MustMarshalBinaryBare(&BundleMessage{})
+	sendMsg(txR, peer, &BundleMessage{Msgs: [][]byte{inner}})
+	assert.False(t, peer.IsRunning())
+}
+
+func TestCoalesceOutboundRetriesFailedBundle(t *testing.T) {
+	txR := newTestReactor(t, ReactorCoalesceOutbound(2, 20*time.Millisecond), ReactorMaxSendAttempts(3))
+	defer txR.Stop()
+
+	// The first send is refused, the next ones go through.
+	var refused int32
+	peer := &refusingPeer{
+		testPeer: newTestPeer("peer"),
+		refuse: func(TxpoolMessage) bool {
+			return atomic.CompareAndSwapInt32(&refused, 0, 1)
+		},
+	}
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	votes := []types.TxVote{newTestVote(1, validator), newTestVote(1, validator)}
+	for _, vote := range votes {
+		require.NoError(t, txR.Txpool.CheckTx(vote))
+	}
+	waitFor(t, time.Second, func() bool { return len(bundledVotes(t, peer.testPeer)) == 2 },
+		"votes not sent again")
+	for _, vote := range votes {
+		memTx, ok := txR.Txpool.memTxByID(vote.Signature)
+		require.True(t, ok)
+		assert.True(t, memTx.hasSender(txR.ids.GetForPeer(peer)))
+	}
+	assert.Empty(t, txR.DeadLetters())
+}
+
+func TestCoalesceOutboundDeadLettersAfterMaxAttempts(t *testing.T) {
+	txR := newTestReactor(t, ReactorCoalesceOutbound(2, 10*time.Millisecond), ReactorMaxSendAttempts(3))
+	defer txR.Stop()
+
+	var attempts int32
+	peer := &refusingPeer{
+		testPeer: newTestPeer("peer"),
+		refuse: func(TxpoolMessage) bool {
+			atomic.AddInt32(&attempts, 1)
+			return true
+		},
+	}
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	waitFor(t, time.Second, func() bool { return len(txR.DeadLetters()) == 1 }, "vote not dead lettered")
+	deadLetters := txR.DeadLetters()
+	assert.Equal(t, vote, deadLetters[0].Tx)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+}
+
+func TestCoalesceOutboundQueuesWhileSending(t *testing.T) {
+	txR := newTestReactor(t, ReactorCoalesceOutbound(2, time.Hour))
+	defer txR.Stop()
+
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	peer := &refusingPeer{
+		testPeer: newTestPeer("peer"),
+		refuse: func(TxpoolMessage) bool {
+			entered <- struct{}{}
+			<-release
+			return false
+		},
+	}
+	ack := cdc.MustMarshalBinaryBare(&AckMessage{})
+	go func() {
+		txR.queueOutbound(peer, ack, nil)
+		txR.queueOutbound(peer, ack, nil)
+	}()
+	<-entered
+
+	// Messages are queued while the full outbox is sent.
+	queued := make(chan struct{})
+	go func() {
+		txR.queueOutbound(peer, ack, nil)
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("queueing blocked by the send in progress")
+	}
+	close(release)
+}
+
+// bundledVotes returns the votes sent to the peer so far, on their own or in
+// bundles.
+func bundledVotes(t *testing.T, peer *testPeer) []types.TxVote {
+	var votes []types.TxVote
+	for _, msg := range peer.Sent() {
+		msgs := []TxpoolMessage{msg}
+		if bundle, ok := msg.(*BundleMessage); ok {
+			msgs = msgs[:0]
+			for _, bz := range bundle.Msgs {
+				inner, err := decodeMsg(bz)
+				require.NoError(t, err)
+				msgs = append(msgs, inner)
+			}
+		}
+		for _, m := range msgs {
+			if txMsg, ok := m.(*TxMessage); ok {
+				votes = append(votes, txMsg.Tx)
+			}
+		}
+	}
+	return votes
+}
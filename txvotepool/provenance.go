@@ -0,0 +1,81 @@
+package txvotepool
+
+import (
+	"time"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// RelayHop is a node a vote went through, and when it got there.
+type RelayHop struct {
+	NodeID     p2p.ID
+	ReceivedAt time.Time
+}
+
+// maxRelayHops bounds the nodes recorded with a vote. Longer records are
+// dropped.
+const maxRelayHops = 32
+
+// ReactorRelayProvenance records, along with the votes received in signed
+// envelopes, the nodes they went through and when, and passes the record on
+// in the envelopes of the votes relayed, so that the path of a vote across
+// nodes can be traced with Provenance. The votes themselves are left as is.
+// Only applies with ReactorSignEnvelopes, as the record is signed along with
+// the envelope. Only the last hop is authenticated though: the record is
+// signed as a whole by the node relaying the vote, so any node on the path
+// can rewrite the hops before it. Records of over 32 hops are dropped.
+// Nothing is recorded by default.
+func ReactorRelayProvenance() ReactorOption {
+	return func(txR *TxpoolReactor) { txR.relayProvenance = true }
+}
+
+// recordsProvenance returns true if the reactor records provenance, which
+// needs a key to sign envelopes with.
+func (txR *TxpoolReactor) recordsProvenance() bool {
+	return txR.relayProvenance && txR.privKey != nil
+}
+
+// nodeID returns the ID of the node, as derived from the key signing
+// envelopes.
+func (txR *TxpoolReactor) nodeID() p2p.ID {
+	return p2p.PubKeyToID(txR.privKey.PubKey())
+}
+
+// inboundProvenance returns the nodes the vote of the envelope went through,
+// this one included, nil if provenance isn't recorded.
+func (txR *TxpoolReactor) inboundProvenance(msg *SignedTxMessage) []RelayHop {
+	if !txR.recordsProvenance() {
+		return nil
+	}
+	if len(msg.Provenance) >= maxRelayHops {
+		txR.Logger.Debug("Dropping over-long provenance", "tx", TxVoteID(msg.Tx), "hops", len(msg.Provenance))
+		return nil
+	}
+	provenance := make([]RelayHop, len(msg.Provenance), len(msg.Provenance)+1)
+	copy(provenance, msg.Provenance)
+	return append(provenance, RelayHop{NodeID: txR.nodeID(), ReceivedAt: time.Now().UTC()})
+}
+
+// outboundProvenance returns the nodes the vote went through, to be passed on
+// with it. Votes which didn't come in a signed envelope start from this node.
+func (txR *TxpoolReactor) outboundProvenance(memTx *mempoolTxVote) []RelayHop {
+	if !txR.recordsProvenance() {
+		return nil
+	}
+	if len(memTx.provenance) > 0 {
+		return memTx.provenance
+	}
+	return []RelayHop{{NodeID: txR.nodeID(), ReceivedAt: memTx.timestamp.UTC()}}
+}
+
+// Provenance returns the nodes the vote with the given ID (see TxVoteID) went
+// through to get to the pool, see ReactorRelayProvenance, and false if the
+// pool doesn't hold it. It returns no nodes for votes which weren't relayed
+// in a signed envelope.
+func (txVotePool *TxVotePool) Provenance(id []byte) ([]RelayHop, bool) {
+	memTx, ok := txVotePool.memTxByID(id)
+	if !ok {
+		return nil, false
+	}
+	return append([]RelayHop(nil), memTx.provenance...), true
+}
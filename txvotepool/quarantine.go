@@ -0,0 +1,110 @@
+package txvotepool
+
+import (
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+var (
+	// ErrTxVoteQuarantined is returned by CheckTx when the vote failed the soft
+	// check and was quarantined.
+	ErrTxVoteQuarantined = errors.New("TxVote quarantined")
+
+	// ErrQuarantineFull is returned by CheckTx when the vote failed the soft
+	// check, but the quarantine can't hold any more votes.
+	ErrQuarantineFull = errors.New("Quarantine is full")
+)
+
+// SoftCheckFunc is a check votes which may become valid later fail, eg.
+// votes signed by a validator unknown yet. It must be safe for concurrent
+// use.
+type SoftCheckFunc func(types.TxVote) error
+
+// quarantinedVote is a vote held in quarantine, with the info it was checked
+// with so it can be added to the pool as if just received.
+type quarantinedVote struct {
+	tx   types.TxVote
+	info TxVoteInfo
+}
+
+// WithQuarantine holds up to size votes failing check in quarantine instead
+// of rejecting them. Call ReevaluateQuarantine once they may pass, eg. after
+// a validator set update. Disabled by default.
+func WithQuarantine(check SoftCheckFunc, size int) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		txVotePool.softCheck = check
+		txVotePool.quarantineCap = size
+		txVotePool.quarantine = make(map[[sha256.Size]byte]quarantinedVote)
+	}
+}
+
+// quarantineIfSuspicious runs the soft check on tx, and quarantines it if it
+// fails. It returns nil if the vote passed.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) quarantineIfSuspicious(tx types.TxVote, txInfo TxVoteInfo) error {
+	if txVotePool.softCheck == nil {
+		return nil
+	}
+	err := txVotePool.softCheck(tx)
+	if err == nil {
+		return nil
+	}
+
+	key := txVoteKey(tx)
+	if _, ok := txVotePool.quarantine[key]; ok {
+		return ErrTxVoteQuarantined
+	}
+	if len(txVotePool.quarantine) >= txVotePool.quarantineCap {
+		return ErrQuarantineFull
+	}
+	txVotePool.quarantine[key] = quarantinedVote{tx: tx, info: txInfo}
+	txVotePool.quarantineOrder = append(txVotePool.quarantineOrder, key)
+	txVotePool.metrics.reportCacheEntries(cacheQuarantine, len(txVotePool.quarantine))
+	txVotePool.logger.Info("Quarantined vote", "event", TxVoteID(tx), "err", err)
+	return ErrTxVoteQuarantined
+}
+
+// QuarantineSize returns the number of votes held in quarantine.
+func (txVotePool *TxVotePool) QuarantineSize() int {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	return len(txVotePool.quarantine)
+}
+
+// ReevaluateQuarantine runs the soft check again on the quarantined votes.
+// Those passing it are checked into the pool, in the order they were
+// quarantined, the others are dropped. It returns the number of votes added
+// to the pool.
+func (txVotePool *TxVotePool) ReevaluateQuarantine() int {
+	txVotePool.proxyMtx.Lock()
+	votes := make([]quarantinedVote, 0, len(txVotePool.quarantineOrder))
+	for _, key := range txVotePool.quarantineOrder {
+		votes = append(votes, txVotePool.quarantine[key])
+	}
+	if txVotePool.quarantine != nil {
+		txVotePool.quarantine = make(map[[sha256.Size]byte]quarantinedVote)
+	}
+	txVotePool.quarantineOrder = nil
+	txVotePool.metrics.reportCacheEntries(cacheQuarantine, 0)
+	txVotePool.proxyMtx.Unlock()
+
+	var promoted, dropped int
+	for _, v := range votes {
+		if err := txVotePool.softCheck(v.tx); err != nil {
+			dropped++
+			continue
+		}
+		if err := txVotePool.CheckTxWithInfo(v.tx, v.info); err != nil {
+			txVotePool.logger.Info("Could not promote quarantined vote", "event", TxVoteID(v.tx), "err", err)
+			continue
+		}
+		promoted++
+	}
+	if len(votes) > 0 {
+		txVotePool.logger.Info("Reevaluated quarantine", "promoted", promoted, "dropped", dropped)
+	}
+	return promoted
+}
@@ -0,0 +1,527 @@
+package txvotepool
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestReadyAtHeightCountsDistinctSigners(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	val1, val2, val3 := newTestValidator(), newTestValidator(), newTestValidator()
+	// val1 signs several votes at height 2, which must only count once.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(2, val1)))
+	}
+	require.NoError(t, txVotePool.CheckTx(newTestVote(2, val2)))
+	require.NoError(t, txVotePool.CheckTx(newTestVote(3, val3)))
+
+	assert.True(t, txVotePool.ReadyAtHeight(2, 1))
+	assert.True(t, txVotePool.ReadyAtHeight(2, 2))
+	assert.False(t, txVotePool.ReadyAtHeight(2, 3))
+	assert.True(t, txVotePool.ReadyAtHeight(3, 1))
+	assert.False(t, txVotePool.ReadyAtHeight(3, 2))
+	assert.False(t, txVotePool.ReadyAtHeight(4, 1))
+	assert.True(t, txVotePool.ReadyAtHeight(4, 0))
+}
+
+func TestRequeueReapedVote(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txVotePool.CheckTx(vote))
+
+	reaped := txVotePool.ReapMaxTxs(-1)
+	require.Len(t, reaped, 1)
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(1, reaped))
+	txVotePool.Unlock()
+	require.Zero(t, txVotePool.Size())
+
+	// Processing failed downstream, put the vote back.
+	require.NoError(t, txVotePool.Requeue(vote))
+	assert.Equal(t, 1, txVotePool.Size())
+	assert.True(t, txVotePool.TxsFront().Value.(*mempoolTxVote).requeued)
+
+	// Requeueing a vote still in the pool doesn't add it twice.
+	require.NoError(t, txVotePool.Requeue(vote))
+	assert.Equal(t, 1, txVotePool.Size())
+
+	assert.Equal(t, []types.TxVote{vote}, txVotePool.ReapMaxTxs(-1))
+
+	txVotePool.Stop()
+	assert.Equal(t, ErrPoolStopped, txVotePool.Requeue(newTestVote(1, newTestValidator())))
+}
+
+func TestRequeuedVoteBroadcastAgain(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	txR.AddPeer(peer)
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txR.Txpool.CheckTx(vote))
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 }, "vote not broadcast")
+	reaped := txR.Txpool.ReapMaxTxs(-1)
+	txR.Txpool.Lock()
+	require.NoError(t, txR.Txpool.Update(1, reaped))
+	txR.Txpool.Unlock()
+
+	// The routine waiting past the reaped vote picks up the requeued one.
+	require.NoError(t, txR.Txpool.Requeue(vote))
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 2 }, "requeued vote not broadcast")
+	assert.True(t, sentVote(peer, vote))
+}
+
+func TestSnapshotDoesNotAliasPool(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	validator := newTestValidator()
+	votes := []types.TxVote{newTestVote(1, validator), newTestVote(1, validator), newTestVote(2, validator)}
+	for _, vote := range votes {
+		require.NoError(t, txVotePool.CheckTx(vote))
+	}
+
+	snapshot := txVotePool.Snapshot()
+	require.Equal(t, votes, snapshot.Votes)
+	assert.Equal(t, map[int64]int{1: 2, 2: 1}, snapshot.Heights)
+	assert.Equal(t, txVotePool.TxsBytes(), snapshot.TxsBytes)
+
+	// Mutate the pool and the votes it holds.
+	memTx := txVotePool.TxsFront().Value.(*mempoolTxVote)
+	memTx.tx.Signature[0] ^= 0xff
+	memTx.tx.ValidatorAddress[0] ^= 0xff
+	require.NoError(t, txVotePool.CheckTx(newTestVote(3, validator)))
+	txVotePool.Flush()
+
+	assert.Len(t, snapshot.Votes, 3)
+	assert.NotEqual(t, memTx.tx.Signature, snapshot.Votes[0].Signature)
+	assert.NotEqual(t, memTx.tx.ValidatorAddress, snapshot.Votes[0].ValidatorAddress)
+	assert.Equal(t, map[int64]int{1: 2, 2: 1}, snapshot.Heights)
+}
+
+func TestCommittedVotesKeptDuringGrace(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithCommitGrace(200*time.Millisecond))
+
+	committed, pending := newTestVote(1, newTestValidator()), newTestVote(1, newTestValidator())
+	require.NoError(t, txVotePool.CheckTx(committed))
+	require.NoError(t, txVotePool.CheckTx(pending))
+
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(1, []types.TxVote{committed}))
+	txVotePool.Unlock()
+
+	// Still answerable, but no longer reaped.
+	vote, ok := txVotePool.GetVote(committed.Signature)
+	require.True(t, ok)
+	assert.Equal(t, committed, vote)
+	assert.Equal(t, []types.TxVote{pending}, txVotePool.ReapMaxTxs(-1))
+
+	time.Sleep(250 * time.Millisecond)
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(2, nil))
+	txVotePool.Unlock()
+
+	_, ok = txVotePool.GetVote(committed.Signature)
+	assert.False(t, ok)
+	assert.Equal(t, 1, txVotePool.Size())
+}
+
+func TestCommittedVotesRemovedWithoutGrace(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, txVotePool.CheckTx(vote))
+
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(1, []types.TxVote{vote}))
+	txVotePool.Unlock()
+
+	_, ok := txVotePool.GetVote(vote.Signature)
+	assert.False(t, ok)
+	assert.Zero(t, txVotePool.Size())
+}
+
+func TestPositionFollowsPoolOrder(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 5)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		require.NoError(t, txVotePool.CheckTx(votes[i]))
+	}
+
+	for i, vote := range votes {
+		pos, ok := txVotePool.Position(vote.Signature)
+		require.True(t, ok)
+		assert.Equal(t, i, pos)
+	}
+
+	_, ok := txVotePool.Position(newTestVote(1, validator).Signature)
+	assert.False(t, ok)
+
+	// Removing a vote moves the ones behind it up.
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(1, votes[1:2]))
+	txVotePool.Unlock()
+	pos, ok := txVotePool.Position(votes[4].Signature)
+	require.True(t, ok)
+	assert.Equal(t, 3, pos)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	config := cfg.TestConfig()
+	src := NewTxVotePool(config.Mempool)
+
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 10)
+	for i := range votes {
+		votes[i] = newTestVote(int64(i+1), validator)
+		require.NoError(t, src.CheckTx(votes[i]))
+	}
+	// Committed votes kept around for the grace period aren't exported.
+	srcGrace := NewTxVotePool(config.Mempool, WithCommitGrace(time.Minute))
+	for _, vote := range votes {
+		require.NoError(t, srcGrace.CheckTx(vote))
+	}
+	srcGrace.Lock()
+	require.NoError(t, srcGrace.Update(1, votes[:3]))
+	srcGrace.Unlock()
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, src.ExportTo(buf))
+	dst := NewTxVotePool(config.Mempool)
+	require.NoError(t, dst.ImportFrom(buf))
+	assert.Equal(t, votes, dst.ReapMaxTxs(-1))
+
+	buf.Reset()
+	require.NoError(t, srcGrace.ExportTo(buf))
+	dst = NewTxVotePool(config.Mempool)
+	// Votes already in the pool are skipped.
+	require.NoError(t, dst.CheckTx(votes[5]))
+	require.NoError(t, dst.ImportFrom(buf))
+	assert.Equal(t, len(votes)-3, dst.Size())
+
+	// A truncated stream is an error.
+	buf.Reset()
+	require.NoError(t, src.ExportTo(buf))
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	assert.Error(t, NewTxVotePool(config.Mempool).ImportFrom(truncated))
+}
+
+func TestExportImportMigration(t *testing.T) {
+	config := cfg.TestConfig()
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 5)
+	for i := range votes {
+		votes[i] = newTestVote(int64(i+1), validator)
+	}
+
+	// A release writing version 0 exported its votes as TxVoteV2.
+	buf := new(bytes.Buffer)
+	_, err := cdc.MarshalBinaryLengthPrefixedWriter(buf, exportHeader{Version: 0})
+	require.NoError(t, err)
+	for _, vote := range votes {
+		v2, ok := toTxVoteV2(vote)
+		require.True(t, ok)
+		_, err := cdc.MarshalBinaryLengthPrefixedWriter(buf, v2)
+		require.NoError(t, err)
+	}
+	old := buf.Bytes()
+
+	var migrated []uint32
+	migrate := func(version uint32, record []byte) (types.TxVote, error) {
+		migrated = append(migrated, version)
+		var v2 TxVoteV2
+		err := cdc.UnmarshalBinaryBare(record, &v2)
+		return fromTxVoteV2(v2), err
+	}
+	dst := NewTxVotePool(config.Mempool)
+	require.NoError(t, dst.Import(bytes.NewReader(old), migrate))
+	assert.Equal(t, votes, dst.ReapMaxTxs(-1))
+	assert.Equal(t, []uint32{0, 0, 0, 0, 0}, migrated)
+
+	// Without a migration, older exports are refused.
+	assert.Error(t, NewTxVotePool(config.Mempool).Import(bytes.NewReader(old), nil))
+
+	// Exports of the current version are imported as they are.
+	buf = new(bytes.Buffer)
+	require.NoError(t, dst.Export(buf))
+	migrated = nil
+	current := NewTxVotePool(config.Mempool)
+	require.NoError(t, current.Import(buf, migrate))
+	assert.Equal(t, votes, current.ReapMaxTxs(-1))
+	assert.Empty(t, migrated)
+
+	// Newer exports are refused.
+	buf = new(bytes.Buffer)
+	_, err = cdc.MarshalBinaryLengthPrefixedWriter(buf, exportHeader{Version: PoolExportVersion + 1})
+	require.NoError(t, err)
+	assert.Error(t, NewTxVotePool(config.Mempool).Import(buf, migrate))
+}
+
+func TestEmptyTransitionCallback(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	var transitions []bool
+	txVotePool.SetEmptyTransitionCallback(func(empty bool) {
+		// The pool is usable from the callback.
+		assert.Equal(t, empty, txVotePool.Size() == 0)
+		transitions = append(transitions, empty)
+	})
+
+	validator := newTestValidator()
+	vote1, vote2 := newTestVote(1, validator), newTestVote(1, validator)
+	require.NoError(t, txVotePool.CheckTx(vote1))
+	require.NoError(t, txVotePool.CheckTx(vote2))
+	assert.Equal(t, []bool{false}, transitions)
+
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(1, []types.TxVote{vote1}))
+	txVotePool.Unlock()
+	assert.Equal(t, []bool{false}, transitions)
+
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(2, []types.TxVote{vote2}))
+	txVotePool.Unlock()
+	assert.Equal(t, []bool{false, true}, transitions)
+
+	// Rejected votes don't change anything.
+	assert.Error(t, txVotePool.CheckTx(vote1))
+	assert.Equal(t, []bool{false, true}, transitions)
+
+	require.NoError(t, txVotePool.CheckTx(newTestVote(3, validator)))
+	txVotePool.Flush()
+	assert.Equal(t, []bool{false, true, false, true}, transitions)
+}
+
+func TestTakeMaxConcurrentTakersGetDisjointVotes(t *testing.T) {
+	config := cfg.TestConfig()
+	config.Mempool.Size = 1000
+	txVotePool := NewTxVotePool(config.Mempool)
+
+	const numVotes = 500
+	validator := newTestValidator()
+	for i := 0; i < numVotes; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	}
+
+	taken := make([][]types.TxVote, 2)
+	var wg sync.WaitGroup
+	for i := range taken {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				txs := txVotePool.TakeMax(7)
+				if len(txs) == 0 {
+					return
+				}
+				assert.True(t, len(txs) <= 7)
+				taken[i] = append(taken[i], txs...)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, txs := range taken {
+		for _, tx := range txs {
+			assert.False(t, seen[TxVoteID(tx)], "vote taken twice")
+			seen[TxVoteID(tx)] = true
+		}
+	}
+	assert.Len(t, seen, numVotes)
+	assert.Zero(t, txVotePool.Size())
+	assert.Zero(t, txVotePool.TxsBytes())
+}
+
+func TestGapsReportsSkippedHeights(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithGapTracking(10, 1))
+
+	val1, val2 := newTestValidator(), newTestValidator()
+	for _, height := range []int64{1, 2, 4, 5, 8} {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(height, val1)))
+	}
+	assert.Equal(t, []int64{3, 6, 7}, txVotePool.Gaps(val1))
+
+	// Heights falling out of the window are forgotten.
+	require.NoError(t, txVotePool.CheckTx(newTestVote(13, val1)))
+	assert.Equal(t, []int64{6, 7, 9, 10, 11, 12}, txVotePool.Gaps(val1))
+
+	// Signers past the cap aren't tracked.
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, val2)))
+	require.NoError(t, txVotePool.CheckTx(newTestVote(3, val2)))
+	assert.Nil(t, txVotePool.Gaps(val2))
+
+	assert.Nil(t, newTestTxVotePool().Gaps(val1))
+}
+
+func TestDrainBelowPassesVotesToSink(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	validator := newTestValidator()
+	for _, height := range []int64{1, 3, 2, 3} {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(height, validator)))
+	}
+
+	var drained []int64
+	txVotePool.DrainBelow(3, func(tx types.TxVote) {
+		_, inPool := txVotePool.txsMap.Load(txVoteKey(tx))
+		assert.True(t, inPool, "vote removed before reaching the sink")
+		drained = append(drained, tx.Height)
+	})
+	assert.Equal(t, []int64{1, 2}, drained)
+	assert.Equal(t, 2, txVotePool.Size())
+	for _, tx := range txVotePool.ReapMaxTxs(-1) {
+		assert.Equal(t, int64(3), tx.Height)
+	}
+}
+
+func TestDrainBelowSinkPanicLeavesPoolConsistent(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	}
+
+	sunk := 0
+	assert.Panics(t, func() {
+		txVotePool.DrainBelow(2, func(types.TxVote) {
+			if sunk == 1 {
+				panic("cold storage unavailable")
+			}
+			sunk++
+		})
+	})
+	// The pool is unlocked, and only holds the votes which weren't drained.
+	assert.Equal(t, 2, txVotePool.Size())
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	assert.Equal(t, 3, txVotePool.Size())
+}
+
+func TestDigestIsDeterministic(t *testing.T) {
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 20)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+	}
+
+	pool1, pool2 := newTestTxVotePool(), newTestTxVotePool()
+	for i := range votes {
+		require.NoError(t, pool1.CheckTx(votes[i]))
+		require.NoError(t, pool2.CheckTx(votes[len(votes)-1-i]))
+	}
+	digest := pool1.Digest()
+	assert.Len(t, digest, DigestSize)
+	assert.Equal(t, digest, pool1.Digest())
+	assert.Equal(t, digest, pool2.Digest(), "digest depends on the order of the votes")
+
+	require.NoError(t, pool2.CheckTx(newTestVote(1, validator)))
+	assert.NotEqual(t, digest, pool2.Digest())
+}
+
+func TestMissingFromDigest(t *testing.T) {
+	validator := newTestValidator()
+	ours, theirs := newTestTxVotePool(), newTestTxVotePool()
+
+	var missing []types.TxVote
+	for i := 0; i < 100; i++ {
+		vote := newTestVote(1, validator)
+		require.NoError(t, ours.CheckTx(vote))
+		if i%4 == 0 {
+			missing = append(missing, vote)
+		} else {
+			require.NoError(t, theirs.CheckTx(vote))
+		}
+	}
+	// Votes only they have don't matter.
+	require.NoError(t, theirs.CheckTx(newTestVote(1, validator)))
+
+	assert.Equal(t, missing, ours.MissingFrom(theirs.Digest()))
+	assert.Empty(t, theirs.MissingFrom(theirs.Digest()))
+	assert.Nil(t, ours.MissingFrom([]byte{0x01}))
+}
+
+func TestTimeRange(t *testing.T) {
+	txVotePool := newTestTxVotePool()
+	_, _, ok := txVotePool.TimeRange()
+	assert.False(t, ok)
+
+	validator := newTestValidator()
+	before := time.Now()
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	time.Sleep(20 * time.Millisecond)
+	middle := time.Now()
+	require.NoError(t, txVotePool.CheckTx(newTestVote(1, validator)))
+	time.Sleep(20 * time.Millisecond)
+	last := newTestVote(2, validator)
+	require.NoError(t, txVotePool.CheckTx(last))
+	after := time.Now()
+
+	oldest, newest, ok := txVotePool.TimeRange()
+	require.True(t, ok)
+	assert.True(t, !oldest.Before(before) && oldest.Before(middle), "oldest %v", oldest)
+	assert.True(t, newest.After(middle) && !newest.After(after), "newest %v", newest)
+	assert.True(t, newest.Sub(oldest) >= 40*time.Millisecond)
+
+	// Committing the newest vote moves the range.
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(2, []types.TxVote{last}))
+	txVotePool.Unlock()
+	_, newest, ok = txVotePool.TimeRange()
+	require.True(t, ok)
+	assert.True(t, newest.Before(middle.Add(20*time.Millisecond)), "newest %v", newest)
+}
+
+func TestGraceHeightPolicy(t *testing.T) {
+	testCases := []struct {
+		policy GraceHeightPolicy
+		err    error
+		stored bool
+		reaped bool
+	}{
+		{GraceHeightAccept, nil, true, true},
+		{GraceHeightReject, ErrTxVoteHeightCommitted, false, false},
+		{GraceHeightServe, nil, true, false},
+	}
+	for _, tc := range testCases {
+		config := cfg.TestConfig()
+		txVotePool := NewTxVotePool(config.Mempool, WithCommitGrace(200*time.Millisecond),
+			WithGraceHeightPolicy(tc.policy))
+
+		committed := newTestVote(1, newTestValidator())
+		require.NoError(t, txVotePool.CheckTx(committed))
+		txVotePool.Lock()
+		require.NoError(t, txVotePool.Update(1, []types.TxVote{committed}))
+		txVotePool.Unlock()
+
+		// A vote for the height still in grace shows up.
+		late := newTestVote(1, newTestValidator())
+		assert.Equal(t, tc.err, txVotePool.CheckTx(late), "policy %v", tc.policy)
+		_, ok := txVotePool.GetVote(late.Signature)
+		assert.Equal(t, tc.stored, ok, "policy %v", tc.policy)
+		assert.Equal(t, tc.reaped, len(txVotePool.ReapMaxTxs(-1)) == 1, "policy %v", tc.policy)
+
+		// Once the grace period is over, the height is no longer special.
+		time.Sleep(250 * time.Millisecond)
+		txVotePool.Lock()
+		require.NoError(t, txVotePool.Update(2, nil))
+		txVotePool.Unlock()
+		assert.NoError(t, txVotePool.CheckTx(newTestVote(1, newTestValidator())), "policy %v", tc.policy)
+	}
+}
@@ -1,17 +1,28 @@
 package txvotepool
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"reflect"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	amino "github.com/tendermint/go-amino"
 
 	"github.com/andrecronje/babble-abci/types"
 	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto"
 	"github.com/tendermint/tendermint/libs/clist"
+	cmn "github.com/tendermint/tendermint/libs/common"
 	"github.com/tendermint/tendermint/libs/log"
 	"github.com/tendermint/tendermint/p2p"
 	ttypes "github.com/tendermint/tendermint/types"
@@ -23,13 +34,77 @@ const (
 	maxMsgSize = 1048576        // 1MB TODO make it configurable
 	maxTxSize  = maxMsgSize - 8 // account for amino overhead of TxMessage
 
+	// defaultMaxMsgElements is the default max number of fields, counting
+	// each element of repeated fields, a message may encode.
+	defaultMaxMsgElements = 4096
+
 	peerCatchupSleepIntervalMS = 100 // If peer is behind, sleep this amount
 
+	// defaultMaxScanPerWake is the default max number of votes a broadcast
+	// routine handles in a row before yielding.
+	defaultMaxScanPerWake = 1024
+
 	// UnknownPeerID is the peer ID to use when running CheckTx when there is
 	// no peer (e.g. RPC)
 	UnknownPeerID uint16 = 0
 
 	maxActiveIDs = math.MaxUint16
+
+	// reassignGrace is how long the old ID of a reassigned peer stays
+	// reserved, see ReassignPeer.
+	reassignGrace = time.Second
+)
+
+var (
+	// ErrTooManyUnknownMessages is the reason a peer is stopped for when it
+	// keeps sending messages of unknown types.
+	ErrTooManyUnknownMessages = errors.New("Too many messages of unknown type")
+
+	// ErrInvalidEnvelopeSignature is the reason a peer is stopped for when a
+	// vote it relayed isn't properly signed by it.
+	ErrInvalidEnvelopeSignature = errors.New("Invalid envelope signature")
+
+	// ErrWrongChannel is the reason a peer is stopped for when it sends a
+	// message on a channel other than TxpoolChannel, with WrongChannelStopPeer.
+	ErrWrongChannel = errors.New("Msg on wrong channel")
+
+	// ErrTooManyMsgElements is the reason a peer is stopped for when it sends
+	// a message encoding more elements than allowed.
+	ErrTooManyMsgElements = errors.New("Msg has too many elements")
+
+	// ErrNestedBundle is the reason a peer is stopped for when it sends a
+	// BundleMessage within a BundleMessage.
+	ErrNestedBundle = errors.New("Bundle within a bundle")
+
+	// ErrTrailingBytes is the reason a peer is stopped for when it sends a
+	// message followed by bytes which aren't part of it.
+	ErrTrailingBytes = errors.New("Msg has trailing bytes")
+
+	// ErrPeerIDsInUse is returned by Reset when peers still hold IDs.
+	ErrPeerIDsInUse = errors.New("Peer IDs still in use")
+
+	// ErrUnknownPeer is returned by SyncPeer for a peer which wasn't added,
+	// or was removed since.
+	ErrUnknownPeer = errors.New("Unknown peer")
+
+	// ErrPeerSendFailed is returned by SyncPeer when the peer couldn't take a
+	// vote.
+	ErrPeerSendFailed = errors.New("Send to peer failed")
+
+	// ErrBroadcastDisabled is returned by SubmitVote when the config turns
+	// broadcasting off, as the vote wouldn't reach peers.
+	ErrBroadcastDisabled = errors.New("Broadcast disabled")
+)
+
+// WrongChannelPolicy defines how the reactor handles messages received on a
+// channel other than TxpoolChannel.
+type WrongChannelPolicy int
+
+const (
+	// WrongChannelDrop logs and drops such messages.
+	WrongChannelDrop WrongChannelPolicy = iota
+	// WrongChannelStopPeer stops the peer with ErrWrongChannel.
+	WrongChannelStopPeer
 )
 
 // TxpooReactor handles txpool tx broadcasting amongst peers.
@@ -40,6 +115,223 @@ type TxpoolReactor struct {
 	config *cfg.MempoolConfig
 	Txpool *TxVotePool
 	ids    *txpoolIDs
+
+	// max number of peers a vote is pushed to per broadcast cycle, 0 means
+	// unlimited.
+	broadcastFanout int
+	// source and weights of the random picks of the peers of a vote's first
+	// cycle, see ReactorRandomFanout
+	fanoutRandMtx sync.Mutex
+	fanoutRand    *rand.Rand
+	fanoutWeight  func(p2p.ID) float64
+	// votes from peers scoring below trustThreshold are dropped on receipt,
+	// see ReactorPeerTrust
+	peerScore      func(p2p.ID) float64
+	trustThreshold float64
+	// how long to wait after adding a peer before broadcasting to it
+	broadcastStartDelay time.Duration
+	// if limitPeerLag is set, peers more than maxPeerLag heights behind the
+	// pool get no broadcasts until they catch up
+	limitPeerLag bool
+	maxPeerLag   int64
+	// peers whose height hasn't changed for maxPeerStateAge get no
+	// broadcasts until it does, see ReactorMaxPeerStateAge
+	maxPeerStateAge time.Duration
+	peerHeightsMtx  sync.Mutex
+	peerHeights     map[p2p.ID]peerHeight
+	// transforms applied to the votes sent to, and received from, peers,
+	// see ReactorVoteTransforms
+	outboundTransform func(types.TxVote) types.TxVote
+	inboundTransform  func(types.TxVote) types.TxVote
+	// rate in bytes per second, and burst, of the budget each peer is sent
+	// votes within, unlimited if peerSendRate is 0
+	peerSendRate  int64
+	peerSendBurst int64
+	// slots of the votes messages being sent at once, unlimited if nil, see
+	// ReactorMaxConcurrentSends
+	sendSlots chan struct{}
+	// max number of votes sent per TxsMessage, and how long a partial batch
+	// may wait, see ReactorBroadcastBatch, timed with batchClock
+	batchSize          int
+	batchFlushInterval time.Duration
+	batchClock         BatchClock
+	// bounds of the pool transfers on connect, see ReactorBulkSync
+	bulkMaxVotes  int
+	bulkChunkSize int
+	bulkInterval  time.Duration
+	// offset of the chunk requested from the peers being bulk synced, and
+	// when the peers bulk syncing from us were last served a chunk
+	bulkSyncMtx sync.Mutex
+	bulkSyncing map[p2p.ID]int
+	bulkServed  map[p2p.ID]time.Time
+	// bounds of the warm-up on startup, see ReactorWarmUp, the number of
+	// peers still to ask, the votes still accepted from the peers asked, and
+	// the peers already served
+	warmUpPeers    int
+	warmUpMaxVotes int
+	warmUpMtx      sync.Mutex
+	warmUpLeft     int
+	warmingUp      map[p2p.ID]int
+	warmedUp       map[p2p.ID]struct{}
+	// how often Compact runs, never if 0
+	compactInterval time.Duration
+	// stats of the background loops by name, see LoopStats
+	loopsMtx sync.Mutex
+	loops    map[string]LoopStats
+	// votes received while syncStatus reports the node is syncing, up to
+	// maxDeferred, see ReactorSyncGuard
+	syncStatus  SyncStatus
+	maxDeferred int
+	deferredMtx sync.Mutex
+	deferred    []deferredVote
+	// optional check of received votes, run on up to verifyParallelism votes
+	// of a batch at once
+	voteVerifier      func(types.TxVote) error
+	verifyParallelism int
+	// batches of a peer verified at once, off the receive goroutine if > 1
+	peerReceiveWorkers int
+	receiversMtx       sync.Mutex
+	receivers          map[p2p.ID]*peerReceiver
+	removedReceivers   map[p2p.ID]p2p.Peer // removed peers, not given a receiver again
+	// only broadcast to peers validatorPeers, or their PeerState, report as
+	// validators
+	validatorPeersOnly bool
+	validatorPeers     ValidatorPeers
+	wrongChannelPolicy WrongChannelPolicy
+	// stop peers on any protocol violation, see ReactorStrictProtocol
+	strictProtocol bool
+	// logger for the lines logged for every received message, sampled 1 in
+	// logSampling
+	recvLogger  log.Logger
+	logSampling int
+	// max number of elements a received message may encode
+	maxMsgElements int
+	// how received messages are held back once the pool is loaded above
+	// backpressureThreshold, see ReactorBackpressure
+	backpressure          BackpressurePolicy
+	backpressureThreshold float64
+	backpressureMaxDelay  time.Duration
+	// votes being verified and checked, nil unless ReactorCoalesceReceives
+	// is used
+	inflight *inflightVotes
+	// max number of votes a broadcast routine handles in a row before
+	// yielding to other goroutines
+	maxScanPerWake int
+	// how long a broadcast routine waits for more votes once woken, see
+	// ReactorWakeCoalesceWindow
+	wakeCoalesceWindow time.Duration
+	// failed sends after which a vote is dead lettered, unlimited if 0, and
+	// the dead lettered votes, see DeadLetters
+	maxSendAttempts int
+	deadLettersMtx  sync.Mutex
+	deadLetters     []DeadVote
+	// lane of the votes, and how many high lane votes are sent before a
+	// normal lane one, see ReactorPriorityLanes
+	laneClassifier  func(types.TxVote) Lane
+	normalLaneEvery int
+
+	// Only set by tests: when non nil, broadcast routines wait for a channel
+	// on it before handling each vote, and close that channel once done. This
+	// lets tests drive broadcasting one vote at a time without sleeping.
+	broadcastStep chan chan struct{}
+
+	// number of messages of unknown type a peer may send before being
+	// stopped, 0 means they are only logged.
+	maxUnknownMsgs int
+	unknownMsgsMtx sync.Mutex
+	unknownMsgs    map[p2p.ID]int
+	// number of messages received from each peer by type, see
+	// PeerMessageCounts
+	msgCountsMtx sync.Mutex
+	msgCounts    map[p2p.ID]map[string]int64
+
+	// votes the peers declared an interest in, peers without a declaration
+	// get all votes.
+	interestsMtx sync.RWMutex
+	interests    map[p2p.ID]*InterestMessage
+
+	// key used to sign relayed votes, nil if envelope signing is disabled
+	privKey crypto.PrivKey
+	// record the nodes votes go through in their envelopes, see
+	// ReactorRelayProvenance
+	relayProvenance bool
+	// peers which announced they sign their envelopes and verify ours
+	signingPeersMtx sync.RWMutex
+	signingPeers    map[p2p.ID]struct{}
+
+	// key signing the capabilities we announce, nil if they aren't, and the
+	// interest announced with them, see ReactorCapabilities
+	capabilitiesKey crypto.PrivKey
+	interest        *InterestMessage
+
+	// latest vote version we send, and the latest the peers announced they
+	// support, see ReactorTxVoteVersions
+	maxTxVoteVersion uint8
+	peerVersionsMtx  sync.RWMutex
+	peerVersions     map[p2p.ID]uint8
+
+	// peers whose votes are dropped and who get no broadcasts, and the IDs
+	// of the ones connected
+	blacklistMtx   sync.RWMutex
+	blacklist      map[p2p.ID]struct{}
+	blacklistedIDs map[uint16]struct{}
+
+	// connected peers, by ID
+	peersMtx sync.RWMutex
+	peers    map[p2p.ID]p2p.Peer
+
+	// unix nanos of the last vote sent to a peer, and how long broadcasting or
+	// the pool may make no progress before Healthz reports it
+	lastSend     int64
+	stallTimeout time.Duration
+
+	// sequence number of the last received message, used to order receipts
+	// when correlating logs across the cluster.
+	recvSeq uint64
+
+	// broadcast routines by peer ID, used to make sure a reconnecting peer
+	// never ends up with two routines sending to it.
+	routinesMtx sync.Mutex
+	routines    map[p2p.ID]*broadcastRoutine
+	// peers whose broadcast routine exited after broadcastIdleTimeout without
+	// votes to handle, see ReactorBroadcastIdleTimeout
+	broadcastIdleTimeout time.Duration
+	idlePeers            map[p2p.ID]p2p.Peer
+	// number of shared broadcast workers, a routine per peer if 0, and the
+	// queue of peers they pick from, see ReactorBroadcastWorkers
+	broadcastWorkers   int
+	broadcastScheduler *broadcastScheduler
+	// number of goroutines broadcasting votes, routines or workers
+	broadcastGoroutines int64
+
+	// votes not broadcast, see WithholdHeight
+	withhold withholdFilter
+
+	// acknowledge the votes received from peers, see ReactorAcks
+	acks bool
+
+	// max number of messages queued for a peer, and how long they may wait,
+	// see ReactorCoalesceOutbound
+	outboundMaxMsgs       int
+	outboundFlushInterval time.Duration
+	outboxesMtx           sync.Mutex
+	outboxes              map[p2p.ID]*outbox
+
+	// where received messages are recorded, nil if they aren't, see
+	// ReactorRecordTrace
+	traceMtx sync.Mutex
+	trace    io.Writer
+
+	// see OnHeightBroadcastComplete
+	heightCompleteMtx sync.Mutex
+	heightCompleteCb  func(height int64)
+	completedHeights  map[int64]struct{}
+}
+
+// broadcastRoutine tracks a running broadcastTxRoutine.
+type broadcastRoutine struct {
+	peer p2p.Peer
+	done chan struct{} // closed once the routine has returned
 }
 
 type txpoolIDs struct {
@@ -47,6 +339,21 @@ type txpoolIDs struct {
 	peerMap   map[p2p.ID]uint16
 	nextID    uint16              // assumes that a node will never have over 65536 active peers
 	activeIDs map[uint16]struct{} // used to check if a given peerID key is used, the value doesn't matter
+
+	// derive IDs from the peers' p2p.ID instead of assigning them in order
+	deterministic bool
+
+	// IDs freed less than cooldown ago, only handed out again to the peer
+	// which held them unless no other ID is left, see ReactorPeerIDCooldown
+	cooldown time.Duration
+	cooling  map[uint16]coolingID
+}
+
+// coolingID is a freed ID, with the peer which held it and until when it is
+// kept from other peers.
+type coolingID struct {
+	peer  p2p.ID
+	until time.Time
 }
 
 // Reserve searches for the next unused ID and assignes it to the
@@ -55,22 +362,74 @@ func (ids *txpoolIDs) ReserveForPeer(peer p2p.Peer) {
 	ids.mtx.Lock()
 	defer ids.mtx.Unlock()
 
-	curID := ids.nextPeerID()
+	var curID uint16
+	if ids.deterministic {
+		curID = ids.derivePeerID(peer.ID())
+	} else {
+		curID = ids.nextPeerID(peer.ID())
+	}
 	ids.peerMap[peer.ID()] = curID
 	ids.activeIDs[curID] = struct{}{}
+	delete(ids.cooling, curID)
+}
+
+// unavailable returns a function telling whether an ID can't be given to the
+// peer: it is active, or cooling down after being freed by another peer. IDs
+// cooling down are handed out anyway when no other ID is left.
+// This assumes that ids's mutex is already locked.
+func (ids *txpoolIDs) unavailable(peerID p2p.ID) func(uint16) bool {
+	now := time.Now()
+	for id, c := range ids.cooling {
+		if !now.Before(c.until) {
+			delete(ids.cooling, id)
+		}
+	}
+	honorCooling := len(ids.activeIDs)+len(ids.cooling) < maxActiveIDs
+	return func(id uint16) bool {
+		if _, ok := ids.activeIDs[id]; ok {
+			return true
+		}
+		c, ok := ids.cooling[id]
+		return ok && honorCooling && c.peer != peerID
+	}
+}
+
+// coolDown keeps the ID freed by the peer from other peers for the cooldown.
+// This assumes that ids's mutex is already locked.
+func (ids *txpoolIDs) coolDown(id uint16, peerID p2p.ID) {
+	if ids.cooldown > 0 {
+		ids.cooling[id] = coolingID{peer: peerID, until: time.Now().Add(ids.cooldown)}
+	}
+}
+
+// derivePeerID returns an unused ID derived from the hash of the peer's
+// p2p.ID, so that a peer gets the same ID whatever the order peers are added
+// in. Collisions are resolved by taking the next unused ID.
+// This assumes that ids's mutex is already locked.
+func (ids *txpoolIDs) derivePeerID(peerID p2p.ID) uint16 {
+	if len(ids.activeIDs) == maxActiveIDs {
+		panic(fmt.Sprintf("node has maximum %d active IDs and wanted to get one more", maxActiveIDs))
+	}
+
+	hash := sha256.Sum256([]byte(peerID))
+	curID := binary.BigEndian.Uint16(hash[:2])
+	unavailable := ids.unavailable(peerID)
+	for unavailable(curID) {
+		curID++
+	}
+	return curID
 }
 
-// nextPeerID returns the next unused peer ID to use.
+// nextPeerID returns the next unused peer ID to give to the peer.
 // This assumes that ids's mutex is already locked.
-func (ids *txpoolIDs) nextPeerID() uint16 {
+func (ids *txpoolIDs) nextPeerID(peerID p2p.ID) uint16 {
 	if len(ids.activeIDs) == maxActiveIDs {
 		panic(fmt.Sprintf("node has maximum %d active IDs and wanted to get one more", maxActiveIDs))
 	}
 
-	_, idExists := ids.activeIDs[ids.nextID]
-	for idExists {
+	unavailable := ids.unavailable(peerID)
+	for unavailable(ids.nextID) {
 		ids.nextID++
-		_, idExists = ids.activeIDs[ids.nextID]
 	}
 	curID := ids.nextID
 	ids.nextID++
@@ -86,7 +445,40 @@ func (ids *txpoolIDs) Reclaim(peer p2p.Peer) {
 	if ok {
 		delete(ids.activeIDs, removedID)
 		delete(ids.peerMap, peer.ID())
+		ids.coolDown(removedID, peer.ID())
+	}
+}
+
+// Reassign reserves a new ID for the peer, and returns it. The old one is kept
+// reserved until given back with Free. The peer's broadcast routine isn't
+// stopped; it picks up the new ID on its next pass.
+func (ids *txpoolIDs) Reassign(peer p2p.Peer) uint16 {
+	ids.mtx.Lock()
+	defer ids.mtx.Unlock()
+
+	// the new ID is taken while the old one is still active, so they differ
+	var curID uint16
+	if ids.deterministic {
+		curID = ids.derivePeerID(peer.ID())
+	} else {
+		curID = ids.nextPeerID(peer.ID())
+	}
+	ids.peerMap[peer.ID()] = curID
+	ids.activeIDs[curID] = struct{}{}
+	delete(ids.cooling, curID)
+	return curID
+}
+
+// Free returns the ID the peer held before Reassign to the unused pool.
+func (ids *txpoolIDs) Free(id uint16, peer p2p.Peer) {
+	ids.mtx.Lock()
+	defer ids.mtx.Unlock()
+
+	if ids.peerMap[peer.ID()] == id {
+		return // the peer was given it back
 	}
+	delete(ids.activeIDs, id)
+	ids.coolDown(id, peer.ID())
 }
 
 // GetForPeer returns an ID reserved for the peer.
@@ -97,39 +489,441 @@ func (ids *txpoolIDs) GetForPeer(peer p2p.Peer) uint16 {
 	return ids.peerMap[peer.ID()]
 }
 
+// peerFor returns the peer the ID is reserved for, and false if none is.
+func (ids *txpoolIDs) peerFor(id uint16) (p2p.ID, bool) {
+	ids.mtx.RLock()
+	defer ids.mtx.RUnlock()
+
+	for peerID, reserved := range ids.peerMap {
+		if reserved == id {
+			return peerID, true
+		}
+	}
+	return "", false
+}
+
+// NextID returns the ID the allocator tries first for the next peer, unless
+// IDs are derived from the peers' IDs.
+func (ids *txpoolIDs) NextID() uint16 {
+	ids.mtx.RLock()
+	defer ids.mtx.RUnlock()
+
+	return ids.nextID
+}
+
+// ActiveIDs returns the number of IDs reserved for peers, UnknownPeerID
+// excluded.
+func (ids *txpoolIDs) ActiveIDs() int {
+	ids.mtx.RLock()
+	defer ids.mtx.RUnlock()
+
+	return len(ids.activeIDs) - 1
+}
+
+// Reset returns the allocator to its initial state. It returns
+// ErrPeerIDsInUse, and leaves the allocator as is, if peers still hold IDs.
+func (ids *txpoolIDs) Reset() error {
+	ids.mtx.Lock()
+	defer ids.mtx.Unlock()
+
+	if len(ids.peerMap) > 0 {
+		return ErrPeerIDsInUse
+	}
+	ids.activeIDs = map[uint16]struct{}{UnknownPeerID: {}}
+	ids.nextID = UnknownPeerID + 1
+	ids.cooling = make(map[uint16]coolingID)
+	return nil
+}
+
+// ActivePeers returns a copy of the mapping from peers to their reserved IDs.
+func (ids *txpoolIDs) ActivePeers() map[p2p.ID]uint16 {
+	ids.mtx.RLock()
+	defer ids.mtx.RUnlock()
+
+	peers := make(map[p2p.ID]uint16, len(ids.peerMap))
+	for peerID, id := range ids.peerMap {
+		peers[peerID] = id
+	}
+	return peers
+}
+
+// RetainedIDs returns the IDs whose senders are kept: the active ones, and
+// those cooling down, which the peer that held them gets back if it
+// reconnects meanwhile.
+func (ids *txpoolIDs) RetainedIDs() map[uint16]struct{} {
+	ids.mtx.RLock()
+	defer ids.mtx.RUnlock()
+
+	retained := make(map[uint16]struct{}, len(ids.activeIDs)+len(ids.cooling))
+	for id := range ids.activeIDs {
+		retained[id] = struct{}{}
+	}
+	now := time.Now()
+	for id, c := range ids.cooling {
+		if now.Before(c.until) {
+			retained[id] = struct{}{}
+		}
+	}
+	return retained
+}
+
 func newTxpoolIDs() *txpoolIDs {
 	return &txpoolIDs{
 		peerMap:   make(map[p2p.ID]uint16),
 		activeIDs: map[uint16]struct{}{0: {}},
 		nextID:    1, // reserve unknownPeerID(0) for mempoolReactor.BroadcastTx
+		cooling:   make(map[uint16]coolingID),
 	}
 }
 
+// ReactorOption sets an optional parameter on the TxpoolReactor.
+type ReactorOption func(*TxpoolReactor)
+
 // NewTxpoolReactor returns a new TxpoolReactor with the given config and txpool.
-func NewTxpoolReactor(config *cfg.MempoolConfig, txpool *TxVotePool) *TxpoolReactor {
+// It panics if either is nil.
+func NewTxpoolReactor(config *cfg.MempoolConfig, txpool *TxVotePool, options ...ReactorOption) *TxpoolReactor {
+	if config == nil {
+		panic("NewTxpoolReactor: config is nil")
+	}
+	if txpool == nil {
+		panic("NewTxpoolReactor: txpool is nil")
+	}
 	txR := &TxpoolReactor{
-		config: config,
-		Txpool: txpool,
-		ids:    newTxpoolIDs(),
+		config:           config,
+		Txpool:           txpool,
+		ids:              newTxpoolIDs(),
+		routines:         make(map[p2p.ID]*broadcastRoutine),
+		idlePeers:        make(map[p2p.ID]p2p.Peer),
+		receivers:        make(map[p2p.ID]*peerReceiver),
+		removedReceivers: make(map[p2p.ID]p2p.Peer),
+		peers:            make(map[p2p.ID]p2p.Peer),
+		bulkSyncing:      make(map[p2p.ID]int),
+		bulkServed:       make(map[p2p.ID]time.Time),
+		warmingUp:        make(map[p2p.ID]int),
+		warmedUp:         make(map[p2p.ID]struct{}),
+		unknownMsgs:      make(map[p2p.ID]int),
+		msgCounts:        make(map[p2p.ID]map[string]int64),
+		interests:        make(map[p2p.ID]*InterestMessage),
+		blacklist:        make(map[p2p.ID]struct{}),
+		blacklistedIDs:   make(map[uint16]struct{}),
+		signingPeers:     make(map[p2p.ID]struct{}),
+		peerVersions:     make(map[p2p.ID]uint8),
+		outboxes:         make(map[p2p.ID]*outbox),
+		peerHeights:      make(map[p2p.ID]peerHeight),
+		loops:            make(map[string]LoopStats),
+
+		broadcastScheduler: newBroadcastScheduler(),
+
+		maxTxVoteVersion:  VoteVersion1,
+		maxMsgElements:    defaultMaxMsgElements,
+		verifyParallelism: 1,
+		maxScanPerWake:    defaultMaxScanPerWake,
+		stallTimeout:      defaultStallTimeout,
+		batchClock:        systemBatchClock{},
+		lastSend:          time.Now().UnixNano(),
 	}
 	txR.BaseReactor = *p2p.NewBaseReactor("TxpoolReactor", txR)
+
+	for _, option := range options {
+		option(txR)
+	}
+	txR.recvLogger = newSampledLogger(txR.Logger, txR.logSampling)
+
 	return txR
 }
 
+// ReactorBroadcastFanout limits the number of peers a vote is pushed to per
+// broadcast cycle. The remaining peers get it on the following cycles, which
+// trades a little latency for smoother bandwidth usage.
+func ReactorBroadcastFanout(fanout int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.broadcastFanout = fanout }
+}
+
+// ReactorBroadcastStartDelay delays the first broadcast to a newly added peer,
+// giving other reactors time to set its PeerState. Defaults to no delay.
+func ReactorBroadcastStartDelay(delay time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.broadcastStartDelay = delay }
+}
+
+// ReactorMaxPeerLag defers broadcasting to peers more than lag heights behind
+// the pool's height until they catch up, instead of evaluating every vote
+// against peers which are still syncing. Disabled by default.
+func ReactorMaxPeerLag(lag int64) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.limitPeerLag = true
+		txR.maxPeerLag = lag
+	}
+}
+
+// ReactorCompactionInterval makes the reactor run Compact at the given
+// interval, reclaiming the memory held for peers and votes which are gone.
+// Compaction is disabled by default.
+func ReactorCompactionInterval(interval time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.compactInterval = interval }
+}
+
+// ReactorVoteVerifier sets a check received votes must pass before being
+// added to the pool, eg. verifying their signature against the validator set.
+// Votes failing it are dropped.
+func ReactorVoteVerifier(verify func(types.TxVote) error) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.voteVerifier = verify }
+}
+
+// ReactorVerifyParallelism sets the number of votes of a TxsMessage batch
+// which are verified at once, see ReactorVoteVerifier. The votes are still
+// added to the pool in the order of the batch. Defaults to 1 (serial).
+func ReactorVerifyParallelism(n int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.verifyParallelism = n }
+}
+
+// ReactorPeerSendRate limits the votes sent to each peer to rate bytes per
+// second, allowing bursts of up to burst bytes. This keeps a peer catching up
+// from taking all the upload bandwidth. Sends are unlimited by default.
+func ReactorPeerSendRate(rate, burst int64) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.peerSendRate = rate
+		txR.peerSendBurst = burst
+	}
+}
+
+// ReactorValidatorPeersOnly restricts broadcasting to validator peers, that
+// is peers validators reports as such, see ValidatorNodeIDs, or whose
+// PeerState implements ValidatorPeerState and reports them as validators.
+// validators may be nil if the peer states tell. Votes are broadcast to all
+// peers by default.
+func ReactorValidatorPeersOnly(validators ValidatorPeers) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.validatorPeersOnly = true
+		txR.validatorPeers = validators
+	}
+}
+
+// ReactorLogSampling only logs 1 in n of the debug and info lines logged for
+// every received message, which would otherwise flood the logs under heavy
+// gossip. Errors are always logged. Every line is logged by default.
+func ReactorLogSampling(n int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.logSampling = n }
+}
+
+// ReactorWrongChannelPolicy sets how messages received on a channel other
+// than TxpoolChannel are handled. They are dropped by default.
+func ReactorWrongChannelPolicy(policy WrongChannelPolicy) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.wrongChannelPolicy = policy }
+}
+
+// ReactorMaxMsgElements sets the max number of fields, counting each element
+// of repeated fields, a received message may encode. Peers sending larger
+// messages are stopped before the message is decoded. Defaults to
+// defaultMaxMsgElements.
+func ReactorMaxMsgElements(max int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.maxMsgElements = max }
+}
+
+// ReactorMaxScanPerWake makes broadcast routines yield after handling max
+// votes in a row, so one walking a long pool for a peer far behind doesn't
+// starve the others. Defaults to defaultMaxScanPerWake.
+func ReactorMaxScanPerWake(max int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.maxScanPerWake = max }
+}
+
+// ReactorWakeCoalesceWindow makes broadcast routines, once woken by a vote
+// arriving while they were caught up, wait for window before handling it, so
+// that a burst of votes is handled in one go rather than with a wake per vote.
+// This trades a little latency for less scheduling. Routines handle votes as
+// soon as they arrive by default.
+func ReactorWakeCoalesceWindow(window time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.wakeCoalesceWindow = window }
+}
+
+// ReactorMaxUnknownMessages stops peers once they sent more than max messages
+// of unknown type. With max = 0 (the default) such messages are only logged.
+func ReactorMaxUnknownMessages(max int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.maxUnknownMsgs = max }
+}
+
+// ReactorDeterministicPeerIDs derives the IDs reserved for peers from their
+// p2p.ID rather than assigning them in the order peers are added, which makes
+// the mapping reproducible. Peers are given IDs in order by default.
+func ReactorDeterministicPeerIDs() ReactorOption {
+	return func(txR *TxpoolReactor) { txR.ids.deterministic = true }
+}
+
+// ReactorPeerIDCooldown keeps the ID of a removed peer from being given to
+// another peer for cooldown, so that a peer connecting right after another
+// left doesn't get its ID while votes may still be marked as sent under it.
+// The removed peer gets its ID back if it reconnects meanwhile, and IDs
+// cooling down are given out anyway when no other ID is left. IDs can be
+// given again right away by default.
+func ReactorPeerIDCooldown(cooldown time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.ids.cooldown = cooldown }
+}
+
+// ReactorSignEnvelopes makes the reactor sign the votes it relays with the
+// node key, and verify the signature of the votes relayed by peers. This
+// authenticates the relay path on top of the votes' own signatures. Signed
+// envelopes are sent to all peers: peers which enabled it too reject
+// unsigned votes from the node, and the others accept signed ones as well.
+func ReactorSignEnvelopes(privKey crypto.PrivKey) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.privKey = privKey }
+}
+
 // SetLogger sets the Logger on the reactor and the underlying Mempool.
 func (txR *TxpoolReactor) SetLogger(l log.Logger) {
 	txR.Logger = l
+	txR.recvLogger = newSampledLogger(l, txR.logSampling)
 	txR.Txpool.SetLogger(l)
 }
 
 // OnStart implements p2p.BaseReactor.
 func (txR *TxpoolReactor) OnStart() error {
+	if err := checkMessagesRegistered(cdc); err != nil {
+		return err
+	}
 	if !txR.config.Broadcast {
 		txR.Logger.Info("Tx broadcasting is disabled")
 	}
+	if txR.compactInterval > 0 {
+		go txR.compactRoutine()
+	}
+	if txR.syncStatus != nil {
+		go txR.syncGuardRoutine()
+	}
+	if txR.broadcastIdleTimeout > 0 {
+		go txR.idleWakeRoutine()
+	}
+	if txR.sharedBroadcast() {
+		txR.startBroadcastWorkers()
+	}
+	txR.armWarmUp()
 	return nil
 }
 
+// compactRoutine compacts the reactor and the pool every compactInterval.
+func (txR *TxpoolReactor) compactRoutine() {
+	ticker := time.NewTicker(txR.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			txR.recordLoopRun(loopCompactor, start, txR.compact())
+		case <-txR.Quit():
+			return
+		}
+	}
+}
+
+// Compact forgets which votes the peers which are gone had, as their IDs may
+// be given to new peers, once their IDs are done cooling down, see
+// ReactorPeerIDCooldown, and then compacts the pool. Votes are processed one
+// at a time, so broadcasting isn't held up.
+func (txR *TxpoolReactor) Compact() {
+	txR.compact()
+}
+
+// compact runs Compact, and returns the number of senders forgotten.
+func (txR *TxpoolReactor) compact() int {
+	// the senders of IDs cooling down are kept, as their peer gets them back
+	// if it reconnects before the cooldown is over
+	retained := txR.ids.RetainedIDs()
+
+	var pruned int
+	for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		memTx.senders.Range(func(key, _ interface{}) bool {
+			id := key.(uint16)
+			if _, ok := retained[id]; !ok && id != UnknownPeerID && memTx.removeSender(id) {
+				pruned++
+			}
+			return true
+		})
+	}
+	txR.Txpool.Compact()
+	txR.Logger.Debug("Compacted", "prunedSenders", pruned)
+	return pruned
+}
+
+// ReassignPeer gives the peer a new ID, see txpoolIDs.Reassign, and returns
+// it. The votes the peer had under its old ID, its duplicates and its
+// blacklisting, are moved to the new one, so the old ID can be given to
+// another peer. The old ID stays reserved for reassignGrace, as the sends
+// started under it may still mark votes as sent under it, and is then freed
+// once they are moved too.
+func (txR *TxpoolReactor) ReassignPeer(peer p2p.Peer) uint16 {
+	oldID := txR.ids.GetForPeer(peer)
+	newID := txR.ids.Reassign(peer)
+
+	txR.blacklistMtx.Lock()
+	if _, ok := txR.blacklistedIDs[oldID]; ok {
+		delete(txR.blacklistedIDs, oldID)
+		txR.blacklistedIDs[newID] = struct{}{}
+	}
+	txR.blacklistMtx.Unlock()
+
+	moved := txR.moveSenders(oldID, newID)
+	txR.Logger.Debug("Reassigned peer ID", "peer", peer, "old", oldID, "new", newID, "movedSenders", moved)
+	time.AfterFunc(reassignGrace, func() {
+		txR.moveSenders(oldID, newID)
+		txR.ids.Free(oldID, peer)
+	})
+	return newID
+}
+
+// moveSenders moves the votes, and duplicates, recorded under oldID to newID,
+// and returns the number of votes moved.
+func (txR *TxpoolReactor) moveSenders(oldID, newID uint16) int {
+	var moved int
+	for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.removeSender(oldID) {
+			memTx.addSender(newID)
+			moved++
+		}
+	}
+	txR.Txpool.movePeerDuplicates(oldID, newID)
+	return moved
+}
+
+// SubmitVote checks the vote into the pool, as if passed to CheckTx, and
+// returns what came of it. Once added, the vote is picked up by the broadcast
+// routines, or workers, of all the peers. It returns ErrBroadcastDisabled,
+// without checking the vote, if the config turns broadcasting off.
+func (txR *TxpoolReactor) SubmitVote(vote types.TxVote) (CheckTxResult, error) {
+	if !txR.config.Broadcast {
+		return CheckTxResult{PoolSize: txR.Txpool.Size()}, ErrBroadcastDisabled
+	}
+	return txR.Txpool.CheckTxWithResult(vote, TxVoteInfo{PeerID: UnknownPeerID})
+}
+
+// SyncPeer sends the peer every vote of the pool it hasn't seen yet, as the
+// broadcast routine would but whatever the peer's height, eg. to catch up a
+// peer after it lost votes. It returns the number of votes sent, and stops
+// at the first one the peer can't take, returning ErrPeerSendFailed.
+func (txR *TxpoolReactor) SyncPeer(peer p2p.Peer) (int, error) {
+	txR.peersMtx.RLock()
+	current := txR.peers[peer.ID()] == peer
+	txR.peersMtx.RUnlock()
+	if !current {
+		return 0, ErrUnknownPeer
+	}
+
+	peerID := txR.ids.GetForPeer(peer)
+	signed := txR.signsOutbound()
+	var sent int
+	for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+		if !txR.shouldSendTo(peer, peerID, e) {
+			continue
+		}
+		txTx := e.Value.(*mempoolTxVote)
+		if !txR.deliverVote(peer, peerID, txR.encodeVoteFor(peer, txTx, signed), txTx) {
+			return sent, ErrPeerSendFailed
+		}
+		sent++
+	}
+	txR.Logger.Debug("Synced peer", "peer", peer, "sent", sent)
+	return sent, nil
+}
+
 // GetChannels implements Reactor.
 // It returns the list of channels for this reactor.
 func (txR *TxpoolReactor) GetChannels() []*p2p.ChannelDescriptor {
@@ -141,40 +935,511 @@ func (txR *TxpoolReactor) GetChannels() []*p2p.ChannelDescriptor {
 	}
 }
 
+// ActivePeers returns the peers the reactor knows of, with the IDs reserved
+// for them.
+func (txR *TxpoolReactor) ActivePeers() map[p2p.ID]uint16 {
+	return txR.ids.ActivePeers()
+}
+
+// PeerLag is how far a connected peer is behind our height.
+type PeerLag struct {
+	ID     p2p.ID
+	Height int64 // height reported in the peer's PeerState
+	Lag    int64 // number of heights the peer is behind
+}
+
+// LaggingPeers returns the connected peers whose reported height is below
+// ourHeight, most lagging first. Peers without a PeerState are left out, as
+// the broadcast routine doesn't know their height either.
+func (txR *TxpoolReactor) LaggingPeers(ourHeight int64) []PeerLag {
+	txR.peersMtx.RLock()
+	defer txR.peersMtx.RUnlock()
+
+	lagging := make([]PeerLag, 0)
+	for id, peer := range txR.peers {
+		peerState, ok := peer.Get(ttypes.PeerStateKey).(PeerState)
+		if !ok {
+			continue
+		}
+		if height := peerState.GetHeight(); height < ourHeight {
+			lagging = append(lagging, PeerLag{ID: id, Height: height, Lag: ourHeight - height})
+		}
+	}
+	sort.Slice(lagging, func(i, j int) bool {
+		if lagging[i].Lag != lagging[j].Lag {
+			return lagging[i].Lag > lagging[j].Lag
+		}
+		return lagging[i].ID < lagging[j].ID
+	})
+	return lagging
+}
+
+// BroadcastCoverage returns, for each vote in the pool keyed by its hex
+// encoded ID, the number of active peers known to have it, either because
+// they sent it to us or because we sent it to them.
+func (txR *TxpoolReactor) BroadcastCoverage() map[string]int {
+	active := txR.ids.ActivePeers()
+	coverage := make(map[string]int)
+	for e := txR.Txpool.TxsFront(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		covered := 0
+		for _, id := range active {
+			if _, ok := memTx.senders.Load(id); ok {
+				covered++
+			}
+		}
+		coverage[fmt.Sprintf("%X", memTx.tx.Signature)] = covered
+	}
+	return coverage
+}
+
+// Blacklist makes the reactor drop the votes received from the peer with the
+// given ID, and stop broadcasting to it. The peer stays blacklisted if it
+// reconnects, while the ID, once freed, isn't. Nothing is blacklisted if no
+// peer has the ID. The blacklist is kept in memory only.
+func (txR *TxpoolReactor) Blacklist(peerID uint16) {
+	txR.blacklistMtx.Lock()
+	defer txR.blacklistMtx.Unlock()
+	// resolved with the lock held, so that a peer being removed meanwhile
+	// can't leave its ID blacklisted
+	if id, ok := txR.ids.peerFor(peerID); ok {
+		txR.blacklist[id] = struct{}{}
+		txR.blacklistedIDs[peerID] = struct{}{}
+	}
+}
+
+// Unblacklist removes the peer with the given ID from the blacklist.
+func (txR *TxpoolReactor) Unblacklist(peerID uint16) {
+	txR.blacklistMtx.Lock()
+	defer txR.blacklistMtx.Unlock()
+	if id, ok := txR.ids.peerFor(peerID); ok {
+		delete(txR.blacklist, id)
+	}
+	delete(txR.blacklistedIDs, peerID)
+}
+
+func (txR *TxpoolReactor) isBlacklisted(peerID uint16) bool {
+	txR.blacklistMtx.RLock()
+	defer txR.blacklistMtx.RUnlock()
+	_, ok := txR.blacklistedIDs[peerID]
+	return ok
+}
+
+// addBlacklistedID blacklists the ID of the peer, if the peer is.
+func (txR *TxpoolReactor) addBlacklistedID(peer p2p.Peer) {
+	txR.blacklistMtx.Lock()
+	defer txR.blacklistMtx.Unlock()
+	if _, ok := txR.blacklist[peer.ID()]; ok {
+		txR.blacklistedIDs[txR.ids.GetForPeer(peer)] = struct{}{}
+	}
+}
+
+// removeBlacklistedID frees the ID of the peer from the blacklist, once the
+// peer is removed.
+func (txR *TxpoolReactor) removeBlacklistedID(id uint16) {
+	txR.blacklistMtx.Lock()
+	delete(txR.blacklistedIDs, id)
+	txR.blacklistMtx.Unlock()
+}
+
 // AddPeer implements Reactor.
 // It starts a broadcast routine ensuring all txs are forwarded to the given peer.
 func (txR *TxpoolReactor) AddPeer(peer p2p.Peer) {
 	txR.ids.ReserveForPeer(peer)
-	go txR.broadcastTxRoutine(peer)
+	txR.addBlacklistedID(peer)
+	txR.peersMtx.Lock()
+	txR.peers[peer.ID()] = peer
+	txR.peersMtx.Unlock()
+	txR.recountHeightBroadcasts()
+	txR.addPeerReceiver(peer)
+	if txR.privKey != nil {
+		peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(&SignedEnvelopesMessage{}))
+	}
+	txR.announceVersion(peer)
+	txR.announceCapabilities(peer)
+	if txR.bulkSyncEnabled() {
+		txR.startBulkSync(peer)
+	}
+	txR.maybeWarmUp(peer)
+	if txR.sharedBroadcast() {
+		txR.broadcastScheduler.add(peer)
+	} else if !txR.startBroadcastRoutine(peer) {
+		txR.Logger.Error("Broadcast routine already running for peer", "peer", peer)
+	}
+}
+
+// startBroadcastRoutine spawns broadcastTxRoutine for the given peer. On a
+// fast reconnect the routine of the previous connection may not have noticed
+// its peer quit yet, so we wait for it to return before spawning a new one.
+// It returns false if a routine for this very peer is already running.
+func (txR *TxpoolReactor) startBroadcastRoutine(peer p2p.Peer) bool {
+	return txR.spawnBroadcastRoutine(peer, txR.broadcastStartDelay)
+}
+
+// spawnBroadcastRoutine is startBroadcastRoutine, with the routine waiting
+// for startDelay before broadcasting.
+func (txR *TxpoolReactor) spawnBroadcastRoutine(peer p2p.Peer, startDelay time.Duration) bool {
+	for {
+		txR.routinesMtx.Lock()
+		prev, ok := txR.routines[peer.ID()]
+		if !ok {
+			routine := &broadcastRoutine{peer: peer, done: make(chan struct{})}
+			txR.routines[peer.ID()] = routine
+			txR.routinesMtx.Unlock()
+
+			txR.trackBroadcastGoroutine(1)
+			go func() {
+				defer txR.trackBroadcastGoroutine(-1)
+				defer txR.finishBroadcastRoutine(routine)
+				txR.broadcastTxRoutine(peer, startDelay)
+			}()
+			return true
+		}
+		txR.routinesMtx.Unlock()
+
+		if prev.peer == peer {
+			return false
+		}
+		select {
+		case <-prev.done:
+		case <-txR.Quit():
+			return false
+		}
+	}
+}
+
+// finishBroadcastRoutine unregisters the routine and signals anyone waiting
+// to start a new one for the same peer ID.
+func (txR *TxpoolReactor) finishBroadcastRoutine(routine *broadcastRoutine) {
+	txR.routinesMtx.Lock()
+	id := routine.peer.ID()
+	if txR.routines[id] == routine {
+		delete(txR.routines, id)
+	}
+	txR.routinesMtx.Unlock()
+	close(routine.done)
 }
 
 // RemovePeer implements Reactor.
 func (txR *TxpoolReactor) RemovePeer(peer p2p.Peer, reason interface{}) {
+	txR.recordDisconnect(peer, reason)
+	id := txR.ids.GetForPeer(peer)
+	txR.Txpool.forgetPeerDuplicates(id)
 	txR.ids.Reclaim(peer)
+	txR.removeBlacklistedID(id)
+	txR.recountHeightBroadcasts()
+	txR.peersMtx.Lock()
+	if txR.peers[peer.ID()] == peer {
+		delete(txR.peers, peer.ID())
+	}
+	txR.peersMtx.Unlock()
+
+	txR.unknownMsgsMtx.Lock()
+	delete(txR.unknownMsgs, peer.ID())
+	txR.unknownMsgsMtx.Unlock()
+
+	txR.msgCountsMtx.Lock()
+	delete(txR.msgCounts, peer.ID())
+	txR.msgCountsMtx.Unlock()
+
+	txR.interestsMtx.Lock()
+	delete(txR.interests, peer.ID())
+	txR.interestsMtx.Unlock()
+
+	txR.signingPeersMtx.Lock()
+	delete(txR.signingPeers, peer.ID())
+	txR.signingPeersMtx.Unlock()
+
+	txR.peerVersionsMtx.Lock()
+	delete(txR.peerVersions, peer.ID())
+	txR.peerVersionsMtx.Unlock()
+
+	txR.bulkSyncMtx.Lock()
+	delete(txR.bulkSyncing, peer.ID())
+	delete(txR.bulkServed, peer.ID())
+	txR.bulkSyncMtx.Unlock()
+
+	txR.warmUpMtx.Lock()
+	delete(txR.warmingUp, peer.ID())
+	delete(txR.warmedUp, peer.ID())
+	txR.warmUpMtx.Unlock()
+
+	txR.peerHeightsMtx.Lock()
+	delete(txR.peerHeights, peer.ID())
+	txR.peerHeightsMtx.Unlock()
+
+	txR.stopPeerReceiver(peer)
+	txR.removeOutbox(peer)
+	txR.broadcastScheduler.remove(peer)
+
+	txR.routinesMtx.Lock()
+	if txR.idlePeers[peer.ID()] == peer {
+		delete(txR.idlePeers, peer.ID())
+	}
+	txR.routinesMtx.Unlock()
 	// broadcast routine checks if peer is gone and returns
 }
 
 // Receive implements Reactor.
 // It adds any received transactions to the txpool.
 func (txR *TxpoolReactor) Receive(chID byte, src p2p.Peer, msgBytes []byte) {
+	txR.recordTrace(chID, src, msgBytes)
+	if chID != TxpoolChannel {
+		txR.Logger.Error("Message on wrong channel", "src", src, "chId", chID)
+		txR.Txpool.metrics.WrongChannelMsgs.Add(1)
+		if txR.wrongChannelPolicy == WrongChannelStopPeer || txR.strictProtocol {
+			txR.Switch.StopPeerForError(src, ErrWrongChannel)
+		}
+		return
+	}
+	txR.applyBackpressure(src)
+	txR.receiveMsg(src, msgBytes, false)
+}
+
+// receiveMsg decodes and handles a message received from the peer, on its own
+// or in a bundle.
+func (txR *TxpoolReactor) receiveMsg(src p2p.Peer, msgBytes []byte, bundled bool) {
+	if err := checkMsgElements(msgBytes, txR.maxMsgElements); err != nil {
+		txR.Logger.Error("Rejecting message", "src", src, "chId", TxpoolChannel, "err", err)
+		txR.Switch.StopPeerForError(src, malformedMsgErr(err))
+		return
+	}
 	msg, err := decodeMsg(msgBytes)
 	if err != nil {
-		txR.Logger.Error("Error decoding message", "src", src, "chId", chID, "msg", msg, "err", err, "bytes", msgBytes)
-		txR.Switch.StopPeerForError(src, err)
+		txR.Logger.Error("Error decoding message", "src", src, "chId", TxpoolChannel, "msg", msg, "err", err, "bytes", msgBytes)
+		txR.Switch.StopPeerForError(src, malformedMsgErr(err))
 		return
 	}
-	txR.Logger.Debug("Receive", "src", src, "chId", chID, "msg", msg)
+	seq := atomic.AddUint64(&txR.recvSeq, 1)
+	txR.recvLogger.Debug("Receive", "src", src, "chId", TxpoolChannel, "seq", seq, "msg", msg)
+	txR.countMsg(src, msg)
 
+	if txR.dropUntrusted(src, msg) {
+		return
+	}
+	txR.restoreVotes(msg)
 	switch msg := msg.(type) {
 	case *TxMessage:
-		peerID := txR.ids.GetForPeer(src)
-		err := txR.Txpool.CheckTxWithInfo(msg.Tx, TxVoteInfo{PeerID: peerID})
-		if err != nil {
-			txR.Logger.Info("Could not check tx", "tx", TxVoteID(msg.Tx), "err", err)
+		txR.receiveUnsignedTx(src, msg.Tx, seq)
+	case *TxV2Message:
+		txR.receiveUnsignedTx(src, txR.inboundVote(fromTxVoteV2(msg.Tx)), seq)
+	case *VersionMessage:
+		txR.receiveVersion(src, msg)
+	case *TxsMessage:
+		if txR.privKey != nil && txR.signsEnvelopes(src) {
+			txR.Switch.StopPeerForError(src, ErrInvalidEnvelopeSignature)
+			return
+		}
+		txR.receiveBatch(src, msg.Txs, seq)
+	case *SignedTxMessage:
+		if err := msg.Verify(src.ID()); err != nil {
+			txR.Logger.Error("Invalid envelope", "src", src, "tx", TxVoteID(msg.Tx), "err", err)
+			txR.Switch.StopPeerForError(src, err)
+			return
+		}
+		txR.verifyAndReceiveTx(src, txR.inboundVote(msg.Tx), seq, txR.inboundProvenance(msg))
+	case *SignedEnvelopesMessage:
+		txR.signingPeersMtx.Lock()
+		txR.signingPeers[src.ID()] = struct{}{}
+		txR.signingPeersMtx.Unlock()
+	case *PoolRequestMessage:
+		txR.servePoolChunk(src, msg)
+	case *PoolChunkMessage:
+		if msg.Signature != nil || txR.privKey != nil && txR.signsEnvelopes(src) {
+			if err := msg.Verify(src.ID()); err != nil {
+				txR.Logger.Error("Invalid pool chunk signature", "src", src, "offset", msg.Offset, "err", err)
+				txR.Switch.StopPeerForError(src, err)
+				return
+			}
+			txR.restoreTxs(msg.Txs)
+		}
+		txR.receivePoolChunk(src, msg, seq)
+	case *WarmUpRequestMessage:
+		txR.serveWarmUp(src, msg)
+	case *WarmUpChunkMessage:
+		if msg.Signature != nil || txR.privKey != nil && txR.signsEnvelopes(src) {
+			if err := msg.Verify(src.ID()); err != nil {
+				txR.Logger.Error("Invalid warm-up chunk signature", "src", src, "err", err)
+				txR.Switch.StopPeerForError(src, err)
+				return
+			}
+			txR.restoreTxs(msg.Txs)
+		}
+		txR.receiveWarmUpChunk(src, msg, seq)
+	case *AckMessage:
+		txR.receiveAck(src, msg)
+	case *BundleMessage:
+		if bundled {
+			txR.Logger.Error("Nested bundle", "src", src)
+			txR.Switch.StopPeerForError(src, malformedMsgErr(ErrNestedBundle))
+			return
 		}
-		// broadcasting happens from go routines per peer
+		txR.receiveBundle(src, msg)
+	case *ExtensionMessage:
+		txR.receiveExtension(src, msg, bundled)
+	case *CapabilitiesMessage:
+		txR.receiveCapabilities(src, msg)
+	case *InterestMessage:
+		txR.interestsMtx.Lock()
+		txR.interests[src.ID()] = msg
+		txR.interestsMtx.Unlock()
 	default:
 		txR.Logger.Error(fmt.Sprintf("Unknown message type %v", reflect.TypeOf(msg)))
+		if txR.strictProtocol {
+			txR.Switch.StopPeerForError(src, ErrUnknownMsgType)
+		} else if txR.countUnknownMsg(src) {
+			txR.Switch.StopPeerForError(src, ErrTooManyUnknownMessages)
+		}
+	}
+}
+
+// receiveUnsignedTx verifies a vote the peer sent outside of an envelope, and
+// adds it to the pool.
+func (txR *TxpoolReactor) receiveUnsignedTx(src p2p.Peer, tx types.TxVote, seq uint64) {
+	if txR.privKey != nil && txR.signsEnvelopes(src) {
+		// The peer agreed to sign what it relays, don't let unsigned votes
+		// through.
+		txR.Switch.StopPeerForError(src, ErrInvalidEnvelopeSignature)
+		return
+	}
+	if txR.peerReceiveWorkers > 1 {
+		// keep it in order with the batches being verified
+		txR.receiveBatch(src, []types.TxVote{tx}, seq)
+		return
+	}
+	txR.verifyAndReceiveTx(src, tx, seq, nil)
+}
+
+// receiveTx adds a vote received from the peer to the pool, and returns the
+// error checking it, errVoteNotChecked if it wasn't, or errVoteDropped if
+// the pool dropped it. Only the votes added, or already seen, are acked.
+func (txR *TxpoolReactor) receiveTx(src p2p.Peer, tx types.TxVote, seq uint64, provenance []RelayHop) error {
+	peerID := txR.ids.GetForPeer(src)
+	if txR.isBlacklisted(peerID) {
+		txR.Txpool.metrics.BlacklistedTxs.Add(1)
+		return errVoteNotChecked
+	}
+	info := TxVoteInfo{PeerID: peerID, ReceiveSeq: seq, Provenance: provenance}
+	if txR.deferIfSyncing(tx, info) {
+		return errVoteNotChecked
+	}
+	res, err := txR.Txpool.CheckTxWithResult(tx, info)
+	if err != nil && err != ErrPoolStopped { // shutting down, drop it quietly
+		txR.recvLogger.Info("Could not check tx", "tx", TxVoteID(tx), "seq", seq, "height", tx.Height, "err", err)
+	}
+	if res.Dropped {
+		txR.recvLogger.Debug("Dropped tx", "tx", TxVoteID(tx), "seq", seq, "height", tx.Height)
+		return errVoteDropped
+	}
+	if err == nil || err == ErrTxVoteInCache {
+		txR.sendAck(src, tx)
+	}
+	// either way, the peer has it
+	txR.checkTxHeightBroadcast(tx)
+	// broadcasting happens from go routines per peer
+	return err
+}
+
+// verifyVote runs the vote verifier, if any, on tx.
+func (txR *TxpoolReactor) verifyVote(tx types.TxVote) error {
+	if txR.voteVerifier == nil {
+		return nil
+	}
+	return txR.voteVerifier(tx)
+}
+
+// verifyVotes verifies the votes of a batch using up to verifyParallelism
+// goroutines, and returns the verification error of each vote.
+func (txR *TxpoolReactor) verifyVotes(txs []types.TxVote) []error {
+	errs := make([]error, len(txs))
+	workers := txR.verifyParallelism
+	if workers > len(txs) {
+		workers = len(txs)
+	}
+	if txR.voteVerifier == nil || workers <= 1 {
+		for i, tx := range txs {
+			errs[i] = txR.verifyVote(tx)
+		}
+		return errs
+	}
+
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan int)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = txR.verifyVote(txs[i])
+			}
+		}()
+	}
+	for i := range txs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+// signsOutbound returns true if the votes sent to peers go in signed
+// envelopes. It is the case for all peers once ReactorSignEnvelopes is used,
+// whether they announced signing or not: the node announces it to every peer
+// as soon as added, and those signing too reject unsigned votes from it,
+// including the first ones, sent before their own announcement got in.
+func (txR *TxpoolReactor) signsOutbound() bool {
+	return txR.privKey != nil
+}
+
+// signsEnvelopes returns true if the peer announced it signs the votes it
+// relays.
+func (txR *TxpoolReactor) signsEnvelopes(peer p2p.Peer) bool {
+	txR.signingPeersMtx.RLock()
+	defer txR.signingPeersMtx.RUnlock()
+	_, ok := txR.signingPeers[peer.ID()]
+	return ok
+}
+
+// countUnknownMsg records a message of unknown type from the peer and returns
+// true if the peer went over the limit.
+func (txR *TxpoolReactor) countUnknownMsg(peer p2p.Peer) bool {
+	if txR.maxUnknownMsgs <= 0 {
+		return false
+	}
+
+	txR.unknownMsgsMtx.Lock()
+	defer txR.unknownMsgsMtx.Unlock()
+
+	txR.unknownMsgs[peer.ID()]++
+	return txR.unknownMsgs[peer.ID()] > txR.maxUnknownMsgs
+}
+
+// peerInterested returns true if the vote matches the interest declared by the
+// peer, or if the peer didn't declare any.
+func (txR *TxpoolReactor) peerInterested(peer p2p.Peer, tx types.TxVote) bool {
+	txR.interestsMtx.RLock()
+	interest, ok := txR.interests[peer.ID()]
+	txR.interestsMtx.RUnlock()
+	return !ok || interest.Matches(tx)
+}
+
+// coalesceWake is called by broadcast routines woken by a vote. It waits for
+// the coalescing window, if any, and returns false if the peer or the reactor
+// stopped meanwhile.
+func (txR *TxpoolReactor) coalesceWake(peer p2p.Peer) bool {
+	txR.Txpool.metrics.BroadcastWakes.Add(1)
+	if txR.wakeCoalesceWindow <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(txR.wakeCoalesceWindow):
+		return true
+	case <-peer.Quit():
+		return false
+	case <-txR.Quit():
+		return false
 	}
 }
 
@@ -183,28 +1448,154 @@ type PeerState interface {
 	GetHeight() int64
 }
 
+// ValidatorPeerState is implemented by the PeerState of peers which may be
+// validators. See ReactorValidatorPeersOnly.
+type ValidatorPeerState interface {
+	PeerState
+	IsValidator() bool
+}
+
+// isValidatorPeer returns true if the validator peers, or the peer's state,
+// report the peer as a validator.
+func (txR *TxpoolReactor) isValidatorPeer(peer p2p.Peer, peerState PeerState) bool {
+	if txR.validatorPeers != nil && txR.validatorPeers.IsValidatorPeer(peer.ID()) {
+		return true
+	}
+	vps, ok := peerState.(ValidatorPeerState)
+	return ok && vps.IsValidator()
+}
+
 // Send new txpool txs to peer.
-func (txR *TxpoolReactor) broadcastTxRoutine(peer p2p.Peer) {
+func (txR *TxpoolReactor) broadcastTxRoutine(peer p2p.Peer, startDelay time.Duration) {
 	if !txR.config.Broadcast {
 		return
 	}
 
+	if startDelay > 0 {
+		select {
+		case <-time.After(startDelay):
+		case <-peer.Quit():
+			return
+		case <-txR.Quit():
+			return
+		}
+	}
+
 	peerID := txR.ids.GetForPeer(peer)
-	var next *clist.CElement
+	var budget *byteBudget
+	if txR.peerSendRate > 0 {
+		budget = newByteBudget(txR.peerSendRate, txR.peerSendBurst)
+	}
+	var batch *voteBatch
+	if txR.batchSize > 1 {
+		batch = newVoteBatch(txR.batchSize, txR.batchFlushInterval, txR.batchClock)
+		defer batch.take()
+	}
+	lanes := newLaneScheduler(txR.laneClassifier, txR.normalLaneEvery)
+	var (
+		next        *clist.CElement
+		nextHandled bool            // next was handled, move on to the vote after it
+		queued      *clist.CElement // vote deferred by lanes or retries, being handled
+		retries     fanoutRetries   // votes skipped until the next cycle, see claimFanout
+		stepDone    chan struct{}   // step being handled, see broadcastStep
+		scanned     int             // votes handled since the last yield
+		attempts    int             // failed sends of the vote being handled
+	)
+	idle := newIdleTimer(txR.broadcastIdleTimeout)
+	defer idle.stop()
+	defer retries.stop()
 	for {
 		// In case of both next.NextWaitChan() and peer.Quit() are variable at the same time
 		if !txR.IsRunning() || !peer.IsRunning() {
 			return
 		}
+		select {
+		case <-batch.flushC():
+			// the batch came due while we were busy
+			if !txR.flushBatch(peer, peerID, batch, budget) {
+				return
+			}
+		default:
+		}
+		idle.reset()
+		if next != nil && nextHandled && queued == nil {
+			caughtUp := next.Next() == nil
+			if queued = retries.popDue(); queued == nil {
+				queued = lanes.popDue(caughtUp)
+			}
+			if queued == nil {
+			waitNext:
+				for {
+					select {
+					case <-retries.dueC():
+						if queued = retries.popDue(); queued != nil {
+							break waitNext
+						}
+					case <-next.NextWaitChan():
+						if caughtUp && !txR.coalesceWake(peer) {
+							return
+						}
+						// see below for nil check
+						next = next.Next()
+						nextHandled = false
+						break waitNext
+					case <-batch.flushC():
+						if !txR.flushBatch(peer, peerID, batch, budget) {
+							return
+						}
+					case <-idle.C():
+						if _, ok := retries.untilDue(); !ok && txR.parkBroadcastRoutine(peer, next) {
+							return
+						}
+					case <-peer.Quit():
+						return
+					case <-txR.Quit():
+						return
+					}
+				}
+			}
+		}
 		// This happens because the CElement we were looking at got garbage
 		// collected (removed). That is, .NextWait() returned nil. Go ahead and
 		// start from the beginning.
-		if next == nil {
-			select {
-			case <-txR.Txpool.TxsWaitChan(): // Wait until a tx is available
-				if next = txR.Txpool.TxsFront(); next == nil {
+		if next == nil && queued == nil {
+			if queued = retries.popDue(); queued == nil {
+				queued = lanes.popDue(true)
+			}
+			if queued == nil {
+				empty := txR.Txpool.TxsFront() == nil
+				select {
+				case <-retries.dueC():
+					continue
+				case <-txR.Txpool.TxsWaitChan(): // Wait until a tx is available
+					if empty && !txR.coalesceWake(peer) {
+						return
+					}
+					if next = txR.Txpool.TxsFront(); next == nil {
+						continue
+					}
+					nextHandled = false
+				case <-batch.flushC():
+					if !txR.flushBatch(peer, peerID, batch, budget) {
+						return
+					}
 					continue
+				case <-idle.C():
+					if _, ok := retries.untilDue(); !ok && txR.parkBroadcastRoutine(peer, nil) {
+						return
+					}
+					continue
+				case <-peer.Quit():
+					return
+				case <-txR.Quit():
+					return
 				}
+			}
+		}
+
+		if txR.broadcastStep != nil && stepDone == nil {
+			select {
+			case stepDone = <-txR.broadcastStep:
 			case <-peer.Quit():
 				return
 			case <-txR.Quit():
@@ -212,47 +1603,160 @@ func (txR *TxpoolReactor) broadcastTxRoutine(peer p2p.Peer) {
 			}
 		}
 
-		txTx := next.Value.(*mempoolTxVote)
+		// the peer's ID may have been reassigned, see ReassignPeer
+		peerID = txR.ids.GetForPeer(peer)
+		elem := next
+		if queued != nil {
+			elem = queued
+		}
+		txTx := elem.Value.(*mempoolTxVote)
 
 		// make sure the peer is up to date
-		peerState, ok := peer.Get(ttypes.PeerStateKey).(PeerState)
-		if !ok {
-			// Peer does not have a state yet. We set it in the consensus reactor, but
-			// when we add peer in Switch, the order we call reactors#AddPeer is
-			// different every time due to us using a map. Sometimes other reactors
-			// will be initialized before the consensus reactor. We should wait a few
-			// milliseconds and retry.
-			time.Sleep(peerCatchupSleepIntervalMS * time.Millisecond)
-			continue
+		ready, stop := txR.peerReadyFor(peer, txTx)
+		if stop {
+			return
 		}
-		if peerState.GetHeight() < txTx.Height()-1 { // Allow for a lag of 1 block
+		if !ready {
 			time.Sleep(peerCatchupSleepIntervalMS * time.Millisecond)
 			continue
 		}
 
-		// ensure peer hasn't already sent us this tx
-		if _, ok := txTx.senders.Load(peerID); !ok {
-			// send txTx
-			msg := &TxMessage{Tx: txTx.tx}
-			success := peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(msg))
-			if !success {
-				time.Sleep(peerCatchupSleepIntervalMS * time.Millisecond)
-				continue
+		// normal lane votes are deferred until no high lane vote is due
+		deferred := queued == nil && !elem.Removed() && lanes.deferVote(next)
+		if !deferred && txR.shouldSendTo(peer, peerID, elem) {
+			claimed := txTx.claimFanout(txR.broadcastFanout, peer.ID(), txR.fanoutPicker())
+			signed := txR.signsOutbound()
+			switch {
+			case !claimed:
+				// Enough peers got the vote during this cycle, move on to the
+				// next votes and come back to it on the next one.
+				retries.add(elem)
+			case batch != nil && !signed:
+				// the vote is sent with the batch, see flushBatch
+				batch.size = txR.batchSizeFor(peer)
+				if batch.add(txTx) && !txR.flushBatch(peer, peerID, batch, budget) {
+					return
+				}
+			default:
+				// send txTx
+				msgBytes := txR.encodeVoteFor(peer, txTx, signed)
+				if budget != nil && !budget.wait(int64(len(msgBytes)), peer.Quit(), txR.Quit()) {
+					txTx.releaseFanout(txR.broadcastFanout)
+					return
+				}
+				if !txR.deliverVote(peer, peerID, msgBytes, txTx) {
+					// the send is claimed again on the next attempt
+					txTx.releaseFanout(txR.broadcastFanout)
+					attempts++
+					if txR.maxSendAttempts <= 0 || attempts < txR.maxSendAttempts {
+						time.Sleep(peerCatchupSleepIntervalMS * time.Millisecond)
+						continue
+					}
+					// give up on the vote for this peer
+					txR.deadLetter(peer, "send failed", attempts, txTx.tx)
+				}
 			}
 		}
+		attempts = 0
 
-		select {
-		case <-next.NextWaitChan():
-			// see the start of the for loop for nil check
-			next = next.Next()
-		case <-peer.Quit():
-			return
-		case <-txR.Quit():
-			return
+		if stepDone != nil {
+			close(stepDone)
+			stepDone = nil
+		}
+
+		scanned++
+		if scanned >= txR.maxScanPerWake {
+			scanned = 0
+			txR.Txpool.metrics.BroadcastScanYields.Add(1)
+			runtime.Gosched()
+		}
+
+		if queued != nil {
+			queued = nil
+		} else {
+			nextHandled = true
+			if !deferred {
+				lanes.handledHigh()
+			}
 		}
 	}
 }
 
+// peerReadyFor returns true if the peer is ready for the vote, judging by
+// its PeerState. It returns true for stop if the peer's state can't be read,
+// in which case waiting won't help.
+func (txR *TxpoolReactor) peerReadyFor(peer p2p.Peer, txTx *mempoolTxVote) (ready, stop bool) {
+	value := peer.Get(ttypes.PeerStateKey)
+	peerState, ok := value.(PeerState)
+	if !ok && value != nil {
+		// Someone else stored something under the key, waiting won't help.
+		txR.Logger.Error("Peer state of unexpected type, not broadcasting to peer",
+			"peer", peer, "type", fmt.Sprintf("%T", value))
+		return false, true
+	}
+	if !ok {
+		// Peer does not have a state yet. We set it in the consensus reactor, but
+		// when we add peer in Switch, the order we call reactors#AddPeer is
+		// different every time due to us using a map. Sometimes other reactors
+		// will be initialized before the consensus reactor. We should wait a few
+		// milliseconds and retry.
+		return false, false
+	}
+	if txR.validatorPeersOnly && !txR.isValidatorPeer(peer, peerState) {
+		// Votes only matter to validators. The peer may become one later.
+		return false, false
+	}
+	if txR.limitPeerLag && peerState.GetHeight() < txR.Txpool.Height()-txR.maxPeerLag {
+		// Peer is still syncing, wait for it to catch up.
+		return false, false
+	}
+	if txR.peerStateStale(peer, peerState.GetHeight()) {
+		// Peer's state isn't being updated, its height can't be trusted.
+		return false, false
+	}
+	// Allow for a lag of 1 block
+	return peerState.GetHeight() >= txTx.Height()-1, false
+}
+
+// shouldSendTo returns true if the vote in elem is to be sent to the peer:
+// the peer hasn't already sent us the vote, the vote wasn't committed, it is
+// still in the pool (it may have been flushed while we held it), the peer
+// isn't blacklisted and wants it, and the vote isn't withheld.
+func (txR *TxpoolReactor) shouldSendTo(peer p2p.Peer, peerID uint16, elem *clist.CElement) bool {
+	txTx := elem.Value.(*mempoolTxVote)
+	return !txTx.hasSender(peerID) && !txTx.isCommitted() && !elem.Removed() &&
+		!txR.isBlacklisted(peerID) && txR.peerInterested(peer, txTx.tx) && !txR.withhold.withholds(txTx.tx)
+}
+
+// encodeVoteFor returns the message sending the vote to the peer, in an
+// envelope if signed.
+func (txR *TxpoolReactor) encodeVoteFor(peer p2p.Peer, txTx *mempoolTxVote, signed bool) []byte {
+	if signed {
+		msg := &SignedTxMessage{Tx: txR.outboundVote(txTx.tx), Provenance: txR.outboundProvenance(txTx)}
+		return cdc.MustMarshalBinaryBare(signTxMessage(msg, txR.privKey))
+	}
+	return txR.encodeTxMessageFor(peer, txTx)
+}
+
+// deliverVote sends msgBytes, carrying the vote, to the peer and marks the
+// vote as sent to it. When coalescing, the message is queued instead, and the
+// vote marked as sent with the bundle, see sendBundle. It returns false
+// if the send failed.
+func (txR *TxpoolReactor) deliverVote(peer p2p.Peer, peerID uint16, msgBytes []byte, txTx *mempoolTxVote) bool {
+	if txR.coalescesOutboundTo(peer) {
+		txR.queueOutbound(peer, msgBytes, txTx)
+		return true
+	}
+	if !txR.sendVotes(peer, msgBytes, txTx) {
+		return false
+	}
+	// the peer has it now too
+	txTx.addSender(peerID)
+	atomic.StoreInt64(&txR.lastSend, time.Now().UnixNano())
+	txR.checkHeightBroadcast(txTx)
+	return true
+}
+
 //-----------------------------------------------------------------------------
 // Messages
 
@@ -262,14 +1766,129 @@ type TxpoolMessage interface{}
 func RegisterTxVotePoolMessages(cdc *amino.Codec) {
 	cdc.RegisterInterface((*TxpoolMessage)(nil), nil)
 	cdc.RegisterConcrete(&TxMessage{}, "tendermint/txpool/TxMessage", nil)
+	cdc.RegisterConcrete(&TxsMessage{}, "tendermint/txpool/TxsMessage", nil)
+	cdc.RegisterConcrete(&InterestMessage{}, "tendermint/txpool/InterestMessage", nil)
+	cdc.RegisterConcrete(&PoolRequestMessage{}, "tendermint/txpool/PoolRequestMessage", nil)
+	cdc.RegisterConcrete(&PoolChunkMessage{}, "tendermint/txpool/PoolChunkMessage", nil)
+	cdc.RegisterConcrete(&SignedTxMessage{}, "tendermint/txpool/SignedTxMessage", nil)
+	cdc.RegisterConcrete(&SignedEnvelopesMessage{}, "tendermint/txpool/SignedEnvelopesMessage", nil)
+	cdc.RegisterConcrete(&AckMessage{}, "tendermint/txpool/AckMessage", nil)
+	cdc.RegisterConcrete(&VersionMessage{}, "tendermint/txpool/VersionMessage", nil)
+	cdc.RegisterConcrete(&TxV2Message{}, "tendermint/txpool/TxV2Message", nil)
+	cdc.RegisterConcrete(&BundleMessage{}, "tendermint/txpool/BundleMessage", nil)
+	cdc.RegisterConcrete(&CapabilitiesMessage{}, "tendermint/txpool/CapabilitiesMessage", nil)
+	cdc.RegisterConcrete(&WarmUpRequestMessage{}, "tendermint/txpool/WarmUpRequestMessage", nil)
+	cdc.RegisterConcrete(&WarmUpChunkMessage{}, "tendermint/txpool/WarmUpChunkMessage", nil)
+	cdc.RegisterConcrete(&ExtensionMessage{}, "tendermint/txpool/ExtensionMessage", nil)
 }
 
 func decodeMsg(bz []byte) (msg TxpoolMessage, err error) {
 	if len(bz) > maxMsgSize {
 		return msg, fmt.Errorf("Msg exceeds max size (%d > %d)", len(bz), maxMsgSize)
 	}
-	err = cdc.UnmarshalBinaryBare(bz, &msg)
-	return
+	if err = cdc.UnmarshalBinaryBare(bz, &msg); err != nil {
+		return msg, err
+	}
+	// Amino skips the fields it doesn't know, so bytes appended to a message
+	// may decode fine. Anything from the first field the message doesn't
+	// have on wasn't part of it.
+	if n := decodedLen(bz, msgFields(msg)); n != len(bz) {
+		return nil, errors.Wrapf(ErrTrailingBytes, "%T decoded from %d bytes, got %d", msg, n, len(bz))
+	}
+	return msg, nil
+}
+
+// msgFields returns the number of fields amino encodes msg with: its exported
+// fields, numbered from 1 in order.
+func msgFields(msg TxpoolMessage) int {
+	rt := reflect.TypeOf(msg)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	var n int
+	for i := 0; i < rt.NumField(); i++ {
+		if f := rt.Field(i); f.PkgPath == "" && f.Tag.Get("json") != "-" {
+			n++
+		}
+	}
+	return n
+}
+
+// decodedLen returns the number of bytes of the amino encoded message bz
+// amino decodes into a message with numFields fields: the bytes up to the
+// first field with a higher number, or out of order.
+func decodedLen(bz []byte, numFields int) int {
+	if len(bz) < 4 {
+		return len(bz) // too short for the prefix, decoding reports it
+	}
+	n := 4 // the prefix of the concrete type
+	var last uint64
+	for n < len(bz) {
+		num, size, err := msgField(bz[n:])
+		if err != nil || num > uint64(numFields) || num < last {
+			break
+		}
+		last = num
+		n += size
+	}
+	return n
+}
+
+// msgField returns the number of the first field of bz, an amino encoded
+// message without its prefix, and the bytes it takes, its key included.
+func msgField(bz []byte) (num uint64, size int, err error) {
+	key, ksize := binary.Uvarint(bz)
+	if ksize <= 0 {
+		return 0, 0, errors.New("Invalid field key")
+	}
+	bz = bz[ksize:]
+
+	switch typ3 := key & 0x07; typ3 {
+	case 0: // varint
+		if _, size = binary.Uvarint(bz); size <= 0 {
+			return 0, 0, errors.New("Invalid varint field")
+		}
+	case 1: // 8 bytes
+		size = 8
+	case 2: // length prefixed
+		length, lsize := binary.Uvarint(bz)
+		if lsize <= 0 || length > uint64(len(bz)-lsize) {
+			return 0, 0, fmt.Errorf("Field length %d exceeds msg", length)
+		}
+		size = lsize + int(length)
+	case 5: // 4 bytes
+		size = 4
+	default:
+		return 0, 0, fmt.Errorf("Invalid field type %d", typ3)
+	}
+	if size > len(bz) {
+		return 0, 0, errors.New("Field exceeds msg")
+	}
+	return key >> 3, ksize + size, nil
+}
+
+// checkMsgElements walks the fields of the amino encoded message bz without
+// decoding them, and returns an error as soon as more than max fields are
+// found, or a field claims more bytes than bz holds. Repeated fields encode
+// each element as a separate field, so this bounds what decoding allocates.
+// Only the top level fields of the message are counted.
+func checkMsgElements(bz []byte, max int) error {
+	if len(bz) < 4 {
+		return nil // too short for the prefix, decoding reports it
+	}
+	bz = bz[4:] // skip the prefix of the concrete type
+
+	for n := 0; len(bz) > 0; n++ {
+		if n >= max {
+			return ErrTooManyMsgElements
+		}
+		_, size, err := msgField(bz)
+		if err != nil {
+			return err
+		}
+		bz = bz[size:]
+	}
+	return nil
 }
 
 //-------------------------------------
@@ -283,3 +1902,221 @@ type TxMessage struct {
 func (m *TxMessage) String() string {
 	return fmt.Sprintf("[TxMessage %v]", m.Tx)
 }
+
+//-------------------------------------
+
+// TxV2Message is a TxpoolMessage containing a vote in its version 2 wire
+// form, see ReactorTxVoteVersions.
+type TxV2Message struct {
+	Tx TxVoteV2
+}
+
+// String returns a string representation of the TxV2Message.
+func (m *TxV2Message) String() string {
+	return fmt.Sprintf("[TxV2Message %v]", fromTxVoteV2(m.Tx))
+}
+
+//-------------------------------------
+
+// VersionMessage is a TxpoolMessage announcing the latest vote version the
+// sending peer supports, see ReactorTxVoteVersions.
+type VersionMessage struct {
+	MaxTxVoteVersion uint8
+}
+
+// String returns a string representation of the VersionMessage.
+func (m *VersionMessage) String() string {
+	return fmt.Sprintf("[VersionMessage v%d]", m.MaxTxVoteVersion)
+}
+
+//-------------------------------------
+
+// TxsMessage is a TxpoolMessage containing a batch of votes. The votes are
+// added to the pool in the order of the batch.
+type TxsMessage struct {
+	Txs []types.TxVote
+}
+
+// String returns a string representation of the TxsMessage.
+func (m *TxsMessage) String() string {
+	return fmt.Sprintf("[TxsMessage %d votes]", len(m.Txs))
+}
+
+//-------------------------------------
+
+// PoolRequestMessage is a TxpoolMessage requesting up to Limit votes of the
+// peer's pool, starting at Offset. See ReactorBulkSync.
+type PoolRequestMessage struct {
+	Offset int
+	Limit  int
+}
+
+// String returns a string representation of the PoolRequestMessage.
+func (m *PoolRequestMessage) String() string {
+	return fmt.Sprintf("[PoolRequestMessage %d+%d]", m.Offset, m.Limit)
+}
+
+// PoolChunkMessage is a TxpoolMessage answering a PoolRequestMessage with the
+// votes of the pool starting at Offset. More is set if the pool holds votes
+// past this chunk. Nodes signing envelopes, see ReactorSignEnvelopes, sign
+// the chunks they serve, PubKey and Signature are empty otherwise.
+type PoolChunkMessage struct {
+	Offset    int
+	Txs       []types.TxVote
+	More      bool
+	PubKey    crypto.PubKey
+	Signature []byte
+}
+
+func (m *PoolChunkMessage) signBytes() []byte {
+	return cdc.MustMarshalBinaryBare(&PoolChunkMessage{Offset: m.Offset, Txs: m.Txs, More: m.More})
+}
+
+// sign signs the chunk with the given key.
+func (m *PoolChunkMessage) sign(privKey crypto.PrivKey) {
+	m.PubKey, m.Signature = signEnvelope(privKey, m.signBytes())
+}
+
+// Verify checks that the chunk was signed by the node with the given ID.
+func (m *PoolChunkMessage) Verify(peerID p2p.ID) error {
+	return verifyEnvelope(peerID, m.PubKey, m.signBytes(), m.Signature)
+}
+
+// String returns a string representation of the PoolChunkMessage.
+func (m *PoolChunkMessage) String() string {
+	return fmt.Sprintf("[PoolChunkMessage %d+%d more:%v]", m.Offset, len(m.Txs), m.More)
+}
+
+//-------------------------------------
+
+// BundleMessage is a TxpoolMessage carrying several encoded TxpoolMessages,
+// each handled as if it was sent on its own, see ReactorCoalesceOutbound.
+type BundleMessage struct {
+	Msgs [][]byte
+}
+
+// String returns a string representation of the BundleMessage.
+func (m *BundleMessage) String() string {
+	return fmt.Sprintf("[BundleMessage %d msgs]", len(m.Msgs))
+}
+
+//-------------------------------------
+
+// AckMessage is a TxpoolMessage confirming the receipt of the vote with the
+// given ID (see TxVoteID), see ReactorAcks.
+type AckMessage struct {
+	ID []byte
+}
+
+// String returns a string representation of the AckMessage.
+func (m *AckMessage) String() string {
+	return fmt.Sprintf("[AckMessage %X]", m.ID)
+}
+
+//-------------------------------------
+
+// InterestMessage is a TxpoolMessage declaring which votes the sending peer
+// wants to receive. Zero values put no restriction on the matching field.
+type InterestMessage struct {
+	MinHeight  int64
+	MaxHeight  int64
+	Validators []crypto.Address
+}
+
+// Matches returns true if the vote falls within the declared interest.
+func (m *InterestMessage) Matches(tx types.TxVote) bool {
+	if m.MinHeight > 0 && tx.Height < m.MinHeight {
+		return false
+	}
+	if m.MaxHeight > 0 && tx.Height > m.MaxHeight {
+		return false
+	}
+	if len(m.Validators) == 0 {
+		return true
+	}
+	for _, addr := range m.Validators {
+		if bytes.Equal(addr, tx.ValidatorAddress) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a string representation of the InterestMessage.
+func (m *InterestMessage) String() string {
+	return fmt.Sprintf("[InterestMessage %v-%v %v]", m.MinHeight, m.MaxHeight, m.Validators)
+}
+
+//-------------------------------------
+
+// SignedTxMessage is a TxMessage signed by the node relaying it. With
+// ReactorRelayProvenance, it also carries the nodes the vote went through,
+// covered by the signature.
+type SignedTxMessage struct {
+	Tx         types.TxVote
+	PubKey     crypto.PubKey
+	Signature  []byte
+	Provenance []RelayHop
+}
+
+// newSignedTxMessage returns the vote wrapped in an envelope signed with the
+// given key.
+func newSignedTxMessage(tx types.TxVote, privKey crypto.PrivKey) *SignedTxMessage {
+	return signTxMessage(&SignedTxMessage{Tx: tx}, privKey)
+}
+
+// signTxMessage signs the envelope with the given key, and returns it.
+func signTxMessage(msg *SignedTxMessage, privKey crypto.PrivKey) *SignedTxMessage {
+	msg.PubKey, msg.Signature = signEnvelope(privKey, msg.signBytes())
+	return msg
+}
+
+// signEnvelope returns the public key of privKey and its signature of
+// signBytes, to set on a message signed by the node.
+func signEnvelope(privKey crypto.PrivKey, signBytes []byte) (crypto.PubKey, []byte) {
+	sig, err := privKey.Sign(signBytes)
+	if err != nil {
+		panic(err)
+	}
+	return privKey.PubKey(), sig
+}
+
+// verifyEnvelope checks that signature is the signature of signBytes by
+// pubKey, the key of the node with the given ID.
+func verifyEnvelope(peerID p2p.ID, pubKey crypto.PubKey, signBytes, signature []byte) error {
+	if pubKey == nil || p2p.PubKeyToID(pubKey) != peerID {
+		return ErrInvalidEnvelopeSignature
+	}
+	if !pubKey.VerifyBytes(signBytes, signature) {
+		return ErrInvalidEnvelopeSignature
+	}
+	return nil
+}
+
+func (m *SignedTxMessage) signBytes() []byte {
+	if len(m.Provenance) == 0 {
+		return cdc.MustMarshalBinaryBare(&TxMessage{Tx: m.Tx})
+	}
+	return cdc.MustMarshalBinaryBare(&SignedTxMessage{Tx: m.Tx, Provenance: m.Provenance})
+}
+
+// Verify checks that the envelope was signed by the node with the given ID.
+func (m *SignedTxMessage) Verify(peerID p2p.ID) error {
+	return verifyEnvelope(peerID, m.PubKey, m.signBytes(), m.Signature)
+}
+
+// String returns a string representation of the SignedTxMessage.
+func (m *SignedTxMessage) String() string {
+	return fmt.Sprintf("[SignedTxMessage %v %X]", m.Tx, cmn.Fingerprint(m.Signature))
+}
+
+//-------------------------------------
+
+// SignedEnvelopesMessage is a TxpoolMessage announcing that the sender signs
+// the votes it relays and verifies the signature of the ones it receives.
+type SignedEnvelopesMessage struct{}
+
+// String returns a string representation of the SignedEnvelopesMessage.
+func (m *SignedEnvelopesMessage) String() string {
+	return "[SignedEnvelopesMessage]"
+}
@@ -0,0 +1,711 @@
+package txvotepool
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	amino "github.com/tendermint/go-amino"
+
+	"github.com/andrecronje/babble-abci/types"
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestReceiveAssignsIncreasingSequence(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	buf := new(bytes.Buffer)
+	txR.SetLogger(log.NewTMLogger(log.NewSyncWriter(buf)))
+
+	peer := newTestPeer("peer")
+	validator := newTestValidator()
+	const numVotes = 5
+	for i := 0; i < numVotes; i++ {
+		sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	}
+	require.Equal(t, numVotes, txR.Txpool.Size())
+
+	matches := regexp.MustCompile(`Added good vote.* seq=(\d+)`).FindAllStringSubmatch(buf.String(), -1)
+	require.Len(t, matches, numVotes)
+	var last uint64
+	for _, m := range matches {
+		seq, err := strconv.ParseUint(m[1], 10, 64)
+		require.NoError(t, err)
+		assert.True(t, seq > last, "expected %d to be greater than %d", seq, last)
+		last = seq
+	}
+}
+
+func TestUnknownMessagesOnlyLoggedByDefault(t *testing.T) {
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	for i := 0; i < 10; i++ {
+		sendMsg(txR, peer, &unknownTestMessage{})
+	}
+	assert.True(t, peer.IsRunning())
+}
+
+func TestUnknownMessagesStopPeerAtThreshold(t *testing.T) {
+	txR := newTestSwitchReactor(t, ReactorMaxUnknownMessages(3))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	for i := 0; i < 3; i++ {
+		sendMsg(txR, peer, &unknownTestMessage{})
+		require.True(t, peer.IsRunning(), "peer stopped after %d unknown messages", i+1)
+	}
+	sendMsg(txR, peer, &unknownTestMessage{})
+	assert.False(t, peer.IsRunning())
+}
+
+func TestStrictProtocolStopsPeerOnViolations(t *testing.T) {
+	invalid := newTestVote(1, newTestValidator())
+	verify := func(tx types.TxVote) error {
+		if bytes.Equal(tx.Signature, invalid.Signature) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	valid := cdc.MustMarshalBinaryBare(&TxMessage{Tx: newTestVote(1, newTestValidator())})
+
+	violations := []struct {
+		name    string
+		lenient bool // tolerated outside of strict mode
+		send    func(txR *TxpoolReactor, peer *testPeer)
+	}{
+		{"oversized", false, func(txR *TxpoolReactor, peer *testPeer) {
+			txR.Receive(TxpoolChannel, peer, make([]byte, maxMsgSize+1))
+		}},
+		{"trailing bytes", false, func(txR *TxpoolReactor, peer *testPeer) {
+			txR.Receive(TxpoolChannel, peer, append(append([]byte(nil), valid...), 0x4a, 0x01, 0x00))
+		}},
+		{"invalid envelope", false, func(txR *TxpoolReactor, peer *testPeer) {
+			sendMsg(txR, peer, newSignedTxMessage(newTestVote(1, newTestValidator()), ed25519.GenPrivKey()))
+		}},
+		{"wrong channel", true, func(txR *TxpoolReactor, peer *testPeer) {
+			txR.Receive(TxpoolChannel+1, peer, valid)
+		}},
+		{"unknown type", true, func(txR *TxpoolReactor, peer *testPeer) {
+			sendMsg(txR, peer, &unknownTestMessage{})
+		}},
+		{"invalid vote", true, func(txR *TxpoolReactor, peer *testPeer) {
+			sendMsg(txR, peer, &TxMessage{Tx: invalid})
+		}},
+	}
+	for _, strict := range []bool{false, true} {
+		options := []ReactorOption{ReactorVoteVerifier(verify)}
+		if strict {
+			options = append(options, ReactorStrictProtocol())
+		}
+		for _, v := range violations {
+			txR := newTestSwitchReactor(t, options...)
+			peer := newTestPeer("peer")
+			txR.AddPeer(peer)
+			v.send(txR, peer)
+			if strict || !v.lenient {
+				assert.False(t, peer.IsRunning(), "peer not stopped for %s, strict %v", v.name, strict)
+			} else {
+				assert.True(t, peer.IsRunning(), "peer stopped for %s, strict %v", v.name, strict)
+			}
+			txR.Stop()
+		}
+	}
+
+	assert.Equal(t, DisconnectUnknownMsgs, classifyDisconnect(ErrUnknownMsgType))
+	assert.Equal(t, DisconnectInvalidVote, classifyDisconnect(errors.Wrap(ErrInvalidVote, "bad signature")))
+}
+
+func TestBlacklistedPeerIsIgnored(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	bad, good := newTestPeer("bad"), newTestPeer("good")
+	for _, peer := range []*testPeer{bad, good} {
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peer)
+	}
+	txR.Blacklist(txR.ids.GetForPeer(bad))
+
+	validator := newTestValidator()
+	sendMsg(txR, bad, &TxMessage{Tx: newTestVote(1, validator)})
+	assert.Zero(t, txR.Txpool.Size())
+
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, time.Second, func() bool { return len(good.Sent()) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, bad.Sent())
+
+	// Once unblacklisted the peer is served again.
+	txR.Unblacklist(txR.ids.GetForPeer(bad))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, time.Second, func() bool { return len(bad.Sent()) == 1 })
+}
+
+func TestBlacklistFollowsPeerNotID(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	bad := newTestPeer("bad")
+	txR.AddPeer(bad)
+	id := txR.ids.GetForPeer(bad)
+	txR.Blacklist(id)
+	txR.RemovePeer(bad, nil)
+
+	// The next peer given the ID isn't blacklisted.
+	txR.ids.nextID = id
+	next := newTestPeer("next")
+	txR.AddPeer(next)
+	require.Equal(t, id, txR.ids.GetForPeer(next))
+	assert.False(t, txR.isBlacklisted(id))
+	validator := newTestValidator()
+	sendMsg(txR, next, &TxMessage{Tx: newTestVote(1, validator)})
+	assert.Equal(t, 1, txR.Txpool.Size())
+
+	// The blacklisted peer still is once it reconnects.
+	txR.AddPeer(bad)
+	assert.True(t, txR.isBlacklisted(txR.ids.GetForPeer(bad)))
+	sendMsg(txR, bad, &TxMessage{Tx: newTestVote(1, validator)})
+	assert.Equal(t, 1, txR.Txpool.Size())
+}
+
+func TestUntrustedPeerVotesDropped(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		scores = map[p2p.ID]float64{"peer": 1}
+	)
+	score := func(id p2p.ID) float64 {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return scores[id]
+	}
+	var verified int32
+	verify := func(types.TxVote) error {
+		atomic.AddInt32(&verified, 1)
+		return nil
+	}
+	txR := newTestReactor(t, ReactorPeerTrust(score, 0.5), ReactorVoteVerifier(verify))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	assert.Equal(t, 1, txR.Txpool.Size())
+
+	// The peer's score drops below the threshold.
+	mtx.Lock()
+	scores["peer"] = 0.2
+	mtx.Unlock()
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	sendMsg(txR, peer, &TxsMessage{Txs: []types.TxVote{newTestVote(1, validator), newTestVote(1, validator)}})
+	assert.Equal(t, 1, txR.Txpool.Size())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&verified), "untrusted votes verified")
+}
+
+func TestPeerMessageCounts(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer, other := newTestPeer("peer"), newTestPeer("other")
+	txR.AddPeer(peer)
+	txR.AddPeer(other)
+	validator := newTestValidator()
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	sendMsg(txR, peer, &TxsMessage{Txs: []types.TxVote{newTestVote(1, validator)}})
+	sendMsg(txR, peer, &InterestMessage{MinHeight: 1})
+	sendMsg(txR, peer, &unknownTestMessage{Payload: []byte{1}})
+	sendMsg(txR, other, &TxMessage{Tx: newTestVote(1, validator)})
+
+	assert.Equal(t, map[p2p.ID]map[string]int64{
+		"peer": {
+			"TxMessage":          2,
+			"TxsMessage":         1,
+			"InterestMessage":    1,
+			"unknownTestMessage": 1,
+		},
+		"other": {"TxMessage": 1},
+	}, txR.PeerMessageCounts())
+
+	txR.RemovePeer(peer, nil)
+	_, ok := txR.PeerMessageCounts()["peer"]
+	assert.False(t, ok)
+}
+
+func TestMsgWithTooManyElementsStopsPeer(t *testing.T) {
+	txR := newTestSwitchReactor(t, ReactorMaxMsgElements(100))
+	defer txR.Stop()
+
+	ok := newTestPeer("ok")
+	sendMsg(txR, ok, &InterestMessage{Validators: []crypto.Address{newTestValidator()}})
+	sendMsg(txR, ok, &TxMessage{Tx: newTestVote(1, newTestValidator())})
+	assert.True(t, ok.IsRunning())
+	assert.Equal(t, 1, txR.Txpool.Size())
+
+	validators := make([]crypto.Address, 200)
+	for i := range validators {
+		validators[i] = newTestValidator()
+	}
+	bad := newTestPeer("bad")
+	sendMsg(txR, bad, &InterestMessage{Validators: validators})
+	assert.False(t, bad.IsRunning())
+	txR.interestsMtx.Lock()
+	_, decoded := txR.interests[bad.ID()]
+	txR.interestsMtx.Unlock()
+	assert.False(t, decoded)
+}
+
+func TestCheckMsgElementsRejectsAbsurdLength(t *testing.T) {
+	bz := cdc.MustMarshalBinaryBare(&InterestMessage{Validators: []crypto.Address{newTestValidator()}})
+	require.NoError(t, checkMsgElements(bz, defaultMaxMsgElements))
+
+	// Keep the prefix and the key of the first field, but claim the field
+	// holds an absurd number of bytes.
+	key := bz[4]
+	absurd := append(append([]byte(nil), bz[:4]...), key)
+	absurd = append(absurd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	assert.Error(t, checkMsgElements(absurd, defaultMaxMsgElements))
+}
+
+func TestMsgWithTrailingBytesStopsPeer(t *testing.T) {
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+
+	vote := newTestVote(1, newTestValidator())
+	bz := cdc.MustMarshalBinaryBare(&TxMessage{Tx: vote})
+	_, err := decodeMsg(bz)
+	require.NoError(t, err)
+
+	// A well formed field amino doesn't know, which it would skip.
+	trailing := append(append([]byte(nil), bz...), 0x4a, 0x01, 0x00)
+	_, err = decodeMsg(trailing)
+	assert.Equal(t, ErrTrailingBytes, errors.Cause(err))
+	// Repeated fields are part of the message.
+	validator := newTestValidator()
+	txs := []types.TxVote{newTestVote(1, validator), newTestVote(1, validator), newTestVote(1, validator)}
+	txsBytes := cdc.MustMarshalBinaryBare(&TxsMessage{Txs: txs})
+	assert.Equal(t, len(txsBytes), decodedLen(txsBytes, msgFields(&TxsMessage{})))
+	_, err = decodeMsg(append(txsBytes, 0x4a, 0x01, 0x00))
+	assert.Equal(t, ErrTrailingBytes, errors.Cause(err))
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	txR.Receive(TxpoolChannel, peer, trailing)
+	assert.False(t, peer.IsRunning())
+	_, ok := txR.Txpool.GetVote(vote.Signature)
+	assert.False(t, ok, "vote of a message with trailing bytes added")
+}
+
+func TestTxsMessageVerifiedInParallel(t *testing.T) {
+	var running, maxRunning int32
+	verify := func(tx types.TxVote) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		if tx.Height%2 == 1 {
+			return errors.New("odd height")
+		}
+		return nil
+	}
+	txR := newTestReactor(t, ReactorVoteVerifier(verify), ReactorVerifyParallelism(8))
+	defer txR.Stop()
+
+	validator := newTestValidator()
+	batch := make([]types.TxVote, 200)
+	var valid []types.TxVote
+	for i := range batch {
+		batch[i] = newTestVote(int64(i), validator)
+		if i%2 == 0 {
+			valid = append(valid, batch[i])
+		}
+	}
+	sendMsg(txR, newTestPeer("peer"), &TxsMessage{Txs: batch})
+
+	assert.Equal(t, valid, txR.Txpool.ReapMaxTxs(-1))
+	assert.True(t, atomic.LoadInt32(&maxRunning) > 1, "votes were verified serially")
+}
+
+func TestMsgOnWrongChannelIsRejected(t *testing.T) {
+	msgBytes := cdc.MustMarshalBinaryBare(&TxMessage{Tx: newTestVote(1, newTestValidator())})
+
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+	peer := newTestPeer("peer")
+	txR.Receive(TxpoolChannel+1, peer, msgBytes)
+	assert.Zero(t, txR.Txpool.Size())
+	assert.True(t, peer.IsRunning())
+
+	txR = newTestSwitchReactor(t, ReactorWrongChannelPolicy(WrongChannelStopPeer))
+	defer txR.Stop()
+	txR.Receive(TxpoolChannel+1, peer, msgBytes)
+	assert.Zero(t, txR.Txpool.Size())
+	assert.False(t, peer.IsRunning())
+}
+
+func TestLogSamplingKeepsErrors(t *testing.T) {
+	txR := newTestSwitchReactor(t, ReactorLogSampling(10))
+	defer txR.Stop()
+
+	buf := new(bytes.Buffer)
+	txR.SetLogger(log.NewTMLogger(log.NewSyncWriter(buf)))
+
+	vote := newTestVote(1, newTestValidator())
+	sendMsg(txR, newTestPeer("peer"), &TxMessage{Tx: vote})
+	// The duplicates each log that they could not be checked.
+	for i := 0; i < 100; i++ {
+		sendMsg(txR, newTestPeer("peer"), &TxMessage{Tx: vote})
+	}
+	for i := 0; i < 20; i++ {
+		txR.Receive(TxpoolChannel, newTestPeer("peer"), []byte{0x01, 0x02, 0x03, 0x04})
+	}
+
+	assert.Equal(t, 10, strings.Count(buf.String(), "Could not check tx"))
+	assert.Equal(t, 20, strings.Count(buf.String(), "Error decoding message"))
+}
+
+// testSyncStatus is a SyncStatus which can be toggled.
+type testSyncStatus struct {
+	syncing int32
+}
+
+func (s *testSyncStatus) IsSyncing() bool { return atomic.LoadInt32(&s.syncing) == 1 }
+
+func (s *testSyncStatus) set(syncing bool) {
+	var v int32
+	if syncing {
+		v = 1
+	}
+	atomic.StoreInt32(&s.syncing, v)
+}
+
+func TestSyncGuardDefersVotesUntilSynced(t *testing.T) {
+	status := &testSyncStatus{}
+	status.set(true)
+	txR := newTestReactor(t, ReactorSyncGuard(status, 2))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	validator := newTestValidator()
+	for i := 0; i < 3; i++ {
+		sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	}
+	time.Sleep(2 * syncPollInterval)
+	assert.Zero(t, txR.Txpool.Size(), "votes processed while syncing")
+
+	// Only the votes which fit are processed once synced.
+	status.set(false)
+	waitFor(t, time.Second, func() bool { return txR.Txpool.Size() == 2 })
+
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, validator)})
+	assert.Equal(t, 3, txR.Txpool.Size())
+}
+
+func TestExtensionsOfUnknownTypesSkipped(t *testing.T) {
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+
+	// a message of a type registered by newer nodes only
+	unregistered := append([]byte{0xDE, 0xAD, 0xBE, 0xEF}, 0x0A, 0x01, 0x01)
+	peer := newTestPeer("peer")
+	for i := 0; i < 3; i++ {
+		sendMsg(txR, peer, &ExtensionMessage{Msg: unregistered})
+	}
+	assert.True(t, peer.IsRunning(), "peer stopped for an extension of unknown type")
+
+	// Messages of known types are handled as if sent on their own.
+	wrapped := cdc.MustMarshalBinaryBare(&TxMessage{Tx: newTestVote(1, newTestValidator())})
+	sendMsg(txR, peer, &ExtensionMessage{Msg: wrapped})
+	assert.Equal(t, 1, txR.Txpool.Size())
+	assert.True(t, peer.IsRunning())
+
+	nested := cdc.MustMarshalBinaryBare(&ExtensionMessage{Msg: unregistered})
+	sendMsg(txR, peer, &ExtensionMessage{Msg: nested})
+	assert.False(t, peer.IsRunning(), "peer not stopped for a nested extension")
+
+	// Unwrapped, the unknown type is a decoding error.
+	peer = newTestPeer("other")
+	txR.Receive(TxpoolChannel, peer, unregistered)
+	assert.False(t, peer.IsRunning(), "peer not stopped for an unknown type")
+}
+
+func TestCheckMessagesRegistered(t *testing.T) {
+	assert.NoError(t, checkMessagesRegistered(cdc))
+
+	err := checkMessagesRegistered(amino.NewCodec())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not registered")
+}
+
+func TestPeerReceiveWorkersKeepPeerOrder(t *testing.T) {
+	validator := newTestValidator()
+	const numVotes = 10
+	votes := make([]types.TxVote, numVotes)
+	delays := make(map[string]time.Duration)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		// Earlier votes take longer to verify, so they'd be added last if
+		// votes were added as soon as verified.
+		delays[TxVoteID(votes[i])] = time.Duration(numVotes-i) * 5 * time.Millisecond
+	}
+	verify := func(tx types.TxVote) error {
+		time.Sleep(delays[TxVoteID(tx)])
+		return nil
+	}
+	txR := newTestReactor(t, ReactorVoteVerifier(verify), ReactorPeerReceiveWorkers(4))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	for i, vote := range votes {
+		if i%3 == 0 {
+			sendMsg(txR, peer, &TxMessage{Tx: vote})
+		} else {
+			sendMsg(txR, peer, &TxsMessage{Txs: []types.TxVote{vote}})
+		}
+	}
+
+	waitFor(t, 2*time.Second, func() bool { return txR.Txpool.Size() == numVotes })
+	assert.Equal(t, votes, txR.Txpool.ReapMaxTxs(-1))
+}
+
+func TestAckRoundTripMarksSender(t *testing.T) {
+	receiver := newTestReactor(t, ReactorAcks())
+	defer receiver.Stop()
+	sender := newTestReactor(t)
+	defer sender.Stop()
+
+	vote := newTestVote(1, newTestValidator())
+	require.NoError(t, sender.Txpool.CheckTx(vote))
+
+	// The receiver acks the vote to the peer standing for the sender.
+	senderPeer := newTestPeer("sender")
+	receiver.AddPeer(senderPeer)
+	sendMsg(receiver, senderPeer, &TxMessage{Tx: vote})
+	var ack *AckMessage
+	for _, msg := range senderPeer.Sent() {
+		if m, ok := msg.(*AckMessage); ok {
+			ack = m
+		}
+	}
+	require.NotNil(t, ack, "vote not acked")
+	assert.Equal(t, vote.Signature, ack.ID)
+
+	// The sender records the receiver has the vote.
+	receiverPeer := newTestPeer("receiver")
+	sender.AddPeer(receiverPeer)
+	sendMsg(sender, receiverPeer, ack)
+	memTx, ok := sender.Txpool.memTxByID(vote.Signature)
+	require.True(t, ok)
+	_, confirmed := memTx.senders.Load(sender.ids.GetForPeer(receiverPeer))
+	assert.True(t, confirmed)
+}
+
+func TestDroppedVoteNotAcked(t *testing.T) {
+	config := cfg.TestConfig()
+	txVotePool := NewTxVotePool(config.Mempool, WithCommittedHeightPolicy(CommittedHeightDrop))
+	txVotePool.Lock()
+	require.NoError(t, txVotePool.Update(5, nil))
+	txVotePool.Unlock()
+	txR := NewTxpoolReactor(config.Mempool, txVotePool, ReactorAcks())
+	require.NoError(t, txR.Start())
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(5, newTestValidator())})
+	assert.Empty(t, peer.Sent())
+	assert.Equal(t, 0, txVotePool.Size())
+}
+
+func TestNoAckByDefault(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, &TxMessage{Tx: newTestVote(1, newTestValidator())})
+	assert.Empty(t, peer.Sent())
+}
+
+// labeledTestCounter is a metrics.Counter which can be read by label values,
+// joined as "label=value".
+type labeledTestCounter struct {
+	mtx    *sync.Mutex
+	vals   map[string]float64
+	labels string
+}
+
+func newLabeledTestCounter() *labeledTestCounter {
+	return &labeledTestCounter{mtx: new(sync.Mutex), vals: make(map[string]float64)}
+}
+
+func (c *labeledTestCounter) With(labelValues ...string) metrics.Counter {
+	return &labeledTestCounter{mtx: c.mtx, vals: c.vals, labels: c.labels + strings.Join(labelValues, "=")}
+}
+
+func (c *labeledTestCounter) Add(delta float64) {
+	c.mtx.Lock()
+	c.vals[c.labels] += delta
+	c.mtx.Unlock()
+}
+
+func (c *labeledTestCounter) value(labels string) float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.vals[labels]
+}
+
+func TestRemovePeerRecordsDisconnectReason(t *testing.T) {
+	txR := newTestSwitchReactor(t)
+	defer txR.Stop()
+	disconnects := newLabeledTestCounter()
+	txR.Txpool.metrics.PeerDisconnects = disconnects
+	buf := new(bytes.Buffer)
+	txR.SetLogger(log.NewTMLogger(log.NewSyncWriter(buf)))
+
+	// Stopped by us for sending garbage.
+	peer := newTestPeer("garbage")
+	txR.AddPeer(peer)
+	txR.Receive(TxpoolChannel, peer, []byte{0x01, 0x02, 0x03, 0x04})
+	assert.Equal(t, float64(1), disconnects.value("reason=malformed_msg"))
+	assert.Contains(t, buf.String(), "class=malformed_msg")
+
+	for i, reason := range []interface{}{nil, io.EOF, errors.New("some reason"), ErrInvalidEnvelopeSignature} {
+		peer := newTestPeer(p2p.ID(strconv.Itoa(i)))
+		txR.AddPeer(peer)
+		txR.RemovePeer(peer, reason)
+	}
+	assert.Equal(t, float64(1), disconnects.value("reason=none"))
+	assert.Equal(t, float64(1), disconnects.value("reason=connection"))
+	assert.Equal(t, float64(1), disconnects.value("reason=other"))
+	assert.Equal(t, float64(1), disconnects.value("reason=invalid_envelope"))
+	assert.Contains(t, buf.String(), "some reason")
+}
+
+func TestCoalesceReceivesKeepsHonestCopy(t *testing.T) {
+	vote := newTestVote(1, newTestValidator())
+	tampered := vote
+	tampered.Height++
+	verify := func(tx types.TxVote) error {
+		time.Sleep(50 * time.Millisecond)
+		if tx.Height != vote.Height {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	txR := newTestReactor(t, ReactorCoalesceReceives(), ReactorVoteVerifier(verify))
+	defer txR.Stop()
+
+	// The tampered copy, with the same signature, is verified first.
+	liar, honest := newTestPeer("liar"), newTestPeer("honest")
+	txR.AddPeer(liar)
+	txR.AddPeer(honest)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sendMsg(txR, liar, &TxMessage{Tx: tampered})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sendMsg(txR, honest, &TxMessage{Tx: vote})
+	wg.Wait()
+
+	assert.Equal(t, []types.TxVote{vote}, txR.Txpool.ReapMaxTxs(-1))
+}
+
+func TestClassifyDisconnect(t *testing.T) {
+	assert.Equal(t, DisconnectWrongChannel, classifyDisconnect(ErrWrongChannel))
+	assert.Equal(t, DisconnectMalformedMsg, classifyDisconnect(ErrTooManyMsgElements))
+	assert.Equal(t, DisconnectMalformedMsg, classifyDisconnect(malformedMsgErr(errors.New("bad prefix"))))
+	assert.Equal(t, DisconnectUnknownMsgs, classifyDisconnect(ErrTooManyUnknownMessages))
+	assert.Equal(t, DisconnectConnection, classifyDisconnect(&net.OpError{Op: "read", Err: io.EOF}))
+	assert.Equal(t, DisconnectOther, classifyDisconnect("shutting down"))
+}
+
+func TestCoalesceReceivesVerifiesOnce(t *testing.T) {
+	receiveFromPeers := func(options ...ReactorOption) (verified int32, txR *TxpoolReactor, peers []*testPeer, vote types.TxVote) {
+		verify := func(tx types.TxVote) error {
+			atomic.AddInt32(&verified, 1)
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		}
+		txR = newTestReactor(t, append(options, ReactorVoteVerifier(verify))...)
+
+		vote = newTestVote(1, newTestValidator())
+		peers = make([]*testPeer, 10)
+		var wg sync.WaitGroup
+		for i := range peers {
+			peers[i] = newTestPeer(p2p.ID(strconv.Itoa(i)))
+			txR.AddPeer(peers[i])
+			wg.Add(1)
+			go func(peer *testPeer) {
+				defer wg.Done()
+				sendMsg(txR, peer, &TxMessage{Tx: vote})
+			}(peers[i])
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&verified), txR, peers, vote
+	}
+
+	verified, txR, _, _ := receiveFromPeers()
+	txR.Stop()
+	assert.Equal(t, int32(10), verified)
+
+	verified, txR, peers, vote := receiveFromPeers(ReactorCoalesceReceives())
+	defer txR.Stop()
+	assert.Equal(t, int32(1), verified)
+	assert.Equal(t, []types.TxVote{vote}, txR.Txpool.ReapMaxTxs(-1))
+	memTx, ok := txR.Txpool.memTxByID(vote.Signature)
+	require.True(t, ok)
+	for _, peer := range peers {
+		_, sent := memTx.senders.Load(txR.ids.GetForPeer(peer))
+		assert.True(t, sent, "peer %s not recorded as sender", peer.ID())
+	}
+	assert.Empty(t, txR.inflight.calls)
+}
+
+func TestRemovedPeerNotGivenReceiver(t *testing.T) {
+	validator := newTestValidator()
+	txR := newTestReactor(t, ReactorPeerReceiveWorkers(4))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	txR.AddPeer(peer)
+	txR.RemovePeer(peer, nil)
+	// a batch received while the peer was being removed
+	sendMsg(txR, peer, &TxsMessage{Txs: []types.TxVote{newTestVote(1, validator)}})
+
+	txR.receiversMtx.Lock()
+	assert.Empty(t, txR.receivers)
+	txR.receiversMtx.Unlock()
+	assert.Equal(t, 0, txR.Txpool.Size())
+
+	// the peer is given a receiver again once it reconnects
+	txR.AddPeer(peer)
+	sendMsg(txR, peer, &TxsMessage{Txs: []types.TxVote{newTestVote(1, validator)}})
+	waitFor(t, time.Second, func() bool { return txR.Txpool.Size() == 1 })
+}
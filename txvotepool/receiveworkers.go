@@ -0,0 +1,140 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorPeerReceiveWorkers verifies up to n of the batches received from
+// each peer at once, off the p2p receive goroutine, see ReactorVoteVerifier.
+// The votes of a peer are still added to the pool in the order they were
+// received. Defaults to 1: votes are verified as they are received.
+func ReactorPeerReceiveWorkers(n int) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.peerReceiveWorkers = n }
+}
+
+// peerReceiver verifies the votes received from a peer in parallel, and adds
+// them to the pool in order.
+type peerReceiver struct {
+	workers chan struct{}       // a slot per batch being verified
+	batches chan *receivedBatch // in the order they were received
+	quit    chan struct{}       // closed once the peer is removed
+}
+
+// receivedBatch is a batch of votes being verified.
+type receivedBatch struct {
+	txs  []types.TxVote
+	seq  uint64
+	errs chan []error // receives the verification errors of txs
+}
+
+// receiveBatch verifies and adds the votes received from the peer to the
+// pool, through the peer's receiver if there is more than one worker per
+// peer.
+func (txR *TxpoolReactor) receiveBatch(src p2p.Peer, txs []types.TxVote, seq uint64) {
+	if txR.peerReceiveWorkers <= 1 {
+		txR.addVerified(src, txs, seq, txR.verifyVotes(txs))
+		return
+	}
+
+	pr, ok := txR.peerReceiverFor(src)
+	if !ok {
+		return
+	}
+	batch := &receivedBatch{txs: txs, seq: seq, errs: make(chan []error, 1)}
+	// wait for a worker, which throttles a peer sending faster than its votes
+	// are verified
+	select {
+	case pr.workers <- struct{}{}:
+	case <-pr.quit:
+		return
+	case <-txR.Quit():
+		return
+	}
+	go func() {
+		batch.errs <- txR.verifyVotes(batch.txs)
+		<-pr.workers
+	}()
+	select {
+	case pr.batches <- batch:
+	case <-pr.quit:
+	case <-txR.Quit():
+	}
+}
+
+// addVerified adds the votes which passed verification to the pool.
+func (txR *TxpoolReactor) addVerified(src p2p.Peer, txs []types.TxVote, seq uint64, errs []error) {
+	for i, tx := range txs {
+		if errs[i] != nil {
+			if txR.invalidVote(src, tx, seq, errs[i]) {
+				return
+			}
+			continue
+		}
+		txR.receiveTx(src, tx, seq, nil)
+	}
+}
+
+// peerReceiverFor returns the receiver of the peer, starting it if needed.
+// It returns false if the peer was removed, as a batch received while the
+// peer is being removed would otherwise start a receiver no one stops.
+func (txR *TxpoolReactor) peerReceiverFor(peer p2p.Peer) (*peerReceiver, bool) {
+	txR.receiversMtx.Lock()
+	defer txR.receiversMtx.Unlock()
+	if txR.removedReceivers[peer.ID()] == peer {
+		return nil, false
+	}
+	pr, ok := txR.receivers[peer.ID()]
+	if !ok {
+		pr = &peerReceiver{
+			workers: make(chan struct{}, txR.peerReceiveWorkers),
+			batches: make(chan *receivedBatch, txR.peerReceiveWorkers),
+			quit:    make(chan struct{}),
+		}
+		txR.receivers[peer.ID()] = pr
+		go txR.peerReceiveRoutine(peer, pr)
+	}
+	return pr, true
+}
+
+// peerReceiveRoutine adds the batches of the peer to the pool in order, as
+// they are verified.
+func (txR *TxpoolReactor) peerReceiveRoutine(peer p2p.Peer, pr *peerReceiver) {
+	for {
+		select {
+		case batch := <-pr.batches:
+			select {
+			case errs := <-batch.errs:
+				txR.addVerified(peer, batch.txs, batch.seq, errs)
+			case <-pr.quit:
+				return
+			case <-txR.Quit():
+				return
+			}
+		case <-pr.quit:
+			return
+		case <-txR.Quit():
+			return
+		}
+	}
+}
+
+// addPeerReceiver lets the peer, reconnecting after it was removed, be given
+// a receiver again.
+func (txR *TxpoolReactor) addPeerReceiver(peer p2p.Peer) {
+	txR.receiversMtx.Lock()
+	delete(txR.removedReceivers, peer.ID())
+	txR.receiversMtx.Unlock()
+}
+
+// stopPeerReceiver stops the receiver of the peer, if any, and keeps the
+// peer from being given one again until it reconnects.
+func (txR *TxpoolReactor) stopPeerReceiver(peer p2p.Peer) {
+	txR.receiversMtx.Lock()
+	defer txR.receiversMtx.Unlock()
+	txR.removedReceivers[peer.ID()] = peer
+	if pr, ok := txR.receivers[peer.ID()]; ok {
+		close(pr.quit)
+		delete(txR.receivers, peer.ID())
+	}
+}
@@ -0,0 +1,69 @@
+package txvotepool
+
+import (
+	"sync/atomic"
+)
+
+// WithMaxSendersPerVote bounds the number of peers recorded as holding each
+// vote, either because they sent it to us or because we sent it to them, to
+// max. Past it, further peers aren't recorded, so the vote may be sent again
+// to a peer which already has it, which it ignores as a duplicate. This
+// trades some bandwidth for memory on networks with many peers. Unlimited by
+// default.
+func WithMaxSendersPerVote(max int) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.maxSendersPerVote = int32(max) }
+}
+
+// hasSender returns true if the peer is recorded as holding the vote.
+func (memTxVote *mempoolTxVote) hasSender(peerID uint16) bool {
+	_, ok := memTxVote.senders.Load(peerID)
+	return ok
+}
+
+// addSender records the peer as holding the vote, unless the vote already has
+// the max number of senders, and returns true if the peer was already
+// recorded.
+func (memTxVote *mempoolTxVote) addSender(peerID uint16) bool {
+	if memTxVote.hasSender(peerID) {
+		return true
+	}
+	// reserve the slot first, so that concurrent adds can't go past the max
+	n := atomic.AddInt32(&memTxVote.numSenders, 1)
+	if memTxVote.maxSenders > 0 && n > memTxVote.maxSenders {
+		atomic.AddInt32(&memTxVote.numSenders, -1)
+		return false
+	}
+	if _, loaded := memTxVote.senders.LoadOrStore(peerID, true); loaded {
+		atomic.AddInt32(&memTxVote.numSenders, -1)
+		return true
+	}
+	if memTxVote.poolSenders != nil {
+		atomic.AddInt64(memTxVote.poolSenders, 1)
+	}
+	return false
+}
+
+// removeSender forgets the peer holds the vote, and returns true if it was
+// recorded. Of concurrent removals of the same peer, only one returns true.
+func (memTxVote *mempoolTxVote) removeSender(peerID uint16) bool {
+	if _, loaded := memTxVote.senders.LoadAndDelete(peerID); !loaded {
+		return false
+	}
+	atomic.AddInt32(&memTxVote.numSenders, -1)
+	if memTxVote.poolSenders != nil {
+		atomic.AddInt64(memTxVote.poolSenders, -1)
+	}
+	return true
+}
+
+// MarkSentTo records the peer with the given ID, see txpoolIDs, as holding
+// the votes with the given IDs (see TxVoteID), eg. once they were transferred
+// to it in bulk, so that the peer's broadcast routine doesn't send them again.
+// IDs of votes the pool doesn't hold are ignored.
+func (txVotePool *TxVotePool) MarkSentTo(peerID uint16, ids [][]byte) {
+	for _, id := range ids {
+		if memTx, ok := txVotePool.memTxByID(id); ok {
+			memTx.addSender(peerID)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package txvotepool
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestMaxSendersPerVote(t *testing.T) {
+	const maxSenders = 2
+	config := cfg.TestConfig()
+	txR := NewTxpoolReactor(config.Mempool, NewTxVotePool(config.Mempool, WithMaxSendersPerVote(maxSenders)))
+	txR.SetLogger(log.TestingLogger())
+	require.NoError(t, txR.Start())
+	defer txR.Stop()
+
+	peers := make([]*testPeer, 5)
+	for i := range peers {
+		peers[i] = newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i)))
+		peers[i].Set(ttypes.PeerStateKey, testPeerState{1})
+		txR.AddPeer(peers[i])
+	}
+	vote := newTestVote(1, newTestValidator())
+	sendMsg(txR, peers[0], &TxMessage{Tx: vote})
+	require.Equal(t, 1, txR.Txpool.Size())
+
+	// The vote still goes to every other peer, only some are recorded.
+	for _, peer := range peers[1:] {
+		peer := peer
+		waitFor(t, 2*time.Second, func() bool { return votesSent(peer) == 1 }, "vote not sent to %v", peer.ID())
+	}
+	memTx, ok := txR.Txpool.memTxByID(vote.Signature)
+	require.True(t, ok)
+	countSenders := func() int {
+		var n int
+		memTx.senders.Range(func(_, _ interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	assert.Equal(t, maxSenders, countSenders())
+	assert.True(t, memTx.hasSender(txR.ids.GetForPeer(peers[0])), "first sender not recorded")
+
+	// Senders past the max are ignored, duplicates from them included.
+	for _, peer := range peers[1:] {
+		sendMsg(txR, peer, &TxMessage{Tx: vote})
+	}
+	assert.Equal(t, maxSenders, countSenders())
+	assert.Equal(t, 1, txR.Txpool.Size())
+
+	// A slot freed up is taken by the next peer recorded.
+	require.True(t, memTx.removeSender(txR.ids.GetForPeer(peers[0])))
+	assert.False(t, memTx.addSender(txR.ids.GetForPeer(peers[0])))
+	assert.Equal(t, maxSenders, countSenders())
+	assert.True(t, memTx.hasSender(txR.ids.GetForPeer(peers[0])))
+}
+
+func TestConcurrentRemoveSenderCountsOnce(t *testing.T) {
+	var poolSenders int64
+	memTx := &mempoolTxVote{poolSenders: &poolSenders}
+	for i := 0; i < 100; i++ {
+		require.False(t, memTx.addSender(1))
+		var wg sync.WaitGroup
+		removed := make(chan bool, 3)
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				removed <- memTx.removeSender(1)
+			}()
+		}
+		wg.Wait()
+		close(removed)
+		n := 0
+		for ok := range removed {
+			if ok {
+				n++
+			}
+		}
+		require.Equal(t, 1, n)
+		require.Equal(t, int32(0), memTx.numSenders)
+		require.Equal(t, int64(0), poolSenders)
+	}
+}
@@ -0,0 +1,39 @@
+package txvotepool
+
+import (
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorMaxConcurrentSends bounds the number of votes messages being sent
+// to peers at once, across all of them, so that a burst of votes doesn't set
+// off a send to every peer at the same time. Sends wait for a slot, and fail
+// if the peer or the reactor quit meanwhile. Sends are unlimited by default.
+func ReactorMaxConcurrentSends(max int) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.sendSlots = nil
+		if max > 0 {
+			txR.sendSlots = make(chan struct{}, max)
+		}
+	}
+}
+
+// sendVotes sends msgBytes, carrying votes, to the peer, counting a send
+// attempt for each vote.
+func (txR *TxpoolReactor) sendVotes(peer p2p.Peer, msgBytes []byte, votes ...*mempoolTxVote) bool {
+	for _, memTx := range votes {
+		memTx.recordSendAttempt()
+	}
+	if txR.sendSlots != nil {
+		select {
+		case txR.sendSlots <- struct{}{}:
+		case <-peer.Quit():
+			return false
+		case <-txR.Quit():
+			return false
+		}
+		defer func() { <-txR.sendSlots }()
+	}
+	txR.Txpool.metrics.InflightSends.Add(1)
+	defer txR.Txpool.metrics.InflightSends.Add(-1)
+	return peer.Send(TxpoolChannel, msgBytes)
+}
@@ -0,0 +1,61 @@
+package txvotepool
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+// slowPeer is a testPeer whose sends take a while, tracking the most sends
+// in progress at once across the peers sharing inflight and max.
+type slowPeer struct {
+	*testPeer
+	inflight, max *int64
+}
+
+func (sp *slowPeer) Send(chID byte, msgBytes []byte) bool {
+	n := atomic.AddInt64(sp.inflight, 1)
+	defer atomic.AddInt64(sp.inflight, -1)
+	for {
+		max := atomic.LoadInt64(sp.max)
+		if n <= max || atomic.CompareAndSwapInt64(sp.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return sp.testPeer.Send(chID, msgBytes)
+}
+
+func TestMaxConcurrentSends(t *testing.T) {
+	const (
+		maxSends = 2
+		numPeers = 10
+		numVotes = 5
+	)
+	txR := newTestReactor(t, ReactorMaxConcurrentSends(maxSends))
+	defer txR.Stop()
+
+	var inflight, max int64
+	peers := make([]*slowPeer, numPeers)
+	for i := range peers {
+		peers[i] = &slowPeer{testPeer: newTestPeer(p2p.ID(fmt.Sprintf("peer%d", i))), inflight: &inflight, max: &max}
+		peers[i].Set(ttypes.PeerStateKey, testPeerState{10})
+		txR.AddPeer(peers[i])
+	}
+	validator := newTestValidator()
+	for i := 0; i < numVotes; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	for _, peer := range peers {
+		waitFor(t, 5*time.Second, func() bool { return votesSent(peer.testPeer) == numVotes },
+			"peer %v got %d votes", peer.ID(), votesSent(peer.testPeer))
+	}
+	assert.True(t, atomic.LoadInt64(&max) <= maxSends, "%d sends at once", atomic.LoadInt64(&max))
+}
@@ -0,0 +1,36 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// AddSource checks the votes received on ch into the pool, as if passed to
+// CheckTx, so that applications can push votes into the pool without calling
+// it for each of them. The votes are checked in order by a goroutine of their
+// own, which returns once ch is closed or the pool stopped. Votes failing the
+// check are logged and dropped.
+func (txVotePool *TxVotePool) AddSource(ch <-chan types.TxVote) {
+	go txVotePool.sourceRoutine(ch)
+}
+
+// sourceRoutine checks the votes received on ch until it is closed or the
+// pool stopped.
+func (txVotePool *TxVotePool) sourceRoutine(ch <-chan types.TxVote) {
+	for {
+		select {
+		case tx, ok := <-ch:
+			if !ok {
+				return
+			}
+			err := txVotePool.CheckTxWithInfo(tx, TxVoteInfo{PeerID: UnknownPeerID})
+			if err == ErrPoolStopped {
+				return
+			}
+			if err != nil {
+				txVotePool.logger.Info("Could not check tx from source", "tx", TxVoteID(tx), "height", tx.Height, "err", err)
+			}
+		case <-txVotePool.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// StakeProvider decides, based on the stake of their signer, whether votes
+// are admitted in the pool. This keeps stake logic, eg. turning down the
+// votes of signers with a dust stake, or capping the votes pending per
+// signer by stake, outside of the pool.
+type StakeProvider interface {
+	// Admit returns an error if tx must not be added to the pool. pending is
+	// the number of votes of the same signer already in the pool.
+	Admit(tx types.TxVote, pending int) error
+}
+
+// nopStakeProvider admits all votes.
+type nopStakeProvider struct{}
+
+var _ StakeProvider = nopStakeProvider{}
+
+func (nopStakeProvider) Admit(types.TxVote, int) error { return nil }
+
+// WithStakeProvider makes the pool consult the given StakeProvider before
+// adding votes. All votes are admitted by default.
+func WithStakeProvider(provider StakeProvider) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.stakeProvider = provider }
+}
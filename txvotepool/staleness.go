@@ -0,0 +1,39 @@
+package txvotepool
+
+import (
+	"time"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorMaxPeerStateAge stops broadcasting to peers whose PeerState height
+// hasn't changed for maxAge, until it does, as a state which isn't being
+// updated can't be trusted to tell which votes the peer is ready for. maxAge
+// must exceed the time between blocks, or peers will be deemed stale between
+// each of them. Peer states are trusted however old by default.
+func ReactorMaxPeerStateAge(maxAge time.Duration) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.maxPeerStateAge = maxAge }
+}
+
+// peerHeight is the height a peer's state was last seen at, and since when.
+type peerHeight struct {
+	height int64
+	since  time.Time
+}
+
+// peerStateStale records the height the peer's state is at, and returns true
+// if it hasn't changed for maxPeerStateAge.
+func (txR *TxpoolReactor) peerStateStale(peer p2p.Peer, height int64) bool {
+	if txR.maxPeerStateAge <= 0 {
+		return false
+	}
+	now := time.Now()
+	txR.peerHeightsMtx.Lock()
+	defer txR.peerHeightsMtx.Unlock()
+	seen, ok := txR.peerHeights[peer.ID()]
+	if !ok || seen.height != height {
+		txR.peerHeights[peer.ID()] = peerHeight{height: height, since: now}
+		return false
+	}
+	return now.Sub(seen.since) > txR.maxPeerStateAge
+}
@@ -0,0 +1,34 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestStalePeerStatePausesBroadcast(t *testing.T) {
+	const maxAge = 200 * time.Millisecond
+	txR := newTestReactor(t, ReactorMaxPeerStateAge(maxAge))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{10})
+	txR.AddPeer(peer)
+	validator := newTestValidator()
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	waitFor(t, 2*time.Second, func() bool { return votesSent(peer) == 1 }, "vote not sent")
+
+	// The peer's height stays the same for longer than maxAge.
+	time.Sleep(2 * maxAge)
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	time.Sleep(maxAge)
+	assert.Equal(t, 1, votesSent(peer), "vote sent to peer with a stale state")
+
+	// Broadcasting resumes once the peer's height moves on.
+	peer.Set(ttypes.PeerStateKey, testPeerState{11})
+	waitFor(t, 2*time.Second, func() bool { return votesSent(peer) == 2 }, "vote not sent once state updated")
+}
@@ -0,0 +1,42 @@
+package txvotepool
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+var (
+	// ErrUnknownMsgType is the reason a peer is stopped for in strict mode
+	// when it sends a message of unknown type.
+	ErrUnknownMsgType = errors.New("Msg of unknown type")
+
+	// ErrInvalidVote is the reason a peer is stopped for in strict mode when
+	// it sends a vote failing verification, see ReactorVoteVerifier.
+	ErrInvalidVote = errors.New("Invalid vote")
+)
+
+// ReactorStrictProtocol makes the reactor stop peers on any protocol
+// violation, rather than only on those which can't be tolerated. On top of
+// the oversized, malformed or nested messages, the messages with trailing
+// bytes and the invalid envelope or capabilities signatures, which always
+// stop the peer, strict mode stops peers sending a message on the wrong
+// channel, with ErrWrongChannel, a message of unknown type, with
+// ErrUnknownMsgType, or a vote failing verification, with ErrInvalidVote.
+// This overrides ReactorWrongChannelPolicy and ReactorMaxUnknownMessages.
+// Violations are tolerated by default.
+func ReactorStrictProtocol() ReactorOption {
+	return func(txR *TxpoolReactor) { txR.strictProtocol = true }
+}
+
+// invalidVote handles a vote received from the peer which failed
+// verification with err. It returns true if the peer was stopped for it.
+func (txR *TxpoolReactor) invalidVote(src p2p.Peer, tx types.TxVote, seq uint64, err error) bool {
+	txR.recvLogger.Info("Invalid vote", "src", src, "tx", TxVoteID(tx), "seq", seq, "err", err)
+	if !txR.strictProtocol {
+		return false
+	}
+	txR.Switch.StopPeerForError(src, errors.Wrap(ErrInvalidVote, err.Error()))
+	return true
+}
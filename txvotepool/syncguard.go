@@ -0,0 +1,106 @@
+package txvotepool
+
+import (
+	"time"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// syncPollInterval is how often the sync status is polled while votes are
+// being deferred.
+const syncPollInterval = 100 * time.Millisecond
+
+// SyncStatus reports whether the node is catching up with the chain, eg. the
+// blockchain reactor fast syncing.
+type SyncStatus interface {
+	IsSyncing() bool
+}
+
+// ReactorSyncGuard defers the votes received while status reports the node
+// is syncing, as they would only thrash the pool. Up to maxDeferred votes are
+// held, and checked into the pool once the sync completes, the others are
+// dropped. If bulk sync is enabled, the pools of the peers are then fetched
+// too, see ReactorBulkSync. Votes are always processed by default.
+func ReactorSyncGuard(status SyncStatus, maxDeferred int) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.syncStatus = status
+		txR.maxDeferred = maxDeferred
+	}
+}
+
+// deferredVote is a vote received while syncing, with the info to check it
+// with once the sync completed.
+type deferredVote struct {
+	tx   types.TxVote
+	info TxVoteInfo
+}
+
+// deferIfSyncing holds tx back if the node is syncing, and returns true if it
+// did, or dropped it.
+func (txR *TxpoolReactor) deferIfSyncing(tx types.TxVote, info TxVoteInfo) bool {
+	if txR.syncStatus == nil || !txR.syncStatus.IsSyncing() {
+		return false
+	}
+	txR.deferredMtx.Lock()
+	defer txR.deferredMtx.Unlock()
+	if len(txR.deferred) >= txR.maxDeferred {
+		txR.recvLogger.Info("Dropping vote received while syncing", "tx", TxVoteID(tx), "seq", info.ReceiveSeq)
+		return true
+	}
+	txR.deferred = append(txR.deferred, deferredVote{tx: tx, info: info})
+	txR.Txpool.metrics.reportCacheEntries(cacheDeferred, len(txR.deferred))
+	return true
+}
+
+// syncGuardRoutine waits for the node to be done syncing, and then processes
+// the deferred votes.
+func (txR *TxpoolReactor) syncGuardRoutine() {
+	ticker := time.NewTicker(syncPollInterval)
+	defer ticker.Stop()
+	wasSyncing := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-txR.Quit():
+			return
+		}
+		if txR.syncStatus.IsSyncing() {
+			wasSyncing = true
+			continue
+		}
+		start := time.Now()
+		txR.recordLoopRun(loopSyncGuard, start, txR.processDeferred())
+		if wasSyncing {
+			wasSyncing = false
+			txR.Logger.Info("Sync completed, processing votes")
+			if txR.bulkSyncEnabled() {
+				txR.peersMtx.RLock()
+				for _, peer := range txR.peers {
+					txR.startBulkSync(peer)
+				}
+				txR.peersMtx.RUnlock()
+			}
+		}
+	}
+}
+
+// processDeferred checks the deferred votes into the pool, in the order they
+// were received, and returns how many there were.
+func (txR *TxpoolReactor) processDeferred() int {
+	txR.deferredMtx.Lock()
+	votes := txR.deferred
+	txR.deferred = nil
+	txR.Txpool.metrics.reportCacheEntries(cacheDeferred, 0)
+	txR.deferredMtx.Unlock()
+
+	for _, v := range votes {
+		if txR.isBlacklisted(v.info.PeerID) {
+			txR.Txpool.metrics.BlacklistedTxs.Add(1)
+			continue
+		}
+		if err := txR.Txpool.CheckTxWithInfo(v.tx, v.info); err != nil && err != ErrPoolStopped {
+			txR.recvLogger.Info("Could not check tx", "tx", TxVoteID(v.tx), "seq", v.info.ReceiveSeq, "height", v.tx.Height, "err", err)
+		}
+	}
+	return len(votes)
+}
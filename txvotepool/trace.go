@@ -0,0 +1,142 @@
+package txvotepool
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	cmn "github.com/tendermint/tendermint/libs/common"
+	"github.com/tendermint/tendermint/p2p"
+	"github.com/tendermint/tendermint/p2p/conn"
+)
+
+// traceRecordOverhead bounds the bytes a TraceRecord adds to the message it
+// holds.
+const traceRecordOverhead = 1024
+
+// TraceRecord is a message received by the reactor, as recorded by
+// ReactorRecordTrace.
+type TraceRecord struct {
+	UnixNanos int64 `binary:"fixed64"` // when it was received
+	Src       p2p.ID
+	ChID      byte
+	Msg       []byte // as received, not decoded
+}
+
+// ReactorRecordTrace makes the reactor write every message it receives to w,
+// with when and from which peer it was received, so that the session can be
+// reproduced with Replay. Each record is amino encoded, prefixed with its
+// length as an uvarint. Recording stops at the first write error. Messages
+// aren't recorded by default.
+func ReactorRecordTrace(w io.Writer) ReactorOption {
+	return func(txR *TxpoolReactor) { txR.trace = w }
+}
+
+// recordTrace writes the received message to the trace, if recording.
+func (txR *TxpoolReactor) recordTrace(chID byte, src p2p.Peer, msgBytes []byte) {
+	txR.traceMtx.Lock()
+	defer txR.traceMtx.Unlock()
+	if txR.trace == nil {
+		return
+	}
+	rec := TraceRecord{UnixNanos: time.Now().UnixNano(), Src: src.ID(), ChID: chID, Msg: msgBytes}
+	if _, err := cdc.MarshalBinaryLengthPrefixedWriter(txR.trace, rec); err != nil {
+		txR.Logger.Error("Failed to record trace, recording stopped", "err", err)
+		txR.trace = nil
+	}
+}
+
+// Replay feeds the messages recorded by ReactorRecordTrace to the reactor, in
+// the order they were received, one at a time and without waiting between
+// them. The peers they came from are stood for by peers with the same ID,
+// added before their first message and removed once the trace is replayed.
+// It returns an error if r can't be read or decoded.
+func (txR *TxpoolReactor) Replay(r io.Reader) error {
+	peers := make(map[p2p.ID]*replayPeer)
+	defer func() {
+		for _, peer := range peers {
+			txR.RemovePeer(peer, nil)
+			peer.Stop()
+		}
+	}()
+
+	var replayed int
+	for {
+		var rec TraceRecord
+		n, err := cdc.UnmarshalBinaryLengthPrefixedReader(r, &rec, maxMsgSize+traceRecordOverhead)
+		if err == io.EOF && n == 0 {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to decode trace record")
+		}
+		peer, ok := peers[rec.Src]
+		if !ok {
+			peer = newReplayPeer(rec.Src)
+			peers[rec.Src] = peer
+			txR.AddPeer(peer)
+		}
+		txR.Receive(rec.ChID, peer, rec.Msg)
+		replayed++
+	}
+	txR.Logger.Info("Replayed trace", "msgs", replayed, "peers", len(peers))
+	return nil
+}
+
+// replayPeer stands for the peer a recorded message came from. Nothing is
+// sent to it.
+type replayPeer struct {
+	*cmn.BaseService
+	addr *p2p.NetAddress
+
+	mtx sync.Mutex
+	kv  map[string]interface{}
+}
+
+var _ p2p.Peer = (*replayPeer)(nil)
+
+// newReplayPeer returns a started replayPeer with the given ID.
+func newReplayPeer(id p2p.ID) *replayPeer {
+	addr := p2p.NewNetAddressIPPort(net.IP{127, 0, 0, 1}, 26656)
+	addr.ID = id
+	rp := &replayPeer{
+		addr: addr,
+		kv:   make(map[string]interface{}),
+	}
+	rp.BaseService = cmn.NewBaseService(nil, "ReplayPeer", rp)
+	rp.Start()
+	return rp
+}
+
+func (rp *replayPeer) FlushStop()       { rp.Stop() }
+func (rp *replayPeer) ID() p2p.ID       { return rp.addr.ID }
+func (rp *replayPeer) RemoteIP() net.IP { return rp.addr.IP }
+func (rp *replayPeer) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: rp.addr.IP, Port: int(rp.addr.Port)}
+}
+func (rp *replayPeer) IsOutbound() bool                   { return false }
+func (rp *replayPeer) IsPersistent() bool                 { return false }
+func (rp *replayPeer) CloseConn() error                   { return nil }
+func (rp *replayPeer) Status() conn.ConnectionStatus      { return conn.ConnectionStatus{} }
+func (rp *replayPeer) SocketAddr() *p2p.NetAddress        { return rp.addr }
+func (rp *replayPeer) Send(chID byte, msg []byte) bool    { return true }
+func (rp *replayPeer) TrySend(chID byte, msg []byte) bool { return true }
+
+func (rp *replayPeer) NodeInfo() p2p.NodeInfo {
+	return p2p.DefaultNodeInfo{ID_: rp.addr.ID, ListenAddr: rp.addr.DialString()}
+}
+
+func (rp *replayPeer) Get(key string) interface{} {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+	return rp.kv[key]
+}
+
+func (rp *replayPeer) Set(key string, value interface{}) {
+	rp.mtx.Lock()
+	rp.kv[key] = value
+	rp.mtx.Unlock()
+}
@@ -0,0 +1,61 @@
+package txvotepool
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+func TestReplayTraceReproducesPool(t *testing.T) {
+	trace := new(bytes.Buffer)
+	recorder := newTestReactor(t, ReactorRecordTrace(trace))
+	defer recorder.Stop()
+
+	peer1, peer2 := newTestPeer("peer1"), newTestPeer("peer2")
+	recorder.AddPeer(peer1)
+	recorder.AddPeer(peer2)
+	validator := newTestValidator()
+	votes := make([]types.TxVote, 5)
+	for i := range votes {
+		votes[i] = newTestVote(int64(i%2+1), validator)
+	}
+	sendMsg(recorder, peer1, &TxMessage{Tx: votes[0]})
+	sendMsg(recorder, peer2, &TxsMessage{Txs: votes[1:3]})
+	// a duplicate, and a message on the wrong channel, which are dropped
+	sendMsg(recorder, peer1, &TxMessage{Tx: votes[1]})
+	recorder.Receive(TxpoolChannel+1, peer2, cdc.MustMarshalBinaryBare(&TxMessage{Tx: votes[3]}))
+	sendMsg(recorder, peer2, &AckMessage{ID: votes[0].Signature})
+	sendMsg(recorder, peer1, &TxMessage{Tx: votes[4]})
+
+	recorded := recorder.Txpool.Snapshot()
+	require.Len(t, recorded.Votes, 4)
+
+	replayer := newTestReactor(t)
+	defer replayer.Stop()
+	require.NoError(t, replayer.Replay(bytes.NewReader(trace.Bytes())))
+	replayed := replayer.Txpool.Snapshot()
+	assert.Equal(t, recorded.Votes, replayed.Votes)
+	assert.Equal(t, recorded.Heights, replayed.Heights)
+	assert.Equal(t, recorded.TxsBytes, replayed.TxsBytes)
+
+	// The stand in peers are gone once replayed.
+	assert.Empty(t, replayer.ids.ActivePeers())
+}
+
+func TestReplayTruncatedTraceFails(t *testing.T) {
+	trace := new(bytes.Buffer)
+	recorder := newTestReactor(t, ReactorRecordTrace(trace))
+	defer recorder.Stop()
+
+	peer := newTestPeer("peer")
+	recorder.AddPeer(peer)
+	sendMsg(recorder, peer, &TxMessage{Tx: newTestVote(1, newTestValidator())})
+
+	replayer := newTestReactor(t)
+	defer replayer.Stop()
+	assert.Error(t, replayer.Replay(bytes.NewReader(trace.Bytes()[:trace.Len()-1])))
+}
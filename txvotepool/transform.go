@@ -0,0 +1,78 @@
+package txvotepool
+
+import (
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// ReactorVoteTransforms sets the transform applied to votes sent to peers,
+// and the one undoing it on the votes received from them, eg. to leave out
+// fields peers can reconstruct and save bandwidth. Votes are checked, and
+// deduplicated, in their restored form, so inbound must return the vote
+// outbound was given. Votes are sent as is by default.
+func ReactorVoteTransforms(outbound, inbound func(types.TxVote) types.TxVote) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.outboundTransform = outbound
+		txR.inboundTransform = inbound
+	}
+}
+
+// outboundVote returns the vote as sent to peers.
+func (txR *TxpoolReactor) outboundVote(tx types.TxVote) types.TxVote {
+	if txR.outboundTransform == nil {
+		return tx
+	}
+	return txR.outboundTransform(tx)
+}
+
+// inboundVote returns the vote received from a peer as sent by its author.
+func (txR *TxpoolReactor) inboundVote(tx types.TxVote) types.TxVote {
+	if txR.inboundTransform == nil {
+		return tx
+	}
+	return txR.inboundTransform(tx)
+}
+
+// restoreVotes undoes the outbound transform on the votes of the message, in
+// place. Votes in envelopes, or signed chunks, are left as is, as their
+// signature covers the transformed form, and are restored once verified.
+func (txR *TxpoolReactor) restoreVotes(msg TxpoolMessage) {
+	if txR.inboundTransform == nil {
+		return
+	}
+	switch msg := msg.(type) {
+	case *TxMessage:
+		msg.Tx = txR.inboundTransform(msg.Tx)
+	case *TxsMessage:
+		txR.restoreTxs(msg.Txs)
+	case *PoolChunkMessage:
+		if msg.Signature == nil {
+			txR.restoreTxs(msg.Txs)
+		}
+	case *WarmUpChunkMessage:
+		if msg.Signature == nil {
+			txR.restoreTxs(msg.Txs)
+		}
+	}
+}
+
+// restoreTxs undoes the outbound transform on the votes, in place.
+func (txR *TxpoolReactor) restoreTxs(txs []types.TxVote) {
+	if txR.inboundTransform == nil {
+		return
+	}
+	for i := range txs {
+		txs[i] = txR.inboundTransform(txs[i])
+	}
+}
+
+// outboundVotes returns the votes as sent to peers, see outboundVote.
+func (txR *TxpoolReactor) outboundVotes(txs []types.TxVote) []types.TxVote {
+	if txR.outboundTransform == nil {
+		return txs
+	}
+	out := make([]types.TxVote, len(txs))
+	for i, tx := range txs {
+		out[i] = txR.outboundTransform(tx)
+	}
+	return out
+}
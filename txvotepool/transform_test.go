@@ -0,0 +1,48 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestVoteTransformsRoundTrip(t *testing.T) {
+	// All votes come from one validator, so peers can fill its address in.
+	validator := newTestValidator()
+	strip := func(tx types.TxVote) types.TxVote {
+		tx.ValidatorAddress = nil
+		return tx
+	}
+	restore := func(tx types.TxVote) types.TxVote {
+		tx.ValidatorAddress = validator
+		return tx
+	}
+	sender := newTestReactor(t, ReactorVoteTransforms(strip, restore))
+	defer sender.Stop()
+	receiver := newTestReactor(t, ReactorVoteTransforms(strip, restore))
+	defer receiver.Stop()
+
+	peer := newTestPeer("receiver")
+	peer.Set(ttypes.PeerStateKey, testPeerState{10})
+	sender.AddPeer(peer)
+	vote := newTestVote(1, validator)
+	require.NoError(t, sender.Txpool.CheckTx(vote))
+	waitFor(t, 2*time.Second, func() bool { return votesSent(peer) == 1 }, "vote not sent")
+
+	msg, ok := peer.Sent()[0].(*TxMessage)
+	require.True(t, ok)
+	assert.Empty(t, msg.Tx.ValidatorAddress, "field not stripped before broadcast")
+
+	src := newTestPeer("sender")
+	sendMsg(receiver, src, msg)
+	assert.Equal(t, []types.TxVote{vote}, receiver.Txpool.ReapMaxTxs(-1))
+
+	// The restored vote is a duplicate of the canonical one.
+	sendMsg(receiver, src, msg)
+	assert.Equal(t, 1, receiver.Txpool.Size())
+}
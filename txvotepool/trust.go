@@ -0,0 +1,45 @@
+package txvotepool
+
+import (
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorPeerTrust drops the votes of peers whose score is below threshold
+// as soon as they are received, before they are verified or checked, so that
+// no CPU is spent on the votes of peers known to be bad. Unlike the weights
+// of ReactorRandomFanout, which only make peers less likely to get votes,
+// this cuts peers off. score is called for every message carrying votes, so
+// it must be cheap. The votes of all peers are taken by default.
+func ReactorPeerTrust(score func(p2p.ID) float64, threshold float64) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.peerScore = score
+		txR.trustThreshold = threshold
+	}
+}
+
+// dropUntrusted returns true, counting its votes as dropped, if msg carries
+// votes from a peer scoring below the trust threshold.
+func (txR *TxpoolReactor) dropUntrusted(src p2p.Peer, msg TxpoolMessage) bool {
+	if txR.peerScore == nil {
+		return false
+	}
+	var votes int
+	switch msg := msg.(type) {
+	case *TxMessage, *TxV2Message, *SignedTxMessage:
+		votes = 1
+	case *TxsMessage:
+		votes = len(msg.Txs)
+	case *PoolChunkMessage:
+		votes = len(msg.Txs)
+	case *WarmUpChunkMessage:
+		votes = len(msg.Txs)
+	default:
+		return false
+	}
+	if txR.peerScore(src.ID()) >= txR.trustThreshold {
+		return false
+	}
+	txR.Txpool.metrics.UntrustedTxs.Add(float64(votes))
+	txR.recvLogger.Debug("Dropping votes of untrusted peer", "src", src, "votes", votes)
+	return true
+}
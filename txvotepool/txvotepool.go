@@ -4,17 +4,23 @@ import (
 	"container/list"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/andrecronje/babble-abci/types"
 	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/crypto/tmhash"
 	auto "github.com/tendermint/tendermint/libs/autofile"
 	"github.com/tendermint/tendermint/libs/clist"
 	cmn "github.com/tendermint/tendermint/libs/common"
 	"github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
 )
 
 // TxVoteInfo are parameters that get passed when attempting to add a tx vote to the
@@ -23,6 +29,28 @@ type TxVoteInfo struct {
 	// We don't use p2p.ID here because it's too big. The gain is to store max 2
 	// bytes with each tx vote to identify the sender rather than 20 bytes.
 	PeerID uint16
+	// ReceiveSeq is the sequence number the reactor assigned to the message
+	// carrying the vote, zero if the vote did not come from a peer.
+	ReceiveSeq uint64
+	// Provenance are the nodes the vote went through, this one included,
+	// see ReactorRelayProvenance.
+	Provenance []RelayHop
+}
+
+// CheckTxResult tells what came of checking a vote, see CheckTxWithResult.
+type CheckTxResult struct {
+	// Added is set if the vote was added to the pool.
+	Added bool
+	// Duplicate is set if the vote was turned down as already seen.
+	Duplicate bool
+	// Dropped is set if the vote was silently dropped, see
+	// CommittedHeightDrop.
+	Dropped bool
+	// Superseded is set if the vote replaced one already in the pool. The
+	// pool keeps every vote it is given for now, so it is never set.
+	Superseded bool
+	// PoolSize is the number of votes in the pool once the vote was checked.
+	PoolSize int
 }
 
 var (
@@ -31,6 +59,81 @@ var (
 
 	// ErrTxVoteTooLarge means the txvote is too big to be sent in a message to other peers
 	ErrTxVoteTooLarge = fmt.Errorf("TxVote too large. Max size is %d", maxTxSize)
+
+	// ErrTxVoteShed is returned when the pool is under pressure and the vote
+	// is too far from the committed height to be worth accepting.
+	ErrTxVoteShed = errors.New("TxVote shed, pool under pressure")
+
+	// ErrTxVoteHeightCommitted is returned when the vote is for a height the
+	// pool was already updated to.
+	ErrTxVoteHeightCommitted = errors.New("TxVote for an already committed height")
+
+	// ErrPoolStopped is returned when checking a vote after the pool was
+	// stopped.
+	ErrPoolStopped = errors.New("TxVote pool stopped")
+)
+
+// ErrTxVoteFieldTooLarge is returned when a variable length field of a vote
+// is larger than allowed by the pool's FieldLimits.
+type ErrTxVoteFieldTooLarge struct {
+	Field string
+	Size  int
+	Max   int
+}
+
+func (e ErrTxVoteFieldTooLarge) Error() string {
+	return fmt.Sprintf("TxVote %s too large: %d bytes (max: %d)", e.Field, e.Size, e.Max)
+}
+
+// FieldLimits are the max sizes, in bytes, of the variable length fields of
+// the votes accepted in the pool. A limit of 0 disables the check.
+type FieldLimits struct {
+	TxHash           int
+	ValidatorAddress int
+	Signature        int
+}
+
+// DefaultFieldLimits returns the field limits matching well formed votes.
+func DefaultFieldLimits() FieldLimits {
+	return FieldLimits{
+		TxHash:           tmhash.Size,
+		ValidatorAddress: crypto.AddressSize,
+		Signature:        ttypes.MaxSignatureSize,
+	}
+}
+
+// check returns an ErrTxVoteFieldTooLarge for the first field of tx over its
+// limit.
+func (limits FieldLimits) check(tx types.TxVote) error {
+	fields := []struct {
+		name string
+		size int
+		max  int
+	}{
+		{"TxHash", len(tx.TxHash), limits.TxHash},
+		{"ValidatorAddress", len(tx.ValidatorAddress), limits.ValidatorAddress},
+		{"Signature", len(tx.Signature), limits.Signature},
+	}
+	for _, f := range fields {
+		if f.max > 0 && f.size > f.max {
+			return ErrTxVoteFieldTooLarge{Field: f.name, Size: f.size, Max: f.max}
+		}
+	}
+	return nil
+}
+
+// CommittedHeightPolicy defines how the pool handles votes for heights it was
+// already updated to.
+type CommittedHeightPolicy int
+
+const (
+	// CommittedHeightAccept adds such votes like any other.
+	CommittedHeightAccept CommittedHeightPolicy = iota
+	// CommittedHeightReject rejects them with ErrTxVoteHeightCommitted.
+	CommittedHeightReject
+	// CommittedHeightDrop silently drops them: CheckTx returns no error, but
+	// the vote isn't added, see CheckTxResult.Dropped.
+	CommittedHeightDrop
 )
 
 // ErrMempoolIsFull means Tendermint & an application can't handle that much load
@@ -69,6 +172,27 @@ func TxVoteID(tx types.TxVote) string {
 	return string(tx.Signature)
 }
 
+// normalizeTxVote returns the canonical form of tx: the timestamp in UTC
+// without a monotonic clock reading, and empty byte fields set to nil. The
+// byte fields are copied so the result doesn't alias the caller's buffers.
+// Votes differing only in these respects encode to the same bytes and share
+// a TxVoteID, which only depends on the signature. The pool stores, and
+// rebroadcasts, the normalized form.
+func normalizeTxVote(tx types.TxVote) types.TxVote {
+	tx.Timestamp = tx.Timestamp.Round(0).UTC()
+	tx.TxHash = normalizeBytes(tx.TxHash)
+	tx.ValidatorAddress = normalizeBytes(tx.ValidatorAddress)
+	tx.Signature = normalizeBytes(tx.Signature)
+	return tx
+}
+
+func normalizeBytes(bz []byte) []byte {
+	if len(bz) == 0 {
+		return nil
+	}
+	return append([]byte(nil), bz...)
+}
+
 // txVoteKey is the fixed length array sha256 hash used as the key in maps.
 func txVoteKey(tx types.TxVote) [sha256.Size]byte {
 	return sha256.Sum256(tx.Signature)
@@ -79,6 +203,7 @@ func txVoteKey(tx types.TxVote) [sha256.Size]byte {
 type TxVotePool struct {
 	config   *cfg.MempoolConfig
 	proxyMtx sync.Mutex
+	height   int64 // the last block Update()'d to
 
 	txs *clist.CList // concurrent linked-list of good txs
 
@@ -99,6 +224,89 @@ type TxVotePool struct {
 	wal *auto.AutoFile
 
 	logger log.Logger
+	// layout used to render vote timestamps in logs
+	timestampLayout string
+
+	// how long committed votes are kept before being removed
+	commitGrace time.Duration
+
+	// once the pool is filled above shedPressure (a fraction of its
+	// capacity), only votes within shedWindow heights of the committed height
+	// are accepted. Disabled if shedPressure is 0.
+	shedPressure float64
+	shedWindow   int64
+
+	committedHeightPolicy CommittedHeightPolicy
+	graceHeightPolicy     GraceHeightPolicy
+	// number of committed votes kept during the grace period by height
+	graceHeights  map[int64]int
+	// number of uncommitted votes of each height some active peer doesn't
+	// have, nil unless tracked, see OnHeightBroadcastComplete
+	pendingMtx        sync.Mutex
+	pendingBroadcasts map[int64]int
+	fieldLimits   FieldLimits
+	stakeProvider StakeProvider
+	blockStore    BlockStore // nil unless WithBlockStore
+
+	// number of votes in the pool by signer (ValidatorAddress)
+	signerVotes map[string]int
+	// number of votes in the pool by height, and max number of heights, see
+	// WithMaxHeights
+	heightVotes     map[int64]int
+	maxHeights      int
+	heightCapPolicy HeightCapPolicy
+	// see WithMaxSendersPerVote, unlimited if 0
+	maxSendersPerVote int32
+	// number of senders and relay hops of the votes in the pool, and max
+	// memory held by the pool, see WithMaxMemory
+	numSenders   int64
+	numRelayHops int64
+	maxMemory    int64
+	// heights of the votes seen by signer, nil if not tracked
+	gaps *gapTracker
+
+	// optional check votes must pass, and the breaker suspending it when
+	// failing
+	preCheck PreCheckFunc
+	breaker  *circuitBreaker
+	// unix nanos until which the breaker is open, read without locking
+	breakerOpenUntil int64
+
+	// unix nanos of the last time a vote left the pool
+	lastRemoved int64
+
+	// set by Stop, no votes are checked past it
+	stopped bool
+	// closed by Stop, ends the consumers of the sources, see AddSource
+	quit chan struct{}
+
+	// duplicates each peer sent during the current height, nil unless
+	// WithPeerDuplicatePolicy is used
+	dupThreshold int
+	dupPolicy    DuplicatePolicy
+	peerDups     map[uint16]int
+
+	// votes failing softCheck, held until ReevaluateQuarantine
+	softCheck       SoftCheckFunc
+	quarantineCap   int
+	quarantine      map[[sha256.Size]byte]quarantinedVote
+	quarantineOrder [][sha256.Size]byte
+
+	// last heights and buffered votes by signer, nil unless
+	// WithStrictSignerOrder is used
+	signerOrders    map[string]*signerOrder
+	orderBufferSize int
+	orderMaxWait    time.Duration
+	orderBuffered   int
+	// buffered votes to check once the pool is unlocked, see checkReleased
+	released []bufferedVote
+
+	// callback for the pool becoming empty or non empty, see
+	// SetEmptyTransitionCallback
+	emptyMtx       sync.Mutex
+	emptyCb        func(empty bool)
+	emptyReported  bool // whether the pool was empty when last reported
+	emptyNotifying bool // the callback is being invoked
 
 	metrics *Metrics
 }
@@ -112,10 +320,18 @@ func NewTxVotePool(
 	options ...TxVotePoolOption,
 ) *TxVotePool {
 	txVotePool := &TxVotePool{
-		config:  config,
-		txs:     clist.New(),
-		logger:  log.NewNopLogger(),
-		metrics: NopMetrics(),
+		config:          config,
+		txs:             clist.New(),
+		logger:          log.NewNopLogger(),
+		timestampLayout: ttypes.TimeFormat,
+		fieldLimits:     DefaultFieldLimits(),
+		stakeProvider:   nopStakeProvider{},
+		signerVotes:     make(map[string]int),
+		heightVotes:     make(map[int64]int),
+		graceHeights:    make(map[int64]int),
+		quit:            make(chan struct{}),
+		lastRemoved:     time.Now().UnixNano(),
+		metrics:         NopMetrics(),
 	}
 	if config.CacheSize > 0 {
 		txVotePool.cache = newMapTxCache(config.CacheSize)
@@ -145,6 +361,43 @@ func WithMetrics(metrics *Metrics) TxVotePoolOption {
 	return func(txVotePool *TxVotePool) { txVotePool.metrics = metrics }
 }
 
+// WithTimestampLayout sets the time layout used to render vote timestamps in
+// logs, so they can be correlated with the logs of other nodes.
+func WithTimestampLayout(layout string) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.timestampLayout = layout }
+}
+
+// WithCommitGrace keeps committed votes in the pool for the given duration
+// after Update, so that peers still converging can fetch them. Such votes are
+// neither reaped nor broadcast anymore. The default of zero removes committed
+// votes immediately.
+func WithCommitGrace(grace time.Duration) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.commitGrace = grace }
+}
+
+// WithOverloadShedding makes the pool, once filled above the given fraction
+// of its capacity, reject votes more than window heights away from the last
+// committed height. This keeps room for the votes that matter most when
+// receiving faster than votes get committed. Shedding is disabled by default.
+func WithOverloadShedding(pressure float64, window int64) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) {
+		txVotePool.shedPressure = pressure
+		txVotePool.shedWindow = window
+	}
+}
+
+// WithFieldLimits sets the max sizes of the variable length fields of the
+// votes. Defaults to DefaultFieldLimits.
+func WithFieldLimits(limits FieldLimits) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.fieldLimits = limits }
+}
+
+// WithCommittedHeightPolicy sets how votes for heights the pool was already
+// updated to are handled. They are accepted by default.
+func WithCommittedHeightPolicy(policy CommittedHeightPolicy) TxVotePoolOption {
+	return func(txVotePool *TxVotePool) { txVotePool.committedHeightPolicy = policy }
+}
+
 // InitWAL creates a directory for the WAL file and opens a file itself.
 //
 // *panics* if can't create directory or open file.
@@ -179,9 +432,47 @@ func (txVotePool *TxVotePool) Lock() {
 	txVotePool.proxyMtx.Lock()
 }
 
-// Unlock unlocks the mempool.
+// Unlock unlocks the mempool, and then reports whether it became empty or non
+// empty while locked, see SetEmptyTransitionCallback.
 func (txVotePool *TxVotePool) Unlock() {
 	txVotePool.proxyMtx.Unlock()
+	txVotePool.notifyEmptyTransition()
+}
+
+// SetEmptyTransitionCallback sets a callback invoked when the pool becomes
+// empty (with true) or non empty (with false). It is only invoked on these
+// edges, once the pool is unlocked, so the pool can be used from it. Changes
+// undone while the pool was locked, eg. by Update removing all the votes
+// before new ones are checked, aren't reported. Callbacks are not invoked
+// concurrently.
+func (txVotePool *TxVotePool) SetEmptyTransitionCallback(cb func(empty bool)) {
+	txVotePool.emptyMtx.Lock()
+	txVotePool.emptyCb = cb
+	txVotePool.emptyReported = txVotePool.Size() == 0
+	txVotePool.emptyMtx.Unlock()
+}
+
+// notifyEmptyTransition invokes the empty transition callback if the pool
+// became empty or non empty since it was last invoked. If the callback is
+// already running, eg. in another goroutine or because it modified the pool,
+// the running invocation checks again once done instead.
+func (txVotePool *TxVotePool) notifyEmptyTransition() {
+	txVotePool.emptyMtx.Lock()
+	defer txVotePool.emptyMtx.Unlock()
+
+	if txVotePool.emptyCb == nil || txVotePool.emptyNotifying {
+		return
+	}
+	for empty := txVotePool.Size() == 0; empty != txVotePool.emptyReported; empty = txVotePool.Size() == 0 {
+		txVotePool.emptyReported = empty
+		cb := txVotePool.emptyCb
+
+		txVotePool.emptyNotifying = true
+		txVotePool.emptyMtx.Unlock()
+		cb(empty)
+		txVotePool.emptyMtx.Lock()
+		txVotePool.emptyNotifying = false
+	}
 }
 
 // Size returns the number of transactions in the mempool.
@@ -189,6 +480,11 @@ func (txVotePool *TxVotePool) Size() int {
 	return txVotePool.txs.Len()
 }
 
+// Height returns the last height the pool was updated to.
+func (txVotePool *TxVotePool) Height() int64 {
+	return atomic.LoadInt64(&txVotePool.height)
+}
+
 // TxsBytes returns the total size of all txs in the mempool.
 func (txVotePool *TxVotePool) TxsBytes() int64 {
 	return atomic.LoadInt64(&txVotePool.txsBytes)
@@ -197,17 +493,35 @@ func (txVotePool *TxVotePool) TxsBytes() int64 {
 // Flush removes all transactions from the mempool and cache
 func (txVotePool *TxVotePool) Flush() {
 	txVotePool.proxyMtx.Lock()
-	defer txVotePool.proxyMtx.Unlock()
+	defer txVotePool.Unlock()
 
 	txVotePool.cache.Reset()
+	txVotePool.reportDedupCacheEntries()
 
+	// Entries are deleted one by one rather than replacing the map, as
+	// GetVote reads it without the lock. Broadcast routines holding a removed
+	// element skip it, see broadcastTxRoutine.
 	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
 		txVotePool.txs.Remove(e)
 		e.DetachPrev()
+		txVotePool.txsMap.Delete(txVoteKey(e.Value.(*mempoolTxVote).tx))
+		txVotePool.removePendingBroadcast(e.Value.(*mempoolTxVote))
 	}
 
-	txVotePool.txsMap = sync.Map{}
 	_ = atomic.SwapInt64(&txVotePool.txsBytes, 0)
+	atomic.StoreInt64(&txVotePool.numSenders, 0)
+	atomic.StoreInt64(&txVotePool.numRelayHops, 0)
+	txVotePool.signerVotes = make(map[string]int)
+	txVotePool.heightVotes = make(map[int64]int)
+	txVotePool.metrics.reportCacheEntries(cacheHeights, 0)
+	txVotePool.graceHeights = make(map[int64]int)
+	if txVotePool.signerOrders != nil {
+		txVotePool.signerOrders = make(map[string]*signerOrder)
+		txVotePool.orderBuffered = 0
+		txVotePool.metrics.reportCacheEntries(cacheOrderBuffered, 0)
+	}
+	atomic.StoreInt64(&txVotePool.lastRemoved, time.Now().UnixNano())
+	txVotePool.metrics.Size.Set(0)
 }
 
 // TxsFront returns the first transaction in the ordered list for peer
@@ -233,12 +547,44 @@ func (txVotePool *TxVotePool) CheckTx(tx types.TxVote) (err error) {
 	return txVotePool.CheckTxWithInfo(tx, TxVoteInfo{PeerID: UnknownPeerID})
 }
 
+// Stop stops the pool during shutdown. Votes checked afterwards are rejected
+// with ErrPoolStopped.
+func (txVotePool *TxVotePool) Stop() {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	if !txVotePool.stopped {
+		close(txVotePool.quit)
+	}
+	txVotePool.stopped = true
+}
+
 // CheckTxWithInfo performs the same operation as CheckTx, but with extra meta data about the tx.
 // Currently this metadata is the peer who sent it,
 // used to prevent the tx from being gossiped back to them.
 func (txVotePool *TxVotePool) CheckTxWithInfo(tx types.TxVote, txInfo TxVoteInfo) (err error) {
+	_, err = txVotePool.CheckTxWithResult(tx, txInfo)
+	return err
+}
+
+// CheckTxWithResult performs the same operation as CheckTxWithInfo, and also
+// returns what came of it.
+func (txVotePool *TxVotePool) CheckTxWithResult(tx types.TxVote, txInfo TxVoteInfo) (res CheckTxResult, err error) {
 	txVotePool.proxyMtx.Lock()
-	defer txVotePool.proxyMtx.Unlock()
+	if txVotePool.signerOrders != nil {
+		// runs once the pool is unlocked
+		defer txVotePool.checkReleased()
+	}
+	defer txVotePool.Unlock()
+	defer func() { res.PoolSize = txVotePool.Size() }()
+
+	if txVotePool.stopped {
+		return res, ErrPoolStopped
+	}
+	if txVotePool.peerThrottled(txInfo.PeerID) {
+		return res, ErrPeerThrottled
+	}
+
+	tx = normalizeTxVote(tx)
 
 	var (
 		memSize  = txVotePool.Size()
@@ -247,7 +593,7 @@ func (txVotePool *TxVotePool) CheckTxWithInfo(tx types.TxVote, txInfo TxVoteInfo
 
 	if memSize >= txVotePool.config.Size ||
 		int64(tx.Size())+txsBytes > txVotePool.config.MaxTxsBytes {
-		return ErrMempoolIsFull{
+		return res, ErrMempoolIsFull{
 			memSize, txVotePool.config.Size,
 			txsBytes, txVotePool.config.MaxTxsBytes}
 	}
@@ -256,28 +602,80 @@ func (txVotePool *TxVotePool) CheckTxWithInfo(tx types.TxVote, txInfo TxVoteInfo
 	// can't be larger than the maxMsgSize, otherwise we can't
 	// relay it to peers.
 	if tx.Size() > maxTxSize {
-		return ErrTxVoteTooLarge
+		return res, ErrTxVoteTooLarge
 	}
 
-	// CACHE
-	if !txVotePool.cache.Push(tx) {
-		// Record a new sender for a tx we've already seen.
-		// Note it's possible a tx is still in the cache but no longer in the mempool
-		// (eg. after committing a block, txs are removed from mempool but not cache),
-		// so we only record the sender for txs still in the mempool.
-		if e, ok := txVotePool.txsMap.Load(txVoteKey(tx)); ok {
-			memTxVote := e.(*clist.CElement).Value.(*mempoolTxVote)
-			if _, loaded := memTxVote.senders.LoadOrStore(txInfo.PeerID, true); loaded {
-				// TODO: consider punishing peer for dups,
-				// its non-trivial since invalid txs can become valid,
-				// but they can spam the same tx with little cost to them atm.
-			}
+	if err := txVotePool.fieldLimits.check(tx); err != nil {
+		return res, err
+	}
+
+	if txVotePool.committedHeightPolicy != CommittedHeightAccept && tx.Height <= txVotePool.height {
+		txVotePool.metrics.CommittedHeightTxs.Add(1)
+		if txVotePool.committedHeightPolicy == CommittedHeightDrop {
+			res.Dropped = true
+			return res, nil
 		}
+		return res, ErrTxVoteHeightCommitted
+	}
+	inGrace := txVotePool.inGrace(tx.Height)
+	if inGrace && txVotePool.graceHeightPolicy == GraceHeightReject {
+		txVotePool.metrics.CommittedHeightTxs.Add(1)
+		return res, ErrTxVoteHeightCommitted
+	}
 
-		return ErrTxVoteInCache
+	if txVotePool.shouldShed(tx, memSize) {
+		txVotePool.metrics.ShedTxs.Add(1)
+		return res, ErrTxVoteShed
 	}
+
+	// CACHE
+	if !txVotePool.cache.Push(tx) {
+		txVotePool.recordSender(tx, txInfo)
+		res.Duplicate = true
+		return res, ErrTxVoteInCache
+	}
+	txVotePool.reportDedupCacheEntries()
 	// END CACHE
 
+	// The checks below are only run once per vote, duplicates being turned
+	// down by the cache. A vote they reject is let in again.
+	if err := txVotePool.checkBlock(tx); err != nil {
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
+	if err := txVotePool.runPreCheck(tx); err != nil {
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
+	if err := txVotePool.quarantineIfSuspicious(tx, txInfo); err != nil {
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
+	if err := txVotePool.checkOrder(tx, txInfo); err != nil {
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
+	if err := txVotePool.stakeProvider.Admit(tx, txVotePool.signerVotes[string(tx.ValidatorAddress)]); err != nil {
+		// Let the vote in again once its signer is admitted.
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
+	if err := txVotePool.makeRoomForHeight(tx); err != nil {
+		// Let the vote in again once there is room.
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
+	if err := txVotePool.reclaimMemory(tx); err != nil {
+		txVotePool.cache.Remove(tx)
+		return res, err
+	}
+
 	// WAL
 	if txVotePool.wal != nil {
 		// TODO: Notify administrators when WAL fails
@@ -295,29 +693,132 @@ func (txVotePool *TxVotePool) CheckTxWithInfo(tx types.TxVote, txInfo TxVoteInfo
 	// END WAL
 
 	memTxVote := &mempoolTxVote{
-		height: txVotePool.height,
-		tx:     tx,
+		height:      txVotePool.height,
+		timestamp:   time.Now(),
+		tx:          tx,
+		provenance:  txInfo.Provenance,
+		maxSenders:  txVotePool.maxSendersPerVote,
+		poolSenders: &txVotePool.numSenders,
 	}
 
-	memTxVote.senders.Store(txInfo.PeerID, true)
+	memTxVote.addSender(txInfo.PeerID)
+	txVotePool.markReceivedFrom(memTxVote, txInfo.PeerID)
+	if inGrace && txVotePool.graceHeightPolicy == GraceHeightServe {
+		txVotePool.commitVote(memTxVote, memTxVote.timestamp)
+	}
 	txVotePool.addTx(memTxVote)
+	txVotePool.advanceOrder(tx)
 	txVotePool.logger.Info("Added good vote",
 		"event", TxVoteID(tx),
 		"height", memTxVote.height,
+		"voteHeight", tx.Height,
+		"timestamp", tx.Timestamp.Format(txVotePool.timestampLayout),
+		"seq", txInfo.ReceiveSeq,
 		"total", txVotePool.Size(),
 	)
 	txVotePool.notifyTxsAvailable()
 	txVotePool.metrics.Size.Set(float64(txVotePool.Size()))
+	txVotePool.metrics.VoteLatency.Observe(time.Since(tx.Timestamp).Seconds())
+
+	res.Added = true
+	return res, nil
+}
+
+// Requeue puts back a vote which was reaped but failed downstream processing,
+// so it can be reaped again. The vote is not added twice if it is still in the
+// pool. A requeued vote goes to the back of the pool with no senders, so the
+// broadcast routines pick it up again for the peers which dropped it too;
+// those still holding it turn it down as a duplicate. It returns
+// ErrPoolStopped once the pool is stopped.
+func (txVotePool *TxVotePool) Requeue(tx types.TxVote) error {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.Unlock()
+
+	if txVotePool.stopped {
+		return ErrPoolStopped
+	}
+
+	tx = normalizeTxVote(tx)
+
+	if _, ok := txVotePool.txsMap.Load(txVoteKey(tx)); ok {
+		return nil
+	}
+
+	var (
+		memSize  = txVotePool.Size()
+		txsBytes = txVotePool.TxsBytes()
+	)
+	if memSize >= txVotePool.config.Size ||
+		int64(tx.Size())+txsBytes > txVotePool.config.MaxTxsBytes {
+		return ErrMempoolIsFull{
+			memSize, txVotePool.config.Size,
+			txsBytes, txVotePool.config.MaxTxsBytes}
+	}
+
+	_ = txVotePool.cache.Push(tx)
+	memTxVote := &mempoolTxVote{
+		height:      txVotePool.height,
+		timestamp:   time.Now(),
+		tx:          tx,
+		requeued:    true,
+		maxSenders:  txVotePool.maxSendersPerVote,
+		poolSenders: &txVotePool.numSenders,
+	}
+	memTxVote.addSender(UnknownPeerID)
+	txVotePool.addTx(memTxVote)
+	txVotePool.logger.Info("Requeued vote", "event", TxVoteID(tx), "total", txVotePool.Size())
+	txVotePool.notifyTxsAvailable()
+	txVotePool.metrics.Size.Set(float64(txVotePool.Size()))
 
 	return nil
 }
 
+// shouldShed returns true if the pool is under pressure and the vote is too far
+// from the committed height.
+func (txVotePool *TxVotePool) shouldShed(tx types.TxVote, memSize int) bool {
+	if txVotePool.shedPressure <= 0 ||
+		float64(memSize) < txVotePool.shedPressure*float64(txVotePool.config.Size) {
+		return false
+	}
+	distance := tx.Height - txVotePool.height
+	if distance < 0 {
+		distance = -distance
+	}
+	return distance > txVotePool.shedWindow
+}
+
+// recordSender records a new sender for a tx we've already seen.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) recordSender(tx types.TxVote, txInfo TxVoteInfo) {
+	// Note it's possible a tx is still in the cache but no longer in the mempool
+	// (eg. after committing a block, txs are removed from mempool but not cache),
+	// so we only record the sender for txs still in the mempool.
+	if e, ok := txVotePool.txsMap.Load(txVoteKey(tx)); ok {
+		memTxVote := e.(*clist.CElement).Value.(*mempoolTxVote)
+		memTxVote.addSender(txInfo.PeerID)
+		// senders also holds the peers we sent the vote to, so duplicates
+		// are told from the peers which sent it to us
+		if txVotePool.markReceivedFrom(memTxVote, txInfo.PeerID) {
+			txVotePool.recordPeerDuplicate(txInfo.PeerID)
+		}
+	}
+}
+
 // Called from:
 //  - resCbFirstTime (lock not held) if tx is valid
 func (txVotePool *TxVotePool) addTx(memTx *mempoolTxVote) {
+	txVotePool.signerVotes[string(memTx.tx.ValidatorAddress)]++
+	txVotePool.heightVotes[memTx.tx.Height]++
+	txVotePool.metrics.reportCacheEntries(cacheHeights, len(txVotePool.heightVotes))
+	if txVotePool.gaps != nil {
+		txVotePool.gaps.record(string(memTx.tx.ValidatorAddress), memTx.tx.Height)
+		txVotePool.metrics.reportCacheEntries(cacheGapSigners, len(txVotePool.gaps.signers))
+	}
 	e := txVotePool.txs.PushBack(memTx)
 	txVotePool.txsMap.Store(txVoteKey(memTx.tx), e)
 	atomic.AddInt64(&txVotePool.txsBytes, int64(memTx.tx.Size()))
+	atomic.AddInt64(&txVotePool.numRelayHops, int64(len(memTx.provenance)))
+	txVotePool.addPendingBroadcast(memTx)
 	txVotePool.metrics.TxSizeBytes.Observe(float64(memTx.tx.Size()))
 }
 
@@ -326,9 +827,27 @@ func (txVotePool *TxVotePool) addTx(memTx *mempoolTxVote) {
 // 	- resCbRecheck (lock not held) if tx was invalidated
 func (txVotePool *TxVotePool) removeTx(tx types.TxVote, elem *clist.CElement, removeFromCache bool) {
 	txVotePool.txs.Remove(elem)
+	memTx := elem.Value.(*mempoolTxVote)
+	if memTx.isCommitted() {
+		txVotePool.uncommitVote(memTx)
+	}
+	atomic.AddInt64(&txVotePool.numSenders, -int64(atomic.LoadInt32(&memTx.numSenders)))
+	atomic.AddInt64(&txVotePool.numRelayHops, -int64(len(memTx.provenance)))
+	txVotePool.removePendingBroadcast(memTx)
+	signer := string(tx.ValidatorAddress)
+	txVotePool.signerVotes[signer]--
+	if txVotePool.signerVotes[signer] <= 0 {
+		delete(txVotePool.signerVotes, signer)
+	}
+	txVotePool.heightVotes[tx.Height]--
+	if txVotePool.heightVotes[tx.Height] <= 0 {
+		delete(txVotePool.heightVotes, tx.Height)
+	}
+	txVotePool.metrics.reportCacheEntries(cacheHeights, len(txVotePool.heightVotes))
 	elem.DetachPrev()
 	txVotePool.txsMap.Delete(txVoteKey(tx))
 	atomic.AddInt64(&txVotePool.txsBytes, int64(-tx.Size()))
+	atomic.StoreInt64(&txVotePool.lastRemoved, time.Now().UnixNano())
 
 	if removeFromCache {
 		txVotePool.cache.Remove(tx)
@@ -370,20 +889,231 @@ func (txVotePool *TxVotePool) ReapMaxTxs(max int) []types.TxVote {
 	txs := make([]types.TxVote, 0, cmn.MinInt(txVotePool.txs.Len(), max))
 	for e := txVotePool.txs.Front(); e != nil && len(txs) <= max; e = e.Next() {
 		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
 		txs = append(txs, memTx.tx)
 	}
 	return txs
 }
 
-// Update informs the mempool that the given txs were committed and can be discarded.
+// TakeMax removes up to max votes from the pool and returns them, in pool
+// order, so that no other caller gets them. If max is negative, all the votes
+// are taken. The votes are kept in the cache, so they aren't added again when
+// received from peers.
+func (txVotePool *TxVotePool) TakeMax(max int) []types.TxVote {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.Unlock()
+
+	if max < 0 {
+		max = txVotePool.txs.Len()
+	}
+
+	txs := make([]types.TxVote, 0, cmn.MinInt(txVotePool.txs.Len(), max))
+	for e := txVotePool.txs.Front(); e != nil && len(txs) < max; {
+		next := e.Next()
+		memTx := e.Value.(*mempoolTxVote)
+		if !memTx.isCommitted() {
+			txs = append(txs, memTx.tx)
+			txVotePool.removeTx(memTx.tx, e, false)
+		}
+		e = next
+	}
+	txVotePool.metrics.Size.Set(float64(txVotePool.Size()))
+	return txs
+}
+
+// DrainBelow removes the votes cast at a height below height, passing each to
+// sink right before removing it, eg. to persist them to cold storage. Should
+// sink panic, the votes it was passed before are gone from the pool and the
+// others are left untouched. sink is called with the pool locked, so it must
+// not call the pool.
+func (txVotePool *TxVotePool) DrainBelow(height int64, sink func(types.TxVote)) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.Unlock()
+	defer func() { txVotePool.metrics.Size.Set(float64(txVotePool.Size())) }()
+
+	for e := txVotePool.txs.Front(); e != nil; {
+		next := e.Next()
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.tx.Height < height {
+			sink(memTx.tx)
+			txVotePool.removeTx(memTx.tx, e, false)
+		}
+		e = next
+	}
+}
+
+// ReadyAtHeight returns true if the pool holds votes for the given height from
+// at least required distinct validators. Several votes signed by the same
+// validator only count once.
+func (txVotePool *TxVotePool) ReadyAtHeight(height int64, required int) bool {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+
+	signers := make(map[string]struct{})
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.tx.Height != height {
+			continue
+		}
+		signers[string(memTx.tx.ValidatorAddress)] = struct{}{}
+		if len(signers) >= required {
+			return true
+		}
+	}
+	return len(signers) >= required
+}
+
+// Position returns the index of the vote with the given ID (see TxVoteID) in
+// the order votes are broadcast, and false if the pool doesn't hold it.
+// NOTE: this walks the pool, so it's O(n).
+func (txVotePool *TxVotePool) Position(id []byte) (int, bool) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+
+	key := sha256.Sum256(id)
+	pos := 0
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		if txVoteKey(e.Value.(*mempoolTxVote).tx) == key {
+			return pos, true
+		}
+		pos++
+	}
+	return 0, false
+}
+
+// TimeRange returns when the oldest and newest votes in the pool were added
+// to it, which tells how stale its contents are, and false if the pool holds
+// no votes. Committed votes are left out.
+// NOTE: this walks the pool, so it's O(n).
+func (txVotePool *TxVotePool) TimeRange() (oldest, newest time.Time, ok bool) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
+		if !ok || memTx.timestamp.Before(oldest) {
+			oldest = memTx.timestamp
+		}
+		if !ok || memTx.timestamp.After(newest) {
+			newest = memTx.timestamp
+		}
+		ok = true
+	}
+	return oldest, newest, ok
+}
+
+// PoolSnapshot is a point in time copy of the pool contents.
+type PoolSnapshot struct {
+	Height   int64          // last height the pool was updated to
+	Votes    []types.TxVote // votes in pool order
+	TxsBytes int64          // total size of the votes, in bytes
+	Heights  map[int64]int  // number of votes by vote height
+	// sends of each vote of Votes to peers, see SendAttempts
+	SendAttempts []int64
+}
+
+// Snapshot returns a copy of the pool contents and some metadata about them.
+// The snapshot doesn't share any mutable state with the pool, so it can be
+// inspected at leisure without holding any locks.
+func (txVotePool *TxVotePool) Snapshot() PoolSnapshot {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+
+	snapshot := PoolSnapshot{
+		Height:   txVotePool.height,
+		Votes:    make([]types.TxVote, 0, txVotePool.txs.Len()),
+		TxsBytes: txVotePool.TxsBytes(),
+		Heights:  make(map[int64]int),
+
+		SendAttempts: make([]int64, 0, txVotePool.txs.Len()),
+	}
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		snapshot.Votes = append(snapshot.Votes, copyTxVote(memTx.tx))
+		snapshot.SendAttempts = append(snapshot.SendAttempts, atomic.LoadInt64(&memTx.sendAttempts))
+		snapshot.Heights[memTx.tx.Height]++
+	}
+	return snapshot
+}
+
+// ExportTo writes the pending votes to w in pool order, without copying the
+// pool. Each vote is amino encoded, prefixed with its length as an uvarint.
+// Votes added while exporting may or may not be written. Read them back with
+// ImportFrom.
+func (txVotePool *TxVotePool) ExportTo(w io.Writer) error {
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
+		if _, err := cdc.MarshalBinaryLengthPrefixedWriter(w, memTx.tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportFrom adds the votes written by ExportTo to the pool, as if received
+// through CheckTx. Votes the pool rejects, eg. because they are already in
+// it, are skipped. It returns an error if r can't be read or decoded.
+func (txVotePool *TxVotePool) ImportFrom(r io.Reader) error {
+	var imported, skipped int
+	for {
+		var tx types.TxVote
+		n, err := cdc.UnmarshalBinaryLengthPrefixedReader(r, &tx, maxTxSize)
+		if err == io.EOF && n == 0 {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to decode vote")
+		}
+		if err := txVotePool.CheckTx(tx); err != nil {
+			txVotePool.logger.Debug("Skipped imported vote", "event", TxVoteID(tx), "err", err)
+			skipped++
+			continue
+		}
+		imported++
+	}
+	txVotePool.logger.Info("Imported votes", "imported", imported, "skipped", skipped)
+	return nil
+}
+
+// copyTxVote returns a deep copy of the vote.
+func copyTxVote(tx types.TxVote) types.TxVote {
+	tx.TxHash = append(cmn.HexBytes(nil), tx.TxHash...)
+	tx.ValidatorAddress = append(crypto.Address(nil), tx.ValidatorAddress...)
+	tx.Signature = append([]byte(nil), tx.Signature...)
+	return tx
+}
+
+// Update informs the mempool that the given txs were committed at the given
+// height and can be discarded. With a commit grace period, committed votes are
+// kept around (but no longer reaped nor broadcast) until it expires. A height
+// below the pool's means the chain was rolled back, which is handled first,
+// see HandleReorg.
 // NOTE: this should be called *after* block is committed by consensus.
 // NOTE: unsafe; Lock/Unlock must be managed by caller
-func (txVotePool *TxVotePool) Update(txs []types.TxVote) error {
+func (txVotePool *TxVotePool) Update(height int64, txs []types.TxVote) error {
+	if prev := atomic.LoadInt64(&txVotePool.height); height < prev {
+		txVotePool.handleReorg(prev, height)
+	}
+	atomic.StoreInt64(&txVotePool.height, height)
 	txVotePool.notifiedTxsAvailable = false
+	txVotePool.resetPeerDuplicates()
 
 	// Add committed transactions to cache (if missing).
 	for _, tx := range txs {
 		_ = txVotePool.cache.Push(tx)
+		txVotePool.advanceOrder(tx)
+	}
+	if len(txVotePool.released) > 0 {
+		// runs once the caller unlocks the pool
+		go txVotePool.checkReleased()
 	}
 
 	// Remove committed transactions.
@@ -397,10 +1127,108 @@ func (txVotePool *TxVotePool) Update(txs []types.TxVote) error {
 
 	// Update metrics
 	txVotePool.metrics.Size.Set(float64(txVotePool.Size()))
+	txVotePool.reportDedupCacheEntries()
 
 	return nil
 }
 
+// Compact rebuilds the internal maps of the pool which retain memory after
+// entries are removed from them: the cache, the votes by signer and by
+// height, and the quarantine.
+func (txVotePool *TxVotePool) Compact() {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.proxyMtx.Unlock()
+	txVotePool.compact()
+}
+
+// compact runs Compact.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) compact() {
+	txVotePool.cache.Compact()
+	signerVotes := make(map[string]int, len(txVotePool.signerVotes))
+	for k, v := range txVotePool.signerVotes {
+		signerVotes[k] = v
+	}
+	txVotePool.signerVotes = signerVotes
+	heightVotes := make(map[int64]int, len(txVotePool.heightVotes))
+	for k, v := range txVotePool.heightVotes {
+		heightVotes[k] = v
+	}
+	txVotePool.heightVotes = heightVotes
+	if txVotePool.quarantine != nil {
+		compacted := make(map[[sha256.Size]byte]quarantinedVote, len(txVotePool.quarantine))
+		for k, v := range txVotePool.quarantine {
+			compacted[k] = v
+		}
+		txVotePool.quarantine = compacted
+	}
+}
+
+// HandleReorg reconciles the pool after the chain was rolled back from height
+// from to height to. Votes for the abandoned heights (to, from] are removed,
+// from the cache too so they are accepted again if signed anew. The other
+// pending votes are moved to the back of the pool with their senders reset,
+// so that they are gossiped again to all peers, and reaped again. Committed
+// votes kept during the commit grace period are left alone. Update calls it
+// when given a height below the pool's, so it only needs calling directly
+// when the rollback isn't followed by a commit.
+func (txVotePool *TxVotePool) HandleReorg(from, to int64) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.Unlock()
+	txVotePool.handleReorg(from, to)
+}
+
+// handleReorg runs HandleReorg.
+// NOTE: the pool must be locked.
+func (txVotePool *TxVotePool) handleReorg(from, to int64) {
+	if atomic.LoadInt64(&txVotePool.height) > to {
+		atomic.StoreInt64(&txVotePool.height, to)
+	}
+
+	// Collect the elements first, as re-added votes go to the back.
+	elems := make([]*clist.CElement, 0, txVotePool.txs.Len())
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		elems = append(elems, e)
+	}
+
+	var pruned, regossiped int
+	for _, e := range elems {
+		memTx := e.Value.(*mempoolTxVote)
+		if memTx.isCommitted() {
+			continue
+		}
+		txVotePool.removeTx(memTx.tx, e, false)
+		if memTx.tx.Height > to && memTx.tx.Height <= from {
+			txVotePool.cache.Remove(memTx.tx)
+			pruned++
+			continue
+		}
+
+		height := memTx.Height()
+		if height > to {
+			height = to
+		}
+		readded := &mempoolTxVote{
+			height:      height,
+			timestamp:   time.Now(),
+			tx:          memTx.tx,
+			maxSenders:  txVotePool.maxSendersPerVote,
+			poolSenders: &txVotePool.numSenders,
+		}
+		readded.addSender(UnknownPeerID)
+		txVotePool.addTx(readded)
+		regossiped++
+	}
+
+	txVotePool.logger.Info("Handled reorg", "from", from, "to", to,
+		"pruned", pruned, "regossiped", regossiped, "total", txVotePool.Size())
+	txVotePool.notifiedTxsAvailable = false
+	if txVotePool.Size() > 0 {
+		txVotePool.notifyTxsAvailable()
+	}
+	txVotePool.metrics.Size.Set(float64(txVotePool.Size()))
+}
+
 func (txVotePool *TxVotePool) removeTxs(txs []types.TxVote) []types.TxVote {
 	// Build a map for faster lookups.
 	txsMap := make(map[string]struct{}, len(txs))
@@ -408,14 +1236,19 @@ func (txVotePool *TxVotePool) removeTxs(txs []types.TxVote) []types.TxVote {
 		txsMap[TxVoteID(tx)] = struct{}{}
 	}
 
+	now := time.Now()
 	txsLeft := make([]types.TxVote, 0, txVotePool.txs.Len())
 	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
 		memTx := e.Value.(*mempoolTxVote)
-		// Remove the tx if it's already in a block.
-		if _, ok := txsMap[TxVoteID(memTx.tx)]; ok {
+		if _, ok := txsMap[TxVoteID(memTx.tx)]; ok && !memTx.isCommitted() {
+			txVotePool.commitVote(memTx, now)
+		}
+		if memTx.isCommitted() {
+			// Remove the tx if it's already in a block and its grace period is over.
 			// NOTE: we don't remove committed txs from the cache.
-			txVotePool.removeTx(memTx.tx, e, false)
-
+			if !now.Before(memTx.committedTime().Add(txVotePool.commitGrace)) {
+				txVotePool.removeTx(memTx.tx, e, false)
+			}
 			continue
 		}
 		txsLeft = append(txsLeft, memTx.tx)
@@ -423,6 +1256,37 @@ func (txVotePool *TxVotePool) removeTxs(txs []types.TxVote) []types.TxVote {
 	return txsLeft
 }
 
+// GetVote returns the vote with the given ID (see TxVoteID) if the pool holds
+// it, including committed votes still within their grace period.
+func (txVotePool *TxVotePool) GetVote(id []byte) (types.TxVote, bool) {
+	memTx, ok := txVotePool.memTxByID(id)
+	if !ok {
+		return types.TxVote{}, false
+	}
+	return memTx.tx, true
+}
+
+// SendAttempts returns how many times the vote with the given ID (see
+// TxVoteID) was sent to peers, failed sends included, and false if the pool
+// doesn't hold it. Counts well above the number of peers point at votes or
+// peers having trouble propagating.
+func (txVotePool *TxVotePool) SendAttempts(id []byte) (int64, bool) {
+	memTx, ok := txVotePool.memTxByID(id)
+	if !ok {
+		return 0, false
+	}
+	return atomic.LoadInt64(&memTx.sendAttempts), true
+}
+
+// memTxByID returns the pool entry of the vote with the given ID.
+func (txVotePool *TxVotePool) memTxByID(id []byte) (*mempoolTxVote, bool) {
+	e, ok := txVotePool.txsMap.Load(sha256.Sum256(id))
+	if !ok {
+		return nil, false
+	}
+	return e.(*clist.CElement).Value.(*mempoolTxVote), true
+}
+
 //--------------------------------------------------------------------------------
 
 // mempoolTxVote is a transaction that successfully ran
@@ -433,6 +1297,37 @@ type mempoolTxVote struct {
 	// ids of peers who've sent us this tx (as a map for quick lookups).
 	// senders: PeerID -> bool
 	senders sync.Map
+	// ids of the peers which sent us the vote, as opposed to the ones we sent
+	// it to, only tracked with WithPeerDuplicatePolicy
+	receivedFrom sync.Map
+	// number of senders, and max number recorded, see WithMaxSendersPerVote
+	numSenders int32
+	maxSenders int32
+	// number of senders of the votes in the pool, see WithMaxMemory
+	poolSenders *int64
+
+	timestamp time.Time // when the vote was added to the pool
+	requeued  bool      // put back with Requeue
+
+	// nodes the vote went through, see Provenance
+	provenance []RelayHop
+
+	// counted in TxVotePool.pendingBroadcasts, guarded by its pendingMtx
+	pendingBroadcast bool
+
+	committedAt int64 // unix nanos at which the vote was committed, 0 if it wasn't
+
+	// sends of the vote to peers, failed ones included, see SendAttempts
+	sendAttempts int64
+
+	// amino encoding of tx, set on its first broadcast, see encodedVote
+	encoded atomic.Value
+
+	fanoutMtx   sync.Mutex
+	fanoutCycle int64 // broadcast cycle fanoutSent refers to
+	fanoutSent  int   // number of peers the vote was pushed to during fanoutCycle
+	// peers picked to get the vote during the first cycle, nil until picked
+	fanoutPicked map[p2p.ID]struct{}
 }
 
 // Height returns the height for this transaction
@@ -440,12 +1335,87 @@ func (memTxVote *mempoolTxVote) Height() int64 {
 	return atomic.LoadInt64(&memTxVote.height)
 }
 
+// isCommitted returns true if the vote was committed and is only kept around
+// during the commit grace period.
+func (memTxVote *mempoolTxVote) isCommitted() bool {
+	return atomic.LoadInt64(&memTxVote.committedAt) != 0
+}
+
+// recordSendAttempt counts a send of the vote to a peer.
+func (memTxVote *mempoolTxVote) recordSendAttempt() {
+	atomic.AddInt64(&memTxVote.sendAttempts, 1)
+}
+
+func (memTxVote *mempoolTxVote) markCommitted(t time.Time) {
+	atomic.StoreInt64(&memTxVote.committedAt, t.UnixNano())
+}
+
+func (memTxVote *mempoolTxVote) committedTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&memTxVote.committedAt))
+}
+
+// claimFanout reserves a send of the vote to the peer in the current
+// broadcast cycle. It returns false if the vote was already pushed to fanout
+// peers during this cycle. A fanout <= 0 means unlimited. If pick is not nil,
+// only the peers it returns, called once per vote, may get the vote during the
+// first cycle, otherwise the first peers to claim a send do.
+func (memTxVote *mempoolTxVote) claimFanout(fanout int, peer p2p.ID, pick func() map[p2p.ID]struct{}) bool {
+	if fanout <= 0 {
+		return true
+	}
+
+	memTxVote.fanoutMtx.Lock()
+	defer memTxVote.fanoutMtx.Unlock()
+
+	cycle := memTxVote.broadcastCycle()
+	if cycle != memTxVote.fanoutCycle {
+		memTxVote.fanoutCycle = cycle
+		memTxVote.fanoutSent = 0
+	}
+	if cycle == 0 && pick != nil {
+		if memTxVote.fanoutPicked == nil {
+			memTxVote.fanoutPicked = pick()
+		}
+		if _, ok := memTxVote.fanoutPicked[peer]; !ok {
+			return false
+		}
+	}
+	if memTxVote.fanoutSent >= fanout {
+		return false
+	}
+	memTxVote.fanoutSent++
+	return true
+}
+
+// releaseFanout gives back a send claimed with claimFanout which failed, so
+// that another peer may get the vote during the cycle.
+func (memTxVote *mempoolTxVote) releaseFanout(fanout int) {
+	if fanout <= 0 {
+		return
+	}
+
+	memTxVote.fanoutMtx.Lock()
+	defer memTxVote.fanoutMtx.Unlock()
+
+	// claims of past cycles no longer count
+	if memTxVote.broadcastCycle() == memTxVote.fanoutCycle && memTxVote.fanoutSent > 0 {
+		memTxVote.fanoutSent--
+	}
+}
+
+// broadcastCycle returns the number of broadcast cycles since the vote was
+// added to the pool.
+func (memTxVote *mempoolTxVote) broadcastCycle() int64 {
+	return int64(time.Since(memTxVote.timestamp) / (peerCatchupSleepIntervalMS * time.Millisecond))
+}
+
 //--------------------------------------------------------------------------------
 
 type txCache interface {
 	Reset()
 	Push(tx types.TxVote) bool
 	Remove(tx types.TxVote)
+	Compact()
 }
 
 // mapTxCache maintains a LRU cache of transactions. This only stores the hash
@@ -468,6 +1438,13 @@ func newMapTxCache(cacheSize int) *mapTxCache {
 	}
 }
 
+// Len returns the number of txs in the cache.
+func (cache *mapTxCache) Len() int {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	return cache.list.Len()
+}
+
 // Reset resets the cache to an empty state.
 func (cache *mapTxCache) Reset() {
 	cache.mtx.Lock()
@@ -502,6 +1479,19 @@ func (cache *mapTxCache) Push(tx types.TxVote) bool {
 	return true
 }
 
+// Compact rebuilds the map of the cache, releasing the memory kept by the
+// entries removed from it.
+func (cache *mapTxCache) Compact() {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	compacted := make(map[[sha256.Size]byte]*list.Element, len(cache.map_))
+	for k, v := range cache.map_ {
+		compacted[k] = v
+	}
+	cache.map_ = compacted
+}
+
 // Remove removes the given tx from the cache.
 func (cache *mapTxCache) Remove(tx types.TxVote) {
 	cache.mtx.Lock()
@@ -522,3 +1512,4 @@ var _ txCache = (*nopTxCache)(nil)
 func (nopTxCache) Reset()                 {}
 func (nopTxCache) Push(types.TxVote) bool { return true }
 func (nopTxCache) Remove(types.TxVote)    {}
+func (nopTxCache) Compact()               {}
@@ -1,3 +1,6 @@
+//go:build legacymempool
+// +build legacymempool
+
 package txvotepool
 
 import (
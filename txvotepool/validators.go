@@ -0,0 +1,48 @@
+package txvotepool
+
+import (
+	"sync"
+
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ValidatorPeers tells which peers are validators, see
+// ReactorValidatorPeersOnly. It must be safe for concurrent use.
+type ValidatorPeers interface {
+	IsValidatorPeer(id p2p.ID) bool
+}
+
+// ValidatorNodeIDs is a ValidatorPeers holding the node IDs of the
+// validators, to be updated by the node as the validator set changes.
+type ValidatorNodeIDs struct {
+	mtx sync.RWMutex
+	ids map[p2p.ID]struct{}
+}
+
+var _ ValidatorPeers = (*ValidatorNodeIDs)(nil)
+
+// NewValidatorNodeIDs returns a ValidatorNodeIDs holding the given IDs.
+func NewValidatorNodeIDs(ids ...p2p.ID) *ValidatorNodeIDs {
+	v := &ValidatorNodeIDs{}
+	v.Set(ids...)
+	return v
+}
+
+// Set replaces the node IDs of the validators.
+func (v *ValidatorNodeIDs) Set(ids ...p2p.ID) {
+	set := make(map[p2p.ID]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	v.mtx.Lock()
+	v.ids = set
+	v.mtx.Unlock()
+}
+
+// IsValidatorPeer implements ValidatorPeers.
+func (v *ValidatorNodeIDs) IsValidatorPeer(id p2p.ID) bool {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	_, ok := v.ids[id]
+	return ok
+}
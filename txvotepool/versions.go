@@ -0,0 +1,125 @@
+package txvotepool
+
+import (
+	"math"
+	"time"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/crypto"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// Wire versions of a vote. Whatever the version it was received in, the pool
+// stores a vote as a types.TxVote.
+const (
+	// VoteVersion1 is types.TxVote, sent in a TxMessage. All peers support
+	// it.
+	VoteVersion1 uint8 = 1
+	// VoteVersion2 is TxVoteV2, sent in a TxV2Message.
+	VoteVersion2 uint8 = 2
+
+	// LatestVoteVersion is the latest version supported.
+	LatestVoteVersion = VoteVersion2
+)
+
+// TxVoteV2 is the version 2 wire form of a vote. The timestamp is sent as
+// unix nanoseconds, all the pool keeps of it anyway (see normalizeTxVote),
+// which makes votes smaller to encode.
+type TxVoteV2 struct {
+	Height           int64
+	TxHash           cmn.HexBytes
+	UnixNanos        int64 `binary:"fixed64"`
+	ValidatorAddress crypto.Address
+	Signature        []byte
+}
+
+// minV2Time and maxV2Time bound the timestamps unix nanoseconds can hold.
+var (
+	minV2Time = time.Unix(0, math.MinInt64)
+	maxV2Time = time.Unix(0, math.MaxInt64)
+)
+
+// toTxVoteV2 converts tx to its version 2 wire form. It returns false if the
+// timestamp of tx can't be represented in it, in which case tx must be sent
+// in version 1.
+func toTxVoteV2(tx types.TxVote) (TxVoteV2, bool) {
+	if tx.Timestamp.Before(minV2Time) || tx.Timestamp.After(maxV2Time) {
+		return TxVoteV2{}, false
+	}
+	return TxVoteV2{
+		Height:           tx.Height,
+		TxHash:           tx.TxHash,
+		UnixNanos:        tx.Timestamp.UnixNano(),
+		ValidatorAddress: tx.ValidatorAddress,
+		Signature:        tx.Signature,
+	}, true
+}
+
+// fromTxVoteV2 converts a version 2 vote back to a types.TxVote.
+func fromTxVoteV2(v TxVoteV2) types.TxVote {
+	return types.TxVote{
+		Height:           v.Height,
+		TxHash:           v.TxHash,
+		Timestamp:        time.Unix(0, v.UnixNanos).UTC(),
+		ValidatorAddress: v.ValidatorAddress,
+		Signature:        v.Signature,
+	}
+}
+
+// ReactorTxVoteVersions makes the reactor announce to its peers, with a
+// VersionMessage, that it supports vote versions up to max, and send each
+// peer votes in the latest version both support. Peers which never announce
+// anything are sent version 1.
+//
+// Peers running a release which doesn't know VersionMessage stop the peers
+// sending one, so for a rolling upgrade, first upgrade all the nodes, then
+// enable this. By default nothing is announced, and votes are sent as
+// version 1, while votes of all the supported versions are accepted.
+func ReactorTxVoteVersions(max uint8) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		if max > LatestVoteVersion {
+			max = LatestVoteVersion
+		}
+		txR.maxTxVoteVersion = max
+	}
+}
+
+// announceVersion sends the peer the versions we support, if enabled.
+func (txR *TxpoolReactor) announceVersion(peer p2p.Peer) {
+	if txR.maxTxVoteVersion > VoteVersion1 {
+		peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(&VersionMessage{MaxTxVoteVersion: txR.maxTxVoteVersion}))
+	}
+}
+
+// receiveVersion records the versions the peer supports.
+func (txR *TxpoolReactor) receiveVersion(src p2p.Peer, msg *VersionMessage) {
+	txR.peerVersionsMtx.Lock()
+	txR.peerVersions[src.ID()] = msg.MaxTxVoteVersion
+	txR.peerVersionsMtx.Unlock()
+}
+
+// txVoteVersion returns the vote version negotiated with the peer.
+func (txR *TxpoolReactor) txVoteVersion(peer p2p.Peer) uint8 {
+	txR.peerVersionsMtx.RLock()
+	version, ok := txR.peerVersions[peer.ID()]
+	txR.peerVersionsMtx.RUnlock()
+	if !ok || version < VoteVersion1 {
+		return VoteVersion1
+	}
+	if version > txR.maxTxVoteVersion {
+		return txR.maxTxVoteVersion
+	}
+	return version
+}
+
+// txMessageFor returns the message sending tx to the peer, in the version
+// negotiated with it.
+func (txR *TxpoolReactor) txMessageFor(peer p2p.Peer, tx types.TxVote) TxpoolMessage {
+	if txR.txVoteVersion(peer) >= VoteVersion2 {
+		if v2, ok := toTxVoteV2(tx); ok {
+			return &TxV2Message{Tx: v2}
+		}
+	}
+	return &TxMessage{Tx: tx}
+}
@@ -0,0 +1,88 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/p2p"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestTxVoteV1V2Conversion(t *testing.T) {
+	vote := normalizeTxVote(newTestVote(3, newTestValidator()))
+
+	v2, ok := toTxVoteV2(vote)
+	require.True(t, ok)
+	assert.Equal(t, vote, fromTxVoteV2(v2))
+
+	decoded, err := decodeMsg(cdc.MustMarshalBinaryBare(&TxV2Message{Tx: v2}))
+	require.NoError(t, err)
+	assert.Equal(t, vote, fromTxVoteV2(decoded.(*TxV2Message).Tx))
+	assert.True(t, len(cdc.MustMarshalBinaryBare(&TxV2Message{Tx: v2})) <
+		len(cdc.MustMarshalBinaryBare(&TxMessage{Tx: vote})))
+
+	// Timestamps out of the range of v2 fall back to v1.
+	vote.Timestamp = time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, ok = toTxVoteV2(vote)
+	assert.False(t, ok)
+	pool := newTestTxVotePool()
+	txR := NewTxpoolReactor(pool.config, pool, ReactorTxVoteVersions(VoteVersion2))
+	peer := newTestPeer("peer")
+	txR.receiveVersion(peer, &VersionMessage{MaxTxVoteVersion: VoteVersion2})
+	assert.Equal(t, &TxMessage{Tx: vote}, txR.txMessageFor(peer, vote))
+}
+
+func TestMixedVersionGossipConverges(t *testing.T) {
+	txR := newTestReactor(t, ReactorTxVoteVersions(LatestVoteVersion))
+	defer txR.Stop()
+
+	newPeer, oldPeer := newTestPeer("new"), newTestPeer("old")
+	for _, peer := range []*testPeer{newPeer, oldPeer} {
+		peer.Set(ttypes.PeerStateKey, testPeerState{1})
+	}
+	// Only the upgraded peer announces its version.
+	sendMsg(txR, newPeer, &VersionMessage{MaxTxVoteVersion: VoteVersion2})
+	txR.AddPeer(newPeer)
+	txR.AddPeer(oldPeer)
+	assert.Contains(t, newPeer.Sent(), TxpoolMessage(&VersionMessage{MaxTxVoteVersion: VoteVersion2}))
+
+	validator := newTestValidator()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+	countVotes := func(peer *testPeer) (v1, v2 int) {
+		for _, msg := range peer.Sent() {
+			switch msg.(type) {
+			case *TxMessage:
+				v1++
+			case *TxV2Message:
+				v2++
+			}
+		}
+		return v1, v2
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		_, newV2 := countVotes(newPeer)
+		oldV1, _ := countVotes(oldPeer)
+		return newV2 == 5 && oldV1 == 5
+	})
+	newV1, _ := countVotes(newPeer)
+	_, oldV2 := countVotes(oldPeer)
+	assert.Zero(t, newV1)
+	assert.Zero(t, oldV2)
+
+	// Both end up with the same pool.
+	source := newTestPeer(p2p.ID("source"))
+	want := txR.Txpool.ReapMaxTxs(-1)
+	for _, peer := range []*testPeer{newPeer, oldPeer} {
+		remote := newTestReactor(t)
+		for _, msg := range peer.Sent() {
+			sendMsg(remote, source, msg)
+		}
+		assert.Equal(t, want, remote.Txpool.ReapMaxTxs(-1), "pool of %s", peer.ID())
+		remote.Stop()
+	}
+}
@@ -0,0 +1,201 @@
+package txvotepool
+
+import (
+	"fmt"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+// ReactorWarmUp makes a node starting with an empty pool ask the first peers
+// it adds, up to peers of them, for the votes it lacks, rather than waiting
+// for them to be gossiped. The node's Digest is sent along, so that each peer
+// only sends the votes missing from it, up to maxVotes votes per peer. The
+// votes are sent in chunks of up to the number of elements the peer takes
+// per message, see ReactorMaxMsgElements. Disabled by default, warm-ups are
+// always served, once per peer connection.
+func ReactorWarmUp(peers, maxVotes int) ReactorOption {
+	return func(txR *TxpoolReactor) {
+		txR.warmUpPeers = peers
+		txR.warmUpMaxVotes = maxVotes
+	}
+}
+
+// armWarmUp enables the warm-up from the next peers added if the pool is
+// empty.
+func (txR *TxpoolReactor) armWarmUp() {
+	if txR.warmUpPeers <= 0 || txR.warmUpMaxVotes <= 0 || txR.Txpool.Size() > 0 {
+		return
+	}
+	txR.warmUpMtx.Lock()
+	txR.warmUpLeft = txR.warmUpPeers
+	txR.warmUpMtx.Unlock()
+}
+
+// maybeWarmUp asks the peer for the votes missing from the pool, if the
+// warm-up still needs peers.
+func (txR *TxpoolReactor) maybeWarmUp(peer p2p.Peer) {
+	txR.warmUpMtx.Lock()
+	if txR.warmUpLeft == 0 {
+		txR.warmUpMtx.Unlock()
+		return
+	}
+	txR.warmUpLeft--
+	txR.warmingUp[peer.ID()] = txR.warmUpMaxVotes
+	txR.warmUpMtx.Unlock()
+
+	msg := &WarmUpRequestMessage{Digest: txR.Txpool.Digest(), MaxVotes: txR.warmUpMaxVotes}
+	peer.Send(TxpoolChannel, cdc.MustMarshalBinaryBare(msg))
+}
+
+// serveWarmUp sends the peer the votes missing from its digest, up to the
+// number it asked for, from a routine of its own so that the messages
+// received from the peer meanwhile aren't held up. A peer is only served
+// once, further requests are ignored.
+func (txR *TxpoolReactor) serveWarmUp(peer p2p.Peer, req *WarmUpRequestMessage) {
+	txR.warmUpMtx.Lock()
+	_, served := txR.warmedUp[peer.ID()]
+	txR.warmedUp[peer.ID()] = struct{}{}
+	txR.warmUpMtx.Unlock()
+	if served || req.MaxVotes <= 0 {
+		txR.Logger.Debug("Ignoring warm-up request", "src", peer, "served", served)
+		return
+	}
+
+	missing := txR.Txpool.MissingFrom(req.Digest)
+	if len(missing) > req.MaxVotes {
+		missing = missing[:req.MaxVotes]
+	}
+	go txR.sendWarmUpChunks(peer, missing)
+}
+
+// sendWarmUpChunks sends the votes to the peer in chunks, signed if
+// envelopes are, within the peer's send budget, see ReactorPeerSendRate. It
+// stops at the first chunk the peer can't take.
+func (txR *TxpoolReactor) sendWarmUpChunks(peer p2p.Peer, missing []types.TxVote) {
+	var budget *byteBudget
+	if txR.peerSendRate > 0 {
+		budget = newByteBudget(txR.peerSendRate, txR.peerSendBurst)
+	}
+	chunkSize := txR.warmUpChunkSize(peer)
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk := &WarmUpChunkMessage{Txs: txR.outboundVotes(missing[:n]), More: n < len(missing)}
+		if txR.signsOutbound() {
+			chunk.sign(txR.privKey)
+		}
+		msgBytes := cdc.MustMarshalBinaryBare(chunk)
+		if budget != nil && !budget.wait(int64(len(msgBytes)), peer.Quit(), txR.Quit()) {
+			return
+		}
+		if !txR.sendVotes(peer, msgBytes) {
+			txR.Logger.Debug("Stopped serving warm-up", "peer", peer, "left", len(missing))
+			return
+		}
+		missing = missing[n:]
+	}
+}
+
+// warmUpChunkSize returns the max number of votes sent to the peer per
+// WarmUpChunkMessage: the number of fields the peer takes per message, as it
+// announced it or else as we take it, see ReactorMaxMsgElements, less the
+// other fields of the chunk.
+func (txR *TxpoolReactor) warmUpChunkSize(peer p2p.Peer) int {
+	max := txR.maxMsgElements
+	if caps, ok := txR.PeerCapabilities(peer); ok && caps.MaxBatchSize > 0 {
+		max = caps.MaxBatchSize
+	}
+	size := max - 1 // More
+	if txR.signsOutbound() {
+		size -= 2 // PubKey and Signature
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// receiveWarmUpChunk adds the votes of a chunk from a peer we asked for a
+// warm-up to the pool, up to the votes still accepted from it. Chunks from
+// other peers are ignored.
+func (txR *TxpoolReactor) receiveWarmUpChunk(src p2p.Peer, chunk *WarmUpChunkMessage, seq uint64) {
+	txR.warmUpMtx.Lock()
+	left, ok := txR.warmingUp[src.ID()]
+	txs := chunk.Txs
+	if len(txs) > left {
+		txs = txs[:left]
+	}
+	left -= len(txs)
+	if left == 0 || !chunk.More {
+		delete(txR.warmingUp, src.ID())
+	} else if ok {
+		txR.warmingUp[src.ID()] = left
+	}
+	txR.warmUpMtx.Unlock()
+	if !ok {
+		txR.Logger.Debug("Ignoring unexpected warm-up chunk", "src", src)
+		return
+	}
+
+	errs := txR.verifyVotes(txs)
+	for i, tx := range txs {
+		if errs[i] != nil {
+			if txR.invalidVote(src, tx, seq, errs[i]) {
+				return
+			}
+			continue
+		}
+		txR.receiveTx(src, tx, seq, nil)
+	}
+	if left == 0 || !chunk.More {
+		txR.Logger.Info("Warmed up pool", "src", src, "votes", txR.warmUpMaxVotes-left)
+	}
+}
+
+//-------------------------------------
+
+// WarmUpRequestMessage is a TxpoolMessage asking for up to MaxVotes votes
+// missing from the sender's pool, whose Digest is Digest. See ReactorWarmUp.
+type WarmUpRequestMessage struct {
+	Digest   []byte
+	MaxVotes int
+}
+
+// String returns a string representation of the WarmUpRequestMessage.
+func (m *WarmUpRequestMessage) String() string {
+	return fmt.Sprintf("[WarmUpRequestMessage max:%d]", m.MaxVotes)
+}
+
+// WarmUpChunkMessage is a TxpoolMessage answering a WarmUpRequestMessage with
+// some of the votes missing from the requester's pool. More is set if further
+// chunks follow. Nodes signing envelopes, see ReactorSignEnvelopes, sign the
+// chunks they serve, PubKey and Signature are empty otherwise.
+type WarmUpChunkMessage struct {
+	Txs       []types.TxVote
+	More      bool
+	PubKey    crypto.PubKey
+	Signature []byte
+}
+
+func (m *WarmUpChunkMessage) signBytes() []byte {
+	return cdc.MustMarshalBinaryBare(&WarmUpChunkMessage{Txs: m.Txs, More: m.More})
+}
+
+// sign signs the chunk with the given key.
+func (m *WarmUpChunkMessage) sign(privKey crypto.PrivKey) {
+	m.PubKey, m.Signature = signEnvelope(privKey, m.signBytes())
+}
+
+// Verify checks that the chunk was signed by the node with the given ID.
+func (m *WarmUpChunkMessage) Verify(peerID p2p.ID) error {
+	return verifyEnvelope(peerID, m.PubKey, m.signBytes(), m.Signature)
+}
+
+// String returns a string representation of the WarmUpChunkMessage.
+func (m *WarmUpChunkMessage) String() string {
+	return fmt.Sprintf("[WarmUpChunkMessage %d votes more:%v]", len(m.Txs), m.More)
+}
@@ -0,0 +1,183 @@
+package txvotepool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/p2p"
+)
+
+func TestWarmUpFromPopulatedPeer(t *testing.T) {
+	const (
+		numVotes  = 30
+		chunkSize = 8
+	)
+	populated := newTestReactor(t, ReactorMaxMsgElements(chunkSize))
+	defer populated.Stop()
+	validator := newTestValidator()
+	votes := make([]types.TxVote, numVotes)
+	for i := range votes {
+		votes[i] = newTestVote(1, validator)
+		require.NoError(t, populated.Txpool.CheckTx(votes[i]))
+	}
+
+	fresh := newTestReactor(t, ReactorWarmUp(1, 100), ReactorMaxMsgElements(chunkSize))
+	defer fresh.Stop()
+
+	// Neither peer has a PeerState, so only the warm-up moves votes.
+	populatedPeer, freshPeer := newTestPeer("populated"), newTestPeer("fresh")
+	populated.AddPeer(freshPeer)
+	fresh.AddPeer(populatedPeer)
+
+	for _, msg := range populatedPeer.Sent() {
+		sendMsg(populated, freshPeer, msg)
+	}
+	// The chunks are served from a routine of their own.
+	var chunks []*WarmUpChunkMessage
+	waitFor(t, 2*time.Second, func() bool {
+		chunks = warmUpChunks(freshPeer)
+		return len(chunks) > 0 && !chunks[len(chunks)-1].More
+	}, "warm-up not served")
+	for _, msg := range freshPeer.Sent() {
+		sendMsg(fresh, populatedPeer, msg)
+	}
+	waitFor(t, 2*time.Second, func() bool { return fresh.Txpool.Size() == numVotes },
+		"fresh pool has %d votes", fresh.Txpool.Size())
+	assert.Equal(t, populated.Txpool.Digest(), fresh.Txpool.Digest())
+	assert.True(t, populatedPeer.IsRunning(), "serving peer stopped")
+	// Chunks leave room for More within the peer's limit.
+	require.Len(t, chunks, 5)
+	for _, chunk := range chunks {
+		assert.True(t, len(chunk.Txs) <= chunkSize-1)
+	}
+	assert.False(t, chunks[4].More)
+
+	// The warm-up is only served once per peer, and only asked of the first
+	// peers.
+	served := len(freshPeer.Sent())
+	sendMsg(populated, freshPeer, &WarmUpRequestMessage{Digest: make([]byte, DigestSize), MaxVotes: 100})
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, freshPeer.Sent(), served)
+	otherPeer := newTestPeer("other")
+	fresh.AddPeer(otherPeer)
+	for _, msg := range otherPeer.Sent() {
+		_, ok := msg.(*WarmUpRequestMessage)
+		assert.False(t, ok, "warm-up asked of a second peer")
+	}
+}
+
+func TestWarmUpBounds(t *testing.T) {
+	populated := newTestReactor(t)
+	defer populated.Stop()
+	validator := newTestValidator()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, populated.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+
+	fresh := newTestReactor(t, ReactorWarmUp(2, 5))
+	defer fresh.Stop()
+	populatedPeer, freshPeer := newTestPeer("populated"), newTestPeer("fresh")
+	populated.AddPeer(freshPeer)
+	fresh.AddPeer(populatedPeer)
+	for _, msg := range populatedPeer.Sent() {
+		req, ok := msg.(*WarmUpRequestMessage)
+		require.True(t, ok, "unexpected %T", msg)
+		assert.Equal(t, 5, req.MaxVotes)
+		sendMsg(populated, freshPeer, msg)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		chunks := warmUpChunks(freshPeer)
+		return len(chunks) > 0 && !chunks[len(chunks)-1].More
+	}, "warm-up not served")
+	for _, msg := range freshPeer.Sent() {
+		sendMsg(fresh, populatedPeer, msg)
+	}
+	waitFor(t, 2*time.Second, func() bool { return fresh.Txpool.Size() == 5 },
+		"fresh pool has %d votes", fresh.Txpool.Size())
+
+	// Chunks beyond the bound, or from peers which weren't asked, are ignored.
+	extra := &WarmUpChunkMessage{Txs: []types.TxVote{newTestVote(1, validator)}}
+	sendMsg(fresh, populatedPeer, extra)
+	sendMsg(fresh, newTestPeer("other"), extra)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 5, fresh.Txpool.Size())
+
+	// A node starting with votes doesn't warm up.
+	warm := NewTxpoolReactor(fresh.config, NewTxVotePool(fresh.config), ReactorWarmUp(2, 5))
+	require.NoError(t, warm.Txpool.CheckTx(newTestVote(1, validator)))
+	require.NoError(t, warm.Start())
+	defer warm.Stop()
+	peer := newTestPeer("peer")
+	warm.AddPeer(peer)
+	assert.Empty(t, peer.Sent())
+}
+
+func TestWarmUpBetweenSigningPeers(t *testing.T) {
+	populatedKey, freshKey := ed25519.GenPrivKey(), ed25519.GenPrivKey()
+	// Signed chunks leave room for More, PubKey and Signature, so the 8 votes
+	// take several chunks.
+	const maxElements = 5
+	populated := newTestSwitchReactor(t, ReactorSignEnvelopes(populatedKey), ReactorMaxMsgElements(maxElements))
+	defer populated.Stop()
+	fresh := newTestSwitchReactor(t, ReactorWarmUp(1, 100), ReactorSignEnvelopes(freshKey), ReactorMaxMsgElements(maxElements))
+	defer fresh.Stop()
+
+	validator := newTestValidator()
+	for i := 0; i < 8; i++ {
+		require.NoError(t, populated.Txpool.CheckTx(newTestVote(1, validator)))
+	}
+
+	populatedPeer := newTestPeer(p2p.PubKeyToID(populatedKey.PubKey()))
+	freshPeer := newTestPeer(p2p.PubKeyToID(freshKey.PubKey()))
+	populated.AddPeer(freshPeer)
+	fresh.AddPeer(populatedPeer)
+	for _, msg := range populatedPeer.Sent() {
+		sendMsg(populated, freshPeer, msg)
+	}
+	var chunks []*WarmUpChunkMessage
+	waitFor(t, 2*time.Second, func() bool {
+		chunks = warmUpChunks(freshPeer)
+		return len(chunks) > 0 && !chunks[len(chunks)-1].More
+	}, "warm-up not served")
+	for _, chunk := range chunks {
+		sendMsg(fresh, populatedPeer, chunk)
+	}
+	waitFor(t, 2*time.Second, func() bool { return fresh.Txpool.Size() == 8 },
+		"fresh pool has %d votes", fresh.Txpool.Size())
+	assert.True(t, populatedPeer.IsRunning(), "signing peer stopped")
+	assert.Len(t, chunks, 4)
+
+	// Chunks are signed by the serving node.
+	chunk := chunks[0]
+	assert.NoError(t, chunk.Verify(populatedPeer.ID()))
+	chunk.More = !chunk.More
+	assert.Equal(t, ErrInvalidEnvelopeSignature, chunk.Verify(populatedPeer.ID()))
+}
+
+func TestWarmUpChunkSizeFromPeerCapabilities(t *testing.T) {
+	txR := newTestReactor(t, ReactorMaxMsgElements(10))
+	defer txR.Stop()
+
+	peer := newTestPeer("peer")
+	assert.Equal(t, 9, txR.warmUpChunkSize(peer))
+	peer.Set(PeerCapabilitiesKey, Capabilities{MaxBatchSize: 4})
+	assert.Equal(t, 3, txR.warmUpChunkSize(peer))
+	peer.Set(PeerCapabilitiesKey, Capabilities{MaxBatchSize: 1})
+	assert.Equal(t, 1, txR.warmUpChunkSize(peer))
+}
+
+// warmUpChunks returns the warm-up chunks sent to the peer so far.
+func warmUpChunks(peer *testPeer) []*WarmUpChunkMessage {
+	var chunks []*WarmUpChunkMessage
+	for _, msg := range peer.Sent() {
+		if chunk, ok := msg.(*WarmUpChunkMessage); ok {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
@@ -1,11 +1,51 @@
 package txvotepool
 
 import (
+	"github.com/pkg/errors"
 	amino "github.com/tendermint/go-amino"
+	cryptoAmino "github.com/tendermint/tendermint/crypto/encoding/amino"
 )
 
 var cdc = amino.NewCodec()
 
 func init() {
+	cryptoAmino.RegisterAmino(cdc)
 	RegisterTxVotePoolMessages(cdc)
+	registerPrefixes()
+}
+
+// txpoolMessages holds a message of each type the TxpoolReactor handles.
+var txpoolMessages = []TxpoolMessage{
+	&TxMessage{},
+	&TxsMessage{},
+	&InterestMessage{},
+	&PoolRequestMessage{},
+	&PoolChunkMessage{},
+	&SignedTxMessage{},
+	&SignedEnvelopesMessage{},
+	&AckMessage{},
+	&VersionMessage{},
+	&TxV2Message{},
+	&BundleMessage{},
+	&CapabilitiesMessage{},
+	&WarmUpRequestMessage{},
+	&WarmUpChunkMessage{},
+	&ExtensionMessage{},
+}
+
+// checkMessagesRegistered returns an error if the messages of the
+// TxpoolReactor can't be encoded and decoded with c, eg. because
+// RegisterTxVotePoolMessages wasn't called on it.
+func checkMessagesRegistered(c *amino.Codec) error {
+	for _, m := range txpoolMessages {
+		bz, err := c.MarshalBinaryBare(m)
+		if err == nil {
+			var msg TxpoolMessage
+			err = c.UnmarshalBinaryBare(bz, &msg)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Txpool message %T not registered on codec", m)
+		}
+	}
+	return nil
 }
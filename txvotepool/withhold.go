@@ -0,0 +1,31 @@
+package txvotepool
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/andrecronje/babble-abci/types"
+)
+
+// withholdFilter holds the votes broadcast routines don't send, see
+// WithholdHeight, which is only built with the txpooldebug build tag. Without
+// it nothing is ever withheld.
+type withholdFilter struct {
+	active int32 // set once anything was withheld, read without locking
+
+	mtx        sync.RWMutex
+	heights    map[int64]struct{}
+	validators map[string]struct{}
+}
+
+// withholds returns true if tx must not be broadcast.
+func (w *withholdFilter) withholds(tx types.TxVote) bool {
+	if atomic.LoadInt32(&w.active) == 0 {
+		return false
+	}
+	w.mtx.RLock()
+	defer w.mtx.RUnlock()
+	_, height := w.heights[tx.Height]
+	_, validator := w.validators[string(tx.ValidatorAddress)]
+	return height || validator
+}
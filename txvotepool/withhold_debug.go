@@ -0,0 +1,99 @@
+//go:build txpooldebug
+// +build txpooldebug
+
+package txvotepool
+
+import (
+	"sync/atomic"
+
+	"github.com/andrecronje/babble-abci/types"
+	"github.com/tendermint/tendermint/crypto"
+	"github.com/tendermint/tendermint/libs/clist"
+)
+
+// WithholdHeight stops broadcasting the votes for height h, simulating
+// censorship or a partition for consensus integration tests, until
+// ReleaseHeight. Votes are still received and added to the pool. It is only
+// built with the txpooldebug build tag, so it can't be used in production.
+func (txR *TxpoolReactor) WithholdHeight(h int64) {
+	w := &txR.withhold
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.heights == nil {
+		w.heights = make(map[int64]struct{})
+	}
+	w.heights[h] = struct{}{}
+	atomic.StoreInt32(&w.active, 1)
+}
+
+// ReleaseHeight resumes broadcasting the votes for height h, including those
+// withheld so far, unless withheld by WithholdValidator.
+func (txR *TxpoolReactor) ReleaseHeight(h int64) {
+	w := &txR.withhold
+	w.mtx.Lock()
+	delete(w.heights, h)
+	w.mtx.Unlock()
+	txR.Txpool.regossip(func(tx types.TxVote) bool {
+		return tx.Height == h && !w.withholds(tx)
+	})
+}
+
+// WithholdValidator stops broadcasting the votes signed by the validator with
+// the given address, like WithholdHeight, until ReleaseValidator.
+func (txR *TxpoolReactor) WithholdValidator(addr crypto.Address) {
+	w := &txR.withhold
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.validators == nil {
+		w.validators = make(map[string]struct{})
+	}
+	w.validators[string(addr)] = struct{}{}
+	atomic.StoreInt32(&w.active, 1)
+}
+
+// ReleaseValidator resumes broadcasting the votes signed by the validator with
+// the given address, including those withheld so far, unless withheld by
+// WithholdHeight.
+func (txR *TxpoolReactor) ReleaseValidator(addr crypto.Address) {
+	w := &txR.withhold
+	w.mtx.Lock()
+	delete(w.validators, string(addr))
+	w.mtx.Unlock()
+	txR.Txpool.regossip(func(tx types.TxVote) bool {
+		return string(tx.ValidatorAddress) == string(addr) && !w.withholds(tx)
+	})
+}
+
+// regossip moves the votes matching match to the back of the pool, so that
+// the broadcast routines, which went past them, get to them again. The peers
+// known to have them still don't get them.
+func (txVotePool *TxVotePool) regossip(match func(types.TxVote) bool) {
+	txVotePool.proxyMtx.Lock()
+	defer txVotePool.Unlock()
+
+	// Collect the elements first, as moved votes go to the back.
+	var elems []*clist.CElement
+	for e := txVotePool.txs.Front(); e != nil; e = e.Next() {
+		memTx := e.Value.(*mempoolTxVote)
+		if !memTx.isCommitted() && match(memTx.tx) {
+			elems = append(elems, e)
+		}
+	}
+	for _, e := range elems {
+		memTx := e.Value.(*mempoolTxVote)
+		txVotePool.removeTx(memTx.tx, e, false)
+		moved := &mempoolTxVote{
+			height:      memTx.height,
+			timestamp:   memTx.timestamp,
+			tx:          memTx.tx,
+			requeued:    memTx.requeued,
+			maxSenders:  memTx.maxSenders,
+			poolSenders: memTx.poolSenders,
+		}
+		memTx.senders.Range(func(peerID, _ interface{}) bool {
+			moved.addSender(peerID.(uint16))
+			return true
+		})
+		txVotePool.addTx(moved)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build txpooldebug
+// +build txpooldebug
+
+package txvotepool
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andrecronje/babble-abci/types"
+	ttypes "github.com/tendermint/tendermint/types"
+)
+
+// sentVotes returns the votes sent to the peer.
+func sentVotes(peer *testPeer) []types.TxVote {
+	var votes []types.TxVote
+	for _, msg := range peer.Sent() {
+		if m, ok := msg.(*TxMessage); ok {
+			votes = append(votes, m.Tx)
+		}
+	}
+	return votes
+}
+
+func containsVote(votes []types.TxVote, vote types.TxVote) bool {
+	for _, v := range votes {
+		if bytes.Equal(v.Signature, vote.Signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithheldHeightNotBroadcastUntilReleased(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+	txR.WithholdHeight(2)
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{5})
+	txR.AddPeer(peer)
+
+	validator := newTestValidator()
+	withheld := newTestVote(2, validator)
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, validator)))
+	require.NoError(t, txR.Txpool.CheckTx(withheld))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(3, validator)))
+
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, containsVote(sentVotes(peer), withheld))
+
+	txR.ReleaseHeight(2)
+	waitFor(t, time.Second, func() bool { return containsVote(sentVotes(peer), withheld) })
+	assert.Len(t, peer.Sent(), 3)
+	assert.Equal(t, 3, txR.Txpool.Size())
+}
+
+func TestWithheldValidatorNotBroadcastUntilReleased(t *testing.T) {
+	txR := newTestReactor(t)
+	defer txR.Stop()
+	censored, other := newTestValidator(), newTestValidator()
+	txR.WithholdValidator(censored)
+	txR.WithholdHeight(1)
+
+	peer := newTestPeer("peer")
+	peer.Set(ttypes.PeerStateKey, testPeerState{5})
+	txR.AddPeer(peer)
+
+	withheld := newTestVote(2, censored)
+	require.NoError(t, txR.Txpool.CheckTx(withheld))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(1, censored)))
+	require.NoError(t, txR.Txpool.CheckTx(newTestVote(2, other)))
+
+	waitFor(t, time.Second, func() bool { return len(peer.Sent()) == 1 })
+
+	// Height 1 is still withheld.
+	txR.ReleaseValidator(censored)
+	waitFor(t, time.Second, func() bool { return containsVote(sentVotes(peer), withheld) })
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, peer.Sent(), 2)
+}